@@ -203,7 +203,7 @@ class Ctx:
         ))
         self.prog('if player == 0 {')
         self.prog('    for i := 0; i < {size}; i++ {{'.format(size=size))
-        self.prog('        {elem}[i] = add({elem}[i], {tmp}[i])'.format(
+        self.prog('        {elem}[i] = oip.Field().add({elem}[i], {tmp}[i])'.format(
             elem=elem,
             tmp=tmp,
         ))
@@ -241,7 +241,7 @@ class Ctx:
 
     def additive_random(self, name, size):
         # each player picks a bunch of random integers
-        self.prog('{name} := random({size})'.format(
+        self.prog('{name} := oip.Field().random({size})'.format(
             name=name,
             size=size
         ))
@@ -254,18 +254,61 @@ class Ctx:
     def prog(self, l=''):
         self.runner.append(l)
 
+    def shape(self, gates):
+        # shape of the circuit, selects the BFV parameters with "params: auto" (see mpc/params.go),
+        # after translation: every branch of a disjunction selects a vector of the length of its permutation
+        disjunctions = [g for g in gates if isinstance(g, Disjunction)]
+        self.prog('')
+        self.prog('var CIRCUIT = CircuitShape{{Branches: {branches}, Width: {width}}}'.format(
+            branches=max([len(g.perms) for g in disjunctions], default=1),
+            width=max([len(perm) for g in disjunctions for perm in g.perms], default=0)
+        ))
+
     def compile_cdn(self, gates):
         self.prog('package main')
         self.prog('')
+        self.prog('import "context"')
+        self.prog('')
         self.prog('func init() { MP_SPDZ = false }') # disable MP-SPDZ functionality
         self.prog('')
-        self.prog('func run(me int, inputs []FieldElem, mpc *MPC, oip *OIP) ([]Share, error) {')
+
+        # the wires are authenticated shares (see mpc/mac.go), without MAC keys they are the plain shares of the CDN engine
+
+        # the masks and encoded branches of every disjunction are independent of the selectors:
+        # prepare them ahead of the evaluation (see mpc/prepare.go)
+        disjunctions = [(w, g) for (w, g) in enumerate(gates) if isinstance(g, Disjunction)]
+
+        self.prog('func prepare(ctx context.Context, me int, e *AuthCDN) ([]*PreparedAuthDisjunction, error) {')
+        self.prog('    prep := make([]*PreparedAuthDisjunction, 0, {size})'.format(size=len(disjunctions)))
+
+        for (w, g) in disjunctions:
+            # translate branch sub-circuits to position-dependent disjunction meta-circuit
+            g.translate(w)
+
+            self.prog('if err := func() error {')
+
+            # export permutation to runner
+            self.prog('mapping := [][]int{')
+            for perm in g.perms:
+                self.prog('    {' + ','.join(map(str, perm)) +'},')
+            self.prog('}')
+
+            self.prog('p, err := e.PrepareDisjunction(ctx, mapping, {in_dim})'.format(in_dim=len(g.disj_inputs)))
+            self.prog('if err != nil { return err }')
+            self.prog('prep = append(prep, p)')
+            self.prog('return nil')
+            self.prog('}(); err != nil { return nil, err }')
+
+        self.prog('    return prep, nil')
+        self.prog('}')
+        self.prog('')
+
+        self.prog('func run(ctx context.Context, me int, inputs []FieldElem, mpc *MPC, e *AuthCDN, prep []*PreparedAuthDisjunction) ([]Share, error) {')
         self.prog('    if mpc != nil { panic("MP-SPDZ Enabled") }')
         self.prog('    nxt_input := 0')
         self.prog('    var err error')
         self.prog('    output := make([]FieldElem, 0, 16)')
-        self.prog('    wires := make([]Share, {size})'.format(size=len(gates)))
-        self.prog('    cdn := NewCDN(oip)')
+        self.prog('    wires := NewAuthShares({size}, e.Keys())'.format(size=len(gates)))
 
         # we batch multiplications to improve efficiency
 
@@ -294,22 +337,12 @@ class Ctx:
             self.prog('   idx_r := []int{{ {right} }}'.format(right=','.join(map(str, rs))))
             self.prog('   idx_m := []int{{ {mul} }}'.format(mul=','.join(map(str, ms))))
 
-            # pack wires
-            self.prog('   l := make([]Share, {size})'.format(size=len(ls)))
-            self.prog('   r := make([]Share, {size})'.format(size=len(ls)))
-            self.prog('   for i := 0; i < {size}; i++ {{'.format(size=len(ls)))
-            self.prog('       l[i] = wires[idx_l[i]]')
-            self.prog('       r[i] = wires[idx_r[i]]')
-            self.prog('   }')
-
-            # execute multiplications
-            self.prog('   m, err := cdn.Mul(l, r)')
-            self.prog('   if err != nil { return nil }')
+            # execute multiplications on the packed wires
+            self.prog('   m, err := e.Mul(ctx, wires.Gather(idx_l), wires.Gather(idx_r))')
+            self.prog('   if err != nil { return err }')
 
             # write back to each location
-            self.prog('   for i := 0; i < {size}; i++ {{'.format(size=len(ls)))
-            self.prog('       wires[idx_m[i]] = m[i]')
-            self.prog('   }')
+            self.prog('   wires.Scatter(idx_m, m)')
             self.prog('   return nil')
 
             # call and check for error
@@ -335,25 +368,39 @@ class Ctx:
             self.prog('   idx_l := []int{{ {left} }}'.format(left=','.join(map(str, ls))))
             self.prog('   idx_r := []int{{ {right} }}'.format(right=','.join(map(str, rs))))
             self.prog('   idx_m := []int{{ {mul} }}'.format(mul=','.join(map(str, ms))))
-            self.prog('   for i := 0; i < {size}; i++ {{'.format(size=len(ls)))
-            self.prog('       wires[idx_m[i]] = add(wires[idx_l[i]], wires[idx_r[i]])')
-            self.prog('   }')
+            self.prog('   wires.Scatter(idx_m, e.Add(wires.Gather(idx_l), wires.Gather(idx_r)))')
+            self.prog('}()')
+
+        def resolve_inputs(inputs):
+            # authenticate the input shares (one batch)
+            self.prog('err = func() error {')
+            self.prog('   idx := []int{{ {inputs} }}'.format(inputs=','.join(map(str, inputs))))
+            self.prog('   x, err := e.Authenticate(ctx, wires.Gather(idx).V)')
+            self.prog('   if err != nil { return err }')
+            self.prog('   wires.Scatter(idx, x)')
+            self.prog('   return nil')
             self.prog('}()')
+            self.prog('if err != nil { return nil, err }')
 
         additions = {}
         multiplications = {}
+        pending = []
 
         for (w, g) in enumerate(gates):
+            if pending and not isinstance(g, Input):
+                resolve_inputs(pending)
+                pending = []
+
             if isinstance(g, Input):
                 self.prog('    if me == {player} {{'.format(player=g.player))
-                self.prog('        wires[{num}] = inputs[nxt_input]'.format(num=w))
+                self.prog('        wires.V[{num}] = inputs[nxt_input]'.format(num=w))
                 self.prog('        nxt_input += 1')
-                self.prog('    } else { ')
-                self.prog('        wires[{num}] = 0'.format(num=w))
                 self.prog('    }')
+                pending.append(w)
 
             elif isinstance(g, Output):
-                self.prog('    out{idx}, err := cdn.Reconstruct([]Share{{ wires[{num}] }})'.format(num=g.wire, idx=w))
+                # the MACs of the outputs are checked before they are released (see below)
+                self.prog('    out{idx}, err := e.Reconstruct(ctx, wires.Gather([]int{{ {num} }}))'.format(num=g.wire, idx=w))
                 self.prog('    if err != nil { return nil, err }')
                 self.prog('    output = append(output, out{idx}...)'.format(idx=w))
 
@@ -388,20 +435,14 @@ class Ctx:
             elif isinstance(g, Disjunction):
                 inputs = {}
 
-                # translate branch sub-circuits to position-dependent disjunction meta-circuit
-                g.translate(w)
+                # translated and prepared ahead of the evaluation (see prepare above)
+                prep = [d for (d, _) in disjunctions].index(w)
 
                 self.prog('err = func() error {')
 
                 out_dim = len(g.disj_inputs) + g.branch_size
                 in_dim = g.branch_size * 2
 
-                # export permutation to runner
-                self.prog('mapping := [][]int{')
-                for perm in g.perms:
-                    self.prog('    {' + ','.join(map(str, perm)) +'},')
-                self.prog('}')
-
                 # export programming to runner
                 self.prog('programming := [][]bool{')
                 for perm in g.progs:
@@ -409,22 +450,23 @@ class Ctx:
                 self.prog('}')
 
                 # pack selectors
-                self.prog('selectors := []Share{' + ','.join(['wires[%d]' % i for i in g.selector]) + '}')
+                self.prog('selectors := wires.Gather([]int{' + ','.join(map(str, g.selector)) + '})')
 
                 # pack inputs
-                self.prog('inputs := []Share{' + ','.join(['wires[%d]' % i for i in g.disj_inputs]) + '}')
+                self.prog('inputs := wires.Gather([]int{' + ','.join(map(str, g.disj_inputs)) + '})')
 
-                # use cdn.Disjunction helper from CDN implemenation
-                self.prog('''   w, err := cdn.Disjunction(
+                # use e.DisjunctionPrepared helper from CDN implemenation
+                self.prog('''   w, err := e.DisjunctionPrepared(
+        ctx,
+        prep[{prep}],   // prepared masks and branches
         []int{{{levels}}},   // branch evaluation levels
-        {mapping},      // mapping
         {inputs},       // inputs to all branches
         {sel},          // selectors
         {gate_programs}, // gate programmings
     )
                 '''.format(
+                    prep=prep,
                     levels=','.join(map(str, g.levels)),
-                    mapping='mapping',
                     inputs='inputs',
                     sel='selectors',
                     gate_programs='programming'
@@ -432,24 +474,36 @@ class Ctx:
                 self.prog('if err != nil { return err }')
 
                 # copy branch outputs back to wires slice
-                self.prog('copy(wires[{num}:], w)'.format(num=w))
+                self.prog('wires.Copy({num}, w)'.format(num=w))
                 self.prog('return nil')
                 self.prog('}()')
 
                 # handle possible error in disjunction
                 self.prog('if err != nil { return nil, err }')
 
+        if pending: resolve_inputs(pending)
         if multiplications: resolve_mul(multiplications)
         if additions: resolve_add(additions)
 
+        # release the outputs once the MACs of every opened value are checked
+        self.prog('if err := e.Check(ctx); err != nil { return nil, err }')
         self.prog('return output, nil')
         self.prog('}')
+        self.shape(gates)
 
 
     def compile(self, gates):
         self.prog('package main')
         self.prog('')
-        self.prog('func run(player  int, inputs []uint64, mpc *MPC, oip *OIP) ([]uint64, error) {')
+        self.prog('import "context"')
+        self.prog('')
+        # the masks of the disjunctions are sampled inside MP-SPDZ, nothing to prepare
+        self.prog('func prepare(ctx context.Context, player int, e *AuthCDN) ([]*PreparedAuthDisjunction, error) {')
+        self.prog('    return nil, nil')
+        self.prog('}')
+        self.prog('')
+        self.prog('func run(ctx context.Context, player  int, inputs []uint64, mpc *MPC, e *AuthCDN, prep []*PreparedAuthDisjunction) ([]uint64, error) {')
+        self.prog('oip := e.cdn.oip')
         self.prog('output := make([]uint64, 0, 128)')
         self.prog('nxt := 0')
 
@@ -537,7 +591,7 @@ class Ctx:
                 self.additive_random('out', size=out_dim)       # export
                 self.additive_output('b', size=len(g.selector)) # export
                 self.prog('v := apply_mapping(mapping, out)')
-                self.prog('D, err := oip.Select(b, v)')
+                self.prog('D, err := oip.Select(ctx, b, v)')
                 self.prog('if err != nil { return err }')
 
                 # input back into the MPC
@@ -603,6 +657,7 @@ class Ctx:
 
         self.prog('return output, nil')
         self.prog('}')
+        self.shape(gates)
 
 def export(name, ls):
     s = '\n'.join(ls)
@@ -803,7 +858,7 @@ if __name__ == '__main__':
     # prog.append(random_disj(sel, wires=list(range(len(prog))), start=len(prog), length=length))
     # prog.append(random_leveled(sel, wires=list(range(len(prog))), start=len(prog), log_length=16))
 
-    ctx = Ctx(mpc['parties'], prime=65537)
+    ctx = Ctx(mpc['parties'], prime=mpc.get('prime', 65537))
 
     if mpc['type'] == 'cdn':
         # compile to CDN execution
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync/atomic"
+)
+
+// Aborting protocols:
+//
+// every protocol call runs under a context, when the context is cancelled or any worker fails
+// (e.g. because a peer disconnected) all connections are closed: this unblocks every other worker,
+// and the peers observe the closed connections and abort as well.
+// An aborted OIP cannot be used again: every later call returns the error which caused the abort.
+
+// ProtocolError names the phase and the peer of a failed protocol call
+type ProtocolError struct {
+	Phase Phase
+	Peer  int // -1 if the failure was not caused by a peer (e.g. cancellation)
+	Err   error
+}
+
+func (e *ProtocolError) Error() string {
+	if e.Peer < 0 {
+		return "phase " + e.Phase.String() + ": " + e.Err.Error()
+	}
+	return "phase " + e.Phase.String() + ": player " + strconv.Itoa(e.Peer) + ": " + e.Err.Error()
+}
+
+func (e *ProtocolError) Unwrap() error {
+	return e.Err
+}
+
+// current protocol phase
+func (o *OIP) Phase() Phase {
+	return Phase(atomic.LoadInt32(&o.current))
+}
+
+// error caused by player p in the current phase
+func (o *OIP) peerError(p int, err error) error {
+	return &ProtocolError{Phase: o.Phase(), Peer: p, Err: err}
+}
+
+func (o *OIP) send(p int, v interface{}) error {
+	if err := o.Pi(p).Send(v); err != nil {
+		return o.peerError(p, err)
+	}
+	return nil
+}
+
+func (o *OIP) recv(p int, v interface{}) error {
+	if err := o.Pi(p).Recv(v); err != nil {
+		return o.peerError(p, err)
+	}
+	return nil
+}
+
+// the error which aborted the OIP (nil if not aborted)
+func (o *OIP) aborted() error {
+	o.abortLock.Lock()
+	defer o.abortLock.Unlock()
+	return o.abortErr
+}
+
+// abort the OIP by closing every connection, returns the error which caused the (first) abort
+func (o *OIP) abort(err error) error {
+	o.abortLock.Lock()
+	defer o.abortLock.Unlock()
+
+	if o.abortErr != nil {
+		return o.abortErr
+	}
+
+	var perr *ProtocolError
+	if !errors.As(err, &perr) {
+		err = &ProtocolError{Phase: o.Phase(), Peer: -1, Err: err}
+	}
+
+	o.Log("Abort:", err)
+	o.abortErr = err
+
+	for _, conn := range o.conns {
+		if conn != nil {
+			conn.Close()
+		}
+	}
+
+	return err
+}
+
+// wait for num workers: the first error aborts the OIP, which stops the remaining workers
+func (o *OIP) collect(status chan error, num int) error {
+	var first error
+	for i := 0; i < num; i++ {
+		if err := <-status; err != nil && first == nil {
+			first = o.abort(err)
+		}
+	}
+	return first
+}
+
+// run f, aborting the OIP if ctx is cancelled or f fails
+func (o *OIP) run(ctx context.Context, f func() error) error {
+	if err := o.aborted(); err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			o.abort(ctx.Err())
+		case <-done:
+		}
+	}()
+
+	if err := f(); err != nil {
+		return o.abort(err)
+	}
+	return nil
+}
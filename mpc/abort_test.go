@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/ldsec/lattigo/v2/bfv"
+)
+
+// wait for the goroutines started by a test to exit
+func waitGoroutines(t *testing.T, before int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatal("goroutines still running:", runtime.NumGoroutine(), ">", before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	// player 2 never takes part: players 0 and 1 block during key generation
+	oips := setupOIPs(SetupParams(), TopologyStar, 3)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 2)
+	go func() {
+		_, err := oips[0].Multiply(ctx, random(16), random(16))
+		errs <- err
+	}()
+	go func() {
+		_, err := oips[1].Multiply(context.Background(), random(16), random(16))
+		errs <- err
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	for i := 0; i < 2; i++ {
+		err := <-errs
+		var perr *ProtocolError
+		if !errors.As(err, &perr) {
+			t.Fatal("expected protocol error, got", err)
+		}
+		if perr.Phase != PhaseKeyGen {
+			t.Error("wrong phase:", err)
+		}
+		if errors.Is(err, context.Canceled) {
+			// the cancelled player
+			if perr.Peer != -1 {
+				t.Error("cancellation attributed to a peer:", err)
+			}
+		} else if perr.Peer != 0 {
+			// player 1 observes the aggregator disconnecting
+			t.Error("expected player 0 to disconnect:", err)
+		}
+	}
+
+	// an aborted OIP returns the same error
+	err1 := oips[0].aborted()
+	if _, err2 := oips[0].Multiply(context.Background(), random(16), random(16)); err2 != err1 {
+		t.Error("expected", err1, "got", err2)
+	}
+
+	waitGoroutines(t, before)
+}
+
+func TestDisconnect(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	oips := setupOIPs(SetupParams(), TopologyMesh, 3)
+
+	// player 2 disconnects once setup is complete
+	testMul(oips, 16, 1)
+	for _, conn := range oips[2].conns {
+		if conn != nil {
+			conn.Close()
+		}
+	}
+
+	errs := make(chan error, 2)
+	for p := 0; p < 2; p++ {
+		go func(oip *OIP) {
+			_, err := oip.Select(context.Background(), random(2), [][]FieldElem{random(16), random(16)})
+			errs <- err
+		}(oips[p])
+	}
+
+	for i := 0; i < 2; i++ {
+		err := <-errs
+		var perr *ProtocolError
+		if !errors.As(err, &perr) {
+			t.Fatal("expected protocol error, got", err)
+		}
+		if perr.Phase == PhaseOther {
+			t.Error("phase not set:", err)
+		}
+		if perr.Peer < 0 {
+			t.Error("peer not set:", err)
+		}
+		if !errors.Is(err, io.ErrClosedPipe) {
+			t.Error("expected closed connection:", err)
+		}
+	}
+
+	waitGoroutines(t, before)
+}
+
+func TestMalformedPeer(t *testing.T) {
+	for _, topology := range []Topology{TopologyStar, TopologyTree} {
+		// player 1 runs with a ring of another degree: its public key share cannot be aggregated
+		conns := MemoryDummies(topology, 2, MemoryCopy)
+		oips := setupOIPsConns(SetupParams(), topology, conns[:1])
+		oips = append(oips, NewOIP(paramsFor(PRIME, bfv.PN13QP218), 1, conns[1]))
+		oips[1].topology = topology
+
+		errs := make(chan error, 1)
+		go func() { errs <- oips[1].Setup() }()
+
+		err := oips[0].Setup()
+		var perr *ProtocolError
+		if !errors.As(err, &perr) {
+			t.Fatal("expected protocol error, got", err)
+		}
+		if perr.Phase != PhaseKeyGen || perr.Peer != 1 {
+			t.Error("expected player 1 to fail key generation:", err)
+		}
+
+		for _, conn := range conns[0] {
+			if conn != nil {
+				conn.Close()
+			}
+		}
+		<-errs
+	}
+}
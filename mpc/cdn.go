@@ -1,13 +1,16 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log"
 	"sync"
 )
 
 const UNINITIALIZED = 0xffffffffffffffff
 
-const CDN_DEBUG = true
+// debug mode: check the noise budget of every product before decryption, reveals the products (see noise.go)
+var CDN_DEBUG = false
 
 type Share = FieldElem
 
@@ -19,11 +22,16 @@ const (
 )
 
 type CDN struct {
-	oip *OIP
+	oip      *OIP
+	strategy DisjunctionStrategy // strategy of the disjunctions (see hecdn.go)
 }
 
-func (e *CDN) Mul(l []Share, r []Share) ([]Share, error) {
-	return e.oip.Multiply(l, r)
+// multiply using preprocessed Beaver triples if there are enough (see triples.go), otherwise using the OIP
+func (e *CDN) Mul(ctx context.Context, l []Share, r []Share) ([]Share, error) {
+	if e.oip.triples.Len() >= len(l) {
+		return e.MulBeaver(ctx, l, r)
+	}
+	return e.oip.Multiply(ctx, l, r)
 }
 
 func NewCDN(oip *OIP) *CDN {
@@ -41,22 +49,84 @@ func (e *CDN) Input(v FieldElem, player int) Share {
 	return 0
 }
 
+// selector-independent material of a disjunction: the random mask and the prepared selection of the mapped mask
+// (nothing with the homomorphic strategy)
+type PreparedDisjunction struct {
+	mapping [][]int
+	in_dim  int
+	out     []FieldElem
+	sel     *PreparedSelect
+}
+
+// prepare a disjunction of the mapping over in_dim inputs ahead of the selectors (see prepare.go),
+// a prepared disjunction can be used once
+func (e *CDN) PrepareDisjunction(ctx context.Context, mapping [][]int, in_dim int) (*PreparedDisjunction, error) {
+	if len(mapping[0])%2 != 0 {
+		log.Panicln("Mapping of odd length", len(mapping[0]))
+	}
+
+	if e.strategy == DisjunctionHomomorphic {
+		return &PreparedDisjunction{mapping: mapping, in_dim: in_dim}, nil
+	}
+
+	// create a random shared mask and prepare the selection of its permutation
+	branch_size := len(mapping[0]) / 2
+	out := e.oip.field.random(branch_size + in_dim)
+	sel, err := e.oip.PrepareSelect(ctx, apply_mapping(mapping, out))
+	if err != nil {
+		return nil, err
+	}
+
+	return &PreparedDisjunction{
+		mapping: mapping,
+		in_dim:  in_dim,
+		out:     out,
+		sel:     sel,
+	}, nil
+}
+
 // Run a disjunction (mapping and gate program computed by external program)
 //
 // The programming is relatively complex: the majority of the circuit analysis and work is offloaded to the circuit compiler
 func (e *CDN) Disjunction(
+	ctx context.Context,
 	levels []int, // when to multiply and reconstruct block (when to switch level)
 	mapping [][]int, // wire mapping for each branch, i.e mapping[b][i] is the map for gate i in branch b
 	inputs []Share, // indexes of all inputs to the branch
 	sel []Share, // selectors for each branch (indicator variables)
 	gate_programs [][]bool, // gate programmings, i.e. gate_program[b][i] = True iff. the i'th gate in branch b is a multiplication
 ) ([]Share, error) {
+	prep, err := e.PrepareDisjunction(ctx, mapping, len(inputs))
+	if err != nil {
+		return nil, err
+	}
+	return e.DisjunctionPrepared(ctx, prep, levels, inputs, sel, gate_programs)
+}
+
+// Run a prepared disjunction (see Disjunction)
+func (e *CDN) DisjunctionPrepared(
+	ctx context.Context,
+	prep *PreparedDisjunction,
+	levels []int,
+	inputs []Share,
+	sel []Share,
+	gate_programs [][]bool,
+) ([]Share, error) {
+	mapping := prep.mapping
 	branches := len(mapping)
 
-	if branches != len(gate_programs) || branches != len(sel) || len(mapping[0])%2 != 0 {
+	if branches != len(gate_programs) || branches != len(sel) {
 		log.Panicln("Number of branches does not match", len(mapping), len(sel), len(gate_programs))
 	}
+	if len(inputs) != prep.in_dim {
+		log.Panicln("Number of inputs does not match", len(inputs), prep.in_dim)
+	}
+
+	if e.strategy == DisjunctionHomomorphic {
+		return e.DisjunctionHomomorphic(ctx, levels, mapping, inputs, sel, gate_programs)
+	}
 
+	f := e.oip.field
 	branch_size := len(mapping[0]) / 2
 
 	// compute gate programming (1 iff the selected branch has a multiplication in that position)
@@ -72,21 +142,20 @@ func (e *CDN) Disjunction(
 		for j, branch := range gate_programs {
 			for i, g := range branch {
 				if g {
-					programming[i] = add(programming[i], sel[j])
+					programming[i] = f.add(programming[i], sel[j])
 				}
 			}
 		}
 		wg.Done()
 	}()
 
-	// create a random shared mask and select permutation using OIP
+	// select the permutation of the random shared mask using OIP
 
 	in_dim := len(inputs)
 	out_dim := branch_size + in_dim
-	out := random(out_dim)
-	vec := apply_mapping(mapping, out)
+	out := prep.out
 
-	D, err := e.oip.Select(sel, vec)
+	D, err := e.oip.SelectPrepared(ctx, sel, prep.sel)
 	if err != nil {
 		return nil, err
 	}
@@ -101,7 +170,7 @@ func (e *CDN) Disjunction(
 	u := make([]FieldElem, 0, out_dim)
 
 	// fill start of u with masked inputs
-	m_inp, err := e.Reconstruct(add_vec(inputs, out[:in_dim]))
+	m_inp, err := e.Reconstruct(ctx, f.add_vec(inputs, out[:in_dim]))
 	if err != nil {
 		return nil, err
 	}
@@ -113,9 +182,9 @@ func (e *CDN) Disjunction(
 		var sum FieldElem
 		for i := 0; i < branches; i++ {
 			ui := u[mapping[i][idx]]
-			sum += mul(sel[i], ui)
+			sum = f.add(sum, f.mul(sel[i], ui))
 		}
-		sum = sub(reduce(sum), D[nxt])
+		sum = f.sub(sum, D[nxt])
 		nxt += 1
 		return sum
 	}
@@ -148,7 +217,7 @@ func (e *CDN) Disjunction(
 			}
 
 			// FIRST LEVEL: compute (l*r)
-			lr, err := e.Mul(l, r)
+			lr, err := e.Mul(ctx, l, r)
 			if err != nil {
 				return nil, err
 			}
@@ -159,12 +228,12 @@ func (e *CDN) Disjunction(
 			right := p
 
 			for i := 0; i < gates; i++ {
-				left = append(left, add(l[i], r[i]))
-				right = append(right, sub(1, p[i]))
+				left = append(left, f.add(l[i], r[i]))
+				right = append(right, f.sub(e.Input(1, 0), p[i])) // player 0 adds the constant
 			}
 
 			// SECOND LEVEL: compute (l*r)*p and (l+r)*(1-p)
-			res, err := e.Mul(left, right)
+			res, err := e.Mul(ctx, left, right)
 			if err != nil {
 				return nil, err
 			}
@@ -174,8 +243,8 @@ func (e *CDN) Disjunction(
 			l_add_r_mul_1p := res[gates:]
 
 			// THIRD LEVEL: mask and reconstruct((1-p)*(l+r) + p*(l*r) + out)
-			new_w := add_vec(l_mul_r_mul_p, l_add_r_mul_1p)
-			new_u, err := e.Reconstruct(add_vec(out[s:s+gates], new_w))
+			new_w := f.add_vec(l_mul_r_mul_p, l_add_r_mul_1p)
+			new_u, err := e.Reconstruct(ctx, f.add_vec(out[s:s+gates], new_w))
 			if err != nil {
 				return nil, err
 			}
@@ -205,7 +274,7 @@ func (e *CDN) Disjunction(
 	return w, nil
 }
 
-func add_vec(src1, src2 []Share) []Share {
+func (f Field) add_vec(src1, src2 []Share) []Share {
 	// sanity check
 	if len(src1) != len(src2) {
 		panic("Adding vectors of different length")
@@ -213,50 +282,122 @@ func add_vec(src1, src2 []Share) []Share {
 
 	dst := make([]Share, len(src1))
 	for i := 0; i < len(src1); i++ {
-		dst[i] = add(src1[i], src2[i])
+		dst[i] = f.add(src1[i], src2[i])
 	}
 	return dst
 }
 
-// reconstruct to player 0
-func (e *CDN) reconstruct0(shares []Share) ([]FieldElem, error) {
+// reconstruct to the aggregator
+func (e *CDN) reconstructAgg(agg int, shares []Share) ([]FieldElem, error) {
 
-	if e.oip.me != 0 {
-		return nil, e.oip.Send0(shares)
+	if e.oip.me != agg {
+		return nil, e.oip.SendAgg(agg, shares)
 	}
 
 	recon := make([]FieldElem, len(shares))
 	copy(recon, shares)
 
-	// receieve share from every other player
+	// receieve share from every other live player (see threshold.go)
 
 	var tmp []FieldElem
-	for p := 1; p < e.oip.n; p++ {
-		if err := e.oip.Pi(p).Recv(&tmp); err != nil {
+	for p := 0; p < e.oip.n; p++ {
+		if p == agg || !e.oip.live(p) {
+			continue
+		}
+		if err := e.oip.recv(p, &tmp); err != nil {
 			return nil, err
 		}
+		if len(tmp) != len(recon) {
+			return nil, e.oip.peerError(p, errors.New("reconstruction share has wrong length"))
+		}
+		if !e.oip.field.contains(tmp) {
+			return nil, e.oip.peerError(p, errors.New("reconstruction share out of range"))
+		}
 		for i := 0; i < len(recon); i++ {
-			recon[i] = add(recon[i], tmp[i])
+			recon[i] = e.oip.field.add(recon[i], tmp[i])
 		}
 	}
 
 	return recon, nil
 }
 
-// reconstruct to player 0
-func (e *CDN) Reconstruct(shares []Share) ([]FieldElem, error) {
-	// reconstuct to player 0
-	val, err := e.reconstruct0(shares)
+// every player sends its shares directly to every other player
+func (e *CDN) reconstructMesh(shares []Share) ([]FieldElem, error) {
+
+	recon := make([]FieldElem, len(shares))
+	copy(recon, shares)
+
+	var lock sync.Mutex
+
+	err := e.oip.exchange(
+		func(p int) error {
+			return e.oip.send(p, shares)
+		},
+		func(p int) error {
+			var tmp []FieldElem
+			if err := e.oip.recv(p, &tmp); err != nil {
+				return err
+			}
+			if len(tmp) != len(recon) {
+				return e.oip.peerError(p, errors.New("reconstruction share has wrong length"))
+			}
+			if !e.oip.field.contains(tmp) {
+				return e.oip.peerError(p, errors.New("reconstruction share out of range"))
+			}
+			lock.Lock()
+			for i := 0; i < len(recon); i++ {
+				recon[i] = e.oip.field.add(recon[i], tmp[i])
+			}
+			lock.Unlock()
+			return nil
+		},
+	)
+
+	return recon, err
+}
+
+// reconstruct to every player, aborts if ctx is cancelled (see abort.go)
+func (e *CDN) Reconstruct(ctx context.Context, shares []Share) (res []FieldElem, err error) {
+	err = e.oip.run(ctx, func() error {
+		res, err = e.reconstruct(shares)
+		return err
+	})
+	return res, err
+}
+
+func (e *CDN) reconstruct(shares []Share) ([]FieldElem, error) {
+	defer e.oip.phase(PhaseReconstruct)()
+	return e.open(shares)
+}
+
+// reconstruct to every player (traffic is accounted to the current phase)
+func (e *CDN) open(shares []Share) ([]FieldElem, error) {
+	if e.oip.topology == TopologyMesh {
+		return e.reconstructMesh(shares)
+	}
+
+	if e.oip.topology == TopologyTree {
+		return e.reconstructTree(shares)
+	}
+
+	// reconstuct to the aggregator
+	agg := e.oip.aggregator
+	val, err := e.reconstructAgg(agg, shares)
 	if err != nil {
 		return nil, err
 	}
 
-	// player 0 sends the construction to everyone else
-	if e.oip.me == 0 {
-		return val, e.oip.broadcast(val)
-	} else {
-		return val, e.oip.Recv0(&val)
+	// the aggregator sends the construction to everyone else
+	if e.oip.me == agg {
+		return val, e.oip.broadcast(agg, val)
+	}
+	if err := e.oip.RecvAgg(agg, &val); err != nil {
+		return nil, err
+	}
+	if !e.oip.field.contains(val) {
+		return nil, e.oip.peerError(agg, errors.New("reconstruction out of range"))
 	}
+	return val, nil
 }
 
 /*
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// a single addition gate: the constant 1 of (1 - p) is added by a single player,
+// if every player adds it the shares of (1 - p) sum to n and the gate outputs n (l + r)
+func TestDisjunctionAddition(t *testing.T) {
+	for players := 1; players <= 4; players++ {
+		oips := setupOIPs(SetupParams(), TopologyStar, players)
+		inputs := randomShares(players, 2)
+		x := reconstruct(inputs)
+
+		outs, errs := runCDN(oips, func(p int, e *CDN) ([]FieldElem, error) {
+			ctx := context.Background()
+			sel := []Share{e.Input(1, 0)}
+			w, err := e.Disjunction(ctx, []int{0}, [][]int{{0, 1}}, inputs[p], sel, [][]bool{{false}})
+			if err != nil {
+				return nil, err
+			}
+			return e.Reconstruct(ctx, w)
+		})
+
+		for p := range oips {
+			if errs[p] != nil {
+				t.Fatal(players, "players: player", p, "failed:", errs[p])
+			}
+			if outs[p][0] != add(x[0], x[1]) {
+				t.Fatal(players, "players: addition gate output", outs[p][0], "expected", add(x[0], x[1]))
+			}
+		}
+	}
+}
+
+// both gate types over two levels of two branches
+func TestDisjunction(t *testing.T) {
+	for _, topology := range []Topology{TopologyStar, TopologyMesh} {
+		for players := 2; players <= 4; players++ {
+			oips := setupOIPs(SetupParams(), topology, players)
+
+			// u = x0, x1, g0, g1, g2, g3: two levels of two gates
+			levels := []int{1, 3}
+			mapping := [][]int{
+				{0, 1, 0, 1, 2, 3, 2, 0}, // g0 = x0 * x1, g1 = x0 + x1, g2 = g0 * g1, g3 = g0 + x0
+				{0, 0, 1, 1, 2, 3, 3, 1}, // g0 = x0 + x0, g1 = x1 * x1, g2 = g0 + g1, g3 = g1 * x1
+			}
+			programs := [][]bool{
+				{true, false, true, false},
+				{false, true, false, true},
+			}
+
+			inputs := randomShares(len(oips), 2)
+			x := reconstruct(inputs)
+			for b, expected := range [][]FieldElem{
+				{mul(x[0], x[1]), add(x[0], x[1]), mul(mul(x[0], x[1]), add(x[0], x[1])), add(mul(x[0], x[1]), x[0])},
+				{add(x[0], x[0]), mul(x[1], x[1]), add(add(x[0], x[0]), mul(x[1], x[1])), mul(mul(x[1], x[1]), x[1])},
+			} {
+				outs, errs := runCDN(oips, func(p int, e *CDN) ([]FieldElem, error) {
+					ctx := context.Background()
+					sel := []Share{e.Input(FieldElem(1-b), 0), e.Input(FieldElem(b), 0)}
+					w, err := e.Disjunction(ctx, levels, mapping, inputs[p], sel, programs)
+					if err != nil {
+						return nil, err
+					}
+					return e.Reconstruct(ctx, w)
+				})
+
+				for p := range oips {
+					if errs[p] != nil {
+						t.Fatal(topology, players, "players: player", p, "failed:", errs[p])
+					}
+					for i, v := range expected {
+						if outs[p][i] != v {
+							t.Fatal(topology, players, "players: branch", b, "wrong output of gate", i)
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+// a player whose shares are not reduced modulo the prime is rejected by the others
+func TestReconstructOutOfRange(t *testing.T) {
+	for _, topology := range []Topology{TopologyStar, TopologyMesh, TopologyTree} {
+		conns := MemoryDummies(topology, 2, MemoryCopy)
+		oips := setupOIPsConns(SetupParams(), topology, conns)
+		prime := oips[0].Field().Prime()
+
+		errs := make(chan error, 1)
+		go func() {
+			_, err := NewCDN(oips[1]).reconstruct([]Share{prime + 1})
+			errs <- err
+		}()
+
+		_, err := NewCDN(oips[0]).reconstruct([]Share{1})
+		var perr *ProtocolError
+		if !errors.As(err, &perr) {
+			t.Fatal(topology, "expected protocol error, got", err)
+		}
+		if perr.Phase != PhaseReconstruct || perr.Peer != 1 {
+			t.Error(topology, "expected player 1 to fail reconstruction:", err)
+		}
+
+		for _, conn := range conns[0] {
+			if conn != nil {
+				conn.Close()
+			}
+		}
+		<-errs
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// generate the runner of a small circuit with circuit.py (in dir) for the backend typ
+func generateRunner(t *testing.T, dir string, typ string) string {
+	config := []byte(`mpc:
+  type: ` + typ + `
+  parties: 2
+circuit:
+  type: layered
+  parameters:
+    per_layer: 16
+    length: 64
+    branches: 2
+`)
+	if err := os.WriteFile(filepath.Join(dir, typ+".yml"), config, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "MP-SPDZ", "Programs", "Source"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	script, err := filepath.Abs(filepath.Join("..", "circuit.py"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("python3", script, typ+".yml")
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Skip("circuit.py failed (requires python3 with yaml):", err, string(out))
+	}
+	return filepath.Join(dir, "runner-"+typ+".go")
+}
+
+// the runners generated for the MP-SPDZ and the CDN backends compile in place of runner.go
+func TestGeneratedRunners(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go tool not found")
+	}
+	runner, err := filepath.Abs("runner.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, typ := range []string{"mascot_semi", "cdn"} {
+		dir := t.TempDir()
+		overlay, err := json.Marshal(map[string]map[string]string{
+			"Replace": {runner: generateRunner(t, dir, typ)},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "overlay.json"), overlay, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		cmd := exec.Command("go", "build", "-overlay", filepath.Join(dir, "overlay.json"), "-o", os.DevNull, ".")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatal(typ, "runner does not compile:", err, "\n"+string(out))
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sync"
+)
+
+// Commitments and coin tossing:
+//
+// every player commits to its value (sha256 of a random nonce and the value) and opens the commitment
+// once it has received the commitments of every other player, hence no player can choose its value
+// depending on the values of the others. A coin toss hashes the opened seeds of all players,
+// the result is uniformly random as long as one player is honest. Coin tosses are bound to the session identifier
+// (every player opens it along with its seed, and the players abort if their identifiers differ),
+// e.g. the common reference string of the key generation is a coin toss of the session.
+
+const COMMIT_NONCE = 32
+
+// send v to every player and receive the value of every player (indexed by player)
+func (o *OIP) allGather(v []byte) ([][]byte, error) {
+	all := make([][]byte, o.n)
+	all[o.me] = v
+
+	switch o.topology {
+	case TopologyMesh:
+		err := o.exchange(
+			func(p int) error {
+				return o.send(p, v)
+			},
+			func(p int) error {
+				return o.recv(p, &all[p])
+			},
+		)
+		return all, err
+
+	case TopologyTree:
+		// collect the values of the subtree, then broadcast all values down the tree
+		var lock sync.Mutex
+		err := o.treeReduce(
+			func(c int) error {
+				var sub [][]byte
+				if err := o.recv(c, &sub); err != nil {
+					return err
+				}
+				if len(sub) != o.n {
+					return o.peerError(c, errors.New("gathered values have wrong length"))
+				}
+				lock.Lock()
+				for p, w := range sub {
+					if w != nil {
+						all[p] = w
+					}
+				}
+				lock.Unlock()
+				return nil
+			},
+			func(parent int) error {
+				return o.send(parent, all)
+			},
+		)
+		if err != nil {
+			return nil, err
+		}
+		err = o.treeBroadcast(
+			func(parent int) error {
+				var res [][]byte
+				if err := o.recv(parent, &res); err != nil {
+					return err
+				}
+				if len(res) != o.n {
+					return o.peerError(parent, errors.New("gathered values have wrong length"))
+				}
+				all = res
+				return nil
+			},
+			func(c int) error {
+				return o.send(c, all)
+			},
+		)
+		return all, err
+	}
+
+	// the aggregator collects and relays all values
+	agg := o.aggregator
+	if o.me != agg {
+		if err := o.SendAgg(agg, v); err != nil {
+			return nil, err
+		}
+		if err := o.RecvAgg(agg, &all); err != nil {
+			return nil, err
+		}
+		if len(all) != o.n {
+			return nil, o.peerError(agg, errors.New("gathered values have wrong length"))
+		}
+		return all, nil
+	}
+	for p := 0; p < o.n; p++ {
+		if p == agg {
+			continue
+		}
+		if !o.live(p) {
+			return nil, o.peerError(p, ErrDropped)
+		}
+		if err := o.recv(p, &all[p]); err != nil {
+			return nil, err
+		}
+	}
+	return all, o.broadcast(agg, all)
+}
+
+func commitment(nonce []byte, v []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte("bmpc commitment"))
+	h.Write(nonce)
+	h.Write(v)
+	return h.Sum(nil)
+}
+
+// commit to v and open the commitment once every player has committed,
+// returns the values of every player
+func (o *OIP) commitReveal(v []byte) ([][]byte, error) {
+	nonce := make([]byte, COMMIT_NONCE)
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+
+	commitments, err := o.allGather(commitment(nonce, v))
+	if err != nil {
+		return nil, err
+	}
+
+	openings, err := o.allGather(append(nonce, v...))
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([][]byte, o.n)
+	for p, open := range openings {
+		if len(open) < COMMIT_NONCE || !bytes.Equal(commitment(open[:COMMIT_NONCE], open[COMMIT_NONCE:]), commitments[p]) {
+			return nil, o.peerError(p, errors.New("opening does not match the commitment"))
+		}
+		values[p] = open[COMMIT_NONCE:]
+	}
+	return values, nil
+}
+
+// jointly sampled random seed, bound to the session identifier
+func (o *OIP) coinToss() ([]byte, error) {
+	seed := make([]byte, 32)
+	if _, err := rand.Read(seed); err != nil {
+		panic(err)
+	}
+
+	values, err := o.commitReveal(append(append([]byte{}, o.session...), seed...))
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha256.New()
+	h.Write([]byte("bmpc coin"))
+	binary.Write(h, binary.LittleEndian, uint64(len(o.session)))
+	h.Write(o.session)
+	for p, v := range values {
+		if len(v) != len(o.session)+len(seed) || !bytes.Equal(v[:len(o.session)], o.session) {
+			return nil, o.peerError(p, errors.New("session identifier differs"))
+		}
+		h.Write(v[len(o.session):])
+	}
+	return h.Sum(nil), nil
+}
+
+// set the session identifier (all players must use the same one, unique for every session),
+// required by the session configuration (see SessionConfig.Validate)
+func (o *OIP) SetSession(id string) {
+	o.session = []byte(id)
+}
+
+// expand a (public) seed into field elements
+func (f Field) expandSeed(seed []byte, size int) []FieldElem {
+	block, err := aes.NewCipher(seed[:32])
+	if err != nil {
+		panic(err)
+	}
+	stream := cipher.NewCTR(block, make([]byte, aes.BlockSize))
+	return f.randomFrom(cipher.StreamReader{S: stream, R: zeroReader{}}, size)
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
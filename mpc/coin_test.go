@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+)
+
+// run the setup of every player
+func setupAll(oips []*OIP) []error {
+	errs := make([]error, len(oips))
+	var wg sync.WaitGroup
+	for p, oip := range oips {
+		wg.Add(1)
+		go func(p int, o *OIP) {
+			defer wg.Done()
+			errs[p] = o.Setup()
+		}(p, oip)
+	}
+	wg.Wait()
+	return errs
+}
+
+func TestCoinTossCRS(t *testing.T) {
+	params := SetupParams()
+	for _, topology := range []Topology{TopologyStar, TopologyMesh, TopologyTree} {
+		var first []*OIP
+		for run := 0; run < 2; run++ {
+			oips := setupOIPs(params, topology, 3)
+			for _, oip := range oips {
+				oip.SetSession("test session")
+			}
+			for p, err := range setupAll(oips) {
+				if err != nil {
+					t.Fatal(topology, "player", p, "failed:", err)
+				}
+			}
+
+			// every player samples the same common polynomial, which is fresh for every run
+			for p, oip := range oips[1:] {
+				if !oip.crp.Q.Equals(oips[0].crp.Q) || !oip.crp.P.Equals(oips[0].crp.P) {
+					t.Fatal(topology, "player", p+1, "sampled a different common polynomial")
+				}
+			}
+			if first != nil && first[0].crp.Q.Equals(oips[0].crp.Q) {
+				t.Fatal(topology, "common polynomial reused across sessions")
+			}
+			first = oips
+		}
+		testMul(first, 100, 1)
+	}
+}
+
+func TestCoinTossSessionMismatch(t *testing.T) {
+	oips := setupOIPs(SetupParams(), TopologyStar, 3)
+	for p, oip := range oips {
+		oip.SetSession("session")
+		if p == 2 {
+			oip.SetSession("other session")
+		}
+	}
+	for p, err := range setupAll(oips) {
+		var perr *ProtocolError
+		if !errors.As(err, &perr) || perr.Phase != PhaseKeyGen {
+			t.Fatal("player", p, "expected a key generation error, got", err)
+		}
+	}
+}
@@ -0,0 +1,565 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"math/bits"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ldsec/lattigo/v2/bfv"
+	"gopkg.in/yaml.v3"
+)
+
+// Session configuration, shared by all parties (YAML or JSON), e.g.
+//
+//	parties:
+//	  - address: 10.0.0.1:7000
+//	  - address: 10.0.0.2:7000
+//	    listen: 10.0.0.2:7000
+//	topology: star
+//	params: PN12QP109
+//	session: run-2022-01-01
+//	backend:
+//	  type: mp-spdz
+//	  dir: MP-SPDZ
+//	  binary: ./semi-party.x
+//	  args: [-N, "{parties}", -I, -p, "{player}", bmpc-example]
+//	traffic: /tmp/traffic-{player}.yml
+//
+// "{player}" and "{parties}" are replaced by the index of the party and the number of parties
+// in the backend arguments and in all file paths.
+type SessionConfig struct {
+	Parties []PartyConfig `yaml:"parties"`
+
+	// network
+	Topology     string         `yaml:"topology"`      // star (default), mesh or tree
+	TreeArity    int            `yaml:"tree_arity"`    // branching factor of the tree topology
+	Aggregator   string         `yaml:"aggregator"`    // aggregator of the star topology: player index (default 0) or "rotate"
+	Codec        string         `yaml:"codec"`         // binary (default) or gob
+	SetupTimeout string         `yaml:"setup_timeout"` // all parties must be connected within the timeout (e.g. 60s)
+	TLS          *TLSFiles      `yaml:"tls"`           // mutually authenticated TLS (optional)
+	NetProfile   string         `yaml:"net_profile"`   // emulated network conditions of every outgoing link (optional)
+	NetProfiles  map[int]string `yaml:"net_profiles"`  // emulated network conditions of the links to individual players
+	Proofs       bool           `yaml:"proofs"`        // zero-knowledge proofs of plaintext knowledge, verified by the aggregator (star topology)
+	Threshold    int            `yaml:"threshold"`     // any threshold+1 parties can decrypt (star topology with a fixed aggregator)
+	PeerTimeout  string         `yaml:"peer_timeout"`  // with a threshold, parties not responding within the timeout are dropped (e.g. 60s)
+	Debug        bool           `yaml:"debug"`         // check the noise budget before every decryption, reveals the products (see noise.go)
+	Session      string         `yaml:"session"`       // session identifier, bound to the coin-tossed CRS (same for all parties, unique per session)
+	Keystore     *KeystoreFiles `yaml:"keystore"`      // save the key material and reuse it in later runs of the session (optional)
+	Triples      int            `yaml:"triples"`       // Beaver triples preprocessed before the evaluation (cdn backend, see triples.go)
+	MACs         bool           `yaml:"macs"`          // MAC-authenticated shares, checked before the outputs are released (cdn backend, see mac.go)
+	EvalKeys     *EvalKeys      `yaml:"eval_keys"`     // relinearization and rotation keys generated by the setup (optional, see evalkeys.go)
+	Select       string         `yaml:"select"`        // select strategy: tensor (default) or ciphertext (requires eval_keys.relin, see ctselect.go)
+	Disjunction  string         `yaml:"disjunction"`   // disjunction strategy: masked (default) or homomorphic (requires eval_keys.relin, see hecdn.go)
+	Backend      BackendConfig  `yaml:"backend"`
+	Params       string         `yaml:"params"`  // BFV parameter preset (default PN12QP109), or auto: selected for the circuit (see params.go)
+	Prime        uint64         `yaml:"prime"`   // field modulus, also the BFV plaintext modulus (default 65537)
+	CRT          *CRTModuli     `yaml:"crt"`     // composite field modulus of several plaintext moduli, replaces the prime (cdn backend, see crt.go)
+	Sigma        float64        `yaml:"sigma"`   // standard deviation of the smudging noise in distributed decryption
+	Inputs       string         `yaml:"inputs"`  // inputs of the party: field elements separated by whitespace (default: random)
+	Output       string         `yaml:"output"`  // write the output of the party, one field element per line (optional)
+	Traffic      string         `yaml:"traffic"` // write traffic measurements (optional, see traffic.go)
+}
+
+type PartyConfig struct {
+	Address string `yaml:"address"` // host:port the other parties connect to
+	Listen  string `yaml:"listen"`  // interface to listen on (default: all interfaces, port of the address)
+}
+
+type TLSFiles struct {
+	CA   string `yaml:"ca"`   // PEM certificate authority of all parties
+	Cert string `yaml:"cert"` // PEM certificate of the party
+	Key  string `yaml:"key"`  // PEM key of the party
+}
+
+// the keystore is encrypted with the contents of the key file, or with the passphrase in an environment variable
+// (keeping the secret out of the configuration shared by all parties)
+type KeystoreFiles struct {
+	Path          string `yaml:"path"`           // keystore of the party
+	KeyFile       string `yaml:"key_file"`       // file holding the secret of the party
+	PassphraseEnv string `yaml:"passphrase_env"` // environment variable holding the passphrase of the party
+}
+
+type EvalKeys struct {
+	Relin     bool  `yaml:"relin"`     // relinearization key
+	Rotations []int `yaml:"rotations"` // column rotations by k slots (negative: to the right)
+	InnerSum  bool  `yaml:"inner_sum"` // all rotations of InnerSum (including the row rotation)
+}
+
+// the circuit is evaluated modulo every plaintext modulus, one after the other
+type CRTModuli struct {
+	Moduli int `yaml:"moduli"` // number of plaintext moduli
+	Bits   int `yaml:"bits"`   // size of every plaintext modulus (NTT-friendly primes)
+}
+
+// smallest size of a CRT modulus
+const MIN_CRT_BITS = 20
+
+// params selecting the BFV parameters for the shape of the circuit
+const PARAMS_AUTO = "auto"
+
+const BackendCDN = "cdn"
+const BackendMPSPDZ = "mp-spdz"
+
+type BackendConfig struct {
+	Type   string   `yaml:"type"`   // cdn (default) or mp-spdz
+	Dir    string   `yaml:"dir"`    // working directory of MP-SPDZ
+	Binary string   `yaml:"binary"` // MP-SPDZ party binary
+	Args   []string `yaml:"args"`   // arguments of the MP-SPDZ binary
+}
+
+var BFV_PRESETS = map[string]bfv.ParametersLiteral{
+	"PN12QP109":   bfv.PN12QP109,
+	"PN13QP218":   bfv.PN13QP218,
+	"PN14QP438":   bfv.PN14QP438,
+	"PN15QP880":   bfv.PN15QP880,
+	"PN12QP101pq": bfv.PN12QP101pq,
+	"PN13QP202pq": bfv.PN13QP202pq,
+	"PN14QP411pq": bfv.PN14QP411pq,
+	"PN15QP827pq": bfv.PN15QP827pq,
+}
+
+func configError(field string, format string, v ...interface{}) error {
+	return errors.New("config: " + field + ": " + fmt.Sprintf(format, v...))
+}
+
+func LoadConfig(path string) (*SessionConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseConfig(data)
+}
+
+// parse and validate a session configuration, unknown fields are rejected
+func ParseConfig(data []byte) (*SessionConfig, error) {
+	var c SessionConfig
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&c); err != nil && err != io.EOF {
+		return nil, errors.New("config: " + err.Error())
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (c *SessionConfig) Validate() error {
+	if len(c.Parties) == 0 {
+		return configError("parties", "no parties")
+	}
+
+	for i, party := range c.Parties {
+		field := "parties[" + strconv.Itoa(i) + "]"
+		if _, _, err := net.SplitHostPort(party.Address); err != nil {
+			return configError(field+".address", "%v", err)
+		}
+		if party.Listen != "" {
+			if _, _, err := net.SplitHostPort(party.Listen); err != nil {
+				return configError(field+".listen", "%v", err)
+			}
+		}
+	}
+
+	// the coin-tossed CRS is bound to the session (with either backend, the OIP keys are generated in every session):
+	// with an empty identifier the transcripts of distinct sessions of the same parties could be replayed
+	if c.Session == "" {
+		return configError("session", "required (the same for all parties, unique per session)")
+	}
+
+	if _, err := ParseTopology(c.Topology); err != nil {
+		return configError("topology", "%v", err)
+	}
+
+	if c.TreeArity < 0 {
+		return configError("tree_arity", "must be positive")
+	}
+
+	if _, _, err := c.aggregator(); err != nil {
+		return err
+	}
+
+	if topology, _ := ParseTopology(c.Topology); c.Proofs && topology != TopologyStar {
+		return configError("proofs", "require the star topology")
+	}
+
+	if c.Threshold < 0 || (c.Threshold > 0 && c.Threshold >= len(c.Parties)) {
+		return configError("threshold", "must be between 0 and the number of parties - 1")
+	}
+
+	if _, rotate, _ := c.aggregator(); c.Threshold > 0 {
+		if topology, _ := ParseTopology(c.Topology); topology != TopologyStar || rotate {
+			return configError("threshold", "requires the star topology with a fixed aggregator")
+		}
+	}
+
+	if c.Debug && c.Threshold > 0 {
+		return configError("debug", "the noise budget check does not support threshold decryption")
+	}
+
+	if c.PeerTimeout != "" {
+		if timeout, err := time.ParseDuration(c.PeerTimeout); err != nil || timeout <= 0 {
+			return configError("peer_timeout", "invalid duration %q", c.PeerTimeout)
+		}
+	}
+
+	if _, err := ParseCodec(c.Codec); err != nil {
+		return configError("codec", "%v", err)
+	}
+
+	if c.SetupTimeout != "" {
+		if timeout, err := time.ParseDuration(c.SetupTimeout); err != nil || timeout <= 0 {
+			return configError("setup_timeout", "invalid duration %q", c.SetupTimeout)
+		}
+	}
+
+	if c.TLS != nil && (c.TLS.CA == "" || c.TLS.Cert == "" || c.TLS.Key == "") {
+		return configError("tls", "ca, cert and key are required")
+	}
+
+	if c.Keystore != nil {
+		if c.Keystore.Path == "" {
+			return configError("keystore.path", "required")
+		}
+		if (c.Keystore.KeyFile == "") == (c.Keystore.PassphraseEnv == "") {
+			return configError("keystore", "exactly one of key_file and passphrase_env is required")
+		}
+	}
+
+	if _, err := ParseNetProfile(c.NetProfile); err != nil {
+		return configError("net_profile", "%v", err)
+	}
+
+	for p, profile := range c.NetProfiles {
+		field := "net_profiles[" + strconv.Itoa(p) + "]"
+		if p < 0 || p >= len(c.Parties) {
+			return configError(field, "no such player")
+		}
+		if _, err := ParseNetProfile(profile); err != nil {
+			return configError(field, "%v", err)
+		}
+	}
+
+	switch c.Backend.Type {
+	case "", BackendCDN:
+		if c.Backend.Binary != "" || len(c.Backend.Args) != 0 || c.Backend.Dir != "" {
+			return configError("backend", "the cdn backend takes no binary, dir or args")
+		}
+	case BackendMPSPDZ:
+		if c.Backend.Binary == "" {
+			return configError("backend.binary", "required by the mp-spdz backend")
+		}
+	default:
+		return configError("backend.type", "unknown backend %q (cdn or mp-spdz)", c.Backend.Type)
+	}
+
+	if c.EvalKeys != nil {
+		for i, k := range c.EvalKeys.Rotations {
+			if k == 0 {
+				return configError("eval_keys.rotations["+strconv.Itoa(i)+"]", "rotation by zero slots")
+			}
+		}
+	}
+
+	if strategy, err := ParseSelectStrategy(c.Select); err != nil {
+		return configError("select", "%v", err)
+	} else if strategy == SelectCiphertext && (c.EvalKeys == nil || !c.EvalKeys.Relin) {
+		return configError("select", "the ciphertext strategy requires eval_keys.relin")
+	}
+
+	if strategy, err := ParseDisjunctionStrategy(c.Disjunction); err != nil {
+		return configError("disjunction", "%v", err)
+	} else if strategy == DisjunctionHomomorphic {
+		switch {
+		case c.EvalKeys == nil || !c.EvalKeys.Relin:
+			return configError("disjunction", "the homomorphic strategy requires eval_keys.relin")
+		case c.Threshold > 0:
+			return configError("disjunction", "the homomorphic strategy does not support a threshold")
+		case c.MACs:
+			return configError("disjunction", "the homomorphic strategy does not authenticate the shares (macs)")
+		case c.UseMPSPDZ():
+			return configError("disjunction", "the homomorphic strategy requires the cdn backend")
+		}
+	}
+
+	if c.Triples < 0 {
+		return configError("triples", "must be positive")
+	}
+
+	if c.Triples > 0 && c.UseMPSPDZ() {
+		return configError("triples", "require the cdn backend")
+	}
+
+	if c.MACs && c.UseMPSPDZ() {
+		return configError("macs", "require the cdn backend")
+	}
+
+	if c.Params != "" && c.Params != PARAMS_AUTO {
+		if _, ok := BFV_PRESETS[c.Params]; !ok {
+			return configError("params", "unknown BFV parameter preset %q", c.Params)
+		}
+	}
+
+	if c.Params == PARAMS_AUTO && c.CRT != nil {
+		return configError("params", "auto is not supported with crt")
+	}
+
+	if c.Prime != 0 {
+		if err := checkPrime(c.Prime); err != nil {
+			return configError("prime", "%v", err)
+		}
+	}
+
+	// the automatic selection only considers parameters fitting the prime
+	if c.Prime != 0 && c.Params != PARAMS_AUTO {
+		literal := c.literal()
+		literal.T = c.Prime
+		if err := checkPlaintextModulus(literal); err != nil {
+			return configError("prime", "%v", err)
+		}
+		if _, err := bfv.NewParametersFromLiteral(literal); err != nil {
+			return configError("prime", "%v", err)
+		}
+	}
+
+	if c.CRT != nil {
+		switch {
+		case c.CRT.Moduli < 1:
+			return configError("crt.moduli", "must be positive")
+		case c.CRT.Bits < MIN_CRT_BITS || c.CRT.Bits > MAX_PRIME_BITS:
+			return configError("crt.bits", "must be between %d and %d", MIN_CRT_BITS, MAX_PRIME_BITS)
+		case c.Prime != 0:
+			return configError("crt", "replaces the prime")
+		case c.UseMPSPDZ():
+			return configError("crt", "requires the cdn backend")
+		}
+		if _, err := c.Moduli(); err != nil {
+			return configError("crt", "%v", err)
+		}
+	}
+
+	// the noise of the selections of the circuit must fit the parameters of every plaintext modulus (see EstimateNoise),
+	// the automatic selection ensures it
+	if c.Params != PARAMS_AUTO {
+		moduli, err := c.Moduli()
+		if err != nil {
+			return configError("params", "%v", err)
+		}
+		req := CIRCUIT.Request(len(c.Parties))
+		for _, params := range moduli {
+			if noise := EstimateNoise(params, req.Branches, req.Parties); noise.Margin() < 0 {
+				return configError(c.modulusField(), "parameters too small for a plaintext modulus of %d bits: %v", bits.Len64(params.T()), noise)
+			}
+		}
+	}
+
+	if c.Sigma < 0 {
+		return configError("sigma", "must be positive")
+	}
+
+	return nil
+}
+
+// aggregator of the star topology and whether it rotates
+func (c *SessionConfig) aggregator() (int, bool, error) {
+	switch c.Aggregator {
+	case "":
+		return 0, false, nil
+	case "rotate":
+		return 0, true, nil
+	}
+	agg, err := strconv.Atoi(c.Aggregator)
+	if err != nil || agg < 0 || agg >= len(c.Parties) {
+		return 0, false, configError("aggregator", "expected a player index or \"rotate\", got %q", c.Aggregator)
+	}
+	return agg, false, nil
+}
+
+func (c *SessionConfig) UseMPSPDZ() bool {
+	return c.Backend.Type == BackendMPSPDZ
+}
+
+// substitute "{player}" and "{parties}"
+func (c *SessionConfig) Expand(s string, me int) string {
+	s = strings.ReplaceAll(s, "{player}", strconv.Itoa(me))
+	return strings.ReplaceAll(s, "{parties}", strconv.Itoa(len(c.Parties)))
+}
+
+// arguments of the MP-SPDZ binary for player me
+func (c *SessionConfig) BackendArgs(me int) []string {
+	args := make([]string, len(c.Backend.Args))
+	for i, arg := range c.Backend.Args {
+		args[i] = c.Expand(arg, me)
+	}
+	return args
+}
+
+// apply the configuration to the global settings of player me
+func (c *SessionConfig) Apply(me int) error {
+	if me < 0 || me >= len(c.Parties) {
+		return configError("player", "%d is not one of the %d parties", me, len(c.Parties))
+	}
+
+	ADDRESSES = make([]*net.TCPAddr, len(c.Parties))
+	LISTEN = make([]string, len(c.Parties))
+	for i, party := range c.Parties {
+		addr, err := net.ResolveTCPAddr("tcp", party.Address)
+		if err != nil {
+			return configError("parties["+strconv.Itoa(i)+"].address", "%v", err)
+		}
+		ADDRESSES[i] = addr
+		LISTEN[i] = party.Listen
+	}
+
+	CODEC, _ = ParseCodec(c.Codec)
+
+	if c.TreeArity != 0 {
+		TREE_ARITY = c.TreeArity
+	}
+
+	if c.SetupTimeout != "" {
+		SETUP_TIMEOUT, _ = time.ParseDuration(c.SetupTimeout)
+	}
+
+	if c.PeerTimeout != "" {
+		PEER_TIMEOUT, _ = time.ParseDuration(c.PeerTimeout)
+	}
+
+	if c.TLS != nil {
+		var err error
+		TLS, err = LoadTLSConfig(c.Expand(c.TLS.CA, me), c.Expand(c.TLS.Cert, me), c.Expand(c.TLS.Key, me))
+		if err != nil {
+			return configError("tls", "%v", err)
+		}
+	}
+
+	NET_PROFILE, _ = ParseNetProfile(c.NetProfile)
+	NET_EMULATION = c.NetProfile != ""
+	for p, profile := range c.NetProfiles {
+		NET_PROFILES[p], _ = ParseNetProfile(profile)
+		NET_EMULATION = true
+	}
+
+	// the selection depends on the field modulus
+	if c.Params == PARAMS_AUTO {
+		req := CIRCUIT.Request(len(c.Parties))
+		req.Prime = c.FieldPrime()
+		choice, err := SelectParams(req)
+		if err != nil {
+			return configError("params", "%v", err)
+		}
+		LITERAL = choice.Literal
+	} else if c.Params != "" {
+		LITERAL = BFV_PRESETS[c.Params]
+	}
+
+	if c.Sigma != 0 {
+		SIGMA = c.Sigma
+	}
+
+	CDN_DEBUG = c.Debug
+
+	return nil
+}
+
+// path of the keystore of player me and the secret encrypting it
+func (c *SessionConfig) KeystoreSecret(me int) (string, []byte, error) {
+	path := c.Expand(c.Keystore.Path, me)
+	if c.Keystore.KeyFile != "" {
+		secret, err := os.ReadFile(c.Expand(c.Keystore.KeyFile, me))
+		if err != nil {
+			return "", nil, configError("keystore.key_file", "%v", err)
+		}
+		return path, secret, nil
+	}
+	passphrase := os.Getenv(c.Keystore.PassphraseEnv)
+	if passphrase == "" {
+		return "", nil, configError("keystore.passphrase_env", "%s is not set", c.Keystore.PassphraseEnv)
+	}
+	return path, []byte(passphrase), nil
+}
+
+// the field modulus (without CRT): the configured prime or PRIME
+func (c *SessionConfig) FieldPrime() FieldElem {
+	if c.Prime != 0 {
+		return c.Prime
+	}
+	return PRIME
+}
+
+// the configured parameter preset (LITERAL with params: auto, as selected by Apply)
+func (c *SessionConfig) literal() bfv.ParametersLiteral {
+	if c.Params != "" && c.Params != PARAMS_AUTO {
+		return BFV_PRESETS[c.Params]
+	}
+	return LITERAL
+}
+
+// field of the configuration which determines the plaintext moduli
+func (c *SessionConfig) modulusField() string {
+	switch {
+	case c.CRT != nil:
+		return "crt"
+	case c.Prime != 0:
+		return "prime"
+	}
+	return "params"
+}
+
+// the parameters of every plaintext modulus (with the parameters set by Apply): of the prime, or of the CRT moduli
+func (c *SessionConfig) Moduli() ([]bfv.Parameters, error) {
+	if c.CRT == nil {
+		literal := c.literal()
+		literal.T = c.FieldPrime()
+		params, err := bfv.NewParametersFromLiteral(literal)
+		if err != nil {
+			return nil, err
+		}
+		return []bfv.Parameters{params}, nil
+	}
+	return CRTParams(c.literal(), c.CRT.Bits, c.CRT.Moduli)
+}
+
+// read the inputs of player me, elements modulo the field modulus m (nil if not configured)
+func (c *SessionConfig) ReadInputs(me int, m *big.Int) ([]*big.Int, error) {
+	if c.Inputs == "" {
+		return nil, nil
+	}
+
+	path := c.Expand(c.Inputs, me)
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var inputs []*big.Int
+	scanner := bufio.NewScanner(file)
+	scanner.Split(bufio.ScanWords)
+	for scanner.Scan() {
+		v, ok := new(big.Int).SetString(scanner.Text(), 10)
+		if !ok || v.Sign() < 0 || v.Cmp(m) >= 0 {
+			return nil, errors.New(path + ": invalid field element " + strconv.Quote(scanner.Text()))
+		}
+		inputs = append(inputs, v)
+	}
+	return inputs, scanner.Err()
+}
+
+func WriteOutput(w io.Writer, output []*big.Int) error {
+	for _, v := range output {
+		if _, err := fmt.Fprintln(w, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
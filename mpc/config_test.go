@@ -0,0 +1,178 @@
+package main
+
+import (
+	"math/big"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const TEST_CONFIG = `
+parties:
+  - address: 127.0.0.1:7000
+  - address: 127.0.0.1:7001
+    listen: 127.0.0.1:7001
+  - address: 127.0.0.1:7002
+topology: star
+aggregator: 2
+session: test-session
+params: PN13QP218
+prime: 549756174337
+sigma: 6.4
+backend:
+  type: mp-spdz
+  dir: MP-SPDZ
+  binary: ./semi-party.x
+  args: [-N, "{parties}", -p, "{player}", bmpc-example]
+traffic: /tmp/traffic-{player}.yml
+`
+
+func TestParseConfig(t *testing.T) {
+	config, err := ParseConfig([]byte(TEST_CONFIG))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(config.Parties) != 3 || config.Parties[1].Listen != "127.0.0.1:7001" {
+		t.Fatal("Wrong parties", config.Parties)
+	}
+
+	if agg, rotate, _ := config.aggregator(); agg != 2 || rotate {
+		t.Fatal("Wrong aggregator", agg, rotate)
+	}
+
+	if config.Session != "test-session" {
+		t.Fatal("Wrong session", config.Session)
+	}
+
+	if config.Prime != 549756174337 {
+		t.Fatal("Wrong prime", config.Prime)
+	}
+
+	if !config.UseMPSPDZ() {
+		t.Fatal("Expected MP-SPDZ backend")
+	}
+
+	args := config.BackendArgs(1)
+	if !reflect.DeepEqual(args, []string{"-N", "3", "-p", "1", "bmpc-example"}) {
+		t.Fatal("Wrong backend arguments", args)
+	}
+
+	if path := config.Expand(config.Traffic, 1); path != "/tmp/traffic-1.yml" {
+		t.Fatal("Wrong traffic path", path)
+	}
+
+	// JSON is accepted as well
+
+	json := `{"parties": [{"address": "127.0.0.1:7000"}], "topology": "mesh", "aggregator": "rotate", "session": "test-session"}`
+	config, err = ParseConfig([]byte(json))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, rotate, _ := config.aggregator(); !rotate || config.Topology != "mesh" {
+		t.Fatal("Wrong JSON config", config)
+	}
+
+	// a composite field of three 50-bit moduli (see crt.go)
+
+	config, err = ParseConfig([]byte("parties: [{address: 127.0.0.1:7000}]\nsession: s\nparams: PN13QP218\ncrt: {moduli: 3, bits: 50}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	params, err := config.Moduli()
+	if err != nil || len(params) != 3 || params[0].LogN() != 13 || bits.Len64(params[2].T()) != 50 {
+		t.Fatal("Wrong CRT moduli", params, err)
+	}
+
+	// parameters selected for the circuit when applied (see params.go)
+	if _, err = ParseConfig([]byte("parties: [{address: 127.0.0.1:7000}]\nsession: s\nparams: auto\nprime: 549756174337")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	party := "parties: [{address: 127.0.0.1:7000}]\nsession: test-session\n"
+	parties := "parties: [{address: 127.0.0.1:7000}, {address: 127.0.0.1:7001}]\nsession: test-session\n"
+
+	for _, tc := range []struct {
+		config string
+		field  string
+	}{
+		{"", "parties"},
+		{"parties: [{address: nope}]", "parties[0].address"},
+		{"parties: [{address: 127.0.0.1:7000}]", "session"},
+		{"parties: [{address: 127.0.0.1:7000}]\nsession: \"\"", "session"},
+		{party + "topology: ring", "topology"},
+		{party + "aggregator: 1", "aggregator"},
+		{party + "topology: tree\nproofs: true", "proofs"},
+		{party + "threshold: 1", "threshold"},
+		{parties + "threshold: 1\naggregator: rotate", "threshold"},
+		{parties + "threshold: 1\ndebug: true", "debug"},
+		{party + "peer_timeout: soon", "peer_timeout"},
+		{party + "prime: 65535", "prime"},
+		{party + "prime: 549756174337", "prime"},
+		{party + "codec: xml", "codec"},
+		{party + "setup_timeout: soon", "setup_timeout"},
+		{party + "tls: {ca: ca.pem}", "tls"},
+		{party + "net_profile: latency=fast", "net_profile"},
+		{party + "net_profiles: {1: latency=10ms}", "net_profiles[1]"},
+		{party + "backend: {type: mp-spdz}", "backend.binary"},
+		{party + "backend: {binary: ./semi-party.x}", "backend"},
+		{party + "backend: {type: spdz}", "backend.type"},
+		{party + "params: PN99", "params"},
+		{party + "params: auto\ncrt: {moduli: 3, bits: 50}", "params"},
+		{party + "sigma: -1", "sigma"},
+		{party + "triples: -1", "triples"},
+		{party + "triples: 10\nbackend: {type: mp-spdz, binary: ./semi-party.x}", "triples"},
+		{party + "macs: true\nbackend: {type: mp-spdz, binary: ./semi-party.x}", "macs"},
+		{party + "eval_keys: {rotations: [1, 0]}", "eval_keys.rotations[1]"},
+		{party + "select: oblivious", "select"},
+		{party + "select: ciphertext", "select"},
+		{party + "disjunction: garbled", "disjunction"},
+		{party + "crt: {moduli: 0, bits: 50}", "crt.moduli"},
+		{party + "crt: {moduli: 3, bits: 61}", "crt.bits"},
+		{party + "crt: {moduli: 3, bits: 50}\nprime: 65537", "crt"},
+		{party + "crt: {moduli: 3, bits: 50}", "crt"},
+		{party + "crt: {moduli: 2, bits: 30}", "crt: parameters too small"},
+		{party + "params: PN12QP109\nprime: 1073750017", "prime: parameters too small"},
+		{party + "disjunction: homomorphic", "disjunction"},
+		{party + "disjunction: homomorphic\neval_keys: {relin: true}\nmacs: true", "disjunction"},
+		{party + "keystore: {key_file: key}", "keystore.path"},
+		{party + "keystore: {path: keys, key_file: key, passphrase_env: PASSPHRASE}", "keystore"},
+		{party + "players: 2", "field players not found"},
+	} {
+		_, err := ParseConfig([]byte(tc.config))
+		if err == nil || !strings.Contains(err.Error(), tc.field) {
+			t.Fatalf("Config %q: expected error on %s, got %v", tc.config, tc.field, err)
+		}
+	}
+}
+
+func TestReadInputs(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "input-1.txt"), []byte("1 2\n65536\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "input-2.txt"), []byte("65537"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &SessionConfig{Inputs: filepath.Join(dir, "input-{player}.txt")}
+
+	inputs, err := config.ReadInputs(1, big.NewInt(65537))
+	if err != nil || !reflect.DeepEqual(inputs, []*big.Int{big.NewInt(1), big.NewInt(2), big.NewInt(65536)}) {
+		t.Fatal("Wrong inputs", inputs, err)
+	}
+
+	if _, err := config.ReadInputs(2, big.NewInt(65537)); err == nil {
+		t.Fatal("Accepted input outside the field")
+	}
+
+	// elements of a composite field (see crt.go)
+	if inputs, err := config.ReadInputs(2, big.NewInt(65538)); err != nil || inputs[0].Uint64() != 65537 {
+		t.Fatal("Wrong inputs", inputs, err)
+	}
+}
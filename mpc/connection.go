@@ -1,19 +1,165 @@
 package main
 
 import (
+	"bufio"
 	"encoding/gob"
+	"errors"
 	"io"
 	"net"
 	"os"
+	"sync"
+	"sync/atomic"
 	"syscall"
 )
 
+// how the parties are connected to one another
+type Topology int
+
+const (
+	TopologyStar Topology = iota // every player is connected to player 0
+	TopologyMesh                 // every pair of players is connected
+	TopologyTree                 // every player is connected to its parent in a TREE_ARITY-ary tree rooted at player 0
+)
+
+// default branching factor of the tree topology
+var TREE_ARITY = 2
+
+func (t Topology) String() string {
+	switch t {
+	case TopologyStar:
+		return "star"
+	case TopologyMesh:
+		return "mesh"
+	case TopologyTree:
+		return "tree"
+	}
+	return "unknown"
+}
+
+func ParseTopology(s string) (Topology, error) {
+	switch s {
+	case "", "star":
+		return TopologyStar, nil
+	case "mesh":
+		return TopologyMesh, nil
+	case "tree":
+		return TopologyTree, nil
+	}
+	return TopologyStar, errors.New("unknown topology: " + s)
+}
+
+// parent of player p (p > 0) in the tree topology
+func treeParent(p int, arity int) int {
+	return (p - 1) / arity
+}
+
+// children of player p in the tree topology
+func treeChildren(p int, arity int, players int) []int {
+	var children []int
+	for c := p*arity + 1; c <= p*arity+arity && c < players; c++ {
+		children = append(children, c)
+	}
+	return children
+}
+
+// whether players p1 < p2 are directly connected
+func Linked(topology Topology, arity int, p1, p2 int) bool {
+	switch topology {
+	case TopologyMesh:
+		return true
+	case TopologyTree:
+		return treeParent(p2, arity) == p1
+	}
+	return p1 == 0
+}
+
+// how messages are serialized on a connection
+type Codec int
+
+const (
+	CodecBinary Codec = iota // length-prefixed binary frames (see wire.go)
+	CodecGob                 // gob stream (compatibility)
+)
+
+func ParseCodec(s string) (Codec, error) {
+	switch s {
+	case "", "binary":
+		return CodecBinary, nil
+	case "gob":
+		return CodecGob, nil
+	}
+	return CodecBinary, errors.New("unknown codec: " + s)
+}
+
+// codec used by NewConnection
+var CODEC = CodecBinary
+
 type Connection struct {
+	codec Codec
+
+	// gob codec
 	enc *gob.Encoder
 	dec *gob.Decoder
+
+	// binary codec
+	r     *bufio.Reader
+	w     *bufio.Writer
+	buf   []byte     // receive buffer
+	rlock sync.Mutex // serializes receivers (like gob.Decoder)
+	wlock sync.Mutex // serializes senders (like gob.Encoder)
+
+	// in-memory transport (see memory.go)
+	mem *memLink
+
+	// underlying connection (nil if it cannot be closed)
+	closer io.Closer
+
+	// traffic accounting (nil if disabled)
+	traffic *Traffic
+	stats   *[PHASES]LinkStats
+}
+
+// counts the bytes read from / written to the underlying connection
+type meter struct {
+	conn io.ReadWriter
+	c    *Connection
+}
+
+func (m *meter) Read(p []byte) (int, error) {
+	n, err := m.conn.Read(p)
+	if s := m.c.current(); s != nil {
+		atomic.AddUint64(&s.BytesRecv, uint64(n))
+	}
+	return n, err
+}
+
+func (m *meter) Write(p []byte) (int, error) {
+	n, err := m.conn.Write(p)
+	if s := m.c.current(); s != nil {
+		atomic.AddUint64(&s.BytesSent, uint64(n))
+	}
+	return n, err
+}
+
+// counters of the current phase
+func (c *Connection) current() *LinkStats {
+	if c.traffic == nil {
+		return nil
+	}
+	return &c.stats[c.traffic.Phase()]
 }
 
 func DummyPair() (*Connection, *Connection) {
+	return DummyPairCodec(CODEC)
+}
+
+func DummyPairCodec(codec Codec) (*Connection, *Connection) {
+	c1, c2 := dummySockets()
+	return NewConnectionCodec(c1, codec), NewConnectionCodec(c2, codec)
+}
+
+// pair of connected unix sockets
+func dummySockets() (net.Conn, net.Conn) {
 	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
 	if err != nil {
 		panic(err)
@@ -32,35 +178,16 @@ func DummyPair() (*Connection, *Connection) {
 	}
 	syscall.SetNonblock(fds[0], false)
 
-	return NewConnection(c1), NewConnection(c2)
-}
-
-func StarDummies(players int) [][]*Connection {
-	// create multi-dimensional array of connections
-	conns := make([][]*Connection, 0)
-	for p1 := 0; p1 < players; p1++ {
-		p1_conns := make([]*Connection, players)
-		conns = append(conns, p1_conns)
-	}
-
-	// fill with dummies
-	for p1 := 0; p1 < players; p1++ {
-		for p2 := p1 + 1; p2 < players; p2++ {
-			conns[p1][p2] = &Connection{nil, nil}
-			conns[p2][p1] = &Connection{nil, nil}
-		}
-	}
+	// FileConn duplicates the descriptors: close the originals, so closing a connection closes its end of the pair
+	f1.Close()
+	f2.Close()
 
-	// create pair-wise connections
-	for p1 := 1; p1 < players; p1++ {
-		c1, c2 := DummyPair()
-		conns[0][p1] = c1
-		conns[p1][0] = c2
-	}
-	return conns
+	return c1, c2
 }
 
-func NDummies(players int) [][]*Connection {
+// create dummy connections between players (conns[p1][p2] is the connection from p1 to p2),
+// pair(p1, p2) creates the two ends of the connection between linked players p1 and p2 (nil between unlinked players)
+func dummies(topology Topology, arity int, players int, pair func(p1, p2 int) (*Connection, *Connection)) [][]*Connection {
 	// create multi-dimensional array of connections
 	conns := make([][]*Connection, 0)
 	for p1 := 0; p1 < players; p1++ {
@@ -71,8 +198,10 @@ func NDummies(players int) [][]*Connection {
 	// create pair-wise connections
 	for p1 := 0; p1 < players; p1++ {
 		for p2 := p1 + 1; p2 < players; p2++ {
-			// create connection
-			c1, c2 := DummyPair()
+			if !Linked(topology, arity, p1, p2) {
+				continue // no connection (nil), as between unlinked players in main
+			}
+			c1, c2 := pair(p1, p2)
 			conns[p1][p2] = c1
 			conns[p2][p1] = c2
 		}
@@ -80,17 +209,83 @@ func NDummies(players int) [][]*Connection {
 	return conns
 }
 
+func dummyPair(int, int) (*Connection, *Connection) {
+	return DummyPair()
+}
+
+func StarDummies(players int) [][]*Connection {
+	return dummies(TopologyStar, 0, players, dummyPair)
+}
+
+func NDummies(players int) [][]*Connection {
+	return dummies(TopologyMesh, 0, players, dummyPair)
+}
+
+func TreeDummies(players int, arity int) [][]*Connection {
+	return dummies(TopologyTree, arity, players, dummyPair)
+}
+
+func Dummies(topology Topology, players int) [][]*Connection {
+	return dummies(topology, TREE_ARITY, players, dummyPair)
+}
+
 func (c *Connection) Send(v interface{}) error {
-	return c.enc.Encode(v)
+	if s := c.current(); s != nil {
+		atomic.AddUint64(&s.MsgsSent, 1)
+	}
+	if c.mem != nil {
+		return c.sendMemory(v)
+	}
+	if c.codec == CodecGob {
+		return c.enc.Encode(v)
+	}
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	return c.sendBinary(v)
 }
 
+// receive into v, the binary codec decodes into the elements already allocated in v
 func (c *Connection) Recv(v interface{}) error {
-	return c.dec.Decode(v)
+	if s := c.current(); s != nil {
+		atomic.AddUint64(&s.MsgsRecv, 1)
+	}
+	if c.mem != nil {
+		return c.recvMemory(v)
+	}
+	if c.codec == CodecGob {
+		return c.dec.Decode(v)
+	}
+	c.rlock.Lock()
+	defer c.rlock.Unlock()
+	return c.recvBinary(v)
+}
+
+// close the underlying connection: pending and future calls to Send and Recv (at both ends) fail
+func (c *Connection) Close() error {
+	if c.mem != nil {
+		c.mem.close()
+		return nil
+	}
+	if c.closer == nil {
+		return nil
+	}
+	return c.closer.Close()
 }
 
 func NewConnection(conn io.ReadWriter) *Connection {
-	return &Connection{
-		enc: gob.NewEncoder(conn),
-		dec: gob.NewDecoder(conn),
+	return NewConnectionCodec(conn, CODEC)
+}
+
+func NewConnectionCodec(conn io.ReadWriter, codec Codec) *Connection {
+	c := &Connection{codec: codec}
+	c.closer, _ = conn.(io.Closer)
+	m := &meter{conn: conn, c: c}
+	if codec == CodecGob {
+		c.enc = gob.NewEncoder(m)
+		c.dec = gob.NewDecoder(m)
+	} else {
+		c.r = bufio.NewReaderSize(m, TCP_BUFFER)
+		c.w = bufio.NewWriterSize(m, TCP_BUFFER)
 	}
+	return c
 }
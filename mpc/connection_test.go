@@ -0,0 +1,763 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ldsec/lattigo/v2/bfv"
+	"github.com/ldsec/lattigo/v2/dbfv"
+	"github.com/ldsec/lattigo/v2/drlwe"
+	"github.com/ldsec/lattigo/v2/utils"
+)
+
+// generate a certificate authority and a certificate for each player
+func testCertificates(players int) (*x509.CertPool, []tls.Certificate) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "bmpc test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		panic(err)
+	}
+
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		panic(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+
+	certs := make([]tls.Certificate, players)
+	for p := 0; p < players; p++ {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			panic(err)
+		}
+
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(int64(p + 2)),
+			Subject:      pkix.Name{CommonName: PlayerName(p)},
+			DNSNames:     []string{PlayerName(p)},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		}
+
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, &key.PublicKey, caKey)
+		if err != nil {
+			panic(err)
+		}
+
+		certs[p] = tls.Certificate{
+			Certificate: [][]byte{der},
+			PrivateKey:  key,
+		}
+	}
+
+	return pool, certs
+}
+
+// handshake between client and server over loopback TCP,
+// the client expects to be talking to player expect
+func testHandshake(client, server *TLSConfig, expect int) (*Connection, *Connection, int, error) {
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	defer ls.Close()
+
+	type accepted struct {
+		conn *Connection
+		them int
+		err  error
+	}
+
+	done := make(chan accepted, 1)
+	go func() {
+		conn, err := ls.Accept()
+		if err != nil {
+			done <- accepted{nil, 0, err}
+			return
+		}
+		tconn, them, err := server.Server(conn)
+		if err != nil {
+			conn.Close()
+			done <- accepted{nil, 0, err}
+			return
+		}
+		done <- accepted{NewConnection(tconn), them, nil}
+	}()
+
+	conn, err := net.Dial("tcp", ls.Addr().String())
+	if err != nil {
+		panic(err)
+	}
+
+	tconn, err := client.Client(conn, expect)
+	if err != nil {
+		conn.Close()
+		<-done
+		return nil, nil, 0, err
+	}
+
+	res := <-done
+	if res.err != nil {
+		return nil, nil, 0, res.err
+	}
+	return NewConnection(tconn), res.conn, res.them, nil
+}
+
+func TestTLS(t *testing.T) {
+	ca, certs := testCertificates(3)
+
+	p0 := NewTLSConfig(ca, certs[0])
+	p1 := NewTLSConfig(ca, certs[1])
+	p2 := NewTLSConfig(ca, certs[2])
+
+	// player 1 connects to player 0
+
+	c1, c0, them, err := testHandshake(p1, p0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if them != 1 {
+		t.Fatal("server got wrong identity", them)
+	}
+
+	go func() {
+		if err := c1.Send([]FieldElem{1, 2, 3}); err != nil {
+			panic(err)
+		}
+	}()
+
+	var v []FieldElem
+	if err := c0.Recv(&v); err != nil {
+		t.Fatal(err)
+	}
+	if len(v) != 3 || v[0] != 1 || v[1] != 2 || v[2] != 3 {
+		t.Fatal("wrong message", v)
+	}
+
+	// player 1 expects player 2, but player 0 answers
+
+	if _, _, _, err := testHandshake(p1, p0, 2); err == nil {
+		t.Fatal("accepted certificate of wrong player")
+	}
+
+	// certificate from another authority
+
+	otherCA, otherCerts := testCertificates(3)
+	rogue := NewTLSConfig(otherCA, otherCerts[2])
+	if _, _, _, err := testHandshake(rogue, p0, 0); err == nil {
+		t.Fatal("accepted certificate from unknown authority")
+	}
+
+	// player 2 is still accepted
+
+	if _, _, them, err := testHandshake(p2, p0, 0); err != nil || them != 2 {
+		t.Fatal("failed to authenticate player 2", err)
+	}
+}
+
+func testPRNG() utils.PRNG {
+	prng, err := utils.NewPRNG()
+	if err != nil {
+		panic(err)
+	}
+	return prng
+}
+
+func testCodec(t *testing.T, codec Codec) {
+	c1, c2 := DummyPairCodec(codec)
+	testTransport(t, c1, c2, codec == CodecBinary)
+}
+
+// send every type of message from c1 to c2,
+// inplace: ciphertexts are decoded into the preallocated ciphertexts
+func testTransport(t *testing.T, c1 *Connection, c2 *Connection, inplace bool) {
+	params := SetupParams()
+
+	// ciphertexts
+
+	cts := make([]*bfv.Ciphertext, 3)
+	for i := range cts {
+		cts[i] = bfv.NewCiphertextRandom(testPRNG(), params, 1)
+	}
+
+	recv := make([]*bfv.Ciphertext, len(cts))
+	for i := range recv {
+		recv[i] = bfv.NewCiphertext(params, 1)
+	}
+	prealloc := recv[0].Value[0].Coeffs[0]
+
+	go func() {
+		if err := c1.Send(cts); err != nil {
+			panic(err)
+		}
+	}()
+
+	if err := c2.Recv(&recv); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range cts {
+		if !cts[i].Value[0].Equals(recv[i].Value[0]) || !cts[i].Value[1].Equals(recv[i].Value[1]) {
+			t.Fatal("ciphertext does not match")
+		}
+	}
+
+	if inplace && &prealloc[0] != &recv[0].Value[0].Coeffs[0][0] {
+		t.Fatal("ciphertext not decoded into preallocated buffer")
+	}
+
+	// public key
+
+	kgen := bfv.NewKeyGenerator(params)
+	_, pk := kgen.GenKeyPair()
+
+	go func() {
+		if err := c1.Send(pk); err != nil {
+			panic(err)
+		}
+	}()
+
+	pkr := bfv.NewPublicKey(params)
+	if err := c2.Recv(pkr); err != nil {
+		t.Fatal(err)
+	}
+	if !pk.Equals(pkr) {
+		t.Fatal("public key does not match")
+	}
+
+	// field elements, integers and fallback types
+
+	elems := random(1000)
+
+	go func() {
+		if err := c1.Send(elems); err != nil {
+			panic(err)
+		}
+		if err := c1.Send(42); err != nil {
+			panic(err)
+		}
+		if err := c1.Send(map[string]int{"a": 1}); err != nil {
+			panic(err)
+		}
+	}()
+
+	var er []FieldElem
+	if err := c2.Recv(&er); err != nil {
+		t.Fatal(err)
+	}
+	for i := range elems {
+		if elems[i] != er[i] {
+			t.Fatal("field elements do not match")
+		}
+	}
+
+	var v int
+	if err := c2.Recv(&v); err != nil || v != 42 {
+		t.Fatal("integer does not match", err)
+	}
+
+	var m map[string]int
+	if err := c2.Recv(&m); err != nil || m["a"] != 1 {
+		t.Fatal("map does not match", err)
+	}
+}
+
+func TestCodecBinary(t *testing.T) {
+	testCodec(t, CodecBinary)
+}
+
+func TestCodecGob(t *testing.T) {
+	testCodec(t, CodecGob)
+}
+
+// the peer chooses the number and degree of the ciphertexts: bounded by the expected length or the received data
+func TestCodecCiphertextBounds(t *testing.T) {
+	params := SetupParams()
+	fresh := func() *bfv.Ciphertext { return bfv.NewCiphertextRandom(testPRNG(), params, 1) }
+
+	// more ciphertexts than expected
+	c1, c2 := DummyPairCodec(CodecBinary)
+	go c1.Send([]*bfv.Ciphertext{fresh(), fresh()})
+	recv := []*bfv.Ciphertext{bfv.NewCiphertext(params, 1)}
+	if err := c2.Recv(&recv); err == nil {
+		t.Fatal("received more ciphertexts than expected")
+	}
+	c2.Close()
+
+	// a count the peer never sends: nothing allocated up front
+	c1, c2 = DummyPairCodec(CodecBinary)
+	go func() {
+		c1.writeHeader(MsgCiphertexts, 1<<30)
+		c1.w.Flush()
+		c1.Close()
+	}()
+	var cts []*bfv.Ciphertext
+	if err := c2.Recv(&cts); err == nil || len(cts) != 0 {
+		t.Fatal("received missing ciphertexts", err)
+	}
+
+	// a degree without the polynomials
+	c1, c2 = DummyPairCodec(CodecBinary)
+	go func() {
+		c1.writeItems(MsgCiphertexts, 1, func(int) ([]byte, error) { return []byte{200, 0, 0, 0, 0}, nil })
+		c1.w.Flush()
+		c1.Close()
+	}()
+	if err := c2.Recv(&cts); err == nil {
+		t.Fatal("received ciphertext of invalid degree")
+	}
+}
+
+// ciphertexts of another shape are rejected before they are added
+func TestCheckShapes(t *testing.T) {
+	params := SetupParams()
+	ours := []*bfv.Ciphertext{bfv.NewCiphertext(params, 1)}
+
+	if err := checkShapes([]*bfv.Ciphertext{bfv.NewCiphertext(params, 1)}, ours); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkShapes([]*bfv.Ciphertext{bfv.NewCiphertext(params, 2)}, ours); err == nil {
+		t.Fatal("accepted ciphertext of degree 2")
+	}
+
+	lower := bfv.NewCiphertext(params, 1)
+	for _, pol := range lower.Value {
+		pol.Coeffs = pol.Coeffs[:1]
+	}
+	if err := checkShapes([]*bfv.Ciphertext{lower}, ours); err == nil {
+		t.Fatal("accepted ciphertext of lower level")
+	}
+	if err := checkShapes(nil, ours); err == nil {
+		t.Fatal("accepted ciphertexts of wrong length")
+	}
+	if err := checkShapes([]*bfv.Ciphertext{nil}, ours); err == nil {
+		t.Fatal("accepted missing ciphertext")
+	}
+
+	e2s := dbfv.NewE2SProtocol(params, SIGMA)
+	shares := []*drlwe.CKSShare{e2s.AllocateShare(params.MaxLevel())}
+	if err := checkShares([]*drlwe.CKSShare{e2s.AllocateShare(params.MaxLevel())}, shares); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkShares([]*drlwe.CKSShare{e2s.AllocateShare(0)}, shares); err == nil {
+		t.Fatal("accepted decryption share of lower level")
+	}
+	if err := checkShares([]*drlwe.CKSShare{{}}, shares); err == nil {
+		t.Fatal("accepted empty decryption share")
+	}
+
+	other := paramsFor(PRIME, bfv.PN13QP218)
+	ckg := dbfv.NewCKGProtocol(params)
+	if err := checkKeyShare(ckg.AllocateShares(), ckg.AllocateShares()); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkKeyShare(dbfv.NewCKGProtocol(other).AllocateShares(), ckg.AllocateShares()); err == nil {
+		t.Fatal("accepted public key share of another ring")
+	}
+}
+
+func TestCodecUnexpectedMessage(t *testing.T) {
+	c1, c2 := DummyPairCodec(CodecBinary)
+	m1, m2 := MemoryPair(MemoryCopy)
+	k1, k2 := MemoryPair(MemoryCheck)
+
+	for _, pair := range [][2]*Connection{{c1, c2}, {m1, m2}, {k1, k2}} {
+		go pair[0].Send([]FieldElem{1, 2, 3})
+
+		var v int
+		if err := pair[1].Recv(&v); err == nil {
+			t.Fatal("received field elements as integer")
+		}
+	}
+}
+
+func TestMemoryCopy(t *testing.T) {
+	c1, c2 := MemoryPair(MemoryCopy)
+	testTransport(t, c1, c2, false)
+}
+
+func TestMemoryCheckTransport(t *testing.T) {
+	c1, c2 := MemoryPair(MemoryCheck)
+	testTransport(t, c1, c2, true)
+}
+
+func TestMemoryDeepCopy(t *testing.T) {
+	params := SetupParams()
+	c1, c2 := MemoryPair(MemoryCopy)
+
+	cts := []*bfv.Ciphertext{bfv.NewCiphertextRandom(testPRNG(), params, 1)}
+	orig := cts[0].CopyNew()
+	if err := c1.Send(cts); err != nil {
+		t.Fatal(err)
+	}
+
+	// modifying the sent ciphertext does not affect the receiver
+	cts[0].Value[0].Zero()
+
+	var recv []*bfv.Ciphertext
+	if err := c2.Recv(&recv); err != nil {
+		t.Fatal(err)
+	}
+	if !recv[0].Value[0].Equals(orig.Value[0]) {
+		t.Fatal("received ciphertext was modified by the sender")
+	}
+}
+
+func benchmarkCodec(b *testing.B, codec Codec) {
+	params := SetupParams()
+	c1, c2 := DummyPairCodec(codec)
+
+	cts := make([]*bfv.Ciphertext, 16)
+	recv := make([]*bfv.Ciphertext, len(cts))
+	for i := range cts {
+		cts[i] = bfv.NewCiphertextRandom(testPRNG(), params, 1)
+		recv[i] = bfv.NewCiphertext(params, 1)
+	}
+
+	go func() {
+		for i := 0; i < b.N; i++ {
+			if err := c1.Send(cts); err != nil {
+				panic(err)
+			}
+		}
+	}()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := c2.Recv(&recv); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCodecBinary(b *testing.B) {
+	benchmarkCodec(b, CodecBinary)
+}
+
+func BenchmarkCodecGob(b *testing.B) {
+	benchmarkCodec(b, CodecGob)
+}
+
+func TestParseNetProfile(t *testing.T) {
+	profile, err := ParseNetProfile("latency=10ms,jitter=1ms,bandwidth=1e6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile.Latency != 10*time.Millisecond || profile.Jitter != time.Millisecond || profile.Bandwidth != 1e6 {
+		t.Fatal("wrong profile", profile)
+	}
+
+	if _, err := ParseNetProfile("delay=10ms"); err == nil {
+		t.Fatal("accepted unknown option")
+	}
+}
+
+func TestEmulatedLatency(t *testing.T) {
+	latency := 20 * time.Millisecond
+	c1, c2 := EmulatedPair(CodecBinary, NetProfile{Latency: latency}, NetProfile{Latency: latency, Jitter: latency})
+
+	go func() {
+		var v []FieldElem
+		for i := 0; i < 3; i++ {
+			if err := c2.Recv(&v); err != nil {
+				panic(err)
+			}
+			if err := c2.Send(v); err != nil {
+				panic(err)
+			}
+		}
+	}()
+
+	// three round trips: at least 6 times the one-way latency
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		var v []FieldElem
+		if err := c1.Send([]FieldElem{FieldElem(i)}); err != nil {
+			t.Fatal(err)
+		}
+		if err := c1.Recv(&v); err != nil {
+			t.Fatal(err)
+		}
+		if len(v) != 1 || v[0] != FieldElem(i) {
+			t.Fatal("wrong message", v)
+		}
+	}
+
+	if elapsed := time.Since(start); elapsed < 6*latency {
+		t.Fatal("round trips too fast", elapsed)
+	}
+}
+
+// closing does not wait for a writer blocked on a full delivery queue
+func TestEmulatedClose(t *testing.T) {
+	s1, _ := dummySockets()
+	e := NewEmulated(s1, NetProfile{Latency: time.Hour})
+
+	blocked := make(chan error)
+	go func() {
+		for {
+			if _, err := e.Write([]byte{0}); err != nil {
+				blocked <- err
+				return
+			}
+		}
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	closed := make(chan error)
+	go func() {
+		closed <- e.Close()
+	}()
+
+	for _, c := range []chan error{closed, blocked} {
+		select {
+		case <-c:
+		case <-time.After(time.Second):
+			t.Fatal("Close deadlocked with a blocked writer")
+		}
+	}
+}
+
+func TestEmulatedBandwidth(t *testing.T) {
+	// 1 MB at 10 MB/s: at least 100ms
+
+	bandwidth := 10e6
+	c1, c2 := EmulatedPair(CodecBinary, NetProfile{Bandwidth: bandwidth}, NetProfile{})
+
+	msg := random(1 << 17)
+
+	start := time.Now()
+
+	go func() {
+		if err := c1.Send(msg); err != nil {
+			panic(err)
+		}
+	}()
+
+	var v []FieldElem
+	if err := c2.Recv(&v); err != nil {
+		t.Fatal(err)
+	}
+
+	if elapsed := time.Since(start); elapsed < time.Duration(float64(8*len(msg))/bandwidth*float64(time.Second)) {
+		t.Fatal("transfer too fast", elapsed)
+	}
+	for i := range msg {
+		if v[i] != msg[i] {
+			t.Fatal("wrong message")
+		}
+	}
+}
+
+// loopback addresses on free ports
+func testAddresses(players int) []*net.TCPAddr {
+	addrs := make([]*net.TCPAddr, players)
+	for p := range addrs {
+		ls, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			panic(err)
+		}
+		addrs[p] = ls.Addr().(*net.TCPAddr)
+		ls.Close()
+	}
+	return addrs
+}
+
+func TestConnectAnyOrder(t *testing.T) {
+	players := 4
+	ADDRESSES = testAddresses(players)
+	deadline := time.Now().Add(10 * time.Second)
+
+	conns := make([][]*Connection, players)
+	errs := make(chan error, players)
+
+	// start players in reverse order: player 0 is the last to listen
+
+	for p := players - 1; p >= 0; p-- {
+		go func(p int) {
+			var err error
+			conns[p], err = connect_mesh(p, players, deadline)
+			errs <- err
+		}(p)
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if err := collect_errors(errs, players); err != nil {
+		t.Fatal(err)
+	}
+
+	// every pair of players can communicate
+
+	for p1 := 0; p1 < players; p1++ {
+		for p2 := 0; p2 < players; p2++ {
+			if p1 == p2 {
+				continue
+			}
+			go conns[p1][p2].Send(p1)
+			var them int
+			if err := conns[p2][p1].Recv(&them); err != nil || them != p1 {
+				t.Fatal("Wrong connection between", p1, p2, err)
+			}
+		}
+	}
+}
+
+func TestConnectTree(t *testing.T) {
+	players := 6
+	arity := 2
+	ADDRESSES = testAddresses(players)
+	deadline := time.Now().Add(10 * time.Second)
+
+	conns := make([][]*Connection, players)
+	errs := make(chan error, players)
+
+	for p := players - 1; p >= 0; p-- {
+		go func(p int) {
+			var err error
+			conns[p], err = connect_tree(p, players, arity, deadline)
+			errs <- err
+		}(p)
+	}
+
+	if err := collect_errors(errs, players); err != nil {
+		t.Fatal(err)
+	}
+
+	// exactly the links of the tree are connected
+
+	for p1 := 0; p1 < players; p1++ {
+		for p2 := p1 + 1; p2 < players; p2++ {
+			linked := Linked(TopologyTree, arity, p1, p2)
+			if (conns[p1][p2] != nil) != linked || (conns[p2][p1] != nil) != linked {
+				t.Fatal("Wrong link between", p1, p2)
+			}
+			if !linked {
+				continue
+			}
+			go conns[p2][p1].Send(p2)
+			var them int
+			if err := conns[p1][p2].Recv(&them); err != nil || them != p2 {
+				t.Fatal("Wrong connection between", p1, p2, err)
+			}
+		}
+	}
+}
+
+func TestSetupDeadline(t *testing.T) {
+	players := 4
+	ADDRESSES = testAddresses(players)
+	deadline := time.Now().Add(500 * time.Millisecond)
+
+	// player 2 never shows up
+
+	for _, p := range []int{1, 3} {
+		go connect(p, 0, deadline)
+	}
+
+	_, err := wait_connections(0, players, deadline)
+
+	var merr *MissingPlayersError
+	if !errors.As(err, &merr) {
+		t.Fatal("Expected missing players, got", err)
+	}
+	if len(merr.Missing) != 1 || merr.Missing[0] != 2 {
+		t.Fatal("Wrong missing players", merr.Missing)
+	}
+}
+
+func TestSetupBadConnections(t *testing.T) {
+	players := 3
+	ADDRESSES = testAddresses(players)
+	deadline := time.Now().Add(10 * time.Second)
+
+	ls, err := listen(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ls.Close()
+
+	type result struct {
+		conns []*Connection
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conns, err := accept_connections(ls, 0, players, span(0, 0, players), deadline)
+		done <- result{conns, err}
+	}()
+
+	// a connection which closes before the handshake and an unexpected player are rejected
+
+	raw, err := net.DialTCP("tcp", nil, ADDRESSES[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw.Close()
+
+	if c, err := connect(7, 0, deadline); err != nil {
+		t.Fatal(err)
+	} else {
+		defer c.Close()
+	}
+
+	// the second connection of player 1 replaces the first
+
+	first, err := connect(1, 0, deadline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+
+	second, err := connect(1, 0, deadline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+
+	last, err := connect(2, 0, deadline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer last.Close()
+
+	res := <-done
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+
+	for p, c := range []*Connection{second, last} {
+		go c.Send(p + 1)
+		var them int
+		if err := res.conns[p+1].Recv(&them); err != nil || them != p+1 {
+			t.Fatal("Wrong connection of player", p+1, err)
+		}
+	}
+}
@@ -3,54 +3,108 @@ package main
 import (
 	"crypto/rand"
 	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
 	"math/bits"
+	"strconv"
 )
 
 const TCP_BUFFER int = 1 << 16
+
+// default field modulus, also the BFV plaintext modulus (see SetupParams)
 const PRIME FieldElem = 65537
 
 type FieldElem = uint64
 
-func init() {
-	if bits.Len64(uint64(PRIME)) > 31 {
-		panic("prime too large")
-	}
+// the field of integers modulo the prime p: the plaintext modulus of an OIP (see OIP.Field)
+type Field struct {
+	p FieldElem
 }
 
-func reduce(v FieldElem) FieldElem {
-	return v % PRIME
+func NewField(p FieldElem) Field {
+	return Field{p: p}
 }
 
-func inv(v FieldElem) FieldElem {
-	return PRIME - v
+func (f Field) Prime() FieldElem {
+	return f.p
 }
 
-func add(v1, v2 FieldElem) FieldElem {
-	return (v1 + v2) % PRIME
+// largest supported field modulus (lattigo moduli have at most 60 bits)
+const MAX_PRIME_BITS = 60
+
+// check that p can be used as the field modulus
+func checkPrime(p FieldElem) error {
+	if bits.Len64(p) > MAX_PRIME_BITS {
+		return errors.New("prime larger than " + strconv.Itoa(MAX_PRIME_BITS) + " bits")
+	}
+	if !new(big.Int).SetUint64(p).ProbablyPrime(20) {
+		return errors.New(strconv.FormatUint(p, 10) + " is not a prime")
+	}
+	return nil
 }
 
-func sub(v1, v2 FieldElem) FieldElem {
-	return add(v1, inv(v2))
+// vs are elements of the field (values received from a peer are not reduced)
+func (f Field) contains(vs []FieldElem) bool {
+	for _, v := range vs {
+		if v >= f.p {
+			return false
+		}
+	}
+	return true
+}
+
+func (f Field) reduce(v FieldElem) FieldElem {
+	return v % f.p
 }
 
-func mul(v1, v2 FieldElem) FieldElem {
-	return (v1 * v2) % PRIME
+func (f Field) inv(v FieldElem) FieldElem {
+	if v == 0 {
+		return 0
+	}
+	return f.p - v
 }
 
-func random(size int) []FieldElem {
-	// read random bytes
-	bs := make([]byte, size*8, size*8)
-	n, err := rand.Read(bs)
-	if err != nil || n != size*8 {
-		panic(err)
+func (f Field) add(v1, v2 FieldElem) FieldElem {
+	s, carry := bits.Add64(v1, v2, 0)
+	if carry != 0 || s >= f.p {
+		s -= f.p
 	}
+	return s
+}
+
+func (f Field) sub(v1, v2 FieldElem) FieldElem {
+	return f.add(v1, f.inv(v2))
+}
+
+func (f Field) mul(v1, v2 FieldElem) FieldElem {
+	hi, lo := bits.Mul64(v1, v2)
+	return bits.Rem64(hi, lo, f.p)
+}
+
+func (f Field) random(size int) []FieldElem {
+	return f.randomFrom(rand.Reader, size)
+}
+
+// uniform field elements from a stream of random bytes (rejection sampling)
+func (f Field) randomFrom(r io.Reader, size int) []FieldElem {
+	mask := uint64(1)<<bits.Len64(f.p-1) - 1
+	bs := make([]byte, 8*size)
 
-	// convert to uint64
 	nums := make([]FieldElem, 0, size)
-	for i := 0; i < size; i++ {
-		s := i * 8
-		e := (i + 1) * 8
-		nums = append(nums, FieldElem(binary.LittleEndian.Uint64(bs[s:e]))%PRIME)
+	for len(nums) < size {
+		// read random bytes
+		need := bs[:8*(size-len(nums))]
+		if _, err := io.ReadFull(r, need); err != nil {
+			panic(err)
+		}
+
+		// convert to uint64
+		for i := 0; i < len(need); i += 8 {
+			if v := binary.LittleEndian.Uint64(need[i:]) & mask; v < f.p {
+				nums = append(nums, v)
+			}
+		}
 	}
 	return nums
 }
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ldsec/lattigo/v2/bfv"
+	"github.com/ldsec/lattigo/v2/rlwe"
+)
+
+// primes = 1 mod 2^15 (NTT-friendly up to N = 2^14)
+const PRIME_40 FieldElem = 549756174337
+const PRIME_60 FieldElem = 576460752304439297
+const PRIME_61 FieldElem = 1152921504607338497
+
+// arithmetic in the default field (modulo PRIME)
+var defaultField = NewField(PRIME)
+
+func add(v1, v2 FieldElem) FieldElem { return defaultField.add(v1, v2) }
+func sub(v1, v2 FieldElem) FieldElem { return defaultField.sub(v1, v2) }
+func mul(v1, v2 FieldElem) FieldElem { return defaultField.mul(v1, v2) }
+func inv(v FieldElem) FieldElem      { return defaultField.inv(v) }
+func random(size int) []FieldElem    { return defaultField.random(size) }
+
+// BFV parameters of literal with the plaintext modulus t
+func paramsFor(t FieldElem, literal bfv.ParametersLiteral) bfv.Parameters {
+	literal.T = t
+	if err := checkPlaintextModulus(literal); err != nil {
+		panic(err)
+	}
+	params, err := bfv.NewParametersFromLiteral(literal)
+	if err != nil {
+		panic(err)
+	}
+	return params
+}
+
+func TestFieldArithmetic(t *testing.T) {
+	for _, prime := range []FieldElem{65537, PRIME_40, PRIME_60, PRIME_61} {
+		f := NewField(prime)
+		p := new(big.Int).SetUint64(prime)
+		check := func(op string, got FieldElem, want *big.Int) {
+			if want.Mod(want, p).Uint64() != got {
+				t.Fatal(prime, op, "got", got, "want", want)
+			}
+		}
+
+		vs := append(f.random(1000), 0, 1, prime-1, prime-2)
+		for i := 0; i < len(vs); i++ {
+			a, b := vs[i], vs[(i*7+3)%len(vs)]
+			if a >= prime {
+				t.Fatal("random element out of range", a)
+			}
+			x, y := new(big.Int).SetUint64(a), new(big.Int).SetUint64(b)
+			check("add", f.add(a, b), new(big.Int).Add(x, y))
+			check("sub", f.sub(a, b), new(big.Int).Sub(x, y))
+			check("mul", f.mul(a, b), new(big.Int).Mul(x, y))
+			check("inv", f.inv(a), new(big.Int).Neg(x))
+		}
+	}
+}
+
+func TestCheckPrime(t *testing.T) {
+	for _, prime := range []FieldElem{65537, PRIME_40, PRIME_60} {
+		if err := checkPrime(prime); err != nil {
+			t.Error(err)
+		}
+	}
+	for _, v := range []FieldElem{65535, PRIME_60 + 2, PRIME_61} {
+		if err := checkPrime(v); err == nil {
+			t.Error("accepted", v)
+		}
+	}
+
+	literal := bfv.PN14QP438
+	literal.T = 40961 // = 1 mod 2^13, but not mod 2^15
+	if err := checkPlaintextModulus(literal); err == nil {
+		t.Error("accepted plaintext modulus which is not NTT-friendly")
+	}
+}
+
+func TestOIPLargePrime(t *testing.T) {
+	testMul(setupOIPs(paramsFor(PRIME_40, bfv.PN13QP218), TopologyStar, 3), 100, 1)
+
+	// the ciphertext moduli must be larger than the plaintext modulus
+	literal := bfv.ParametersLiteral{LogN: 14, LogQ: []int{60, 60, 60}, LogP: []int{60}, Sigma: rlwe.DefaultSigma}
+	oips := setupOIPs(paramsFor(PRIME_60, literal), TopologyStar, 3)
+	testMul(oips, 100, 1)
+	testOIP(oips, 8, 100, 1)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"math/bits"
+	"strconv"
+
+	"github.com/ldsec/lattigo/v2/bfv"
+	"github.com/ldsec/lattigo/v2/ring"
+)
+
+// CRT mode:
+//
+// the plaintext modulus of BFV is limited to 60 bits, larger (composite) moduli M = m_1 * ... * m_k
+// are emulated by running an OIP over every plaintext modulus m_i (each with its own parameters and key),
+// on the residues of the inputs modulo m_i. The shares of the results modulo every m_i are recombined using CRT:
+// the recombination is a ring isomorphism, hence it maps additive shares modulo every m_i to additive shares modulo M.
+// The OIPs share the connections and run one after the other, each in the field of its own modulus (see OIP.Field).
+
+type CRTOIP struct {
+	oips    []*OIP
+	moduli  []*big.Int
+	modulus *big.Int   // product of the moduli
+	basis   []*big.Int // CRT basis: 1 modulo m_i, 0 modulo every other modulus
+}
+
+// parameters for k plaintext moduli: NTT-friendly primes of logT bits (smaller than the ciphertext moduli of literal,
+// not larger than the special modulus, see evalLiteral)
+func CRTParams(literal bfv.ParametersLiteral, logT int, k int) ([]bfv.Parameters, error) {
+	moduli := ring.GenerateNTTPrimes(logT, 2<<literal.LogN, k)
+	params := make([]bfv.Parameters, k)
+	for i, t := range moduli {
+		literal.T = t
+		var err error
+		if params[i], err = bfv.NewParametersFromLiteral(literal); err != nil {
+			return nil, err
+		}
+		if params[i].LogP() < bits.Len64(t) {
+			return nil, fmt.Errorf("plaintext modulus of %d bits exceeds the special modulus of %d bits", bits.Len64(t), params[i].LogP())
+		}
+	}
+	return params, nil
+}
+
+func NewCRTOIP(params []bfv.Parameters, me int, conns []*Connection) *CRTOIP {
+	c := &CRTOIP{modulus: big.NewInt(1)}
+	for _, p := range params {
+		m := new(big.Int).SetUint64(p.T())
+		for _, other := range c.moduli {
+			if new(big.Int).GCD(nil, nil, m, other).Cmp(big.NewInt(1)) != 0 {
+				log.Panicln("Plaintext moduli are not coprime:", m, other)
+			}
+		}
+		c.oips = append(c.oips, NewOIP(p, me, conns))
+		c.moduli = append(c.moduli, m)
+		c.modulus.Mul(c.modulus, m)
+	}
+
+	// basis_i = (M / m_i) * ((M / m_i)^-1 mod m_i)
+	for _, m := range c.moduli {
+		b := new(big.Int).Quo(c.modulus, m)
+		b.Mul(b, new(big.Int).ModInverse(b, m))
+		c.basis = append(c.basis, b)
+	}
+	return c
+}
+
+func (c *CRTOIP) Modulus() *big.Int {
+	return new(big.Int).Set(c.modulus)
+}
+
+// residues of v modulo the i'th modulus
+func (c *CRTOIP) residues(i int, v []*big.Int) []FieldElem {
+	res := make([]FieldElem, len(v))
+	r := new(big.Int)
+	for j, x := range v {
+		res[j] = r.Mod(x, c.moduli[i]).Uint64()
+	}
+	return res
+}
+
+// recombine the residues modulo every modulus (residues[i] modulo the i'th modulus)
+func (c *CRTOIP) recombine(residues [][]FieldElem) []*big.Int {
+	res := make([]*big.Int, len(residues[0]))
+	tmp := new(big.Int)
+	for j := range res {
+		x := new(big.Int)
+		for i, b := range c.basis {
+			x.Add(x, tmp.Mul(b, tmp.SetUint64(residues[i][j])))
+		}
+		res[j] = x.Mod(x, c.modulus)
+	}
+	return res
+}
+
+// run f for every modulus and recombine the results
+func (c *CRTOIP) each(f func(i int, oip *OIP) ([]FieldElem, error)) ([]*big.Int, error) {
+	residues := make([][]FieldElem, len(c.oips))
+	for i, oip := range c.oips {
+		var err error
+		if residues[i], err = f(i, oip); err != nil {
+			return nil, err
+		}
+		if len(residues[i]) != len(residues[0]) {
+			return nil, errors.New("results modulo different moduli have different lengths")
+		}
+	}
+	return c.recombine(residues), nil
+}
+
+// shares of the element-wise product of the shared vectors left and right modulo M
+func (c *CRTOIP) Multiply(ctx context.Context, left []*big.Int, right []*big.Int) ([]*big.Int, error) {
+	return c.each(func(i int, oip *OIP) ([]FieldElem, error) {
+		return oip.Multiply(ctx, c.residues(i, left), c.residues(i, right))
+	})
+}
+
+// shares of \sum_i sel_i * branches_i modulo M
+func (c *CRTOIP) Select(ctx context.Context, sel []*big.Int, branches [][]*big.Int) ([]*big.Int, error) {
+	return c.each(func(i int, oip *OIP) ([]FieldElem, error) {
+		res := make([][]FieldElem, len(branches))
+		for b, branch := range branches {
+			res[b] = c.residues(i, branch)
+		}
+		return oip.Select(ctx, c.residues(i, sel), res)
+	})
+}
+
+// path of the keystore of the i'th modulus: path itself for a single modulus
+func (c *CRTOIP) KeystorePath(path string, i int) string {
+	if len(c.oips) == 1 {
+		return path
+	}
+	return path + ".crt-" + strconv.Itoa(i)
+}
+
+// resume the OIP of every modulus from its own keystore (see OIP.ResumeKeystore),
+// returns whether the stored keys of every modulus were reused
+func (c *CRTOIP) ResumeKeystore(ctx context.Context, path string, secret []byte) ([]bool, error) {
+	reused := make([]bool, len(c.oips))
+	for i, oip := range c.oips {
+		var err error
+		if reused[i], err = oip.ResumeKeystore(ctx, c.KeystorePath(path, i), secret); err != nil {
+			return nil, err
+		}
+	}
+	return reused, nil
+}
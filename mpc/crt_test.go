@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"math/big"
+	"sync"
+	"testing"
+
+	"github.com/ldsec/lattigo/v2/bfv"
+)
+
+func setupCRTOIPs(t *testing.T, topology Topology, players int) []*CRTOIP {
+	params, err := CRTParams(bfv.PN13QP218, 50, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var crts []*CRTOIP
+	for p, conns := range MemoryDummies(topology, players, MemoryCopy) {
+		c := NewCRTOIP(params, p, conns)
+		for _, oip := range c.oips {
+			oip.topology = topology
+		}
+		crts = append(crts, c)
+	}
+	return crts
+}
+
+func randomBig(m *big.Int, size int) []*big.Int {
+	res := make([]*big.Int, size)
+	for i := range res {
+		var err error
+		if res[i], err = rand.Int(rand.Reader, m); err != nil {
+			panic(err)
+		}
+	}
+	return res
+}
+
+func reconstructBig(m *big.Int, shares [][]*big.Int) []*big.Int {
+	res := make([]*big.Int, len(shares[0]))
+	for i := range res {
+		res[i] = new(big.Int)
+		for _, s := range shares {
+			res[i].Add(res[i], s[i])
+		}
+		res[i].Mod(res[i], m)
+	}
+	return res
+}
+
+func TestCRTRecombine(t *testing.T) {
+	c := setupCRTOIPs(t, TopologyStar, 1)[0]
+	if c.Modulus().BitLen() < 148 {
+		t.Fatal("Composite modulus too small:", c.Modulus().BitLen(), "bits")
+	}
+
+	v := randomBig(c.modulus, 100)
+	residues := make([][]FieldElem, len(c.oips))
+	for i := range residues {
+		residues[i] = c.residues(i, v)
+	}
+	for j, x := range c.recombine(residues) {
+		if x.Cmp(v[j]) != 0 {
+			t.Fatal("Recombination failed at", j)
+		}
+	}
+}
+
+func TestCRTOIP(t *testing.T) {
+	for _, topology := range []Topology{TopologyStar, TopologyMesh} {
+		crts := setupCRTOIPs(t, topology, 3)
+		m := crts[0].Modulus()
+
+		left := make([][]*big.Int, len(crts))
+		right := make([][]*big.Int, len(crts))
+		sel := make([][]*big.Int, len(crts))
+		branches := make([][][]*big.Int, len(crts))
+		for p := range crts {
+			left[p], right[p] = randomBig(m, 100), randomBig(m, 100)
+			sel[p] = randomBig(m, 3)
+			branches[p] = [][]*big.Int{randomBig(m, 10), randomBig(m, 10), randomBig(m, 10)}
+		}
+
+		products := make([][]*big.Int, len(crts))
+		selected := make([][]*big.Int, len(crts))
+		errs := make([]error, len(crts))
+
+		var wg sync.WaitGroup
+		for p, c := range crts {
+			wg.Add(1)
+			go func(p int, c *CRTOIP) {
+				defer wg.Done()
+				if products[p], errs[p] = c.Multiply(context.Background(), left[p], right[p]); errs[p] != nil {
+					return
+				}
+				selected[p], errs[p] = c.Select(context.Background(), sel[p], branches[p])
+			}(p, c)
+		}
+		wg.Wait()
+
+		for p, err := range errs {
+			if err != nil {
+				t.Fatal(topology, "player", p, "failed:", err)
+			}
+		}
+
+		l, r := reconstructBig(m, left), reconstructBig(m, right)
+		for i, v := range reconstructBig(m, products) {
+			if new(big.Int).Mod(new(big.Int).Mul(l[i], r[i]), m).Cmp(v) != 0 {
+				t.Fatal(topology, "wrong product at", i)
+			}
+		}
+
+		// \sum_b sel_b * branch_b, every player holds its own share of the branches
+		s := reconstructBig(m, sel)
+		res := reconstructBig(m, selected)
+		for j := range res {
+			expected := new(big.Int)
+			for b := range s {
+				var shares [][]*big.Int
+				for p := range crts {
+					shares = append(shares, branches[p][b])
+				}
+				expected.Add(expected, new(big.Int).Mul(s[b], reconstructBig(m, shares)[j]))
+			}
+			if expected.Mod(expected, m).Cmp(res[j]) != 0 {
+				t.Fatal(topology, "wrong selection at", j)
+			}
+		}
+	}
+}
+
+// every engine computes in the field of its own modulus: engines of different moduli can run at the same time
+func TestCRTConcurrentEngines(t *testing.T) {
+	params, err := CRTParams(bfv.PN13QP218, 50, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	levels, mapping, programs := homomorphicCircuit(2)
+
+	var wg sync.WaitGroup
+	for i, ps := range params {
+		wg.Add(1)
+		go func(i int, ps bfv.Parameters) {
+			defer wg.Done()
+			oips := setupOIPs(ps, TopologyStar, 3)
+			f := oips[0].Field()
+
+			inputs := make([][]FieldElem, len(oips))
+			for p := range inputs {
+				inputs[p] = f.random(2)
+			}
+			expected := evaluateCircuit(f, mapping[1], programs[1], reconstructIn(f, inputs))
+
+			outs, errs := runCDN(oips, func(p int, e *CDN) ([]FieldElem, error) {
+				ctx := context.Background()
+				sel := []Share{e.Input(0, 0), e.Input(1, 0)}
+				w, err := e.Disjunction(ctx, levels, mapping, inputs[p], sel, programs)
+				if err != nil {
+					return nil, err
+				}
+				return e.Reconstruct(ctx, w)
+			})
+			for p := range oips {
+				if errs[p] != nil {
+					t.Error("modulus", i, "player", p, "failed:", errs[p])
+					return
+				}
+				for g, v := range expected {
+					if outs[p][g] != v {
+						t.Error("modulus", i, "player", p, "wrong output of gate", g)
+						return
+					}
+				}
+			}
+		}(i, ps)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+
+	"github.com/ldsec/lattigo/v2/bfv"
+)
+
+// Ciphertext-ciphertext Select:
+//
+// every player encrypts its selector shares and the blocks of its branch shares, which are aggregated
+// in a single round at the aggregator (player 0 in the tree topology, the aggregator of the star topology otherwise).
+// The aggregator computes the inner product [out_b] = \sum_i [sel_i] * [branch_{b,i}] of the sums homomorphically
+// (ciphertext-ciphertext products, relinearized with the joint relinearization key, see evalkeys.go)
+// and sends it to every player, which decrypt it to shares.
+// Compared to the tensor strategy this saves the second aggregation round, at the cost of encrypting the branches
+// (rather than encoding them) and of the ciphertext-ciphertext products, which are all computed by the aggregator.
+
+type SelectStrategy int
+
+const (
+	SelectTensor     SelectStrategy = iota // aggregate the selectors, every player multiplies by its branch shares, aggregate the products
+	SelectCiphertext                       // aggregate the selectors and branches, the aggregator computes the products
+)
+
+func (s SelectStrategy) String() string {
+	switch s {
+	case SelectTensor:
+		return "tensor"
+	case SelectCiphertext:
+		return "ciphertext"
+	}
+	return "unknown"
+}
+
+func ParseSelectStrategy(s string) (SelectStrategy, error) {
+	switch s {
+	case "", "tensor":
+		return SelectTensor, nil
+	case "ciphertext":
+		return SelectCiphertext, nil
+	}
+	return SelectTensor, errors.New("unknown select strategy: " + s)
+}
+
+// select using strategy s, the ciphertext strategy requires the relinearization key (see SetEvaluationKeys)
+func (o *OIP) SetSelectStrategy(s SelectStrategy) {
+	if s == SelectCiphertext && !o.relin {
+		log.Panicln("The ciphertext select strategy requires the relinearization key")
+	}
+	o.strategy = s
+}
+
+// the blocks of every branch (block-major), padded with zeros
+func branchBlocks(blocks int, block_size int, branches [][]FieldElem) [][]FieldElem {
+	packs := make([][]FieldElem, 0, blocks*len(branches))
+	for b := 0; b < blocks; b++ {
+		for _, vec := range branches {
+			s := min(len(vec), b*block_size)
+			e := min(len(vec), (b+1)*block_size)
+			packs = append(packs, vec[s:e])
+		}
+	}
+	return packs
+}
+
+func (o *OIP) selectCiphertexts(sel []FieldElem, branches [][]FieldElem) ([]FieldElem, error) {
+
+	// maximum length of any vector in v
+	max_len := 0
+	for i := 0; i < len(branches); i++ {
+		if len(branches[i]) > max_len {
+			max_len = len(branches[i])
+		}
+	}
+
+	block_size := 1 << o.params.LogN()
+	blocks := (max_len + (block_size - 1)) / block_size
+
+	o.Log("Ciphertext select: Max Len", max_len, "Blocks", blocks)
+
+	// encrypt the selector shares followed by the blocks of the branch shares
+
+	o.Log("Generate encrypted selector and branch shares")
+
+	packs := make([][]FieldElem, 0, len(sel)*(blocks+1))
+	for _, s := range sel {
+		packs = append(packs, dup(s, block_size))
+	}
+	packs = append(packs, branchBlocks(blocks, block_size, branches)...)
+
+	cts, rel := o.packEncrypt(packs)
+
+	return o.selectAggregated(len(sel), blocks, max_len, cts, rel)
+}
+
+// aggregate the encrypted selectors and branch blocks cts, evaluate the inner product at the aggregator
+// and decrypt the first length elements of the result
+func (o *OIP) selectAggregated(branches int, blocks int, length int, cts []*bfv.Ciphertext, rel *zkRelation) ([]FieldElem, error) {
+	if o.rlk == nil {
+		log.Panicln("Ciphertext select without relinearization key")
+	}
+
+	cts_res, err := func() ([]*bfv.Ciphertext, error) {
+		defer o.phase(PhaseSelectorAggregation)()
+		return o.aggregateEvaluate(cts, rel, blocks, func(sums []*bfv.Ciphertext) []*bfv.Ciphertext {
+			return o.innerProduct(branches, blocks, sums)
+		})
+	}()
+	if err != nil {
+		return nil, err
+	}
+
+	// run distributed decryption
+
+	return o.decrypt(cts_res, length)
+}
+
+// aggregate cts at a single player, proving knowledge of the witness of rel (nil: no proofs),
+// which evaluates f on the sums and sends the dim resulting ciphertexts to every player
+func (o *OIP) aggregateEvaluate(
+	cts []*bfv.Ciphertext,
+	rel *zkRelation,
+	dim int,
+	f func(sums []*bfv.Ciphertext) []*bfv.Ciphertext,
+) ([]*bfv.Ciphertext, error) {
+
+	if rel != nil {
+		if o.topology != TopologyStar {
+			log.Panicln("Proofs require the star topology")
+		}
+		o.proofs++
+	}
+
+	res := make([]*bfv.Ciphertext, dim)
+	for i := range res {
+		res[i] = bfv.NewCiphertext(o.params, 1)
+	}
+
+	recv := func(p int) error {
+		return o.recvCTS(p, res)
+	}
+
+	if o.topology == TopologyTree {
+		if err := o.reduceCTSTree(cts); err != nil {
+			return nil, err
+		}
+
+		if o.IsP0() {
+			o.Log("Evaluate on aggregated encryptions")
+			res = f(cts)
+		}
+
+		o.Log("Broadcast evaluation down the tree")
+
+		return res, o.treeBroadcast(recv, func(c int) error {
+			return o.send(c, res)
+		})
+	}
+
+	agg := o.nextAggregator()
+
+	if o.me != agg {
+		if err := o.sendCTS(agg, cts, rel); err != nil {
+			return nil, err
+		}
+
+		o.Log("Receieve evaluation from player", agg)
+
+		return res, recv(agg)
+	}
+
+	o.Log("Acting as ciphertext aggregator")
+
+	if err := o.gatherCTS(agg, cts, rel); err != nil {
+		return nil, err
+	}
+
+	o.Log("Evaluate on aggregated encryptions")
+
+	res = f(cts)
+
+	o.Log("Broadcast evaluation to everyone else")
+
+	return res, o.broadcast(agg, res)
+}
+
+// Computes:
+// [out_b] = \sum_i [cts_i] * [cts_{branches*(b+1)+i}]
+// i.e. the inner product of the selectors and block b of the branches (see selectCiphertexts)
+func (o *OIP) innerProduct(branches int, blocks int, cts []*bfv.Ciphertext) []*bfv.Ciphertext {
+
+	acc := make([]*bfv.Ciphertext, blocks)
+
+	// execute every block in parallel (good for large branches)
+
+	var wg1 sync.WaitGroup
+
+	for b := 0; b < blocks; b++ {
+
+		wg1.Add(1)
+
+		go func(b int) {
+
+			// execute every branch in each block in parallel (good for many branches)
+
+			var wg2 sync.WaitGroup
+			var lock sync.Mutex
+
+			sum := bfv.NewCiphertext(o.params, 2)
+
+			for i := 0; i < branches; i++ {
+				wg2.Add(1)
+
+				go func(i int) {
+					t := bfv.NewCiphertext(o.params, 2)
+
+					// obtain an evaluator
+					eval := o.getEvaluator()
+
+					// multiply (slow)
+					eval.Mul(cts[i], cts[branches*(b+1)+i], t)
+
+					// take lock and add (fast)
+					lock.Lock()
+					eval.Add(t, sum, sum)
+					lock.Unlock()
+
+					// return resources to pool
+					o.putEvaluator(eval)
+					wg2.Done()
+				}(i)
+			}
+
+			wg2.Wait()
+
+			// relinearize accumulated block
+
+			acc[b] = bfv.NewCiphertext(o.params, 1)
+			eval := o.getEvaluator()
+			eval.Relinearize(sum, acc[b])
+			o.putEvaluator(eval)
+
+			wg1.Done()
+		}(b)
+	}
+
+	wg1.Wait()
+
+	return acc
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func setupOIPsCiphertext(topology Topology, players int, mode MemoryMode) []*OIP {
+	oips := setupOIPsConns(SetupParams(), topology, MemoryDummies(topology, players, mode))
+	for _, oip := range oips {
+		oip.SetEvaluationKeys(true, nil, false)
+		oip.SetSelectStrategy(SelectCiphertext)
+	}
+	return oips
+}
+
+func TestSelectCiphertext(t *testing.T) {
+	for _, topology := range []Topology{TopologyStar, TopologyMesh, TopologyTree} {
+		oips := setupOIPsCiphertext(topology, 3, MemoryCheck)
+		testOIP(oips, rand.Intn(8)+1, rand.Intn(1<<13)+1, 2)
+	}
+}
+
+func TestSelectCiphertextProofs(t *testing.T) {
+	oips := setupOIPsCiphertext(TopologyStar, 3, MemoryCopy)
+	for _, oip := range oips {
+		oip.zk = true
+	}
+	testOIP(oips, rand.Intn(4)+1, rand.Intn(1<<13)+1, 1)
+}
+
+func TestParseSelectStrategy(t *testing.T) {
+	for _, s := range []SelectStrategy{SelectTensor, SelectCiphertext} {
+		if p, err := ParseSelectStrategy(s.String()); err != nil || p != s {
+			t.Fatal("Failed to parse", s, err)
+		}
+	}
+	if _, err := ParseSelectStrategy("oblivious"); err == nil {
+		t.Fatal("Expected error on unknown strategy")
+	}
+}
+
+// one aggregation round less: the ciphertext strategy should win on high latency links
+func BenchmarkSelectTensorLatency100ms_P3_B4_L12(b *testing.B) {
+	benchmarkOIPLatency(b, TopologyStar, SelectTensor, 100*time.Millisecond, 4, 1<<12, 3)
+}
+
+func BenchmarkSelectCiphertextLatency100ms_P3_B4_L12(b *testing.B) {
+	benchmarkOIPLatency(b, TopologyStar, SelectCiphertext, 100*time.Millisecond, 4, 1<<12, 3)
+}
+
+func BenchmarkSelectTensor_P3_B16_L16(b *testing.B) {
+	benchmarkOIPLatency(b, TopologyStar, SelectTensor, 0, 16, 1<<16, 3)
+}
+
+func BenchmarkSelectCiphertext_P3_B16_L16(b *testing.B) {
+	benchmarkOIPLatency(b, TopologyStar, SelectCiphertext, 0, 16, 1<<16, 3)
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"sort"
+	"sync"
+
+	"github.com/ldsec/lattigo/v2/bfv"
+	"github.com/ldsec/lattigo/v2/dbfv"
+	"github.com/ldsec/lattigo/v2/drlwe"
+	"github.com/ldsec/lattigo/v2/rlwe"
+	"github.com/ldsec/lattigo/v2/utils"
+)
+
+// Evaluation keys:
+//
+// the setup optionally generates evaluation keys of the joint secret key s = \sum s_i (see SetEvaluationKeys):
+// the relinearization key (ciphertext-ciphertext products) and rotation keys for a set of Galois elements
+// (slot rotations and InnerSum). The relinearization key takes two rounds of the RKG protocol,
+// the rotation keys take a single round of the RTG protocol for all Galois elements.
+// In every round the shares are summed up the tree or at the aggregator and the sum is sent back to every player,
+// which derives the keys locally. The common random polynomials are expanded from the coin-tossed seed
+// of the common reference string. Evaluation keys are not kept in the keystore: Resume regenerates them.
+
+// generate the relinearization key (relin) and rotation keys during the setup:
+// column rotations by every k in rotations (to the left, negative: to the right)
+// and all rotations of InnerSum (innerSum, including the row rotation)
+func (o *OIP) SetEvaluationKeys(relin bool, rotations []int, innerSum bool) {
+	slots := o.params.N() / 2
+
+	elems := make(map[uint64]bool)
+	for _, k := range rotations {
+		if k%slots == 0 {
+			log.Panicln("Invalid rotation", k)
+		}
+		elems[o.params.GaloisElementForColumnRotationBy(k)] = true
+	}
+	if innerSum {
+		for _, galEl := range o.params.GaloisElementsForRowInnerSum() {
+			elems[galEl] = true
+		}
+	}
+
+	o.relin = relin
+	o.galEls = make([]uint64, 0, len(elems))
+	for galEl := range elems {
+		o.galEls = append(o.galEls, galEl)
+	}
+	sort.Slice(o.galEls, func(i, j int) bool { return o.galEls[i] < o.galEls[j] })
+}
+
+// generate the configured evaluation keys and create evaluators holding them
+func (o *OIP) setupEvaluationKeys() error {
+	if !o.relin && len(o.galEls) == 0 {
+		return nil
+	}
+
+	defer o.phase(PhaseKeyGen)()
+
+	o.rlk, o.rtks = nil, nil
+
+	if o.relin {
+		o.Log("Generate relinearization key")
+		rlk, err := o.genRelinearizationKey()
+		if err != nil {
+			return err
+		}
+		o.rlk = rlk
+	}
+
+	if len(o.galEls) > 0 {
+		o.Log("Generate", len(o.galEls), "rotation keys")
+		rtks, err := o.genRotationKeys(o.galEls)
+		if err != nil {
+			return err
+		}
+		o.rtks = rtks
+	}
+
+	o.setupEvaluators()
+	return nil
+}
+
+// create evaluator pool (for the evaluation keys)
+func (o *OIP) setupEvaluators() {
+	evk := rlwe.EvaluationKey{Rlk: o.rlk, Rtks: o.rtks}
+	o.evaluator =
+		sync.Pool{
+			New: func() interface{} {
+				return bfv.NewEvaluator(o.params, evk)
+			},
+		}
+}
+
+// expand the seed of the common reference string for the key generation identified by tag (and the Galois element)
+func (o *OIP) evaluationCRS(tag string, galEl uint64) (utils.PRNG, error) {
+	var el [8]byte
+	binary.LittleEndian.PutUint64(el[:], galEl)
+	key := append([]byte("bmpc crs "+tag), o.seed...)
+	return utils.NewKeyedPRNG(append(key, el[:]...))
+}
+
+// sum the shares of all players and send the sum to every player (up and down the tree, or through the aggregator):
+// shares returns my shares, add(p) receives the shares of player p and adds them to mine,
+// set(p) receives the sum from player p and replaces mine
+func (o *OIP) allAggregate(shares func() interface{}, add func(p int) error, set func(p int) error) error {
+	send := func(p int) error {
+		return o.send(p, shares())
+	}
+
+	if o.topology == TopologyTree {
+		if err := o.treeReduce(add, send); err != nil {
+			return err
+		}
+		return o.treeBroadcast(set, send)
+	}
+
+	agg := o.aggregator
+	if o.me != agg {
+		if err := o.SendAgg(agg, shares()); err != nil {
+			return err
+		}
+		return set(agg)
+	}
+
+	for p := 0; p < o.n; p++ {
+		if p == agg {
+			continue
+		}
+		if err := add(p); err != nil {
+			return err
+		}
+	}
+	return o.broadcast(agg, shares())
+}
+
+func (o *OIP) genRelinearizationKey() (*rlwe.RelinearizationKey, error) {
+	rkg := dbfv.NewRKGProtocol(o.params)
+	crs, err := o.evaluationCRS("rkg", 0)
+	if err != nil {
+		return nil, err
+	}
+	crp := rkg.SampleCRP(crs)
+
+	ephSk, round1, round2 := rkg.AllocateShares()
+
+	rkg.GenShareRoundOne(o.sk, crp, ephSk, round1)
+	if err := o.aggregateRKG(rkg, round1); err != nil {
+		return nil, err
+	}
+
+	rkg.GenShareRoundTwo(ephSk, o.sk, round1, round2)
+	if err := o.aggregateRKG(rkg, round2); err != nil {
+		return nil, err
+	}
+
+	rlk := rlwe.NewRelinKey(o.params.Parameters, 1)
+	rkg.GenRelinearizationKey(round1, round2, rlk)
+	return rlk, nil
+}
+
+// sum a round of RKG shares of all players into share
+func (o *OIP) aggregateRKG(rkg *dbfv.RKGProtocol, share *drlwe.RKGShare) error {
+	var lock sync.Mutex
+
+	recv := func(p int) (*drlwe.RKGShare, error) {
+		other := new(drlwe.RKGShare)
+		if err := o.recv(p, other); err != nil {
+			return nil, err
+		}
+		if err := checkRKGShare(other, share); err != nil {
+			return nil, o.peerError(p, err)
+		}
+		return other, nil
+	}
+
+	return o.allAggregate(
+		func() interface{} {
+			return share
+		},
+		func(p int) error {
+			other, err := recv(p)
+			if err != nil {
+				return err
+			}
+			lock.Lock()
+			rkg.AggregateShares(other, share, share)
+			lock.Unlock()
+			return nil
+		},
+		func(p int) error {
+			sum, err := recv(p)
+			if err != nil {
+				return err
+			}
+			*share = *sum
+			return nil
+		},
+	)
+}
+
+// the relinearization key share of a peer must have the shape of ours to be aggregated with it
+func checkRKGShare(share, ours *drlwe.RKGShare) error {
+	if len(share.Value) != len(ours.Value) {
+		return errors.New("relinearization key share has wrong dimension")
+	}
+	for i := range share.Value {
+		for j := range share.Value[i] {
+			if checkPolyQP(share.Value[i][j], ours.Value[i][j]) != nil {
+				return errors.New("relinearization key share has wrong dimensions")
+			}
+		}
+	}
+	return nil
+}
+
+// the rotation key share of a peer must have the shape of ours to be aggregated with it
+func checkRTGShare(share, ours *drlwe.RTGShare) error {
+	if share == nil || len(share.Value) != len(ours.Value) {
+		return errors.New("rotation key share has wrong dimension")
+	}
+	for i := range share.Value {
+		if checkPolyQP(share.Value[i], ours.Value[i]) != nil {
+			return errors.New("rotation key share has wrong dimensions")
+		}
+	}
+	return nil
+}
+
+func (o *OIP) genRotationKeys(galEls []uint64) (*rlwe.RotationKeySet, error) {
+	rtg := dbfv.NewRotKGProtocol(o.params)
+
+	crps := make([]drlwe.RTGCRP, len(galEls))
+	shares := make([]*drlwe.RTGShare, len(galEls))
+	for i, galEl := range galEls {
+		crs, err := o.evaluationCRS("rtg", galEl)
+		if err != nil {
+			return nil, err
+		}
+		crps[i] = rtg.SampleCRP(crs)
+		shares[i] = rtg.AllocateShares()
+		rtg.GenShare(o.sk, galEl, crps[i], shares[i])
+	}
+
+	var lock sync.Mutex
+
+	recv := func(p int) ([]*drlwe.RTGShare, error) {
+		var others []*drlwe.RTGShare
+		if err := o.recv(p, &others); err != nil {
+			return nil, err
+		}
+		if len(others) != len(shares) {
+			return nil, o.peerError(p, errors.New("rotation key shares have wrong length"))
+		}
+		for i := range others {
+			if err := checkRTGShare(others[i], shares[i]); err != nil {
+				return nil, o.peerError(p, err)
+			}
+		}
+		return others, nil
+	}
+
+	err := o.allAggregate(
+		func() interface{} {
+			return shares
+		},
+		func(p int) error {
+			others, err := recv(p)
+			if err != nil {
+				return err
+			}
+			lock.Lock()
+			for i := range shares {
+				rtg.Aggregate(others[i], shares[i], shares[i])
+			}
+			lock.Unlock()
+			return nil
+		},
+		func(p int) error {
+			sums, err := recv(p)
+			if err != nil {
+				return err
+			}
+			shares = sums
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	rtks := rlwe.NewRotationKeySet(o.params.Parameters, galEls)
+	for i, galEl := range galEls {
+		rtg.GenRotationKey(shares[i], crps[i], rtks.Keys[galEl])
+	}
+	return rtks, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/ldsec/lattigo/v2/bfv"
+	"github.com/ldsec/lattigo/v2/dbfv"
+)
+
+// encrypt and aggregate the shares of every player, returns the encryption of the sum
+func encryptShares(o *OIP, shares []FieldElem) (*bfv.Ciphertext, error) {
+	cts, _ := o.packEncrypt([][]FieldElem{shares})
+	if err := o.aggregateCTS(cts, nil); err != nil {
+		return nil, err
+	}
+	return cts[0], nil
+}
+
+func TestEvaluationKeys(t *testing.T) {
+	for _, tc := range []struct {
+		topology Topology
+		mode     MemoryMode
+	}{
+		{TopologyStar, MemoryCheck},
+		{TopologyMesh, MemoryCopy},
+		{TopologyTree, MemoryCheck},
+	} {
+		oips := setupOIPsConns(SetupParams(), tc.topology, MemoryDummies(tc.topology, 3, tc.mode))
+		for _, oip := range oips {
+			oip.SetEvaluationKeys(true, []int{1, -3}, true)
+		}
+		for p, err := range setupAll(oips) {
+			if err != nil {
+				t.Fatal(tc.topology, "player", p, "setup failed:", err)
+			}
+		}
+
+		slots := oips[0].params.N()
+		x, y := randomShares(len(oips), slots), randomShares(len(oips), slots)
+
+		// product, rotations and inner sum of the encrypted sums
+		outs, errs := runCDN(oips, func(p int, e *CDN) ([]FieldElem, error) {
+			o := e.oip
+			ctx, err := encryptShares(o, x[p])
+			if err != nil {
+				return nil, err
+			}
+			cty, err := encryptShares(o, y[p])
+			if err != nil {
+				return nil, err
+			}
+
+			eval := o.getEvaluator()
+			defer o.putEvaluator(eval)
+			prod := bfv.NewCiphertext(o.params, 2)
+			eval.Mul(ctx, cty, prod)
+			res := []*bfv.Ciphertext{
+				eval.RelinearizeNew(prod),
+				eval.RotateColumnsNew(ctx, 1),
+				eval.RotateColumnsNew(ctx, -3),
+				bfv.NewCiphertext(o.params, 1),
+			}
+			eval.InnerSum(ctx, res[3])
+
+			shares, err := o.E2S(res)
+			if err != nil {
+				return nil, err
+			}
+			return o.sharesToArray(shares), nil
+		})
+		for p, err := range errs {
+			if err != nil {
+				t.Fatal(tc.topology, "player", p, "failed:", err)
+			}
+		}
+
+		vx, vy, res := reconstruct(x), reconstruct(y), reconstruct(outs)
+
+		// slots form two rows, rotations are within each row
+		row := slots / 2
+		rotated := func(i, k int) FieldElem {
+			return vx[i/row*row+((i%row+k+row)%row)]
+		}
+		var sum FieldElem
+		for _, v := range vx {
+			sum = add(sum, v)
+		}
+		for i := 0; i < slots; i++ {
+			if res[i] != mul(vx[i], vy[i]) {
+				t.Fatal(tc.topology, "wrong product at", i)
+			}
+			if res[slots+i] != rotated(i, 1) || res[2*slots+i] != rotated(i, -3) {
+				t.Fatal(tc.topology, "wrong rotation at", i)
+			}
+			if res[3*slots+i] != sum {
+				t.Fatal(tc.topology, "wrong inner sum at", i)
+			}
+		}
+	}
+}
+
+// evaluation key shares of another ring are rejected before they are aggregated
+func TestCheckEvaluationKeyShares(t *testing.T) {
+	params, other := SetupParams(), paramsFor(PRIME, bfv.PN13QP218)
+
+	_, ours, _ := dbfv.NewRKGProtocol(params).AllocateShares()
+	_, same, _ := dbfv.NewRKGProtocol(params).AllocateShares()
+	_, wrong, _ := dbfv.NewRKGProtocol(other).AllocateShares()
+	if err := checkRKGShare(same, ours); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkRKGShare(wrong, ours); err == nil {
+		t.Fatal("accepted relinearization key share of another ring")
+	}
+	same.Value[0][1].P = nil
+	if err := checkRKGShare(same, ours); err == nil {
+		t.Fatal("accepted relinearization key share without special modulus")
+	}
+
+	rtg := dbfv.NewRotKGProtocol(params)
+	if err := checkRTGShare(rtg.AllocateShares(), rtg.AllocateShares()); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkRTGShare(dbfv.NewRotKGProtocol(other).AllocateShares(), rtg.AllocateShares()); err == nil {
+		t.Fatal("accepted rotation key share of another ring")
+	}
+	if err := checkRTGShare(nil, rtg.AllocateShares()); err == nil {
+		t.Fatal("accepted missing rotation key share")
+	}
+}
@@ -2,9 +2,10 @@ module bmpc
 
 go 1.17
 
-require github.com/ldsec/lattigo/v2 v2.4.0
-
 require (
-	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519 // indirect
-	golang.org/x/sys v0.0.0-20211007075335-d3039528d8ac // indirect
+	github.com/ldsec/lattigo/v2 v2.4.0
+	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519
+	gopkg.in/yaml.v3 v3.0.1
 )
+
+require golang.org/x/sys v0.0.0-20211007075335-d3039528d8ac // indirect
@@ -0,0 +1,527 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+
+	"github.com/ldsec/lattigo/v2/bfv"
+)
+
+// Homomorphic disjunction:
+//
+// rather than masking and reconstructing the wires at every level (see CDN.Disjunction),
+// the players aggregate encryptions of their shares in a single round and every player evaluates the branches locally.
+
+type DisjunctionStrategy int
+
+const (
+	DisjunctionMasked      DisjunctionStrategy = iota // reconstruct the masked wires at every level (see CDN.Disjunction)
+	DisjunctionHomomorphic                            // evaluate the branches on packed encryptions of the wires
+)
+
+func (s DisjunctionStrategy) String() string {
+	switch s {
+	case DisjunctionMasked:
+		return "masked"
+	case DisjunctionHomomorphic:
+		return "homomorphic"
+	}
+	return "unknown"
+}
+
+func ParseDisjunctionStrategy(s string) (DisjunctionStrategy, error) {
+	switch s {
+	case "", "masked":
+		return DisjunctionMasked, nil
+	case "homomorphic":
+		return DisjunctionHomomorphic, nil
+	}
+	return DisjunctionMasked, errors.New("unknown disjunction strategy: " + s)
+}
+
+// run the disjunctions (also the prepared ones) using strategy s, the homomorphic strategy requires
+// the relinearization key (see SetEvaluationKeys) and does not support threshold decryption (see refresh.go)
+func (e *CDN) SetDisjunctionStrategy(s DisjunctionStrategy) {
+	if s == DisjunctionHomomorphic && (!e.oip.relin || e.oip.threshold > 0) {
+		log.Panicln("The homomorphic disjunction requires the relinearization key and no threshold")
+	}
+	e.strategy = s
+}
+
+// a ciphertext and the log2 of a bound on its noise
+type noisyCiphertext struct {
+	ct    *bfv.Ciphertext
+	noise float64
+}
+
+// log2 of the sum of the bounds a and b (log2)
+func addNoise(a, b float64) float64 {
+	return math.Max(a, b) + math.Log2(1+math.Exp2(-math.Abs(a-b)))
+}
+
+// the gates s, s+1, ..., e-1 of a level, packed into the slots of a ciphertext
+type gateChunk struct {
+	level int
+	s, e  int
+}
+
+// Run a disjunction (see Disjunction) by evaluating the branches homomorphically,
+// requires the relinearization key (see SetEvaluationKeys)
+func (e *CDN) DisjunctionHomomorphic(
+	ctx context.Context,
+	levels []int, // when to switch level (last gate of every level)
+	mapping [][]int, // wire mapping for each branch, i.e mapping[b][i] is the map for gate i in branch b
+	inputs []Share, // shares of all inputs to the branch
+	sel []Share, // selectors for each branch (indicator variables)
+	gate_programs [][]bool, // gate programmings, i.e. gate_program[b][i] = True iff. the i'th gate in branch b is a multiplication
+) (res []Share, err error) {
+	err = e.oip.run(ctx, func() error {
+		res, err = e.disjunctionHomomorphic(levels, mapping, inputs, sel, gate_programs)
+		return err
+	})
+	return res, err
+}
+
+func (e *CDN) disjunctionHomomorphic(
+	levels []int,
+	mapping [][]int,
+	inputs []Share,
+	sel []Share,
+	gate_programs [][]bool,
+) ([]Share, error) {
+	o := e.oip
+	branches := len(mapping)
+
+	if branches != len(gate_programs) || branches != len(sel) {
+		log.Panicln("Number of branches does not match", len(mapping), len(sel), len(gate_programs))
+	}
+	if len(mapping[0])%2 != 0 {
+		log.Panicln("Mapping of odd length", len(mapping[0]))
+	}
+
+	// check if one-time key generation setup required
+	if o.pk == nil {
+		if err := o.Setup(); err != nil {
+			return nil, err
+		}
+	}
+	if o.rlk == nil {
+		log.Panicln("Homomorphic disjunction without relinearization key")
+	}
+
+	branch_size := len(mapping[0]) / 2
+	in_dim := len(inputs)
+	slots := o.params.N()
+
+	// split the levels into chunks of at most N gates
+
+	var chunks []gateChunk
+	s := 0 // first gate of level
+	for level, last := range levels {
+		if last < s || last >= branch_size {
+			log.Panicln("Invalid level", level, "ending at gate", last)
+		}
+		for c := s; c <= last; c += slots {
+			chunks = append(chunks, gateChunk{level: level, s: c, e: min(c+slots, last+1)})
+		}
+		for _, m := range mapping {
+			for _, w := range m[2*s : 2*(last+1)] {
+				if w >= in_dim+s {
+					log.Panicln("Gate of level", level, "maps to the undefined wire", w)
+				}
+			}
+		}
+		s = last + 1
+	}
+
+	// sanity check: every gate is in a level
+	if s != branch_size {
+		panic("Last level has not been executed")
+	}
+
+	// the output of gate g is in slot g - chunks[k].s of the output of chunk k
+	where := make([]slotRef, branch_size)
+	for k, c := range chunks {
+		for g := c.s; g < c.e; g++ {
+			where[g] = slotRef{ct: k, slot: g - c.s}
+		}
+	}
+
+	// compute gate programming (1 iff the selected branch has a multiplication in that position)
+
+	programming := make([]FieldElem, branch_size)
+	for j, branch := range gate_programs {
+		for i, g := range branch {
+			if g {
+				programming[i] = e.oip.field.add(programming[i], sel[j])
+			}
+		}
+	}
+
+	// encrypt and aggregate the selectors, the programming and the input slots of the operands
+
+	o.Log("Encrypt selectors, programming and inputs")
+
+	width := 0
+	for _, c := range chunks {
+		if c.e-c.s > width {
+			width = c.e - c.s
+		}
+	}
+
+	packs := make([][]FieldElem, 0, branches+len(chunks))
+	for _, v := range sel {
+		packs = append(packs, repeatShares([]Share{v}, width))
+	}
+	for _, c := range chunks {
+		packs = append(packs, programming[c.s:c.e])
+	}
+
+	// operand side (0: left, 1: right) of branch b of chunk k is packs[operands[k][b][side]], none if negative
+	operands := make([][][2]int, len(chunks))
+	for k, c := range chunks {
+		operands[k] = make([][2]int, branches)
+		for b, m := range mapping {
+			for side := 0; side < 2; side++ {
+				if a := sameOperand(mapping, b, c, side); a < b {
+					operands[k][b][side] = operands[k][a][side]
+					continue
+				}
+				operands[k][b][side] = -1
+				vec := make([]FieldElem, c.e-c.s)
+				for g := c.s; g < c.e; g++ {
+					if w := m[2*g+side]; w < in_dim {
+						vec[g-c.s] = inputs[w]
+						operands[k][b][side] = len(packs)
+					}
+				}
+				if operands[k][b][side] >= 0 {
+					packs = append(packs, vec)
+				}
+			}
+		}
+	}
+
+	cts, rel := o.packEncrypt(packs)
+
+	if err := o.aggregatePhase(PhaseSelectorAggregation, cts, rel); err != nil {
+		return nil, err
+	}
+
+	fresh := o.freshNoise()
+	wires := make([]*noisyCiphertext, len(cts))
+	for i, ct := range cts {
+		wires[i] = &noisyCiphertext{ct: ct, noise: fresh}
+	}
+	sels := wires[:branches]
+	progs := wires[branches : branches+len(chunks)]
+
+	// execute branches in levels
+
+	outs := make([]*noisyCiphertext, 0, len(chunks))
+	for k := 0; k < len(chunks); {
+		level := chunks[k].level
+		n := 1
+		for k+n < len(chunks) && chunks[k+n].level == level {
+			n++
+		}
+
+		o.Log("Evaluate level", level, "gates", chunks[k].s, "to", chunks[k+n-1].e-1)
+
+		ops, err := e.levelOperands(chunks[k:k+n], mapping, in_dim, where, outs, wires, operands[k:k+n])
+		if err != nil {
+			return nil, err
+		}
+		out, err := e.evaluateLevel(sels, progs[k:k+n], ops)
+		if err != nil {
+			return nil, err
+		}
+		outs = append(outs, out...)
+		k += n
+	}
+
+	// run distributed decryption of the outputs
+
+	out_cts := make([]*bfv.Ciphertext, len(outs))
+	for k, out := range outs {
+		out_cts[k] = out.ct
+	}
+
+	arr, err := o.decrypt(out_cts, len(outs)*slots)
+	if err != nil {
+		return nil, err
+	}
+
+	w := make([]Share, branch_size)
+	for g, ref := range where {
+		w[g] = arr[ref.ct*slots+ref.slot]
+	}
+	return w, nil
+}
+
+// the packed operands ops[k][b][side] of the chunks of a level: the input slots (encrypted, see operands)
+// plus the slots which are outputs of earlier levels (rearranged from outs in a single round)
+func (e *CDN) levelOperands(
+	chunks []gateChunk,
+	mapping [][]int,
+	in_dim int,
+	where []slotRef,
+	outs []*noisyCiphertext,
+	wires []*noisyCiphertext,
+	operands [][][2]int,
+) ([][][2]*noisyCiphertext, error) {
+	o := e.oip
+
+	// the layout of the slots of earlier levels (from the outputs used by the level, in order of first use)
+	var srcs []*bfv.Ciphertext
+	index := make(map[int]int)
+	var layout [][]slotRef
+	targets := make([][][2]int, len(chunks))
+	for k, c := range chunks {
+		targets[k] = make([][2]int, len(mapping))
+		for b, m := range mapping {
+			for side := 0; side < 2; side++ {
+				if a := sameOperand(mapping, b, c, side); a < b {
+					targets[k][b][side] = targets[k][a][side]
+					continue
+				}
+				targets[k][b][side] = -1
+				refs := make([]slotRef, c.e-c.s)
+				for g := c.s; g < c.e; g++ {
+					refs[g-c.s] = slotRef{ct: -1}
+					w := m[2*g+side]
+					if w < in_dim {
+						continue
+					}
+					ref := where[w-in_dim]
+					i, ok := index[ref.ct]
+					if !ok {
+						i = len(srcs)
+						index[ref.ct] = i
+						srcs = append(srcs, outs[ref.ct].ct)
+					}
+					refs[g-c.s] = slotRef{ct: i, slot: ref.slot}
+					targets[k][b][side] = len(layout)
+				}
+				if targets[k][b][side] >= 0 {
+					layout = append(layout, refs)
+				}
+			}
+		}
+	}
+
+	var repacked []*bfv.Ciphertext
+	if len(layout) > 0 {
+		var err error
+		repacked, err = o.repack(srcs, layout)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	refreshed := o.refreshedNoise()
+	eval := o.getEvaluator()
+	defer o.putEvaluator(eval)
+
+	// the same operand of several branches is the same ciphertext (see selectPack)
+	sums := make(map[[2]int]*noisyCiphertext)
+	ops := make([][][2]*noisyCiphertext, len(chunks))
+	for k := range chunks {
+		ops[k] = make([][2]*noisyCiphertext, len(mapping))
+		for b := range mapping {
+			for side := 0; side < 2; side++ {
+				in, re := operands[k][b][side], targets[k][b][side]
+				switch {
+				case re < 0:
+					ops[k][b][side] = wires[in]
+				case in < 0:
+					ops[k][b][side] = &noisyCiphertext{ct: repacked[re], noise: refreshed}
+				default:
+					if sums[[2]int{in, re}] == nil {
+						ct := eval.AddNew(wires[in].ct, repacked[re])
+						sums[[2]int{in, re}] = &noisyCiphertext{ct: ct, noise: addNoise(wires[in].noise, refreshed)}
+					}
+					ops[k][b][side] = sums[[2]int{in, re}]
+				}
+			}
+		}
+	}
+	return ops, nil
+}
+
+// the first branch which maps the gates of chunk c to the same operands (side 0: left, 1: right) as branch b
+func sameOperand(mapping [][]int, b int, c gateChunk, side int) int {
+	for a := 0; a < b; a++ {
+		same := true
+		for g := c.s; g < c.e && same; g++ {
+			same = mapping[a][2*g+side] == mapping[b][2*g+side]
+		}
+		if same {
+			return a
+		}
+	}
+	return b
+}
+
+// evaluate the chunks of a level (one for every programming ciphertext in progs) on the packed operands ops
+func (e *CDN) evaluateLevel(
+	sels []*noisyCiphertext,
+	progs []*noisyCiphertext,
+	ops [][][2]*noisyCiphertext,
+) ([]*noisyCiphertext, error) {
+	o := e.oip
+	chunks := len(progs)
+	growth := o.productGrowth()
+	limit := o.noiseCapacity() - NOISE_MARGIN
+	spread := math.Log2(float64(len(sels)))
+
+	// FIRST STEP: select the operands of every chunk, refresh the operands which are too noisy
+
+	// in the same order on every player (the refreshed ciphertexts must match)
+	var used []*noisyCiphertext
+	for _, op := range ops {
+		for _, lr := range op {
+			used = append(used, lr[0], lr[1])
+		}
+	}
+	if err := e.refreshAbove(limit-growth-2*spread, append(used, sels...)); err != nil {
+		return nil, err
+	}
+
+	l := make([]*noisyCiphertext, chunks)
+	r := make([]*noisyCiphertext, chunks)
+	e.parallel(2*chunks, func(eval bfv.Evaluator, i int) {
+		if i%2 == 0 {
+			l[i/2] = e.selectPack(eval, sels, ops[i/2], 0)
+		} else {
+			r[i/2] = e.selectPack(eval, sels, ops[i/2], 1)
+		}
+	})
+
+	// SECOND STEP: compute x = l*r - l - r
+
+	if err := e.refreshAbove(limit-growth-1, append(l, r...)); err != nil {
+		return nil, err
+	}
+
+	x := make([]*noisyCiphertext, chunks)
+	e.parallel(chunks, func(eval bfv.Evaluator, i int) {
+		x[i] = mulNoisy(o, eval, l[i], r[i])
+		eval.Sub(x[i].ct, l[i].ct, x[i].ct)
+		eval.Sub(x[i].ct, r[i].ct, x[i].ct)
+		x[i].noise = addNoise(x[i].noise, addNoise(l[i].noise, r[i].noise))
+	})
+
+	// THIRD STEP: compute the output p*x + l + r
+
+	if err := e.refreshAbove(limit-growth-1, append(x, progs...)); err != nil {
+		return nil, err
+	}
+
+	out := make([]*noisyCiphertext, chunks)
+	e.parallel(chunks, func(eval bfv.Evaluator, i int) {
+		out[i] = mulNoisy(o, eval, progs[i], x[i])
+		eval.Add(out[i].ct, l[i].ct, out[i].ct)
+		eval.Add(out[i].ct, r[i].ct, out[i].ct)
+		out[i].noise = addNoise(out[i].noise, addNoise(l[i].noise, r[i].noise))
+	})
+
+	return out, nil
+}
+
+// the selector-weighted operand \sum_b [sel_b] * [ops[b][side]],
+// the selectors of the branches with the same operand are added up first
+func (e *CDN) selectPack(eval bfv.Evaluator, sels []*noisyCiphertext, ops [][2]*noisyCiphertext, side int) *noisyCiphertext {
+	o := e.oip
+
+	var order []*noisyCiphertext
+	coeffs := make(map[*noisyCiphertext]*noisyCiphertext)
+	for b, op := range ops {
+		w := op[side]
+		c, ok := coeffs[w]
+		if !ok {
+			coeffs[w] = &noisyCiphertext{ct: sels[b].ct.CopyNew(), noise: sels[b].noise}
+			order = append(order, w)
+			continue
+		}
+		eval.Add(c.ct, sels[b].ct, c.ct)
+		c.noise = addNoise(c.noise, sels[b].noise)
+	}
+
+	sum := bfv.NewCiphertext(o.params, 2)
+	tmp := bfv.NewCiphertext(o.params, 2)
+	noise := math.Inf(-1)
+	for _, w := range order {
+		c := coeffs[w]
+		eval.Mul(c.ct, w.ct, tmp)
+		eval.Add(sum, tmp, sum)
+		noise = addNoise(noise, math.Max(c.noise, w.noise)+o.productGrowth())
+	}
+
+	res := bfv.NewCiphertext(o.params, 1)
+	eval.Relinearize(sum, res)
+	return &noisyCiphertext{ct: res, noise: noise}
+}
+
+// relinearized product of a and b
+func mulNoisy(o *OIP, eval bfv.Evaluator, a, b *noisyCiphertext) *noisyCiphertext {
+	res := bfv.NewCiphertext(o.params, 1)
+	eval.Relinearize(eval.MulNew(a.ct, b.ct), res)
+	return &noisyCiphertext{ct: res, noise: math.Max(a.noise, b.noise) + o.productGrowth()}
+}
+
+// run f(i) for every i < n in parallel
+func (e *CDN) parallel(n int, f func(eval bfv.Evaluator, i int)) {
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			eval := e.oip.getEvaluator()
+			f(eval, i)
+			e.oip.putEvaluator(eval)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// refresh the ciphertexts whose noise bound exceeds bound (in a single round, none if all are below the bound),
+// fails if the bound is below the noise of a refreshed ciphertext: the parameters are too small for a single step
+func (e *CDN) refreshAbove(bound float64, cts []*noisyCiphertext) error {
+	o := e.oip
+
+	refreshed := o.refreshedNoise()
+	if bound < refreshed {
+		return fmt.Errorf("%w: %.1f bits of noise allowed, refreshed ciphertexts have %.1f bits", ErrNoiseBudget, bound, refreshed)
+	}
+
+	seen := make(map[*noisyCiphertext]bool)
+	var noisy []*noisyCiphertext
+	for _, c := range cts {
+		if c.noise > bound && !seen[c] {
+			seen[c] = true
+			noisy = append(noisy, c)
+		}
+	}
+	if len(noisy) == 0 {
+		return nil
+	}
+
+	o.Log("Refresh", len(noisy), "ciphertexts with", fmt.Sprintf("more than %.1f bits of noise", bound))
+
+	cts_noisy := make([]*bfv.Ciphertext, len(noisy))
+	for i, c := range noisy {
+		cts_noisy[i] = c.ct
+	}
+	if err := o.refresh(cts_noisy); err != nil {
+		return err
+	}
+	for _, c := range noisy {
+		c.noise = refreshed
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ldsec/lattigo/v2/bfv"
+)
+
+// u = x0, x1, g0, ...: levels of two gates, every level mixes the wires of the previous ones
+func homomorphicCircuit(levels int) ([]int, [][]int, [][]bool) {
+	var ends []int
+	mapping := make([][]int, 2)
+	programs := make([][]bool, 2)
+	for level := 0; level < levels; level++ {
+		a, b := 2*level, 2*level+1 // the outputs of the previous level (the inputs at the first level)
+		mapping[0] = append(mapping[0], a, b, a, 0)
+		mapping[1] = append(mapping[1], a, a, b, 1)
+		programs[0] = append(programs[0], true, false)
+		programs[1] = append(programs[1], false, true)
+		ends = append(ends, 2*level+1)
+	}
+	return ends, mapping, programs
+}
+
+// evaluate the selected branch of the circuit in the clear (in the field f)
+func evaluateCircuit(f Field, mapping []int, program []bool, x []FieldElem) []FieldElem {
+	u := append([]FieldElem(nil), x...)
+	for g, m := range program {
+		l, r := u[mapping[2*g]], u[mapping[2*g+1]]
+		if m {
+			u = append(u, f.mul(l, r))
+		} else {
+			u = append(u, f.add(l, r))
+		}
+	}
+	return u[len(x):]
+}
+
+func TestDisjunctionHomomorphic(t *testing.T) {
+	for _, tc := range []struct {
+		topology Topology
+		literal  bfv.ParametersLiteral
+		levels   int
+		refresh  bool // the evaluation must refresh
+		strategy bool // through the disjunction strategy of the CDN (see SetDisjunctionStrategy)
+	}{
+		{TopologyStar, LITERAL, 2, true, false},
+		{TopologyMesh, LITERAL, 2, true, true},
+		{TopologyTree, LITERAL, 2, true, false},
+		{TopologyStar, bfv.PN14QP438, 2, false, true},
+		{TopologyTree, bfv.PN13QP218, 3, false, false},
+	} {
+		// the estimated noise leaves a margin: the debug check must pass
+		withDebug(func() {
+			oips := setupOIPsConns(paramsFor(PRIME, tc.literal), tc.topology, MemoryDummies(tc.topology, 3, MemoryCheck))
+			for _, oip := range oips {
+				oip.SetEvaluationKeys(true, nil, false)
+			}
+
+			levels, mapping, programs := homomorphicCircuit(tc.levels)
+			inputs := randomShares(len(oips), 2)
+			expected := evaluateCircuit(defaultField, mapping[1], programs[1], reconstruct(inputs))
+
+			outs, errs := runCDN(oips, func(p int, e *CDN) ([]FieldElem, error) {
+				ctx := context.Background()
+				sel := []Share{e.Input(0, 0), e.Input(1, 0)}
+				var w []Share
+				var err error
+				if tc.strategy {
+					e.SetDisjunctionStrategy(DisjunctionHomomorphic)
+					w, err = e.Disjunction(ctx, levels, mapping, inputs[p], sel, programs)
+				} else {
+					w, err = e.DisjunctionHomomorphic(ctx, levels, mapping, inputs[p], sel, programs)
+				}
+				if err != nil {
+					return nil, err
+				}
+				return e.Reconstruct(ctx, w)
+			})
+
+			for p := range oips {
+				if errs[p] != nil {
+					t.Fatal(tc.topology, "player", p, "failed:", errs[p])
+				}
+				if (oips[p].refreshes > 0) != tc.refresh {
+					t.Fatal(tc.topology, "player", p, "refreshed", oips[p].refreshes, "times")
+				}
+				// every level after the first rearranges the outputs of the previous one
+				if oips[p].repacks != uint64(tc.levels-1) {
+					t.Fatal(tc.topology, "player", p, "repacked", oips[p].repacks, "times")
+				}
+				for i, v := range expected {
+					if outs[p][i] != v {
+						t.Fatal(tc.topology, "player", p, "wrong output of gate", i)
+					}
+				}
+			}
+		})
+	}
+}
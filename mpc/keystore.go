@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+
+	"github.com/ldsec/lattigo/v2/bfv"
+	"github.com/ldsec/lattigo/v2/ring"
+	"github.com/ldsec/lattigo/v2/rlwe"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Keystore:
+//
+// the key material of a setup is saved by every player (the secret part sealed under a passphrase)
+// and reused by later runs if every player holds the same public key (see Resume).
+
+const KEYSTORE_MAGIC = "bmpc keystore 1"
+const KEYSTORE_SALT = 16
+
+// scrypt cost parameters (interactive logins)
+const (
+	KEYSTORE_SCRYPT_N = 1 << 15
+	KEYSTORE_SCRYPT_R = 8
+	KEYSTORE_SCRYPT_P = 1
+)
+
+var ErrKeystoreSecret = errors.New("keystore: wrong passphrase or corrupted keystore")
+
+// key material of a setup
+type KeyMaterial struct {
+	Session   []byte          // session identifier
+	Seed      []byte          // coin-tossed seed of the common reference string
+	Params    []byte          // marshalled BFV parameters
+	Threshold int             // threshold of the Shamir sharing (0: none)
+	PK        *rlwe.PublicKey // joint public key
+	SK        *rlwe.SecretKey // secret key share
+	TSK       *ring.Poly      // Shamir share of the secret key (nil without a threshold)
+}
+
+// key material of the completed setup
+func (o *OIP) Keys() (*KeyMaterial, error) {
+	if o.pk == nil {
+		return nil, errors.New("keystore: no setup to save")
+	}
+	params, err := o.params.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return &KeyMaterial{
+		Session:   o.session,
+		Seed:      o.seed,
+		Params:    params,
+		Threshold: o.threshold,
+		PK:        o.pk,
+		SK:        o.sk,
+		TSK:       o.tsk,
+	}, nil
+}
+
+// public part of the key material (authenticated by the sealed secret part)
+func (k *KeyMaterial) public() ([]byte, error) {
+	pk, err := k.PK.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	for _, field := range [][]byte{[]byte(KEYSTORE_MAGIC), k.Session, k.Seed, k.Params} {
+		writeField(&buf, field)
+	}
+	binary.Write(&buf, binary.LittleEndian, uint64(k.Threshold))
+	writeField(&buf, pk)
+	return buf.Bytes(), nil
+}
+
+// hash of the public part, equal for all players holding keys of the same setup
+func (k *KeyMaterial) Hash() ([]byte, error) {
+	public, err := k.public()
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.Sum256(public)
+	return h[:], nil
+}
+
+func writeField(w io.Writer, field []byte) {
+	binary.Write(w, binary.LittleEndian, uint64(len(field)))
+	w.Write(field)
+}
+
+func readField(r *bytes.Reader) ([]byte, error) {
+	var size uint64
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+		return nil, err
+	}
+	if size > uint64(r.Len()) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	field := make([]byte, size)
+	_, err := io.ReadFull(r, field)
+	return field, err
+}
+
+func keystoreCipher(secret []byte, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(secret, salt, KEYSTORE_SCRYPT_N, KEYSTORE_SCRYPT_R, KEYSTORE_SCRYPT_P, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// write the key material to path, sealing the secret part with the secret (passphrase or key file)
+func SaveKeystore(path string, k *KeyMaterial, secret []byte) error {
+	public, err := k.public()
+	if err != nil {
+		return err
+	}
+
+	var plain bytes.Buffer
+	sk, err := k.SK.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	writeField(&plain, sk)
+	var tsk []byte
+	if k.TSK != nil {
+		if tsk, err = k.TSK.MarshalBinary(); err != nil {
+			return err
+		}
+	}
+	writeField(&plain, tsk)
+
+	salt := make([]byte, KEYSTORE_SALT)
+	if _, err := rand.Read(salt); err != nil {
+		panic(err)
+	}
+	aead, err := keystoreCipher(secret, salt)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+
+	out := bytes.NewBuffer(public)
+	writeField(out, salt)
+	writeField(out, nonce)
+	writeField(out, aead.Seal(nil, nonce, plain.Bytes(), public))
+
+	// replace the keystore atomically
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, out.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// read the key material from path, the error wraps os.ErrNotExist if there is no keystore
+func LoadKeystore(path string, secret []byte) (*KeyMaterial, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	corrupted := func(err error) error {
+		return errors.New("keystore: " + path + ": corrupted: " + err.Error())
+	}
+
+	r := bytes.NewReader(data)
+	var k KeyMaterial
+
+	magic, err := readField(r)
+	if err != nil {
+		return nil, corrupted(err)
+	}
+	if string(magic) != KEYSTORE_MAGIC {
+		return nil, errors.New("keystore: " + path + ": not a keystore")
+	}
+	for _, field := range []*[]byte{&k.Session, &k.Seed, &k.Params} {
+		if *field, err = readField(r); err != nil {
+			return nil, corrupted(err)
+		}
+	}
+	var threshold uint64
+	if err := binary.Read(r, binary.LittleEndian, &threshold); err != nil {
+		return nil, corrupted(err)
+	}
+	k.Threshold = int(threshold)
+
+	pk, err := readField(r)
+	if err != nil {
+		return nil, corrupted(err)
+	}
+	public := data[:len(data)-r.Len()]
+
+	var salt, nonce, sealed []byte
+	for _, field := range []*[]byte{&salt, &nonce, &sealed} {
+		if *field, err = readField(r); err != nil {
+			return nil, corrupted(err)
+		}
+	}
+	aead, err := keystoreCipher(secret, salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, corrupted(errors.New("invalid nonce"))
+	}
+	plain, err := aead.Open(nil, nonce, sealed, public)
+	if err != nil {
+		return nil, ErrKeystoreSecret
+	}
+
+	// the public part is authenticated: decode the keys
+	var params bfv.Parameters
+	if err := params.UnmarshalBinary(k.Params); err != nil {
+		return nil, corrupted(err)
+	}
+	k.PK = bfv.NewPublicKey(params)
+	if err := k.PK.UnmarshalBinary(pk); err != nil {
+		return nil, corrupted(err)
+	}
+
+	r = bytes.NewReader(plain)
+	sk, err := readField(r)
+	if err != nil {
+		return nil, corrupted(err)
+	}
+	k.SK = bfv.NewSecretKey(params)
+	if err := k.SK.UnmarshalBinary(sk); err != nil {
+		return nil, corrupted(err)
+	}
+	tsk, err := readField(r)
+	if err != nil {
+		return nil, corrupted(err)
+	}
+	if len(tsk) != 0 {
+		k.TSK = new(ring.Poly)
+		if err := k.TSK.UnmarshalBinary(tsk); err != nil {
+			return nil, corrupted(err)
+		}
+	}
+	return &k, nil
+}
+
+// reuse the stored key material (nil if none) if every player holds the keys of the same setup,
+// otherwise run a fresh setup. Returns whether the stored keys were reused.
+func (o *OIP) Resume(ctx context.Context, k *KeyMaterial) (reused bool, err error) {
+	err = o.run(ctx, func() error {
+		reused, err = o.resume(k)
+		return err
+	})
+	return reused, err
+}
+
+func (o *OIP) resume(k *KeyMaterial) (bool, error) {
+	o.Log("Compare stored keys")
+
+	// only keys of this session, parameters and threshold can be reused
+	var hash []byte
+	if k != nil {
+		params, err := o.params.MarshalBinary()
+		if err != nil {
+			return false, err
+		}
+		if bytes.Equal(k.Session, o.session) && bytes.Equal(k.Params, params) && k.Threshold == o.threshold {
+			if hash, err = k.Hash(); err != nil {
+				return false, err
+			}
+		}
+	}
+
+	hashes, err := func() ([][]byte, error) {
+		defer o.phase(PhaseKeyGen)()
+		return o.allGather(hash)
+	}()
+	if err != nil {
+		return false, err
+	}
+
+	reuse := hash != nil
+	for _, h := range hashes {
+		reuse = reuse && bytes.Equal(h, hash)
+	}
+	if !reuse {
+		o.Log("Stored keys missing or differing, run setup")
+		return false, o.Setup()
+	}
+
+	o.Log("Reuse stored keys")
+	o.sk = k.SK
+	o.pk = k.PK
+	o.tsk = k.TSK
+	if err := o.expandCRS(k.Seed); err != nil {
+		return false, err
+	}
+	if err := o.setupEvaluationKeys(); err != nil {
+		return false, err
+	}
+	o.setupEncryptors()
+	return true, nil
+}
+
+// reuse the keys stored at path (see Resume), otherwise run a fresh setup and save its keys to path.
+// Returns whether the stored keys were reused.
+func (o *OIP) ResumeKeystore(ctx context.Context, path string, secret []byte) (bool, error) {
+	keys, err := LoadKeystore(path, secret)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return false, err
+	}
+	reused, err := o.Resume(ctx, keys)
+	if err != nil || reused {
+		return reused, err
+	}
+	if keys, err = o.Keys(); err != nil {
+		return false, err
+	}
+	return false, SaveKeystore(path, keys, secret)
+}
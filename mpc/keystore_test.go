@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// resume every player with its stored keys (nil: no keys), returns whether the keys were reused
+func resumeAll(t *testing.T, oips []*OIP, keys []*KeyMaterial) []bool {
+	reused := make([]bool, len(oips))
+	errs := make([]error, len(oips))
+	var wg sync.WaitGroup
+	for p, oip := range oips {
+		wg.Add(1)
+		go func(p int, o *OIP) {
+			defer wg.Done()
+			reused[p], errs[p] = o.Resume(context.Background(), keys[p])
+		}(p, oip)
+	}
+	wg.Wait()
+	for p, err := range errs {
+		if err != nil {
+			t.Fatal("Player", p, "failed:", err)
+		}
+	}
+	return reused
+}
+
+func TestKeystore(t *testing.T) {
+	dir := t.TempDir()
+	oips := setupOIPsThreshold(3, 1)
+	for _, oip := range oips {
+		oip.SetSession("keystore")
+	}
+	for p, err := range setupAll(oips) {
+		if err != nil {
+			t.Fatal("Player", p, "failed:", err)
+		}
+	}
+
+	keys, err := oips[1].Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "keys-1")
+	if err := SaveKeystore(path, keys, []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadKeystore(path, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.SK.Value.Equals(keys.SK.Value) || !loaded.PK.Equals(keys.PK) || !loaded.TSK.Equals(keys.TSK) {
+		t.Fatal("Keys changed by the keystore")
+	}
+	if string(loaded.Session) != "keystore" || string(loaded.Seed) != string(keys.Seed) || loaded.Threshold != 1 {
+		t.Fatal("Wrong public part", loaded)
+	}
+
+	if _, err := LoadKeystore(path, []byte("wrong")); err != ErrKeystoreSecret {
+		t.Fatal("Expected wrong passphrase, got", err)
+	}
+	if _, err := LoadKeystore(filepath.Join(dir, "missing"), []byte("secret")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("Expected missing keystore, got", err)
+	}
+
+	// tampering with the public part is detected
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(KEYSTORE_MAGIC)+8+8] ^= 1 // first byte of the session identifier
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadKeystore(path, []byte("secret")); err != ErrKeystoreSecret {
+		t.Fatal("Accepted tampered keystore:", err)
+	}
+}
+
+func TestResume(t *testing.T) {
+	dir := t.TempDir()
+	params := SetupParams()
+
+	// first run: no keys, run the setup and save the keys
+	oips := setupOIPs(params, TopologyStar, 3)
+	for _, oip := range oips {
+		oip.SetSession("resume")
+	}
+	for p, reused := range resumeAll(t, oips, make([]*KeyMaterial, 3)) {
+		if reused {
+			t.Fatal("Player", p, "reused missing keys")
+		}
+	}
+	paths := make([]string, 3)
+	for p, oip := range oips {
+		keys, err := oip.Keys()
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths[p] = filepath.Join(dir, "keys-"+strconv.Itoa(p))
+		if err := SaveKeystore(paths[p], keys, []byte("secret")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	load := func() []*KeyMaterial {
+		keys := make([]*KeyMaterial, len(paths))
+		for p, path := range paths {
+			var err error
+			if keys[p], err = LoadKeystore(path, []byte("secret")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return keys
+	}
+
+	// second run: reuse the keys
+	oips = setupOIPs(params, TopologyStar, 3)
+	for _, oip := range oips {
+		oip.SetSession("resume")
+	}
+	keys := load()
+	for p, reused := range resumeAll(t, oips, keys) {
+		if !reused {
+			t.Fatal("Player", p, "did not reuse its keys")
+		}
+		if !oips[p].pk.Equals(keys[0].PK) || !oips[p].crp.Q.Equals(oips[0].crp.Q) {
+			t.Fatal("Player", p, "resumed with different keys")
+		}
+	}
+	testMul(oips, 100, 1)
+
+	// a player without keys: every player runs a fresh setup
+	oips = setupOIPs(params, TopologyMesh, 3)
+	for _, oip := range oips {
+		oip.SetSession("resume")
+	}
+	keys = load()
+	keys[2] = nil
+	for p, reused := range resumeAll(t, oips, keys) {
+		if reused {
+			t.Fatal("Player", p, "reused keys although player 2 has none")
+		}
+	}
+	if oips[0].pk.Equals(keys[0].PK) {
+		t.Fatal("Public key not regenerated")
+	}
+	testMul(oips, 100, 1)
+
+	// keys of another session are not reused
+	oips = setupOIPs(params, TopologyTree, 3)
+	for _, oip := range oips {
+		oip.SetSession("other")
+	}
+	for p, reused := range resumeAll(t, oips, load()) {
+		if reused {
+			t.Fatal("Player", p, "reused keys of another session")
+		}
+	}
+}
+
+// every modulus of a CRT session has its own keystore: all of them are reused by the next run
+func TestResumeCRT(t *testing.T) {
+	dir := t.TempDir()
+
+	resume := func() ([]*CRTOIP, [][]bool) {
+		crts := setupCRTOIPs(t, TopologyStar, 3)
+		reused := make([][]bool, len(crts))
+		errs := make([]error, len(crts))
+		var wg sync.WaitGroup
+		for p, c := range crts {
+			for i, oip := range c.oips {
+				oip.SetSession("resume/crt-" + strconv.Itoa(i))
+			}
+			wg.Add(1)
+			go func(p int, c *CRTOIP) {
+				defer wg.Done()
+				path := filepath.Join(dir, "keys-"+strconv.Itoa(p))
+				reused[p], errs[p] = c.ResumeKeystore(context.Background(), path, []byte("secret"))
+			}(p, c)
+		}
+		wg.Wait()
+		for p, err := range errs {
+			if err != nil {
+				t.Fatal("Player", p, "failed:", err)
+			}
+		}
+		return crts, reused
+	}
+
+	// first run: a fresh setup of every modulus, saved to its own keystore
+	first, reused := resume()
+	for p := range first {
+		for i, r := range reused[p] {
+			if r {
+				t.Fatal("Player", p, "reused missing keys of modulus", i)
+			}
+			if _, err := os.Stat(first[p].KeystorePath(filepath.Join(dir, "keys-"+strconv.Itoa(p)), i)); err != nil {
+				t.Fatal("Player", p, "saved no keys of modulus", i, err)
+			}
+		}
+	}
+
+	// second run: the keys of every modulus are reused
+	second, reused := resume()
+	for p := range second {
+		for i, oip := range second[p].oips {
+			if !reused[p][i] {
+				t.Fatal("Player", p, "did not reuse its keys of modulus", i)
+			}
+			if !oip.sk.Value.Equals(first[p].oips[i].sk.Value) || !oip.pk.Equals(first[p].oips[i].pk) {
+				t.Fatal("Player", p, "resumed with different keys of modulus", i)
+			}
+		}
+	}
+	for i := range second[0].oips {
+		oips := make([]*OIP, len(second))
+		for p, c := range second {
+			oips[p] = c.oips[i]
+		}
+		testMul(oips, 100, 1)
+	}
+}
@@ -0,0 +1,598 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"log"
+	"math"
+)
+
+// Authenticated shares (SPDZ-style MACs):
+//
+// every value is shared together with its MACs under MAC keys shared by all players,
+// the opened values are checked in a single batch (see Check) before any output is released (see Output).
+
+// statistical security of the MAC check in bits, determines the number of MAC keys
+var MAC_SECURITY = 40
+
+var ErrMACCheck = errors.New("MAC check failed")
+
+// number of MAC keys for MAC_SECURITY bits of statistical security
+func macKeys(f Field) int {
+	return int(math.Ceil(float64(MAC_SECURITY) / (math.Log2(float64(f.p)) - 1)))
+}
+
+// authenticated sharing of a vector: the V sum to the values, the M[k] sum to alpha_k times the values
+type AuthShares struct {
+	V []Share
+	M [][]Share
+}
+
+// authenticated sharing of n zeros (with keys MAC keys)
+func NewAuthShares(n int, keys int) AuthShares {
+	x := AuthShares{V: make([]Share, n), M: make([][]Share, keys)}
+	for k := range x.M {
+		x.M[k] = make([]Share, n)
+	}
+	return x
+}
+
+func (x AuthShares) Len() int {
+	return len(x.V)
+}
+
+func (x AuthShares) Slice(s, e int) AuthShares {
+	res := AuthShares{V: x.V[s:e], M: make([][]Share, len(x.M))}
+	for k, m := range x.M {
+		res.M[k] = m[s:e]
+	}
+	return res
+}
+
+// concatenation (never overwrites the vectors x is sliced from)
+func (x AuthShares) Append(y AuthShares) AuthShares {
+	if x.M == nil {
+		x.M = make([][]Share, len(y.M))
+	}
+	res := AuthShares{V: append(x.V[:len(x.V):len(x.V)], y.V...), M: make([][]Share, len(x.M))}
+	for k, m := range x.M {
+		res.M[k] = append(m[:len(m):len(m)], y.M[k]...)
+	}
+	return res
+}
+
+// the shares at the indexes idx (e.g. of the wires of a circuit)
+func (x AuthShares) Gather(idx []int) AuthShares {
+	res := NewAuthShares(len(idx), len(x.M))
+	for i, j := range idx {
+		res.V[i] = x.V[j]
+		for k, m := range x.M {
+			res.M[k][i] = m[j]
+		}
+	}
+	return res
+}
+
+// overwrite the shares at the indexes idx with y
+func (x AuthShares) Scatter(idx []int, y AuthShares) {
+	for i, j := range idx {
+		x.V[j] = y.V[i]
+		for k, m := range x.M {
+			m[j] = y.M[k][i]
+		}
+	}
+}
+
+// overwrite the shares starting at index s with y
+func (x AuthShares) Copy(s int, y AuthShares) {
+	copy(x.V[s:], y.V)
+	for k, m := range x.M {
+		copy(m[s:], y.M[k])
+	}
+}
+
+type AuthCDN struct {
+	cdn    *CDN
+	alpha  []FieldElem // shares of the MAC keys
+	opened []FieldElem // opened values awaiting the check
+	macs   [][]Share   // macs[k]: MAC shares of the opened values under key k
+	zeros  [][]Share   // zeros[k]: shares which must sum to zero (under key k)
+}
+
+// authenticated engine with macKeys MAC keys
+func NewAuthCDN(cdn *CDN) *AuthCDN {
+	return NewAuthCDNKeys(cdn, macKeys(cdn.oip.field))
+}
+
+// authenticated engine with the given number of MAC keys, without keys the shares are not authenticated
+func NewAuthCDNKeys(cdn *CDN, keys int) *AuthCDN {
+	return &AuthCDN{
+		cdn:   cdn,
+		alpha: cdn.oip.field.random(keys),
+		macs:  make([][]Share, keys),
+		zeros: make([][]Share, keys),
+	}
+}
+
+func (e *AuthCDN) Keys() int {
+	return len(e.alpha)
+}
+
+// the concatenation of the vectors vs
+func concatShares(vs [][]Share) []Share {
+	res := make([]Share, 0, len(vs)*len(vs[0]))
+	for _, v := range vs {
+		res = append(res, v...)
+	}
+	return res
+}
+
+// the concatenation of k copies of v
+func repeatShares(v []Share, k int) []Share {
+	res := make([]Share, 0, k*len(v))
+	for i := 0; i < k; i++ {
+		res = append(res, v...)
+	}
+	return res
+}
+
+// authenticate shares (e.g. of inputs, see CDN.Input) by multiplying them with the MAC keys (in a single batch)
+func (e *AuthCDN) Authenticate(ctx context.Context, shares []Share) (AuthShares, error) {
+	n, keys := len(shares), e.Keys()
+	x := AuthShares{V: shares, M: make([][]Share, keys)}
+	if keys == 0 || n == 0 {
+		for k := range x.M {
+			x.M[k] = []Share{}
+		}
+		return x, nil
+	}
+
+	alphas := make([]Share, 0, keys*n)
+	for _, a := range e.alpha {
+		alphas = append(alphas, dup(a, n)...)
+	}
+	macs, err := e.cdn.Mul(ctx, alphas, repeatShares(shares, keys))
+	if err != nil {
+		return AuthShares{}, err
+	}
+	for k := range x.M {
+		x.M[k] = macs[k*n : (k+1)*n]
+	}
+	return x, nil
+}
+
+func (e *AuthCDN) Add(x, y AuthShares) AuthShares {
+	f := e.cdn.oip.field
+	res := AuthShares{V: f.add_vec(x.V, y.V), M: make([][]Share, len(x.M))}
+	for k := range x.M {
+		res.M[k] = f.add_vec(x.M[k], y.M[k])
+	}
+	return res
+}
+
+func (e *AuthCDN) Sub(x, y AuthShares) AuthShares {
+	return e.Add(x, e.MulConst(y, e.cdn.oip.field.inv(1)))
+}
+
+// x + c: player 0 adds the constant to its share, every player adds its shares of alpha_k * c
+func (e *AuthCDN) AddConst(x AuthShares, c FieldElem) AuthShares {
+	f := e.cdn.oip.field
+	res := NewAuthShares(x.Len(), len(x.M))
+	for i := range x.V {
+		res.V[i] = x.V[i]
+		if e.cdn.oip.me == 0 {
+			res.V[i] = f.add(res.V[i], c)
+		}
+		for k, m := range x.M {
+			res.M[k][i] = f.add(m[i], f.mul(e.alpha[k], c))
+		}
+	}
+	return res
+}
+
+func (e *AuthCDN) MulConst(x AuthShares, c FieldElem) AuthShares {
+	f := e.cdn.oip.field
+	res := NewAuthShares(x.Len(), len(x.M))
+	for i := range x.V {
+		res.V[i] = f.mul(x.V[i], c)
+		for k, m := range x.M {
+			res.M[k][i] = f.mul(m[i], c)
+		}
+	}
+	return res
+}
+
+// multiply and authenticate the products: l * r, [alpha_k l] * r and l * [alpha_k r] in separate batches
+func (e *AuthCDN) Mul(ctx context.Context, l, r AuthShares) (AuthShares, error) {
+	return e.mul(l, r, func(left, right []Share) ([]Share, error) {
+		return e.cdn.Mul(ctx, left, right)
+	})
+}
+
+// Mul using the multiplication mul (of the underlying engine):
+// without proofs a player can add any multiple of the aggregated encryptions of a batch to its products.
+// In a single batch it could add c [alpha l] to l * [alpha r] (as well as c [l] to l * r and c [alpha l] to [alpha l] * r),
+// a consistent forgery of l * r + c l; in separate batches [alpha l] is never encrypted while l * [alpha r] is computed.
+// The MACs under all keys share the batches: [alpha_j l] is not encrypted while l * [alpha_k r] is computed either.
+func (e *AuthCDN) mul(l, r AuthShares, mul func(left, right []Share) ([]Share, error)) (AuthShares, error) {
+	f := e.cdn.oip.field
+	n, keys := l.Len(), e.Keys()
+	if r.Len() != n {
+		panic("Multiplying vectors of different length")
+	}
+
+	val, err := mul(l.V, r.V)
+	if err != nil {
+		return AuthShares{}, err
+	}
+	res := AuthShares{V: val, M: make([][]Share, keys)}
+	if keys == 0 || n == 0 {
+		for k := range res.M {
+			res.M[k] = []Share{}
+		}
+		return res, nil
+	}
+
+	mac, err := mul(concatShares(l.M), repeatShares(r.V, keys))
+	if err != nil {
+		return AuthShares{}, err
+	}
+	check, err := mul(repeatShares(l.V, keys), concatShares(r.M))
+	if err != nil {
+		return AuthShares{}, err
+	}
+
+	for k := 0; k < keys; k++ {
+		res.M[k] = mac[k*n : (k+1)*n]
+		for i := k * n; i < (k+1)*n; i++ {
+			e.zeros[k] = append(e.zeros[k], f.sub(mac[i], check[i]))
+		}
+	}
+	return res, nil
+}
+
+// reconstruct to every player, the MACs of the values are checked by the next Check
+func (e *AuthCDN) Reconstruct(ctx context.Context, x AuthShares) ([]FieldElem, error) {
+	res, err := e.cdn.Reconstruct(ctx, x.V)
+	if err != nil {
+		return nil, err
+	}
+	if e.Keys() > 0 {
+		e.opened = append(e.opened, res...)
+		for k, m := range x.M {
+			e.macs[k] = append(e.macs[k], m...)
+		}
+	}
+	return res, nil
+}
+
+// reconstruct outputs: the values are only returned if the check of every value opened so far passes
+func (e *AuthCDN) Output(ctx context.Context, x AuthShares) ([]FieldElem, error) {
+	res, err := e.Reconstruct(ctx, x)
+	if err != nil {
+		return nil, err
+	}
+	if err := e.Check(ctx); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// batched check of the MACs of all opened values and of all products since the last check,
+// aborts the OIP (with ErrMACCheck) if any player cheated
+func (e *AuthCDN) Check(ctx context.Context) error {
+	if len(e.opened) == 0 && (e.Keys() == 0 || len(e.zeros[0]) == 0) {
+		return nil
+	}
+	return e.cdn.oip.run(ctx, e.check)
+}
+
+func (e *AuthCDN) check() error {
+	f := e.cdn.oip.field
+	o := e.cdn.oip
+	defer o.phase(PhaseCheck)()
+
+	keys := e.Keys()
+	opened, macs, zeros := e.opened, e.macs, e.zeros
+	e.opened, e.macs, e.zeros = nil, make([][]Share, keys), make([][]Share, keys)
+
+	// random coefficients (independent for every key), sampled after the values are fixed
+	seed, err := o.coinToss()
+	if err != nil {
+		return err
+	}
+	num := len(opened) + len(zeros[0])
+	coeffs := f.expandSeed(seed, keys*num)
+
+	// sigma_k,i = \sum_j r_k,j (m_k,j,i - alpha_k,i a_k,j) + \sum_j s_k,j z_k,j,i sums to zero for every key k
+	buf := make([]byte, 8*keys)
+	for k := 0; k < keys; k++ {
+		r := coeffs[k*num : (k+1)*num]
+		var a, sigma FieldElem
+		for j, v := range opened {
+			a = f.add(a, f.mul(r[j], v))
+			sigma = f.add(sigma, f.mul(r[j], macs[k][j]))
+		}
+		sigma = f.sub(sigma, f.mul(e.alpha[k], a))
+		for j, z := range zeros[k] {
+			sigma = f.add(sigma, f.mul(r[len(opened)+j], z))
+		}
+		binary.LittleEndian.PutUint64(buf[8*k:], sigma)
+	}
+
+	// commit before opening, hence no player can choose its shares depending on the others
+	sigmas, err := o.commitReveal(buf)
+	if err != nil {
+		return err
+	}
+
+	sums := make([]FieldElem, keys)
+	for p, s := range sigmas {
+		if len(s) != len(buf) {
+			return o.peerError(p, errors.New("MAC check shares have wrong length"))
+		}
+		for k := range sums {
+			sums[k] = f.add(sums[k], f.reduce(binary.LittleEndian.Uint64(s[8*k:])))
+		}
+	}
+	for _, sum := range sums {
+		if sum != 0 {
+			return o.peerError(-1, ErrMACCheck)
+		}
+	}
+	return nil
+}
+
+// selector-independent material of an authenticated disjunction (see CDN.PrepareDisjunction):
+// the authenticated random mask, the prepared selection of its permutation and MACs (by the selectors),
+// and for every key the prepared selection of its permutation by the MACs of the selectors
+type PreparedAuthDisjunction struct {
+	*PreparedDisjunction
+	macs   [][]Share         // macs[k]: MACs of the mask under key k
+	checks []*PreparedSelect // checks[k]: selection of the permutation of the mask by the MACs of the selectors under key k
+}
+
+// prepare an authenticated disjunction of the mapping over in_dim inputs ahead of the selectors,
+// a prepared disjunction can be used once
+func (e *AuthCDN) PrepareDisjunction(ctx context.Context, mapping [][]int, in_dim int) (*PreparedAuthDisjunction, error) {
+	f := e.cdn.oip.field
+	keys := e.Keys()
+	if keys == 0 {
+		prep, err := e.cdn.PrepareDisjunction(ctx, mapping, in_dim)
+		return &PreparedAuthDisjunction{PreparedDisjunction: prep}, err
+	}
+
+	if len(mapping[0])%2 != 0 {
+		log.Panicln("Mapping of odd length", len(mapping[0]))
+	}
+
+	// authenticated random mask
+	branch_size := len(mapping[0]) / 2
+	out, err := e.Authenticate(ctx, f.random(branch_size+in_dim))
+	if err != nil {
+		return nil, err
+	}
+
+	// the permutations of the mask and of its MACs, selected together
+	vecs := apply_mapping(mapping, out.V)
+	both := make([][]Share, len(mapping))
+	for b := range both {
+		both[b] = append([]Share{}, vecs[b]...)
+	}
+	for _, m := range out.M {
+		for b, v := range apply_mapping(mapping, m) {
+			both[b] = append(both[b], v...)
+		}
+	}
+	sel, err := e.cdn.oip.PrepareSelect(ctx, both)
+	if err != nil {
+		return nil, err
+	}
+
+	checks := make([]*PreparedSelect, keys)
+	for k := range checks {
+		if checks[k], err = e.cdn.oip.PrepareSelect(ctx, vecs); err != nil {
+			return nil, err
+		}
+	}
+
+	return &PreparedAuthDisjunction{
+		PreparedDisjunction: &PreparedDisjunction{
+			mapping: mapping,
+			in_dim:  in_dim,
+			out:     out.V,
+			sel:     sel,
+		},
+		macs:   out.M,
+		checks: checks,
+	}, nil
+}
+
+// obliviously select the permutations of the mask (and their MACs) indicated by the authenticated selector:
+// the MACs of the selector applied to the permutations must agree with the selected MACs
+func (e *AuthCDN) selectAuth(ctx context.Context, sel AuthShares, prep *PreparedAuthDisjunction) (AuthShares, error) {
+	f := e.cdn.oip.field
+	res, err := e.cdn.oip.SelectPrepared(ctx, sel.V, prep.sel)
+	if err != nil {
+		return AuthShares{}, err
+	}
+
+	keys := e.Keys()
+	n := len(res) / (keys + 1)
+	D := AuthShares{V: res[:n], M: make([][]Share, keys)}
+	for k := range D.M {
+		D.M[k] = res[(k+1)*n : (k+2)*n]
+
+		check, err := e.cdn.oip.SelectPrepared(ctx, sel.M[k], prep.checks[k])
+		if err != nil {
+			return AuthShares{}, err
+		}
+		if len(check) != n {
+			panic("Invalid dimensions")
+		}
+		for i := 0; i < n; i++ {
+			e.zeros[k] = append(e.zeros[k], f.sub(D.M[k][i], check[i]))
+		}
+	}
+	return D, nil
+}
+
+// Disjunction on authenticated shares (see CDN.Disjunction), the outputs are authenticated
+func (e *AuthCDN) Disjunction(
+	ctx context.Context,
+	levels []int, // when to multiply and reconstruct block (when to switch level)
+	mapping [][]int, // wire mapping for each branch, i.e mapping[b][i] is the map for gate i in branch b
+	inputs AuthShares, // indexes of all inputs to the branch
+	sel AuthShares, // selectors for each branch (indicator variables)
+	gate_programs [][]bool, // gate programmings, i.e. gate_program[b][i] = True iff. the i'th gate in branch b is a multiplication
+) (AuthShares, error) {
+	prep, err := e.PrepareDisjunction(ctx, mapping, inputs.Len())
+	if err != nil {
+		return AuthShares{}, err
+	}
+	return e.DisjunctionPrepared(ctx, prep, levels, inputs, sel, gate_programs)
+}
+
+// Run a prepared authenticated disjunction (see Disjunction), without keys the disjunction of the CDN engine
+func (e *AuthCDN) DisjunctionPrepared(
+	ctx context.Context,
+	prep *PreparedAuthDisjunction,
+	levels []int,
+	inputs AuthShares,
+	sel AuthShares,
+	gate_programs [][]bool,
+) (AuthShares, error) {
+	f := e.cdn.oip.field
+	keys := e.Keys()
+	if keys == 0 {
+		w, err := e.cdn.DisjunctionPrepared(ctx, prep.PreparedDisjunction, levels, inputs.V, sel.V, gate_programs)
+		return AuthShares{V: w, M: [][]Share{}}, err
+	}
+
+	mapping := prep.mapping
+	branches := len(mapping)
+
+	if branches != len(gate_programs) || branches != sel.Len() {
+		log.Panicln("Number of branches does not match", len(mapping), sel.Len(), len(gate_programs))
+	}
+	if inputs.Len() != prep.in_dim {
+		log.Panicln("Number of inputs does not match", inputs.Len(), prep.in_dim)
+	}
+
+	branch_size := len(mapping[0]) / 2
+
+	// gate programming (1 iff the selected branch has a multiplication in that position)
+	programming := NewAuthShares(branch_size, keys)
+	for j, branch := range gate_programs {
+		for i, g := range branch {
+			if g {
+				programming.V[i] = f.add(programming.V[i], sel.V[j])
+				for k, m := range programming.M {
+					m[i] = f.add(m[i], sel.M[k][j])
+				}
+			}
+		}
+	}
+
+	// authenticated random mask, selected using OIP
+
+	in_dim := inputs.Len()
+	out_dim := branch_size + in_dim
+	out := AuthShares{V: prep.out, M: prep.macs}
+
+	D, err := e.selectAuth(ctx, sel, prep)
+	if err != nil {
+		return AuthShares{}, err
+	}
+
+	// two for every gate: left and right inputs
+	if D.Len() != 2*branch_size {
+		panic("Invalid dimensions")
+	}
+
+	w := NewAuthShares(0, keys)
+	u := make([]FieldElem, 0, out_dim)
+
+	// fill start of u with masked inputs
+	m_inp, err := e.Reconstruct(ctx, e.Add(inputs, out.Slice(0, in_dim)))
+	if err != nil {
+		return AuthShares{}, err
+	}
+	u = append(u, m_inp...)
+
+	// the next selected input: \sum_i sel_i * u_i - D
+	nxt := 0
+	next_masked_input := func(dst *AuthShares, idx int) {
+		var v FieldElem
+		m := make([]FieldElem, keys)
+		for i := 0; i < branches; i++ {
+			ui := u[mapping[i][idx]]
+			v = f.add(v, f.mul(sel.V[i], ui))
+			for k := range m {
+				m[k] = f.add(m[k], f.mul(sel.M[k][i], ui))
+			}
+		}
+		dst.V = append(dst.V, f.sub(v, D.V[nxt]))
+		for k := range m {
+			dst.M[k] = append(dst.M[k], f.sub(m[k], D.M[k][nxt]))
+		}
+		nxt += 1
+	}
+
+	// execute branches in levels
+
+	l, r, p := NewAuthShares(0, keys), NewAuthShares(0, keys), NewAuthShares(0, keys)
+	s := in_dim // start index of level
+	level := 0  // current level
+
+	for g := 0; g < branch_size; g++ {
+		next_masked_input(&l, g*2)
+		next_masked_input(&r, g*2+1)
+		p = p.Append(programming.Slice(g, g+1))
+
+		if g >= levels[level] {
+			log.Println("Execute Level", level)
+
+			gates := p.Len()
+
+			// FIRST LEVEL: compute (l*r)
+			lr, err := e.Mul(ctx, l, r)
+			if err != nil {
+				return AuthShares{}, err
+			}
+
+			// SECOND LEVEL: compute (l*r)*p and (l+r)*(1-p)
+			left := lr.Append(e.Add(l, r))
+			right := p.Append(e.AddConst(e.MulConst(p, f.inv(1)), 1))
+			res, err := e.Mul(ctx, left, right)
+			if err != nil {
+				return AuthShares{}, err
+			}
+
+			// THIRD LEVEL: mask and reconstruct((1-p)*(l+r) + p*(l*r) + out)
+			new_w := e.Add(res.Slice(0, gates), res.Slice(gates, 2*gates))
+			new_u, err := e.Reconstruct(ctx, e.Add(out.Slice(s, s+gates), new_w))
+			if err != nil {
+				return AuthShares{}, err
+			}
+
+			w = w.Append(new_w)
+			u = append(u, new_u...)
+			s += gates
+
+			level += 1
+			l, r, p = NewAuthShares(0, keys), NewAuthShares(0, keys), NewAuthShares(0, keys)
+		}
+	}
+
+	// sanity check: every level was executed
+	if l.Len() != 0 || level != len(levels) {
+		panic("Last level has not been executed")
+	}
+	if w.Len() != branch_size {
+		panic("Insufficient outputs")
+	}
+
+	return w, nil
+}
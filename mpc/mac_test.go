@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"testing"
+
+	"github.com/ldsec/lattigo/v2/bfv"
+)
+
+// run f for every player on an authenticated engine, returns the outputs and errors of every player
+func runAuth(oips []*OIP, f func(p int, e *AuthCDN) ([]FieldElem, error)) ([][]FieldElem, []error) {
+	return runAuthKeys(oips, macKeys(oips[0].Field()), f)
+}
+
+// runAuth with the given number of MAC keys
+func runAuthKeys(oips []*OIP, keys int, f func(p int, e *AuthCDN) ([]FieldElem, error)) ([][]FieldElem, []error) {
+	outs := make([][]FieldElem, len(oips))
+	errs := make([]error, len(oips))
+
+	var wg sync.WaitGroup
+	for p, oip := range oips {
+		wg.Add(1)
+		go func(p int, oip *OIP) {
+			outs[p], errs[p] = f(p, NewAuthCDNKeys(NewCDN(oip), keys))
+			wg.Done()
+		}(p, oip)
+	}
+	wg.Wait()
+	return outs, errs
+}
+
+// random sharings of length values for every player
+func randomShares(players, length int) [][]FieldElem {
+	shares := make([][]FieldElem, players)
+	for p := range shares {
+		shares[p] = random(length)
+	}
+	return shares
+}
+
+func TestAuthKeys(t *testing.T) {
+	if keys := macKeys(NewField(PRIME)); keys != 3 {
+		t.Fatal("Expected 3 MAC keys for", PRIME, "got", keys)
+	}
+	if keys := macKeys(NewField(PRIME_40)); keys != 2 {
+		t.Fatal("Expected 2 MAC keys for", PRIME_40, "got", keys)
+	}
+	if keys := macKeys(NewField(PRIME_60)); keys != 1 {
+		t.Fatal("Expected a single MAC key for", PRIME_60, "got", keys)
+	}
+}
+
+func TestAuthMul(t *testing.T) {
+	oips := setupOIPs(SetupParams(), TopologyStar, 3)
+
+	length := rand.Intn(100) + 1
+	left := randomShares(len(oips), length)
+	right := randomShares(len(oips), length)
+
+	outs, errs := runAuth(oips, func(p int, e *AuthCDN) ([]FieldElem, error) {
+		ctx := context.Background()
+		l, err := e.Authenticate(ctx, left[p])
+		if err != nil {
+			return nil, err
+		}
+		r, err := e.Authenticate(ctx, right[p])
+		if err != nil {
+			return nil, err
+		}
+		m, err := e.Mul(ctx, l, r)
+		if err != nil {
+			return nil, err
+		}
+
+		// 3 * l * r + 5 - r
+		return e.Output(ctx, e.Sub(e.AddConst(e.MulConst(m, 3), 5), r))
+	})
+
+	l, r := reconstruct(left), reconstruct(right)
+	for p := range oips {
+		if errs[p] != nil {
+			t.Fatal("Player", p, "failed:", errs[p])
+		}
+		for i := range l {
+			if outs[p][i] != sub(add(mul(3, mul(l[i], r[i])), 5), r[i]) {
+				t.Fatal("Player", p, "wrong output at", i)
+			}
+		}
+	}
+}
+
+// the disjunction without keys is the disjunction of the CDN engine
+func TestAuthDisjunction(t *testing.T) {
+	for i, topology := range []Topology{TopologyStar, TopologyMesh, TopologyTree, TopologyStar} {
+		oips := setupOIPs(SetupParams(), topology, 3)
+		keys := macKeys(defaultField)
+		if i == 3 {
+			keys = 0
+		}
+
+		// u = x0, x1, g0, g1, g2, g3: two levels of two gates
+		levels := []int{1, 3}
+		mapping := [][]int{
+			{0, 1, 0, 1, 2, 3, 2, 0}, // g0 = x0 * x1, g1 = x0 + x1, g2 = g0 * g1, g3 = g0 + x0
+			{0, 0, 1, 1, 2, 3, 3, 1}, // g0 = x0 + x0, g1 = x1 * x1, g2 = g0 + g1, g3 = g1 * x1
+		}
+		programs := [][]bool{
+			{true, false, true, false},
+			{false, true, false, true},
+		}
+
+		inputs := randomShares(len(oips), 2)
+		x := reconstruct(inputs)
+		branch := rand.Intn(2)
+
+		var expected []FieldElem
+		if branch == 0 {
+			g0, g1 := mul(x[0], x[1]), add(x[0], x[1])
+			expected = []FieldElem{g0, g1, mul(g0, g1), add(g0, x[0])}
+		} else {
+			g0, g1 := add(x[0], x[0]), mul(x[1], x[1])
+			expected = []FieldElem{g0, g1, add(g0, g1), mul(g1, x[1])}
+		}
+
+		outs, errs := runAuthKeys(oips, keys, func(p int, e *AuthCDN) ([]FieldElem, error) {
+			ctx := context.Background()
+			in, err := e.Authenticate(ctx, inputs[p])
+			if err != nil {
+				return nil, err
+			}
+			sel := []Share{e.cdn.Input(0, 0), e.cdn.Input(0, 0)}
+			sel[branch] = e.cdn.Input(1, 0)
+			s, err := e.Authenticate(ctx, sel)
+			if err != nil {
+				return nil, err
+			}
+			w, err := e.Disjunction(ctx, levels, mapping, in, s, programs)
+			if err != nil {
+				return nil, err
+			}
+			if len(w.M) != keys {
+				return nil, errors.New("wrong number of MACs")
+			}
+			return e.Output(ctx, w)
+		})
+
+		for p := range oips {
+			if errs[p] != nil {
+				t.Fatal(topology, "player", p, "failed:", errs[p])
+			}
+			for i, v := range expected {
+				if outs[p][i] != v {
+					t.Fatal(topology, "player", p, "wrong output of gate", i, "in branch", branch)
+				}
+			}
+		}
+	}
+}
+
+// player 1 adds an offset to its share of an opened value: every player aborts
+func TestAuthCheating(t *testing.T) {
+	for _, output := range []bool{true, false} {
+		oips := setupOIPs(SetupParams(), TopologyStar, 3)
+		shares := randomShares(len(oips), 10)
+
+		_, errs := runAuth(oips, func(p int, e *AuthCDN) ([]FieldElem, error) {
+			ctx := context.Background()
+			x, err := e.Authenticate(ctx, shares[p])
+			if err != nil {
+				return nil, err
+			}
+			m, err := e.Mul(ctx, x, x)
+			if err != nil {
+				return nil, err
+			}
+			if p == 1 {
+				m.V[3] = add(m.V[3], 1)
+			}
+			if output {
+				return e.Output(ctx, m)
+			}
+
+			// opened in the middle of the computation, detected by a later check
+			if _, err := e.Reconstruct(ctx, m); err != nil {
+				return nil, err
+			}
+			return e.Output(ctx, x)
+		})
+
+		for p, err := range errs {
+			if err == nil {
+				t.Fatal("Player", p, "released the output")
+			}
+		}
+		var perr *ProtocolError
+		if !errors.Is(errs[0], ErrMACCheck) || !errors.As(errs[0], &perr) || perr.Phase != PhaseCheck {
+			t.Error("Expected failed MAC check, got", errs[0])
+		}
+	}
+}
+
+// Multiply by player o (of a single block), adding c times the aggregated encryption of the left operand to its products
+func multiplyShifted(o *OIP, left, right []FieldElem, c FieldElem) ([]FieldElem, error) {
+	defer o.phase(PhaseMul)()
+
+	cts, rel := o.packEncrypt([][]FieldElem{left})
+	if err := o.aggregateCTS(cts, rel); err != nil {
+		return nil, err
+	}
+
+	res, rel := o.mulCTS(cts, right)
+	eval := o.getEvaluator()
+	shift := bfv.NewCiphertext(o.params, 1)
+	eval.MulScalar(cts[0], uint64(c), shift)
+	eval.Add(res[0], shift, res[0])
+	o.putEvaluator(eval)
+
+	if err := o.aggregateCTS(res, rel); err != nil {
+		return nil, err
+	}
+	shares, err := o.E2S(res)
+	if err != nil {
+		return nil, err
+	}
+	return o.sharesToArray(shares)[:len(left)], nil
+}
+
+// player 1 adds c times the aggregated encryption of the left operand to every product of Mul (without proofs):
+// the value and its MAC are shifted consistently (by c l and c alpha l), the check product only by c l
+func TestAuthCheatingProducts(t *testing.T) {
+	oips := setupOIPs(SetupParams(), TopologyStar, 3)
+	left := randomShares(len(oips), 10)
+	right := randomShares(len(oips), 10)
+
+	_, errs := runAuth(oips, func(p int, e *AuthCDN) ([]FieldElem, error) {
+		ctx := context.Background()
+		l, err := e.Authenticate(ctx, left[p])
+		if err != nil {
+			return nil, err
+		}
+		r, err := e.Authenticate(ctx, right[p])
+		if err != nil {
+			return nil, err
+		}
+
+		mul := func(l, r []Share) ([]Share, error) {
+			return e.cdn.Mul(ctx, l, r)
+		}
+		if p == 1 {
+			mul = func(l, r []Share) ([]Share, error) {
+				return multiplyShifted(e.cdn.oip, l, r, 7)
+			}
+		}
+		m, err := e.mul(l, r, mul)
+		if err != nil {
+			return nil, err
+		}
+		return e.Output(ctx, m)
+	})
+
+	for p, err := range errs {
+		if err == nil {
+			t.Fatal("Player", p, "released the output")
+		}
+	}
+	var perr *ProtocolError
+	if !errors.Is(errs[0], ErrMACCheck) || !errors.As(errs[0], &perr) || perr.Phase != PhaseCheck {
+		t.Error("Expected failed MAC check, got", errs[0])
+	}
+}
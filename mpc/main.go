@@ -1,114 +1,213 @@
 package main
 
 import (
-	"bufio"
+	"context"
+	"crypto/rand"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"math/big"
 	"net"
 	"os"
 	"os/exec"
+	"os/signal"
 	"strconv"
-	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
-const ENV_PLAYER_ADDRESSES = "PLAYER_ADDRESSES"
-
 var MP_SPDZ = true
-var ADDRESSES []*net.TCPAddr
 
-/// load player addresses (only player0 required)
-func init() {
-	var path string
-	for _, e := range os.Environ() {
-		pair := strings.SplitN(e, "=", 2)
-		if pair[0] == ENV_PLAYER_ADDRESSES {
-			path = pair[1]
-		}
+// connection establishment
+var SETUP_TIMEOUT = 60 * time.Second // all players must be connected within the timeout
+var DIAL_BACKOFF = 50 * time.Millisecond
+var DIAL_BACKOFF_MAX = 2 * time.Second
+var ADDRESSES []*net.TCPAddr
+var LISTEN []string // listen address of every player ("": all interfaces)
+var TLS *TLSConfig  // nil: plain TCP
+
+// emulated network conditions of outgoing links (see netem.go)
+var NET_EMULATION = false
+var NET_PROFILE NetProfile
+var NET_PROFILES = map[int]NetProfile{}
+
+// profile of the link to player
+func net_profile(player int) NetProfile {
+	if profile, ok := NET_PROFILES[player]; ok {
+		return profile
 	}
+	return NET_PROFILE
+}
 
-	if path == "" {
-		log.Println("No peer addresses loaded")
-		return
+// emulate the network conditions of the link to player (if enabled)
+func emulate(conn io.ReadWriter, player int) (io.ReadWriter, *Emulated) {
+	if !NET_EMULATION {
+		return conn, nil
 	}
+	em := NewEmulated(conn, net_profile(player))
+	return em, em
+}
 
-	file, err := os.Open(path)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer file.Close()
+// players which never connected before the setup deadline
+type MissingPlayersError struct {
+	Missing []int
+	Err     error // last error observed
+}
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		addr, err := net.ResolveTCPAddr("tcp", scanner.Text())
-		if err != nil {
-			log.Fatal(err)
+func (e *MissingPlayersError) Error() string {
+	return fmt.Sprintf("players %v never connected: %v", e.Missing, e.Err)
+}
+
+func (e *MissingPlayersError) Unwrap() error {
+	return e.Err
+}
+
+// dial player until the deadline, backing off exponentially between attempts
+func dial(player int, deadline time.Time) (*net.TCPConn, error) {
+	backoff := DIAL_BACKOFF
+	for {
+		dialer := net.Dialer{Deadline: deadline}
+		conn, err := dialer.Dial("tcp", ADDRESSES[player].String())
+		if err == nil {
+			return conn.(*net.TCPConn), nil
+		}
+
+		if time.Now().Add(backoff).After(deadline) {
+			return nil, err
+		}
+
+		log.Println("Failed to connect to player", player, "retry in", backoff)
+		time.Sleep(backoff)
+
+		backoff *= 2
+		if backoff > DIAL_BACKOFF_MAX {
+			backoff = DIAL_BACKOFF_MAX
 		}
-		ADDRESSES = append(ADDRESSES, addr)
 	}
 }
 
-func connect(me int, player int) (*Connection, error) {
+func connect(me int, player int, deadline time.Time) (*Connection, error) {
 	if player >= len(ADDRESSES) {
 		log.Fatal("Player addresses not specified", player)
 	}
 
 	// create TCP connection
-	conn, err := net.DialTCP("tcp", nil, ADDRESSES[player])
+	conn, err := dial(player, deadline)
 	if err != nil {
+		return nil, &MissingPlayersError{[]int{player}, err}
+	}
+
+	// handshake must complete before the deadline
+	if err := conn.SetDeadline(deadline); err != nil {
 		return nil, err
 	}
 
-	// wrap in Gob
-	c := NewConnection(conn)
+	// wrap in TLS and Gob
+	var rw io.ReadWriter = conn
+	if TLS != nil {
+		tconn, err := TLS.Client(conn, player)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		rw = tconn
+	}
+	rw, _ = emulate(rw, player)
+
+	c := NewConnection(rw)
 	if err := c.Send(me); err != nil {
+		conn.Close()
 		return nil, err
 	}
-	return c, nil
+	return c, conn.SetDeadline(time.Time{})
 }
 
-func wait_connections(me int, players int) ([]*Connection, error) {
-	conns := make([]*Connection, players)
-
-	log.Println("Waiting for connections")
-
-	// listen on all interfaces
-	addr, err := net.ResolveTCPAddr("tcp", ":"+strconv.Itoa(ADDRESSES[me].Port))
+// listen on the configured interface (default: all interfaces)
+func listen(me int) (*net.TCPListener, error) {
+	listen := ":" + strconv.Itoa(ADDRESSES[me].Port)
+	if me < len(LISTEN) && LISTEN[me] != "" {
+		listen = LISTEN[me]
+	}
+	addr, err := net.ResolveTCPAddr("tcp", listen)
 	if err != nil {
 		return nil, err
 	}
+	return net.ListenTCP("tcp", addr)
+}
+
+// players in [first, last) (except me)
+func span(me int, first int, last int) []int {
+	var players []int
+	for p := first; p < last; p++ {
+		if p != me {
+			players = append(players, p)
+		}
+	}
+	return players
+}
 
-	ls, err := net.ListenTCP("tcp", addr)
-	if err != nil {
-		return nil, err
+// expected players without a connection
+func missing(conns []*Connection, expect []int) []int {
+	var miss []int
+	for _, p := range expect {
+		if conns[p] == nil {
+			miss = append(miss, p)
+		}
 	}
+	return miss
+}
 
-	// accept one connection from each player
-	for p := 0; p < players; p++ {
-		var them int
+func contains(players []int, p int) bool {
+	for _, q := range players {
+		if q == p {
+			return true
+		}
+	}
+	return false
+}
 
-		if p == me {
-			continue
+// accept one connection from every expected player before the deadline,
+// connections which fail the handshake are closed (the player may redial), a later connection of a player replaces the earlier one
+func accept_connections(ls *net.TCPListener, me int, players int, expect []int, deadline time.Time) ([]*Connection, error) {
+	conns := make([]*Connection, players)
+
+	closeAll := func() {
+		for _, c := range conns {
+			if c != nil {
+				c.Close()
+			}
 		}
+	}
+
+	if err := ls.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	for len(missing(conns, expect)) > 0 {
 
 		// accept next connection
 
 		conn, err := ls.AcceptTCP()
 		if err != nil {
-			panic(err)
+			closeAll()
+			return nil, &MissingPlayersError{missing(conns, expect), err}
 		}
-		c := NewConnection(conn)
 
-		// receieve remote identity
-
-		if err := c.Recv(&them); err != nil {
-			return nil, err
+		them, c, err := accept_player(conn, expect, deadline)
+		if err != nil {
+			log.Println("Rejected connection from", conn.RemoteAddr(), ":", err)
+			conn.Close()
+			continue
 		}
 
-		// check for duplicate connection
+		// replace an earlier connection of the player (which redialed)
 
 		if conns[them] != nil {
-			return nil, errors.New("duplicate connection")
+			log.Println("Replace connection from player", them)
+			conns[them].Close()
 		}
 
 		log.Println("Got connection from player", them)
@@ -118,6 +217,168 @@ func wait_connections(me int, players int) ([]*Connection, error) {
 	return conns, nil
 }
 
+// handshake of an accepted connection: returns the identity of the remote player
+func accept_player(conn *net.TCPConn, expect []int, deadline time.Time) (int, *Connection, error) {
+	var them int
+
+	// handshake must complete before the deadline
+
+	if err := conn.SetDeadline(deadline); err != nil {
+		return 0, nil, err
+	}
+
+	// authenticate remote identity using TLS
+
+	var rw io.ReadWriter = conn
+	certified := -1
+	if TLS != nil {
+		tconn, id, err := TLS.Server(conn)
+		if err != nil {
+			return 0, nil, err
+		}
+		rw = tconn
+		certified = id
+	}
+
+	// the link profile is known once the remote identity is
+	rw, em := emulate(rw, -1)
+
+	c := NewConnection(rw)
+
+	// receieve remote identity
+
+	if err := c.Recv(&them); err != nil {
+		return 0, nil, err
+	}
+
+	if TLS != nil && them != certified {
+		return 0, nil, errors.New(
+			"player " + strconv.Itoa(them) + " presented certificate of player " + strconv.Itoa(certified),
+		)
+	}
+
+	if !contains(expect, them) {
+		return 0, nil, errors.New("unexpected connection from player " + strconv.Itoa(them))
+	}
+
+	if em != nil {
+		em.SetProfile(net_profile(them))
+	}
+
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return 0, nil, err
+	}
+
+	return them, c, nil
+}
+
+func wait_connections(me int, players int, deadline time.Time) ([]*Connection, error) {
+	log.Println("Waiting for connections")
+
+	ls, err := listen(me)
+	if err != nil {
+		return nil, err
+	}
+	defer ls.Close()
+
+	return accept_connections(ls, me, players, span(me, 0, players), deadline)
+}
+
+// accept connections from the players in accept, connect to the players in dial (in parallel)
+func connect_peers(me int, players int, accept []int, dial []int, deadline time.Time) ([]*Connection, error) {
+	type accepted struct {
+		conns []*Connection
+		err   error
+	}
+
+	done := make(chan accepted, 1)
+	if len(accept) > 0 {
+		ls, err := listen(me)
+		if err != nil {
+			return nil, err
+		}
+		defer ls.Close()
+
+		go func() {
+			conns, err := accept_connections(ls, me, players, accept, deadline)
+			done <- accepted{conns, err}
+		}()
+	} else {
+		done <- accepted{make([]*Connection, players), nil}
+	}
+
+	dialed := make([]*Connection, players)
+	errs := make([]error, players)
+
+	var wg sync.WaitGroup
+	for _, p := range dial {
+		wg.Add(1)
+		go func(p int) {
+			log.Println("Connect to player", p)
+			dialed[p], errs[p] = connect(me, p, deadline)
+			wg.Done()
+		}(p)
+	}
+	wg.Wait()
+
+	res := <-done
+
+	// report every player which did not connect
+
+	var miss []int
+	var last error
+	for _, p := range dial {
+		if errs[p] != nil {
+			miss = append(miss, p)
+			last = errs[p]
+		}
+	}
+
+	// on failure close the connections which were established
+
+	closeAll := func() {
+		for _, c := range append(dialed, res.conns...) {
+			if c != nil {
+				c.Close()
+			}
+		}
+	}
+
+	if res.err != nil {
+		var merr *MissingPlayersError
+		if !errors.As(res.err, &merr) {
+			closeAll()
+			return nil, res.err
+		}
+		miss = append(miss, merr.Missing...)
+		last = merr.Err
+	}
+
+	if len(miss) > 0 {
+		closeAll()
+		return nil, &MissingPlayersError{miss, last}
+	}
+
+	for _, p := range dial {
+		res.conns[p] = dialed[p]
+	}
+	return res.conns, nil
+}
+
+// full mesh: accept connections from players with a larger index, connect to players with a smaller index
+func connect_mesh(me int, players int, deadline time.Time) ([]*Connection, error) {
+	return connect_peers(me, players, span(me, me+1, players), span(me, 0, me), deadline)
+}
+
+// tree: accept connections from the children, connect to the parent
+func connect_tree(me int, players int, arity int, deadline time.Time) ([]*Connection, error) {
+	var parent []int
+	if me != 0 {
+		parent = []int{treeParent(me, arity)}
+	}
+	return connect_peers(me, players, treeChildren(me, arity, players), parent, deadline)
+}
+
 func apply_mapping(mapping [][]int, inputs []uint64) [][]uint64 {
 
 	out := make([][]uint64, len(mapping))
@@ -134,87 +395,240 @@ func apply_mapping(mapping [][]int, inputs []uint64) [][]uint64 {
 }
 
 func main() {
-	log.Println("Setting up:", os.Args[1:])
+	config_path := flag.String("config", "", "session configuration (YAML or JSON)")
+	player := flag.Int("player", -1, "index of this party")
+	flag.Parse()
 
-	// find number of players
-	parties := func() int {
-		for i := 1; i < len(os.Args); i++ {
-			if os.Args[i] == "-N" || os.Args[i] == "--nparties" {
-				parties, err := strconv.Atoi(os.Args[i+1])
-				if err != nil {
-					panic(err)
-				}
-				return parties
-			}
-		}
-		panic("Parties not specified")
-	}()
+	if *config_path == "" || *player < 0 || flag.NArg() != 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
 
-	if parties > len(ADDRESSES) {
-		log.Fatal("Too few player addresses specified")
+	config, err := LoadConfig(*config_path)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	// find which player
-	me := func() int {
-		for i := 1; i < len(os.Args); i++ {
-			if os.Args[i] == "-p" || os.Args[i] == "--player" {
-				player, err := strconv.Atoi(os.Args[i+1])
-				if err != nil {
-					panic(err)
-				}
-				return player
-			}
+	me := *player
+	if err := config.Apply(me); err != nil {
+		log.Fatal(err)
+	}
+
+	// the backend must match the compiled circuit
+	if config.UseMPSPDZ() != MP_SPDZ {
+		if MP_SPDZ {
+			log.Fatal("config: backend: the circuit was compiled for MP-SPDZ")
 		}
-		panic("Player not specified")
-	}()
+		log.Fatal("config: backend: the circuit was compiled for the cdn backend")
+	}
+
+	parties := len(config.Parties)
+	topology, _ := ParseTopology(config.Topology)
+	aggregator, rotate, _ := config.aggregator()
 
 	log.Println("Player:", me)
 	log.Println("Parties:", parties)
+	log.Println("Topology:", topology)
+	if TLS != nil {
+		log.Println("Using TLS")
+	}
+	if topology == TopologyTree {
+		log.Println("Tree arity:", TREE_ARITY)
+	}
+	if topology == TopologyStar {
+		if rotate {
+			log.Println("Aggregator: rotating")
+		} else {
+			log.Println("Aggregator:", aggregator)
+		}
+	}
+	if config.Proofs {
+		log.Println("Proofs of plaintext knowledge: enabled")
+	}
+	if config.Debug {
+		log.Println("Noise budget check: enabled (reveals the products to every party)")
+	}
+	if config.Threshold > 0 {
+		log.Println("Threshold:", config.Threshold+1, "out of", parties)
+	}
+	log.Println("Session:", config.Session)
+	if config.Select != "" {
+		log.Println("Select strategy:", config.Select)
+	}
+	if config.Disjunction != "" {
+		log.Println("Disjunction strategy:", config.Disjunction)
+	}
 
-	// star topology (everybody connects to player 0)
+	// players may be started in any order, but must all be connected before the deadline
+	deadline := time.Now().Add(SETUP_TIMEOUT)
 
 	var conns []*Connection
 
-	if me == 0 {
+	if topology == TopologyMesh || (topology == TopologyStar && (rotate || config.Threshold > 0)) {
+		// full mesh (everybody connects to everybody)
+		log.Println("Connect to all players")
+		conns, err = connect_mesh(me, parties, deadline)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else if topology == TopologyTree {
+		// tree (everybody connects to its parent)
+		log.Println("Connect to parent and children")
+		conns, err = connect_tree(me, parties, TREE_ARITY, deadline)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else if me == aggregator {
+		// star topology (everybody connects to the aggregator)
 		log.Println("Wait for connections")
-		var err error
-		conns, err = wait_connections(me, parties)
+		conns, err = wait_connections(me, parties, deadline)
 		if err != nil {
-			panic(err)
+			log.Fatal(err)
 		}
 	} else {
-		log.Println("Connect to player 0")
-		conn0, err := connect(me, 0)
+		log.Println("Connect to player", aggregator)
+		conn, err := connect(me, aggregator, deadline)
 		if err != nil {
-			panic(err)
+			log.Fatal(err)
 		}
 		conns = make([]*Connection, parties)
-		conns[0] = conn0
+		conns[aggregator] = conn
+	}
+
+	// setup the OIP of every plaintext modulus: of the prime, or of the CRT moduli (see crt.go)
+	params, err := config.Moduli()
+	if err != nil {
+		log.Fatal(err)
+	}
+	crt := NewCRTOIP(params, me, conns)
+	if config.CRT != nil {
+		log.Println("CRT:", len(params), "plaintext moduli, field modulus of", crt.Modulus().BitLen(), "bits")
+	}
+	if config.Params == PARAMS_AUTO {
+		req := CIRCUIT.Request(parties)
+		log.Println("Parameters: log N =", params[0].LogN(), "log QP =", params[0].LogQP(), "for", req.Branches, "branches,", EstimateNoise(params[0], req.Branches, req.Parties))
+	}
+
+	// account traffic on every link
+	traffic := NewTraffic()
+	for p, conn := range conns {
+		if conn != nil {
+			traffic.Attach(p, conn)
+		}
 	}
 
-	// setup OIP
-	oip := NewOIP(
-		SetupParams(),
-		me,
-		conns,
-	)
+	for i, oip := range crt.oips {
+		oip.topology = topology
+		if topology == TopologyStar {
+			oip.SetAggregator(aggregator, rotate)
+		}
+		if config.Threshold > 0 {
+			oip.SetThreshold(config.Threshold)
+		}
+		if config.EvalKeys != nil {
+			oip.SetEvaluationKeys(config.EvalKeys.Relin, config.EvalKeys.Rotations, config.EvalKeys.InnerSum)
+		}
+		strategy, _ := ParseSelectStrategy(config.Select)
+		oip.SetSelectStrategy(strategy)
+		oip.zk = config.Proofs
+		if config.CRT != nil {
+			oip.SetSession(config.Session + "/crt-" + strconv.Itoa(i))
+		} else {
+			oip.SetSession(config.Session)
+		}
+		oip.log = true
+		oip.traffic = traffic
+	}
+	oip := crt.oips[0]
 
-    oip.log = true
+	var samples []TrafficSample
 
 	// load inputs for party
-	inputs := func() []uint64 {
+	inputs, err := config.ReadInputs(me, crt.Modulus())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if inputs == nil {
+		inputs = make([]*big.Int, 100)
+		for i := range inputs {
+			if me == 1 {
+				inputs[i] = big.NewInt(0)
+			} else if inputs[i], err = rand.Int(rand.Reader, crt.Modulus()); err != nil {
+				log.Fatal(err)
+			}
+		}
 		if me == 1 {
-			inputs := make([]uint64, 100)
-			inputs[3] = 0x1
-			return inputs
+			inputs[3].SetInt64(1)
+		}
+	}
+
+	// interrupting the player aborts the evaluation (and MP-SPDZ)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// reuse the keys of an earlier run, or run the setup and save the keys (a keystore for every modulus)
+	if config.Keystore != nil {
+		path, secret, err := config.KeystoreSecret(me)
+		if err != nil {
+			log.Fatal(err)
+		}
+		reused, err := crt.ResumeKeystore(ctx, path, secret)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for i, r := range reused {
+			if r {
+				log.Println("Reusing keys from", crt.KeystorePath(path, i))
+			} else {
+				log.Println("Saved keys to", crt.KeystorePath(path, i))
+			}
+		}
+	}
+
+	// preprocess Beaver triples, independent of the inputs
+	if config.Triples > 0 {
+		log.Println("Preprocessing", config.Triples, "triples...")
+		start := time.Now()
+		for _, oip := range crt.oips {
+			if err := oip.Preprocess(ctx, config.Triples); err != nil {
+				log.Fatal(err)
+			}
 		}
+		log.Println("Preprocessing took", time.Since(start))
+	}
 
-		return random(100)
-	}()
+	// authenticate the shares of the circuit with enough MAC keys for MAC_SECURITY bits (see mac.go)
+	disjunction, _ := ParseDisjunctionStrategy(config.Disjunction)
+	engines := make([]*AuthCDN, len(crt.oips))
+	for i, oip := range crt.oips {
+		keys := 0
+		if config.MACs {
+			keys = macKeys(oip.Field())
+			log.Println("Authenticating shares with", keys, "MAC keys")
+		}
+		cdn := NewCDN(oip)
+		cdn.SetDisjunctionStrategy(disjunction)
+		engines[i] = NewAuthCDNKeys(cdn, keys)
+	}
+
+	var output []*big.Int
 
 	// we can execute multiple reps with the same setup
 	for reps := 0; reps < 1; reps++ {
 
+		// prepare the selector-independent material of the circuit (see prepare.go)
+		log.Println("Prepare evaluation...")
+		before := traffic.Snapshot()
+		start := time.Now()
+		preps := make([][]*PreparedAuthDisjunction, len(engines))
+		for i, engine := range engines {
+			if preps[i], err = prepare(ctx, me, engine); err != nil {
+				log.Fatal(err)
+			}
+		}
+		prepared := time.Since(start)
+		log.Println("Preparation took", prepared)
+
 		// start MP-SPDZ
 		var mpc *MPC
 		var cmd *exec.Cmd
@@ -222,7 +636,8 @@ func main() {
             log.Println("Wrapping MP-SPDZ")
 			mpc, cmd = func() (*MPC, *exec.Cmd) {
 				// pass arguments to MP-SPDZ command
-				cmd := exec.Command(os.Args[1], os.Args[2:]...)
+				cmd := exec.CommandContext(ctx, config.Backend.Binary, config.BackendArgs(me)...)
+				cmd.Dir = config.Backend.Dir
 
 				// get stdout
 				stdout, err := cmd.StdoutPipe()
@@ -246,16 +661,31 @@ func main() {
 				}
 
 				// wrap in MPC abstraction
-				return NewMPC(stdout, stdin), cmd
+				return NewMPC(stdout, stdin, oip.Field().Prime()), cmd
 			}()
 		}
 
 		// run MPC circuit
 		log.Println("Start evaluation...")
-		output, err := run(me, inputs, mpc, oip)
-		if err != nil {
-			panic(err)
+		online := time.Now()
+		var selecting time.Duration
+		residues := make([][]FieldElem, len(engines))
+		for i, engine := range engines {
+			oip := engine.cdn.oip
+			oip.selecting = 0
+			if residues[i], err = run(ctx, me, crt.residues(i, inputs), mpc, engine, preps[i]); err != nil {
+				log.Fatal(err)
+			}
+			selecting += oip.selecting
 		}
+		output = crt.recombine(residues)
+		log.Println("Evaluation took", time.Since(online), "of which", selecting, "in online selections")
+		samples = append(samples, TrafficSample{
+			Time:    time.Since(start).Seconds(),
+			Prepare: prepared.Seconds(),
+			Select:  selecting.Seconds(),
+			Traffic: traffic.Snapshot().Sub(before),
+		})
 
 		if MP_SPDZ {
             log.Println("Waiting for MP-SPDZ to finish")
@@ -268,4 +698,35 @@ func main() {
 		log.Println("Output:", output)
 	}
 
+	// write output
+	if config.Output != "" {
+		path := config.Expand(config.Output, me)
+		log.Println("Writing output to", path)
+		file, err := os.Create(path)
+		if err != nil {
+			panic(err)
+		}
+		if err := WriteOutput(file, output); err != nil {
+			panic(err)
+		}
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}
+
+	// write traffic measurements
+	if config.Traffic != "" {
+		path := config.Expand(config.Traffic, me)
+		log.Println("Writing traffic to", path)
+		file, err := os.Create(path)
+		if err != nil {
+			panic(err)
+		}
+		if err := WriteTrafficYAML(file, me, samples); err != nil {
+			panic(err)
+		}
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}
 }
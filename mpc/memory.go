@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ldsec/lattigo/v2/bfv"
+	"github.com/ldsec/lattigo/v2/dbfv"
+	"github.com/ldsec/lattigo/v2/drlwe"
+	"github.com/ldsec/lattigo/v2/rlwe"
+)
+
+// In-memory transport for tests: messages are passed through Go channels rather than sockets.
+//
+// MemoryCopy passes a deep copy of every message (no serialization at all),
+// MemoryCheck serializes every message using the binary wire format and decodes it at the receiver,
+// which checks the serialization of every message at a fraction of the cost of a socket.
+
+type MemoryMode int
+
+const (
+	MemoryCopy MemoryMode = iota
+	MemoryCheck
+)
+
+// messages in flight per direction (sends only block once the buffer is full, like a socket)
+const MEMORY_BUFFER = 64
+
+type memLink struct {
+	mode MemoryMode
+	in   <-chan interface{}
+	out  chan<- interface{}
+
+	// closed by either end
+	closed chan struct{}
+	once   *sync.Once
+}
+
+func (l *memLink) close() {
+	l.once.Do(func() { close(l.closed) })
+}
+
+// a message serialized using the binary wire format
+type memFrame []byte
+
+// a message of a type without deep copy, transmitted as a gob stream
+type memGob []byte
+
+func MemoryPair(mode MemoryMode) (*Connection, *Connection) {
+	c12 := make(chan interface{}, MEMORY_BUFFER)
+	c21 := make(chan interface{}, MEMORY_BUFFER)
+	closed := make(chan struct{})
+	once := new(sync.Once)
+	return &Connection{mem: &memLink{mode: mode, in: c21, out: c12, closed: closed, once: once}},
+		&Connection{mem: &memLink{mode: mode, in: c12, out: c21, closed: closed, once: once}}
+}
+
+// like Dummies, using in-memory connections
+func MemoryDummies(topology Topology, players int, mode MemoryMode) [][]*Connection {
+	return dummies(topology, TREE_ARITY, players, func(int, int) (*Connection, *Connection) {
+		return MemoryPair(mode)
+	})
+}
+
+// deep copy of a message
+func memCopy(v interface{}) (interface{}, error) {
+	switch m := v.(type) {
+	case int:
+		return m, nil
+	case []FieldElem:
+		return append([]FieldElem(nil), m...), nil
+	case []byte:
+		return append([]byte(nil), m...), nil
+	case []*bfv.Ciphertext:
+		cts := make([]*bfv.Ciphertext, len(m))
+		for i, ct := range m {
+			cts[i] = ct.CopyNew()
+		}
+		return cts, nil
+	case []*drlwe.CKSShare:
+		shares := make([]*drlwe.CKSShare, len(m))
+		for i, share := range m {
+			shares[i] = &drlwe.CKSShare{Value: share.Value.CopyNew()}
+		}
+		return shares, nil
+	case *drlwe.CKGShare:
+		return &drlwe.CKGShare{Value: m.Value.CopyNew()}, nil
+	case *rlwe.PublicKey:
+		return m.CopyNew(), nil
+	case *zkProof:
+		proof := &zkProof{digest: m.digest, z: make([][]zkPoly, len(m.z))}
+		for r, zr := range m.z {
+			proof.z[r] = make([]zkPoly, len(zr))
+			for i, z := range zr {
+				proof.z[r][i] = zkPoly{lo: append([]uint64(nil), z.lo...), hi: append([]uint64(nil), z.hi...)}
+			}
+		}
+		return proof, nil
+	case *drlwe.RKGShare:
+		share := &drlwe.RKGShare{Value: make([][2]rlwe.PolyQP, len(m.Value))}
+		for i, v := range m.Value {
+			share.Value[i] = [2]rlwe.PolyQP{v[0].CopyNew(), v[1].CopyNew()}
+		}
+		return share, nil
+	case []*drlwe.RTGShare:
+		shares := make([]*drlwe.RTGShare, len(m))
+		for i, share := range m {
+			shares[i] = &drlwe.RTGShare{Value: make([]rlwe.PolyQP, len(share.Value))}
+			for j, v := range share.Value {
+				shares[i].Value[j] = v.CopyNew()
+			}
+		}
+		return shares, nil
+	case []*dbfv.RefreshShare:
+		// the polynomials of a refresh share are private: copy through its binary encoding
+		shares := make([]*dbfv.RefreshShare, len(m))
+		for i, share := range m {
+			data, err := share.MarshalBinary()
+			if err != nil {
+				return nil, err
+			}
+			shares[i] = new(dbfv.RefreshShare)
+			if err := shares[i].UnmarshalBinary(data); err != nil {
+				return nil, err
+			}
+		}
+		return shares, nil
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return memGob(buf.Bytes()), nil
+}
+
+func (c *Connection) sendMemory(v interface{}) error {
+	var msg interface{}
+	var err error
+
+	if c.mem.mode == MemoryCheck {
+		var buf bytes.Buffer
+		enc := &Connection{w: bufio.NewWriter(&buf)}
+		if err = enc.sendBinary(v); err != nil {
+			return err
+		}
+		if s := c.current(); s != nil {
+			atomic.AddUint64(&s.BytesSent, uint64(buf.Len()))
+		}
+		msg = memFrame(buf.Bytes())
+	} else if msg, err = memCopy(v); err != nil {
+		return err
+	}
+
+	select {
+	case c.mem.out <- msg:
+		return nil
+	case <-c.mem.closed:
+		return io.ErrClosedPipe
+	}
+}
+
+func (c *Connection) recvMemory(v interface{}) error {
+	var msg interface{}
+	select {
+	case msg = <-c.mem.in:
+	case <-c.mem.closed:
+		return io.ErrClosedPipe
+	}
+
+	switch m := msg.(type) {
+	case memFrame:
+		if s := c.current(); s != nil {
+			atomic.AddUint64(&s.BytesRecv, uint64(len(m)))
+		}
+		r := bytes.NewReader(m)
+		dec := &Connection{r: bufio.NewReader(r)}
+		if err := dec.recvBinary(v); err != nil {
+			return err
+		}
+		if dec.r.Buffered() != 0 || r.Len() != 0 {
+			return errors.New("remaining unparsed data")
+		}
+		return nil
+	case memGob:
+		if expect := msgType(v); expect != MsgGob {
+			return errors.New("expected " + msgName(expect) + " message, got " + msgName(MsgGob))
+		}
+		return gob.NewDecoder(bytes.NewReader(m)).Decode(v)
+	}
+
+	// check that the peer sent what we expect
+
+	if expect, t := msgType(v), msgType(msg); t != expect {
+		return errors.New("expected " + msgName(expect) + " message, got " + msgName(t))
+	}
+
+	// slices are copied into the existing backing array (like the binary codec)
+
+	switch m := v.(type) {
+	case *int:
+		*m = msg.(int)
+	case *[]FieldElem:
+		*m = append((*m)[:0], msg.([]FieldElem)...)
+	case *[]byte:
+		*m = append((*m)[:0], msg.([]byte)...)
+	case *[]*bfv.Ciphertext:
+		*m = append((*m)[:0], msg.([]*bfv.Ciphertext)...)
+	case *[]*drlwe.CKSShare:
+		*m = append((*m)[:0], msg.([]*drlwe.CKSShare)...)
+	case *drlwe.CKGShare:
+		*m = *msg.(*drlwe.CKGShare)
+	case *rlwe.PublicKey:
+		*m = *msg.(*rlwe.PublicKey)
+	case *zkProof:
+		*m = *msg.(*zkProof)
+	case *drlwe.RKGShare:
+		*m = *msg.(*drlwe.RKGShare)
+	case *[]*drlwe.RTGShare:
+		*m = append((*m)[:0], msg.([]*drlwe.RTGShare)...)
+	case *[]*dbfv.RefreshShare:
+		*m = append((*m)[:0], msg.([]*dbfv.RefreshShare)...)
+	}
+	return nil
+}
@@ -14,14 +14,16 @@ var INPUT_PROMPT = "Please input"
 var OUTPUT_PROMPT = "Output: "
 
 type MPC struct {
-	in  *bufio.Scanner
-	out *bufio.Writer
+	in    *bufio.Scanner
+	out   *bufio.Writer
+	prime FieldElem // field modulus of MP-SPDZ (outputs are signed)
 }
 
-func NewMPC(in io.Reader, out io.Writer) *MPC {
+func NewMPC(in io.Reader, out io.Writer, prime FieldElem) *MPC {
 	return &MPC{
-		in:  bufio.NewScanner(in),
-		out: bufio.NewWriter(out),
+		in:    bufio.NewScanner(in),
+		out:   bufio.NewWriter(out),
+		prime: prime,
 	}
 }
 
@@ -95,7 +97,7 @@ func (m *MPC) Output(size int) ([]uint64, error) {
 					return nil, err
 				}
 				if n < 0 {
-					n += int64(PRIME)
+					n += int64(m.prime)
 				}
 				elems = append(elems, uint64(n))
 			}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// network conditions of one direction of a link
+type NetProfile struct {
+	Latency   time.Duration // one-way latency
+	Jitter    time.Duration // additional uniformly random delay in [0, Jitter)
+	Bandwidth float64       // bytes per second (0 = unlimited)
+}
+
+// parse a profile of the form "latency=10ms,jitter=1ms,bandwidth=125000000"
+func ParseNetProfile(s string) (NetProfile, error) {
+	var profile NetProfile
+	if s == "" {
+		return profile, nil
+	}
+
+	for _, opt := range strings.Split(s, ",") {
+		pair := strings.SplitN(strings.TrimSpace(opt), "=", 2)
+		if len(pair) != 2 {
+			return profile, errors.New("invalid network profile option: " + opt)
+		}
+
+		var err error
+		switch pair[0] {
+		case "latency":
+			profile.Latency, err = time.ParseDuration(pair[1])
+		case "jitter":
+			profile.Jitter, err = time.ParseDuration(pair[1])
+		case "bandwidth":
+			profile.Bandwidth, err = strconv.ParseFloat(pair[1], 64)
+		default:
+			err = errors.New("unknown network profile option: " + pair[0])
+		}
+		if err != nil {
+			return profile, err
+		}
+	}
+
+	if profile.Latency < 0 || profile.Jitter < 0 || profile.Bandwidth < 0 {
+		return profile, errors.New("negative network profile option")
+	}
+
+	return profile, nil
+}
+
+type chunk struct {
+	data []byte
+	at   time.Time // time of arrival at the receiver
+}
+
+// Emulated emulates the network conditions of a profile on the outgoing direction of a connection:
+// writes are paced by the bandwidth and delivered to the underlying connection after the latency (plus jitter).
+// Reads are passed through unchanged, the peer emulates the other direction.
+type Emulated struct {
+	conn    io.ReadWriter
+	profile NetProfile
+	queue   chan chunk
+
+	lock      sync.Mutex
+	departure time.Time // when the last written byte has left the sender
+	arrival   time.Time // arrival of the last chunk (chunks are delivered in order)
+
+	// closed by Close without taking lock: unblocks a writer waiting for room in the queue
+	done      chan struct{}
+	closeOnce sync.Once
+
+	errLock sync.Mutex
+	err     error // delivery error (reported on the next write)
+}
+
+func NewEmulated(conn io.ReadWriter, profile NetProfile) *Emulated {
+	e := &Emulated{
+		conn:    conn,
+		profile: profile,
+		queue:   make(chan chunk, 1024),
+		done:    make(chan struct{}),
+	}
+	go e.deliver()
+	return e
+}
+
+func (e *Emulated) deliver() {
+	for {
+		select {
+		case <-e.done:
+			return
+		case c := <-e.queue:
+			select {
+			case <-e.done:
+				return
+			case <-time.After(time.Until(c.at)):
+			}
+			if _, err := e.conn.Write(c.data); err != nil {
+				e.errLock.Lock()
+				e.err = err
+				e.errLock.Unlock()
+			}
+		}
+	}
+}
+
+// change the profile, applies to subsequent writes
+func (e *Emulated) SetProfile(profile NetProfile) {
+	e.lock.Lock()
+	e.profile = profile
+	e.lock.Unlock()
+}
+
+func (e *Emulated) Read(p []byte) (int, error) {
+	return e.conn.Read(p)
+}
+
+func (e *Emulated) Write(p []byte) (int, error) {
+	e.errLock.Lock()
+	err := e.err
+	e.errLock.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	select {
+	case <-e.done:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+
+	e.lock.Lock()
+
+	// time to put the bytes on the wire
+
+	now := time.Now()
+	if e.departure.Before(now) {
+		e.departure = now
+	}
+	if e.profile.Bandwidth > 0 {
+		e.departure = e.departure.Add(time.Duration(float64(len(p)) / e.profile.Bandwidth * float64(time.Second)))
+	}
+	departure := e.departure
+
+	// time of arrival (never before the previous chunk)
+
+	at := departure.Add(e.profile.Latency)
+	if e.profile.Jitter > 0 {
+		at = at.Add(time.Duration(rand.Int63n(int64(e.profile.Jitter))))
+	}
+	if at.Before(e.arrival) {
+		at = e.arrival
+	}
+	e.arrival = at
+
+	data := make([]byte, len(p))
+	copy(data, p)
+
+	// the chunks are queued in order of arrival (under the lock), a full queue blocks until Close
+	select {
+	case e.queue <- chunk{data: data, at: at}:
+	case <-e.done:
+		e.lock.Unlock()
+		return 0, io.ErrClosedPipe
+	}
+
+	e.lock.Unlock()
+
+	// the sender is blocked while transmitting
+
+	time.Sleep(time.Until(departure))
+	return len(p), nil
+}
+
+// stop delivering and close the underlying connection (if it can be closed)
+func (e *Emulated) Close() error {
+	var err error
+	e.closeOnce.Do(func() {
+		close(e.done)
+		if closer, ok := e.conn.(io.Closer); ok {
+			err = closer.Close()
+		}
+	})
+	return err
+}
+
+// pair of connected dummies, where each direction is emulated using the given profiles
+func EmulatedPair(codec Codec, profile12 NetProfile, profile21 NetProfile) (*Connection, *Connection) {
+	s1, s2 := dummySockets()
+	return NewConnectionCodec(NewEmulated(s1, profile12), codec), NewConnectionCodec(NewEmulated(s2, profile21), codec)
+}
+
+// like Dummies, where profile(from, to) describes the link from player from to player to
+func EmulatedDummies(topology Topology, players int, profile func(from, to int) NetProfile) [][]*Connection {
+	return dummies(topology, TREE_ARITY, players, func(p1, p2 int) (*Connection, *Connection) {
+		return EmulatedPair(CODEC, profile(p1, p2), profile(p2, p1))
+	})
+}
+
+// the same profile on every link
+func UniformProfile(profile NetProfile) func(from, to int) NetProfile {
+	return func(int, int) NetProfile {
+		return profile
+	}
+}
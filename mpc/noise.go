@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+
+	"github.com/ldsec/lattigo/v2/bfv"
+	"github.com/ldsec/lattigo/v2/drlwe"
+	"github.com/ldsec/lattigo/v2/ring"
+	"github.com/ldsec/lattigo/v2/rlwe"
+)
+
+// Noise budget check (debug mode, CDN_DEBUG):
+//
+// before the distributed decryption, the parties key-switch the ciphertexts to the zero key (the debug key):
+// every party publishes a key-switching share h_p = a sk_p + e_p without any mask, so that
+// c_0 + \sum_p h_p = (Q/T) m + noise reveals the plaintext and its noise to every party.
+// Every party measures the remaining noise budget and the run aborts when it falls below NOISE_CHECK_MARGIN bits.
+// This reveals the products to every party: only for debugging.
+
+var ErrNoiseBudget = errors.New("noise budget exhausted")
+
+// bits of noise budget required to be left before decryption (debug mode)
+var NOISE_CHECK_MARGIN = 4.0
+
+// log2 of the largest noise of v = (Q/T) m + noise (coefficient domain), -Inf without noise
+func maxNoise(params bfv.Parameters, v *ring.Poly) float64 {
+	r := params.RingQ()
+	coeffs := make([]*big.Int, r.N)
+	for i := range coeffs {
+		coeffs[i] = new(big.Int)
+	}
+	r.PolyToBigint(v, coeffs)
+
+	// noise = (T v mod Q) / T, centered
+	q, t := r.ModulusBigint, new(big.Int).SetUint64(params.T())
+	half := new(big.Int).Rsh(q, 1)
+	max := new(big.Int)
+	for _, c := range coeffs {
+		c.Mod(c.Mul(c, t), q)
+		if c.Cmp(half) > 0 {
+			c.Sub(q, c)
+		}
+		if c.Quo(c, t).Cmp(max) > 0 {
+			max.Set(c)
+		}
+	}
+	if max.Sign() == 0 {
+		return math.Inf(-1)
+	}
+	return log2Big(max)
+}
+
+// remaining noise budget (in bits) of the ciphertexts, measured jointly by key-switching to the zero key
+func (o *OIP) noiseBudget(cts []*bfv.Ciphertext) (float64, error) {
+	cks := drlwe.NewCKSProtocol(o.params.Parameters, SIGMA)
+	zero := rlwe.NewSecretKey(o.params.Parameters)
+
+	var msg []byte
+	for _, ct := range cts {
+		share := cks.AllocateShare(ct.Level())
+		cks.GenShare(o.sk, zero, ct.Ciphertext, share)
+		data, err := share.MarshalBinary()
+		if err != nil {
+			panic(err)
+		}
+		size := make([]byte, 4)
+		binary.LittleEndian.PutUint32(size, uint32(len(data)))
+		msg = append(append(msg, size...), data...)
+	}
+
+	all, err := o.allGather(msg)
+	if err != nil {
+		return 0, err
+	}
+
+	// c_0 + \sum_p h_p
+	sums := make([]*ring.Poly, len(cts))
+	for i, ct := range cts {
+		sums[i] = ct.Value[0].CopyNew()
+	}
+	for p, data := range all {
+		for _, sum := range sums {
+			share := new(drlwe.CKSShare)
+			if len(data) < 4 || uint64(len(data)-4) < uint64(binary.LittleEndian.Uint32(data)) {
+				return 0, o.peerError(p, errors.New("malformed key-switching shares"))
+			}
+			size := 4 + binary.LittleEndian.Uint32(data)
+			if err := share.UnmarshalBinary(data[4:size]); err != nil || share.Value.Degree() != sum.Degree() || share.Value.Level() != sum.Level() {
+				return 0, o.peerError(p, errors.New("malformed key-switching shares"))
+			}
+			o.params.RingQ().AddLvl(sum.Level(), sum, share.Value, sum)
+			data = data[size:]
+		}
+	}
+
+	noise := math.Inf(-1)
+	for _, sum := range sums {
+		noise = math.Max(noise, maxNoise(o.params, sum))
+	}
+	return log2Big(o.params.RingQ().ModulusBigint) - math.Log2(float64(o.params.T())) - 1 - noise, nil
+}
+
+// abort if the remaining noise budget of the ciphertexts is below NOISE_CHECK_MARGIN bits
+func (o *OIP) checkNoise(cts []*bfv.Ciphertext) error {
+	if o.threshold > 0 {
+		o.Log("Noise budget check is not supported with threshold decryption")
+		return nil
+	}
+	budget, err := o.noiseBudget(cts)
+	if err != nil {
+		return err
+	}
+	o.Log("Noise budget:", fmt.Sprintf("%.1f bits", budget))
+	if budget < NOISE_CHECK_MARGIN {
+		return o.peerError(-1, fmt.Errorf("%w: %.1f bits left, at least %.1f bits required", ErrNoiseBudget, budget, NOISE_CHECK_MARGIN))
+	}
+	return nil
+}
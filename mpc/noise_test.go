@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"testing"
+
+	"github.com/ldsec/lattigo/v2/bfv"
+)
+
+func withDebug(f func()) {
+	CDN_DEBUG = true
+	defer func() {
+		CDN_DEBUG = false
+	}()
+	f()
+}
+
+// multiply random shares on every player, returns the error of every player
+func multiplyAll(oips []*OIP, length int) []error {
+	errs := make([]error, len(oips))
+	var wg sync.WaitGroup
+	for p, oip := range oips {
+		wg.Add(1)
+		go func(p int, oip *OIP) {
+			defer wg.Done()
+			_, errs[p] = oip.Multiply(context.Background(), random(length), random(length))
+		}(p, oip)
+	}
+	wg.Wait()
+	return errs
+}
+
+func TestNoiseBudget(t *testing.T) {
+	withDebug(func() {
+		for _, topology := range []Topology{TopologyStar, TopologyMesh, TopologyTree} {
+			oips := setupOIPs(SetupParams(), topology, 3)
+			testMul(oips, 100, 1)
+			testOIP(oips, 8, 100, 1)
+		}
+	})
+
+	// the jointly measured budget matches the noise measured with the collective secret key
+	oips := setupOIPs(SetupParams(), TopologyStar, 3)
+	res := selection(t, oips, 4)
+	budgets := make([]float64, len(oips))
+	errs := make([]error, len(oips))
+	var wg sync.WaitGroup
+	for p, oip := range oips {
+		wg.Add(1)
+		go func(p int, o *OIP) {
+			defer wg.Done()
+			budgets[p], errs[p] = o.noiseBudget(res[p])
+		}(p, oip)
+	}
+	wg.Wait()
+	for p, err := range errs {
+		if err != nil {
+			t.Fatal("Player", p, "failed:", err)
+		}
+		if budgets[p] != budgets[0] {
+			t.Fatal("Players measured different budgets", budgets)
+		}
+	}
+
+	budget := log2Big(oips[0].params.RingQ().ModulusBigint) - math.Log2(float64(oips[0].Field().Prime())) - 1
+	if noise := decryptNoise(oips, res[0][0]); math.Abs(budgets[0]-(budget-noise)) > 1 {
+		t.Fatal("Measured budget", budgets[0], "but the noise leaves", budget-noise, "bits")
+	}
+}
+
+// parameters too small for a multiplication: the players abort instead of outputting wrong shares
+func TestNoiseBudgetExhausted(t *testing.T) {
+	literal := bfv.ParametersLiteral{LogN: 12, LogQ: []int{35}, LogP: []int{35}}
+	withDebug(func() {
+		for p, err := range multiplyAll(setupOIPs(paramsFor(PRIME, literal), TopologyStar, 3), 100) {
+			if !errors.Is(err, ErrNoiseBudget) {
+				t.Fatal("Player", p, "expected exhausted noise budget, got", err)
+			}
+		}
+	})
+}
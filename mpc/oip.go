@@ -1,19 +1,26 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/ldsec/lattigo/v2/bfv"
 	"github.com/ldsec/lattigo/v2/dbfv"
 	"github.com/ldsec/lattigo/v2/drlwe"
+	"github.com/ldsec/lattigo/v2/ring"
 	"github.com/ldsec/lattigo/v2/rlwe"
 	"github.com/ldsec/lattigo/v2/utils"
 )
 
 var LITERAL bfv.ParametersLiteral = bfv.PN12QP109
 
-var CRS []byte = []byte{'C', 'R', 'S'}
+// standard deviation of the smudging noise added to decryption shares
+var SIGMA float64 = 3.2
 
 func min(a, b int) int {
 	if a < b {
@@ -22,28 +29,91 @@ func min(a, b int) int {
 	return b
 }
 
+// BFV parameters of LITERAL with the default field modulus as plaintext modulus
 func SetupParams() bfv.Parameters {
-	params, err := bfv.NewParametersFromLiteral(LITERAL)
+	return SetupParamsPrime(PRIME)
+}
+
+// BFV parameters of LITERAL with the plaintext modulus t
+func SetupParamsPrime(t FieldElem) bfv.Parameters {
+	literal := LITERAL
+	literal.T = t
+	if err := checkPlaintextModulus(literal); err != nil {
+		panic(err)
+	}
+	params, err := bfv.NewParametersFromLiteral(literal)
 	if err != nil {
 		panic(err)
 	}
 	return params
 }
 
+// the plaintext modulus must be NTT-friendly (T = 1 mod 2N) to pack one field element per slot
+func checkPlaintextModulus(literal bfv.ParametersLiteral) error {
+	if literal.T%(2<<literal.LogN) != 1 {
+		return fmt.Errorf("plaintext modulus %d is not 1 modulo 2N = %d", literal.T, 2<<literal.LogN)
+	}
+	return nil
+}
+
 type OIP struct {
-	me     int // player index
-	n      int // number of parties
-	log    bool
-	params bfv.Parameters //
+	me       int // player index
+	n        int // number of parties
+	log      bool
+	params   bfv.Parameters //
+	field    Field          // arithmetic modulo the plaintext modulus of params
+	topology Topology       // star (everything through player 0), full mesh or tree
+	arity    int            // branching factor of the tree topology
+	traffic  *Traffic       // traffic accounting (optional)
+
+	// aggregation (star topology)
+	aggregator int  // player aggregating ciphertexts, decryption shares and reconstructions
+	rotate     bool // rotate the aggregator round-robin for every aggregation (requires a link to every player)
+	round      int  // number of aggregations so far
+
+	// proofs of plaintext knowledge, verified by the aggregator (see zk.go)
+	zk     bool // attach proofs to the ciphertexts sent during aggregation (star topology)
+	proofs int  // number of proven aggregations so far
+
+	// threshold decryption (see threshold.go)
+	threshold int           // any threshold+1 players can decrypt (0: every player is required)
+	timeout   time.Duration // the aggregator drops players which do not respond within the timeout
+	tsk       *ring.Poly    // Shamir share of the secret key
+	deadLock  sync.Mutex
+	dead      []bool // players dropped by the aggregator
+
+	// evaluation keys generated by the setup (see evalkeys.go)
+	relin  bool                     // generate the relinearization key
+	galEls []uint64                 // generate rotation keys for the Galois elements
+	rlk    *rlwe.RelinearizationKey // joint relinearization key
+	rtks   *rlwe.RotationKeySet     // joint rotation keys
+
+	strategy  SelectStrategy // strategy of Select (see ctselect.go)
+	selecting time.Duration  // time spent in the online phase of prepared selections (see SelectPrepared)
+
+	// collective refresh (see refresh.go)
+	refreshSeed []byte // coin-tossed seed of the common random polynomials of the refreshes
+	refreshes   uint64 // number of refresh rounds so far
+	repacks     uint64 // number of repacking rounds so far (see repack)
+
+	// preprocessed Beaver triples (see triples.go)
+	triples TriplePool
+
+	// aborting (see abort.go)
+	current   int32 // current phase (atomic)
+	abortLock sync.Mutex
+	abortErr  error // cause of the abort (nil if running)
 
 	// key material
 	pk *rlwe.PublicKey // shared public key
 	sk *rlwe.SecretKey // secret key share
 
 	// key generation
-	ckg *dbfv.CKGProtocol // distributed key generation protocol
-	ss  *drlwe.CKGShare   // public key share (aggregated to generate the combined public key)
-	crp drlwe.CKGCRP
+	session []byte            // session identifier, bound to the coin-tossed common reference string
+	seed    []byte            // coin-tossed seed of the common reference string
+	ckg     *dbfv.CKGProtocol // distributed key generation protocol
+	ss      *drlwe.CKGShare   // public key share (aggregated to generate the combined public key)
+	crp     drlwe.CKGCRP
 
 	//
 	encryptor sync.Pool // encryptor
@@ -61,6 +131,7 @@ func NewOIP(params bfv.Parameters, me int, conns []*Connection) *OIP {
 	//
 	return &OIP{
 		params: params,
+		field:  NewField(params.T()),
 		me:     me,
 		encoder: sync.Pool{
 			New: func() interface{} {
@@ -75,32 +146,89 @@ func NewOIP(params bfv.Parameters, me int, conns []*Connection) *OIP {
 				})
 			},
 		},
-		n:     len(conns),
-		conns: conns,
+		n:       len(conns),
+		arity:   TREE_ARITY,
+		timeout: PEER_TIMEOUT,
+		conns:   conns,
+	}
+}
+
+// aggregate at player agg in the star topology, or rotate the aggregator starting at player agg:
+// the aggregator of the ciphertexts (aggregateCTS) and of the decryption shares (E2S) rotates for every call,
+// every other round (key generation, coin tossing, reconstruction, ...) is relayed by player agg
+func (o *OIP) SetAggregator(agg int, rotate bool) {
+	if agg < 0 || agg >= o.n {
+		log.Panicln("Invalid aggregator", agg)
 	}
+
+	// the aggregator must be linked to every player
+	for p, conn := range o.conns {
+		if p != o.me && conn == nil && (rotate || p == agg || o.me == agg) {
+			log.Panicln("No connection to player", p)
+		}
+	}
+
+	o.aggregator = agg
+	o.rotate = rotate
+	o.round = 0
 }
 
-func (o *OIP) P0() *Connection {
-	return o.conns[0]
+// the field of the shares: integers modulo the plaintext modulus
+func (o *OIP) Field() Field {
+	return o.field
 }
 
 func (o *OIP) Pi(i int) *Connection {
 	return o.conns[i]
 }
 
+// account traffic to phase p, returns a function restoring the previous phase
+func (o *OIP) phase(p Phase) func() {
+	prev := Phase(atomic.SwapInt32(&o.current, int32(p)))
+	if o.traffic != nil {
+		o.traffic.SetPhase(p)
+	}
+	return func() {
+		atomic.StoreInt32(&o.current, int32(prev))
+		if o.traffic != nil {
+			o.traffic.SetPhase(prev)
+		}
+	}
+}
+
 func (o *OIP) Log(v ...interface{}) {
 	if o.log {
 		log.Println("OIP Player", o.me, ":", v)
 	}
 }
 
-func (o *OIP) broadcast(v interface{}) error {
-	if o.me != 0 {
-		panic("Only player 0 can broadcast")
+// aggregator of the next aggregation of ciphertexts or decryption shares (rotating, see SetAggregator):
+// every player must call this for the same sequence of aggregations
+func (o *OIP) nextAggregator() int {
+	if !o.rotate {
+		return o.aggregator
+	}
+	agg := (o.aggregator + o.round) % o.n
+	o.round++
+	return agg
+}
+
+func (o *OIP) broadcast(agg int, v interface{}) error {
+	if o.me != agg {
+		panic("Only the aggregator can broadcast")
+	}
+
+	if o.threshold > 0 {
+		return o.gather(agg, func(p int) error {
+			return o.send(p, v)
+		})
 	}
 
-	for p := 1; p < o.n; p++ {
-		if err := o.Pi(p).Send(v); err != nil {
+	for p := 0; p < o.n; p++ {
+		if p == agg {
+			continue
+		}
+		if err := o.send(p, v); err != nil {
 			return err
 		}
 	}
@@ -108,36 +236,71 @@ func (o *OIP) broadcast(v interface{}) error {
 	return nil
 }
 
+// player responsible for aggregating the i'th ciphertext in a mesh
+func (o *OIP) owner(i int) int {
+	return i % o.n
+}
+
+// indexes of the ciphertexts (out of dim) aggregated by player p in a mesh
+func (o *OIP) owned(p int, dim int) []int {
+	idx := make([]int, 0, (dim+o.n-1)/o.n)
+	for i := p; i < dim; i += o.n {
+		idx = append(idx, i)
+	}
+	return idx
+}
+
+// run send(p) and recv(p) concurrently for every other player p,
+// sending and receiving in seperate goroutines avoids deadlocks when both ends send large messages
+func (o *OIP) exchange(send func(p int) error, recv func(p int) error) error {
+	status := make(chan error, 2*o.n)
+	for p := 0; p < o.n; p++ {
+		if p == o.me {
+			continue
+		}
+		go func(p int) { status <- send(p) }(p)
+		go func(p int) { status <- recv(p) }(p)
+	}
+	return o.collect(status, 2*(o.n-1))
+}
+
 func (o *OIP) IsP0() bool {
 	return o.me == 0
 }
 
-func (o *OIP) Send0(v interface{}) error {
-	if o.me == 0 {
-		panic("Player 0 cannot send to self")
+func (o *OIP) SendAgg(agg int, v interface{}) error {
+	if o.me == agg {
+		panic("Aggregator cannot send to self")
 	}
-	return o.P0().Send(v)
+	return o.send(agg, v)
 }
 
-func (o *OIP) Recv0(v interface{}) error {
-	if o.me == 0 {
-		panic("Player 0 cannot receieve from self")
+func (o *OIP) RecvAgg(agg int, v interface{}) error {
+	if o.me == agg {
+		panic("Aggregator cannot receieve from self")
 	}
-	return o.P0().Recv(v)
+	return o.recv(agg, v)
 }
 
-func (o *OIP) CkgIRound1() error {
-	return o.Send0(o.ss)
+func (o *OIP) CkgIRound1(agg int) error {
+	return o.SendAgg(agg, o.ss)
 }
 
-func (o *OIP) Ckg0Round1() error {
+func (o *OIP) CkgAggRound1(agg int) error {
 	// receieve from each player
 	ss := new(drlwe.CKGShare)
-	for i := 1; i < o.n; i++ {
+	for i := 0; i < o.n; i++ {
+		if i == agg {
+			continue
+		}
+
 		// receive share
-		if err := o.Pi(i).Recv(ss); err != nil {
+		if err := o.recv(i, ss); err != nil {
 			return err
 		}
+		if err := checkKeyShare(ss, o.ss); err != nil {
+			return o.peerError(i, err)
+		}
 
 		// aggregate
 		o.ckg.AggregateShares(ss, o.ss, o.ss)
@@ -149,35 +312,30 @@ func (o *OIP) Ckg0Round1() error {
 	o.pk = pk
 
 	// broadcast public key to other players
-	for i := 1; i < o.n; i++ {
-		if err := o.Pi(i).Send(pk); err != nil {
-			return err
-		}
-	}
-	return nil
+	return o.broadcast(agg, pk)
 }
 
-func (o *OIP) CkgIRound2() error {
-	// receieve aggregated public key from player 0
+func (o *OIP) CkgIRound2(agg int) error {
+	// receieve aggregated public key from the aggregator
 	o.Log("Receive aggregated public key")
 	o.pk = bfv.NewPublicKey(o.params)
-	return o.Recv0(o.pk)
+	return o.RecvAgg(agg, o.pk)
 }
 
-func (o *OIP) SetupI() error {
-	if err := o.CkgIRound1(); err != nil {
+func (o *OIP) SetupI(agg int) error {
+	if err := o.CkgIRound1(agg); err != nil {
 		return err
 	}
 
-	if err := o.CkgIRound2(); err != nil {
+	if err := o.CkgIRound2(agg); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func (o *OIP) Setup0() error {
-	if err := o.Ckg0Round1(); err != nil {
+func (o *OIP) SetupAgg(agg int) error {
+	if err := o.CkgAggRound1(agg); err != nil {
 		return err
 	}
 
@@ -188,8 +346,10 @@ func (o *OIP) Setup0() error {
 func (o *OIP) Setup() error {
 	o.Log("Running setup")
 
-	// expand CRS
-	crs, err := utils.NewKeyedPRNG(CRS)
+	defer o.phase(PhaseKeyGen)()
+
+	// coin toss the common reference string of the session
+	seed, err := o.coinToss()
 	if err != nil {
 		return err
 	}
@@ -197,26 +357,61 @@ func (o *OIP) Setup() error {
 	kgen := bfv.NewKeyGenerator(o.params)
 
 	// prepare distributed key generation
-	o.ckg = dbfv.NewCKGProtocol(o.params)
-	o.ss = o.ckg.AllocateShares()
 	o.sk = kgen.GenSecretKey()
-	o.crp = o.ckg.SampleCRP(crs)
+	if err := o.expandCRS(seed); err != nil {
+		return err
+	}
+	o.ss = o.ckg.AllocateShares()
 	o.ckg.GenShare(o.sk, o.crp, o.ss)
 
 	// run protocol
-	if o.IsP0() {
+	if o.topology == TopologyTree {
+		o.Log("Setup in tree")
+		if err := o.setupTree(); err != nil {
+			return err
+		}
+	} else if agg := o.aggregator; o.me == agg {
         o.Log("Setup as aggregator")
-		if err := o.Setup0(); err != nil {
+		if err := o.SetupAgg(agg); err != nil {
 			return err
 		}
 	} else {
         o.Log("Setup as regular player")
-		if err := o.SetupI(); err != nil {
+		if err := o.SetupI(agg); err != nil {
 			return err
 		}
 	}
 
-	// create encryptor pool
+	// Shamir share the secret key
+	if o.threshold > 0 {
+		if err := o.shareSecretKey(); err != nil {
+			return err
+		}
+	}
+
+	// relinearization and rotation keys
+	if err := o.setupEvaluationKeys(); err != nil {
+		return err
+	}
+
+	o.setupEncryptors()
+	return nil
+}
+
+// expand the seed of the common reference string into the common polynomial of the key generation
+func (o *OIP) expandCRS(seed []byte) error {
+	crs, err := utils.NewKeyedPRNG(append([]byte("bmpc crs"), seed...))
+	if err != nil {
+		return err
+	}
+	o.seed = seed
+	o.ckg = dbfv.NewCKGProtocol(o.params)
+	o.crp = o.ckg.SampleCRP(crs)
+	return nil
+}
+
+// create encryptor pool (for the shared public key)
+func (o *OIP) setupEncryptors() {
     o.Log("Setting up encryptors")
 	o.encryptor =
 		sync.Pool{
@@ -224,8 +419,6 @@ func (o *OIP) Setup() error {
                 return bfv.NewEncryptor(o.params, o.pk)
 			},
 		}
-
-	return nil
 }
 
 func (o *OIP) E2S(cts []*bfv.Ciphertext) ([]*rlwe.AdditiveShare, error) {
@@ -233,7 +426,11 @@ func (o *OIP) E2S(cts []*bfv.Ciphertext) ([]*rlwe.AdditiveShare, error) {
 
 	// generate descryption shares
 
-	e2s := dbfv.NewE2SProtocol(o.params, 3.2)
+	e2s := dbfv.NewE2SProtocol(o.params, SIGMA)
+
+	if o.threshold > 0 {
+		return o.e2sThreshold(e2s, cts)
+	}
 
 	publicShares := make([]*drlwe.CKSShare, len(cts))
 	remoteShares := make([]*drlwe.CKSShare, len(cts))
@@ -247,25 +444,41 @@ func (o *OIP) E2S(cts []*bfv.Ciphertext) ([]*rlwe.AdditiveShare, error) {
 
 	// send / aggregate decryption shares
 
-	if o.IsP0() {
-		for p := 1; p < o.n; p++ {
-			if err := o.Pi(p).Recv(&remoteShares); err != nil {
+	if o.topology == TopologyMesh {
+		return o.e2sMesh(e2s, cts, publicShares, secretShares)
+	}
+
+	if o.topology == TopologyTree {
+		return o.e2sTree(e2s, cts, publicShares, secretShares)
+	}
+
+	agg := o.nextAggregator()
+
+	if o.me == agg {
+		for p := 0; p < o.n; p++ {
+			if p == agg {
+				continue
+			}
+			if err := o.recv(p, &remoteShares); err != nil {
 				return nil, err
 			}
+			if err := checkShares(remoteShares, publicShares); err != nil {
+				return nil, o.peerError(p, err)
+			}
 			for i, _ := range cts {
 				e2s.AggregateShares(publicShares[i], remoteShares[i], publicShares[i])
 			}
 		}
 	} else {
-		// send share to player 0
-		if err := o.Send0(publicShares); err != nil {
+		// send share to the aggregator
+		if err := o.SendAgg(agg, publicShares); err != nil {
 			return nil, err
 		}
 	}
 
-	// player 0 generates correction share
+	// the aggregator generates correction share
 
-	if o.IsP0() {
+	if o.me == agg {
 		for i, ct := range cts {
 			e2s.GetShare(secretShares[i], publicShares[i], ct, secretShares[i])
 		}
@@ -274,6 +487,60 @@ func (o *OIP) E2S(cts []*bfv.Ciphertext) ([]*rlwe.AdditiveShare, error) {
 	return secretShares, nil
 }
 
+// every player sends the decryption shares of the ciphertexts owned by another player directly to that player,
+// which aggregates them and generates the correction share: spreads the load of player 0 across all players
+func (o *OIP) e2sMesh(
+	e2s *dbfv.E2SProtocol,
+	cts []*bfv.Ciphertext,
+	publicShares []*drlwe.CKSShare,
+	secretShares []*rlwe.AdditiveShare,
+) ([]*rlwe.AdditiveShare, error) {
+	mine := o.owned(o.me, len(cts))
+	locks := make([]sync.Mutex, len(mine))
+
+	send := func(p int) error {
+		idx := o.owned(p, len(cts))
+		shares := make([]*drlwe.CKSShare, len(idx))
+		for j, i := range idx {
+			shares[j] = publicShares[i]
+		}
+		return o.send(p, shares)
+	}
+
+	recv := func(p int) error {
+		shares := make([]*drlwe.CKSShare, len(mine))
+		ours := make([]*drlwe.CKSShare, len(mine))
+		for j, i := range mine {
+			shares[j] = e2s.AllocateShare(cts[i].Level())
+			ours[j] = publicShares[i]
+		}
+		if err := o.recv(p, &shares); err != nil {
+			return err
+		}
+		if err := checkShares(shares, ours); err != nil {
+			return o.peerError(p, err)
+		}
+		for j, i := range mine {
+			locks[j].Lock()
+			e2s.AggregateShares(publicShares[i], shares[j], publicShares[i])
+			locks[j].Unlock()
+		}
+		return nil
+	}
+
+	if err := o.exchange(send, recv); err != nil {
+		return nil, err
+	}
+
+	// generate correction share for the ciphertexts owned by me
+
+	for _, i := range mine {
+		e2s.GetShare(secretShares[i], publicShares[i], cts[i], secretShares[i])
+	}
+
+	return secretShares, nil
+}
+
 func dup(v FieldElem, len int) []FieldElem {
 	arr := make([]FieldElem, len)
 	for i := 0; i < len; i++ {
@@ -316,11 +583,22 @@ func (o *OIP) putEncryptor(e bfv.Encryptor) {
 	o.encryptor.Put(e)
 }
 
-func (o *OIP) Multiply(left []FieldElem, right []FieldElem) ([]FieldElem, error) {
+// multiply shares of left and right element-wise, aborts if ctx is cancelled (see abort.go)
+func (o *OIP) Multiply(ctx context.Context, left []FieldElem, right []FieldElem) (res []FieldElem, err error) {
+	err = o.run(ctx, func() error {
+		res, err = o.multiply(left, right)
+		return err
+	})
+	return res, err
+}
+
+func (o *OIP) multiply(left []FieldElem, right []FieldElem) ([]FieldElem, error) {
 	if len(left) != len(right) {
 		log.Panicln("Left and right dimension does not match")
 	}
 
+	defer o.phase(PhaseMul)()
+
     o.Log("CDN Batched Multiplication:", len(left), "elements")
 
 	// check if one-time key generation setup required
@@ -349,24 +627,32 @@ func (o *OIP) Multiply(left []FieldElem, right []FieldElem) ([]FieldElem, error)
 		left_blocks[i] = left[s:e]
 	}
 
-	left_cts := o.packEncrypt(left_blocks)
+	left_cts, left_rel := o.packEncrypt(left_blocks)
 
 	// aggregate ciphertexts
 
-	if err := o.aggregateCTS(left_cts); err != nil {
+	if err := o.aggregateCTS(left_cts, left_rel); err != nil {
 		return nil, err
 	}
 
 	// multiply left encryption by right shares
 
-	res_cts := o.mulCTS(left_cts, right)
+	res_cts, res_rel := o.mulCTS(left_cts, right)
 
 	// aggregate result ciphertext
 
-	if err := o.aggregateCTS(res_cts); err != nil {
+	if err := o.aggregateCTS(res_cts, res_rel); err != nil {
 		return nil, err
 	}
 
+	// check the remaining noise budget (debug mode)
+
+	if CDN_DEBUG {
+		if err := o.checkNoise(res_cts); err != nil {
+			return nil, err
+		}
+	}
+
 	// threshold decrypt results to shares
 
 	shares, err := o.E2S(res_cts)
@@ -401,7 +687,8 @@ func (o *OIP) sharesToArray(shares []*rlwe.AdditiveShare) []FieldElem {
 
 // Computes:
 // [out] = [cts] * vec
-func (o *OIP) mulCTS(cts []*bfv.Ciphertext, vec []FieldElem) []*bfv.Ciphertext {
+// returns the relation to prove (nil without proofs)
+func (o *OIP) mulCTS(cts []*bfv.Ciphertext, vec []FieldElem) ([]*bfv.Ciphertext, *zkRelation) {
 
 	var wg sync.WaitGroup
 
@@ -410,6 +697,16 @@ func (o *OIP) mulCTS(cts []*bfv.Ciphertext, vec []FieldElem) []*bfv.Ciphertext {
 
 	res := make([]*bfv.Ciphertext, blocks)
 
+	var rel *zkRelation
+	if o.zk {
+		terms := make([][]int, blocks)
+		for b := range terms {
+			terms[b] = []int{b}
+		}
+		rel = o.productRelation(cts, terms)
+		rel.witness = make([]zkPoly, blocks)
+	}
+
 	for b := 0; b < blocks; b++ {
 		wg.Add(1)
 
@@ -424,30 +721,60 @@ func (o *OIP) mulCTS(cts []*bfv.Ciphertext, vec []FieldElem) []*bfv.Ciphertext {
 			eval := o.getEvaluator()
 
 			// encode and multiply (slow)
-			enco.EncodeUintMul(vec[s:e], p)
+			var witness *zkPoly
+			if rel != nil {
+				witness = &rel.witness[b]
+			}
+			o.encodeMul(enco, vec[s:e], p, witness)
 			eval.Mul(cts[b], p, t)
 
 			// return resources to pool
 			o.putEncoder(enco)
 			o.putEvaluator(eval)
-			wg.Done()
 
 			res[b] = t
+			wg.Done()
 		}(b)
 	}
 
 	wg.Wait()
 
-	return res
+	return res, rel
+}
+
+// encode vec for multiplication, keeping the plaintext as a witness (if not nil)
+func (o *OIP) encodeMul(enco bfv.Encoder, vec []FieldElem, p *bfv.PlaintextMul, witness *zkPoly) {
+	if witness == nil {
+		enco.EncodeUintMul(vec, p)
+		return
+	}
+	pt := bfv.NewPlaintextRingT(o.params)
+	enco.EncodeUintRingT(vec, pt)
+	enco.RingTToMul(pt, p)
+	*witness = zkPolyUint(pt.Value.Coeffs[0])
 }
 
 // Computes:
 // [out] = \sum_j [cts_j] * vec_j
-func (o *OIP) tensorCTS(blocks int, cts []*bfv.Ciphertext, vecs [][]FieldElem) []*bfv.Ciphertext {
+// returns the relation to prove (nil without proofs)
+func (o *OIP) tensorCTS(blocks int, cts []*bfv.Ciphertext, vecs [][]FieldElem) ([]*bfv.Ciphertext, *zkRelation) {
 	if len(cts) != len(vecs) {
 		log.Panicln("Dimensions does not match")
 	}
 
+	var rel *zkRelation
+	if o.zk {
+		terms := make([][]int, blocks)
+		for b := range terms {
+			terms[b] = make([]int, len(cts))
+			for i := range cts {
+				terms[b][i] = i
+			}
+		}
+		rel = o.productRelation(cts, terms)
+		rel.witness = make([]zkPoly, blocks*len(cts))
+	}
+
 	o.Log("Generate share of inner product")
 
 	acc := make([]*bfv.Ciphertext, blocks)
@@ -484,7 +811,11 @@ func (o *OIP) tensorCTS(blocks int, cts []*bfv.Ciphertext, vecs [][]FieldElem) [
 					eval := o.getEvaluator()
 
 					// encode and multiply (slow)
-					enco.EncodeUintMul(vec[s:e], p)
+					var witness *zkPoly
+					if rel != nil {
+						witness = &rel.witness[b*len(cts)+i]
+					}
+					o.encodeMul(enco, vec[s:e], p, witness)
 					eval.Mul(cts[i], p, t)
 
 					// take lock and add (fast)
@@ -510,70 +841,373 @@ func (o *OIP) tensorCTS(blocks int, cts []*bfv.Ciphertext, vecs [][]FieldElem) [
 
 	wg1.Wait()
 
-	return acc
+	return acc, rel
+}
+
+// Computes:
+// [out] = \sum_j [cts_j] * pts_j
+// for the encoded blocks pts[b][j] of every vector (see encodeBranches),
+// returns the relation to prove (nil without proofs)
+func (o *OIP) tensorEncoded(cts []*bfv.Ciphertext, pts [][]*bfv.PlaintextMul, witness [][]zkPoly) ([]*bfv.Ciphertext, *zkRelation) {
+	blocks := len(pts)
+
+	var rel *zkRelation
+	if o.zk {
+		terms := make([][]int, blocks)
+		for b := range terms {
+			terms[b] = make([]int, len(cts))
+			for i := range cts {
+				terms[b][i] = i
+			}
+		}
+		rel = o.productRelation(cts, terms)
+		rel.witness = make([]zkPoly, 0, blocks*len(cts))
+		for b := range witness {
+			rel.witness = append(rel.witness, witness[b]...)
+		}
+	}
+
+	o.Log("Generate share of inner product")
+
+	acc := make([]*bfv.Ciphertext, blocks)
+
+	// execute every block in parallel (good for large branches)
+
+	var wg1 sync.WaitGroup
+
+	for b := 0; b < blocks; b++ {
+
+		wg1.Add(1)
+
+		go func(b int) {
+
+			// execute every branch in each block in parallel (good for many branches)
+
+			var wg2 sync.WaitGroup
+			var lock sync.Mutex
+
+			sum := bfv.NewCiphertext(o.params, 1)
+
+			for i, p := range pts[b] {
+				wg2.Add(1)
+
+				go func(i int, p *bfv.PlaintextMul) {
+					t := bfv.NewCiphertext(o.params, 1)
+
+					// obtain an evaluator
+					eval := o.getEvaluator()
+
+					// multiply (slow)
+					eval.Mul(cts[i], p, t)
+
+					// take lock and add (fast)
+					lock.Lock()
+					eval.Add(t, sum, sum)
+					lock.Unlock()
+
+					// return resources to pool
+					o.putEvaluator(eval)
+					wg2.Done()
+				}(i, p)
+			}
+
+			// save accumulated block
+
+			acc[b] = sum
+
+			wg2.Wait()
+			wg1.Done()
+		}(b)
+	}
+
+	wg1.Wait()
+
+	return acc, rel
 }
 
-func (o *OIP) aggregateCTS(cts []*bfv.Ciphertext) error {
+// aggregate cts, proving knowledge of the witness of rel (nil: no proofs)
+func (o *OIP) aggregateCTS(cts []*bfv.Ciphertext, rel *zkRelation) error {
 
-	if o.IsP0() {
+	if rel != nil {
+		if o.topology != TopologyStar {
+			log.Panicln("Proofs require the star topology")
+		}
+		o.proofs++
+	}
 
-		dim := len(cts)
+	if o.topology == TopologyMesh {
+		return o.aggregateCTSMesh(cts)
+	}
+
+	if o.topology == TopologyTree {
+		return o.aggregateCTSTree(cts)
+	}
+
+	agg := o.nextAggregator()
+
+	if o.me == agg {
 
 		o.Log("Acting as ciphertext aggregator")
 
-		locks := make([]sync.Mutex, len(cts))
-		status := make(chan error, o.n)
-
-		for p := 1; p < o.n; p++ {
-			go func(p int) {
-				// allocate ciphertext
-				ctp := make([]*bfv.Ciphertext, dim)
-				for i := 0; i < dim; i++ {
-					ctp[i] = bfv.NewCiphertext(o.params, 1)
-				}
-
-				// receieve from player
-				if err := o.Pi(p).Recv(&ctp); err != nil {
-					status <- err
-					return
-				}
-
-				// add to accumulator
-				evl := o.getEvaluator()
-				for i := 0; i < dim; i++ {
-					locks[i].Lock()
-					evl.Add(ctp[i], cts[i], cts[i])
-					locks[i].Unlock()
-				}
-				o.putEvaluator(evl)
-
-				status <- nil
-			}(p)
-		}
-
-		if err := collect_errors(status, o.n-1); err != nil {
+		if err := o.gatherCTS(agg, cts, rel); err != nil {
 			return err
 		}
 
 		o.Log("Broadcast aggregated encryptions to everyone else")
 
-		return o.broadcast(cts)
+		return o.broadcast(agg, cts)
 
 	} else {
 
-		o.Log("Send shares to player 0")
+		if err := o.sendCTS(agg, cts, rel); err != nil {
+			return err
+		}
 
-		if err := o.Send0(cts); err != nil {
+		o.Log("Receieve aggregated encryption from player", agg)
+
+		return o.recvCTS(agg, cts)
+	}
+}
+
+// receive the aggregated ciphertexts from player p into cts
+func (o *OIP) recvCTS(p int, cts []*bfv.Ciphertext) error {
+	ctp := make([]*bfv.Ciphertext, len(cts))
+	for i := range ctp {
+		ctp[i] = bfv.NewCiphertext(o.params, 1)
+	}
+	if err := o.recv(p, &ctp); err != nil {
+		return err
+	}
+	if err := checkShapes(ctp, cts); err != nil {
+		return o.peerError(p, err)
+	}
+	copy(cts, ctp)
+	return nil
+}
+
+// the ciphertexts of a peer must have the shape of ours (degree, ring degree and level) to be added to them
+func checkShapes(cts, ours []*bfv.Ciphertext) error {
+	if len(cts) != len(ours) {
+		return errors.New("ciphertexts have wrong length")
+	}
+	for i, ct := range cts {
+		if err := checkShape(ct, ours[i]); err != nil {
 			return err
 		}
+	}
+	return nil
+}
+
+func checkShape(ct, ours *bfv.Ciphertext) error {
+	if ct == nil || ct.Ciphertext == nil || ct.Degree() != ours.Degree() {
+		return errors.New("ciphertext has wrong degree")
+	}
+	for _, pol := range ct.Value {
+		if err := checkPoly(pol, ours.Value[0]); err != nil {
+			return errors.New("ciphertext has wrong dimensions")
+		}
+	}
+	return nil
+}
+
+// the decryption shares of a peer must have the shape of ours to be aggregated with them
+func checkShares(shares, ours []*drlwe.CKSShare) error {
+	if len(shares) != len(ours) {
+		return errors.New("decryption shares have wrong length")
+	}
+	for i, share := range shares {
+		if share == nil || checkPoly(share.Value, ours[i].Value) != nil {
+			return errors.New("decryption share has wrong dimensions")
+		}
+	}
+	return nil
+}
 
-		o.Log("Receieve aggregated encryption from player 0")
+// the public key share of a peer must have the shape of ours to be aggregated with it
+func checkKeyShare(ss, ours *drlwe.CKGShare) error {
+	if ss == nil || checkPoly(ss.Value.Q, ours.Value.Q) != nil || checkPoly(ss.Value.P, ours.Value.P) != nil {
+		return errors.New("public key share has wrong dimensions")
+	}
+	return nil
+}
 
-		return o.Recv0(&cts)
+// both polynomials of pol must have the shape of those of ours
+func checkPolyQP(pol, ours rlwe.PolyQP) error {
+	if err := checkPoly(pol.Q, ours.Q); err != nil {
+		return err
 	}
+	if ours.P == nil {
+		if pol.P != nil {
+			return errors.New("polynomial has wrong level")
+		}
+		return nil
+	}
+	return checkPoly(pol.P, ours.P)
 }
 
-func (o *OIP) packEncrypt(packs [][]FieldElem) []*bfv.Ciphertext {
+// pol must have the level and ring degree of ours
+func checkPoly(pol, ours *ring.Poly) error {
+	if pol == nil || pol.Level() != ours.Level() {
+		return errors.New("polynomial has wrong level")
+	}
+	for _, coeffs := range pol.Coeffs {
+		if len(coeffs) != ours.Degree() {
+			return errors.New("polynomial has wrong ring degree")
+		}
+	}
+	return nil
+}
+
+// receive the ciphertexts of every other player and add them to cts (as the aggregator agg),
+// verifying the proofs of knowledge of the witness of rel (nil: no proofs)
+func (o *OIP) gatherCTS(agg int, cts []*bfv.Ciphertext, rel *zkRelation) error {
+
+	dim := len(cts)
+
+	locks := make([]sync.Mutex, len(cts))
+
+	return o.gather(agg, func(p int) error {
+		// allocate ciphertext
+		ctp := make([]*bfv.Ciphertext, dim)
+		for i := 0; i < dim; i++ {
+			ctp[i] = bfv.NewCiphertext(o.params, 1)
+		}
+
+		// receieve from player
+		if err := o.recv(p, &ctp); err != nil {
+			return err
+		}
+		if err := checkShapes(ctp, cts); err != nil {
+			return o.peerError(p, err)
+		}
+
+		// check the proof before aggregating
+		if rel != nil {
+			if err := o.verifyFrom(p, rel, ctp); err != nil {
+				return err
+			}
+		}
+
+		// add to accumulator
+		evl := o.getEvaluator()
+		for i := 0; i < dim; i++ {
+			locks[i].Lock()
+			evl.Add(ctp[i], cts[i], cts[i])
+			locks[i].Unlock()
+		}
+		o.putEvaluator(evl)
+
+		return nil
+	})
+}
+
+// send cts to the aggregator agg, proving knowledge of the witness of rel (nil: no proofs)
+func (o *OIP) sendCTS(agg int, cts []*bfv.Ciphertext, rel *zkRelation) error {
+
+	o.Log("Send shares to player", agg)
+
+	if err := o.SendAgg(agg, cts); err != nil {
+		return err
+	}
+
+	if rel != nil {
+		o.Log("Prove plaintext knowledge to player", agg)
+		if err := o.proveTo(agg, rel, cts); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Aggregate over direct links (reduce-scatter followed by all-gather):
+// every player sums the ciphertexts it owns and sends the sums to every other player
+func (o *OIP) aggregateCTSMesh(cts []*bfv.Ciphertext) error {
+
+	dim := len(cts)
+	mine := o.owned(o.me, dim)
+	locks := make([]sync.Mutex, len(mine))
+
+	o.Log("Aggregate", len(mine), "of", dim, "ciphertexts")
+
+	sums := make([]*bfv.Ciphertext, len(mine))
+	for j, i := range mine {
+		sums[j] = cts[i]
+	}
+
+	// send every player the ciphertexts it owns, receive the ciphertexts owned by me
+
+	err := o.exchange(
+		func(p int) error {
+			idx := o.owned(p, dim)
+			ctp := make([]*bfv.Ciphertext, len(idx))
+			for j, i := range idx {
+				ctp[j] = cts[i]
+			}
+			return o.send(p, ctp)
+		},
+		func(p int) error {
+			ctp := make([]*bfv.Ciphertext, len(mine))
+			for j := range ctp {
+				ctp[j] = bfv.NewCiphertext(o.params, 1)
+			}
+			if err := o.recv(p, &ctp); err != nil {
+				return err
+			}
+			if err := checkShapes(ctp, sums); err != nil {
+				return o.peerError(p, err)
+			}
+
+			evl := o.getEvaluator()
+			for j, i := range mine {
+				locks[j].Lock()
+				evl.Add(ctp[j], cts[i], cts[i])
+				locks[j].Unlock()
+			}
+			o.putEvaluator(evl)
+			return nil
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	o.Log("Broadcast aggregated encryptions owned by me")
+
+	// send the sums owned by me to every player, receieve the sums owned by every other player
+
+	return o.exchange(
+		func(p int) error {
+			return o.send(p, sums)
+		},
+		func(p int) error {
+			idx := o.owned(p, dim)
+			ctp := make([]*bfv.Ciphertext, len(idx))
+			ours := make([]*bfv.Ciphertext, len(idx))
+			for j, i := range idx {
+				ctp[j] = bfv.NewCiphertext(o.params, 1)
+				ours[j] = cts[i]
+			}
+			if err := o.recv(p, &ctp); err != nil {
+				return err
+			}
+			if err := checkShapes(ctp, ours); err != nil {
+				return o.peerError(p, err)
+			}
+			for j, i := range idx {
+				cts[i] = ctp[j]
+			}
+			return nil
+		},
+	)
+}
+
+// encrypt every pack, returns the relation to prove (nil without proofs)
+func (o *OIP) packEncrypt(packs [][]FieldElem) ([]*bfv.Ciphertext, *zkRelation) {
+
+	if o.zk {
+		return o.encryptWitness(packs)
+	}
 
 	var wg sync.WaitGroup
 
@@ -602,10 +1236,19 @@ func (o *OIP) packEncrypt(packs [][]FieldElem) []*bfv.Ciphertext {
 
 	wg.Wait()
 
-	return cts
+	return cts, nil
+}
+
+// compute shares of the sum of branches weighted by sel, aborts if ctx is cancelled (see abort.go)
+func (o *OIP) Select(ctx context.Context, sel []FieldElem, branches [][]FieldElem) (res []FieldElem, err error) {
+	err = o.run(ctx, func() error {
+		res, err = o.selectBranches(sel, branches)
+		return err
+	})
+	return res, err
 }
 
-func (o *OIP) Select(sel []FieldElem, branches [][]FieldElem) ([]FieldElem, error) {
+func (o *OIP) selectBranches(sel []FieldElem, branches [][]FieldElem) ([]FieldElem, error) {
 	if len(sel) != len(branches) {
 		log.Panicln("Dimensions does not match")
 	}
@@ -620,6 +1263,10 @@ func (o *OIP) Select(sel []FieldElem, branches [][]FieldElem) ([]FieldElem, erro
         o.Log("Use previous setup")
     }
 
+	if o.strategy == SelectCiphertext {
+		return o.selectCiphertexts(sel, branches)
+	}
+
 	// maximum length of any vector in v
 	max_len := 0
 	for i := 0; i < len(branches); i++ {
@@ -643,11 +1290,25 @@ func (o *OIP) Select(sel []FieldElem, branches [][]FieldElem) ([]FieldElem, erro
 		sel_blocks[i] = dup(s, block_size)
 	}
 
-	cts_sel := o.packEncrypt(sel_blocks)
+	cts_sel, sel_rel := o.packEncrypt(sel_blocks)
+
+	return o.selectEncrypted(cts_sel, sel_rel, max_len, func(cts_sel []*bfv.Ciphertext) ([]*bfv.Ciphertext, *zkRelation) {
+		return o.tensorCTS(blocks, cts_sel, branches)
+	})
+}
+
+// aggregate the encrypted selector shares, evaluate the tensor on the aggregated selectors
+// and decrypt the first length elements of the result
+func (o *OIP) selectEncrypted(
+	cts_sel []*bfv.Ciphertext,
+	sel_rel *zkRelation,
+	length int,
+	tensor func(cts_sel []*bfv.Ciphertext) ([]*bfv.Ciphertext, *zkRelation),
+) ([]FieldElem, error) {
 
-	// send selector shares to player 0 and aggregate
+	// send selector shares to the aggregator and aggregate
 
-	if err := o.aggregateCTS(cts_sel); err != nil {
+	if err := o.aggregatePhase(PhaseSelectorAggregation, cts_sel, sel_rel); err != nil {
 		return nil, err
 	}
 
@@ -655,22 +1316,41 @@ func (o *OIP) Select(sel []FieldElem, branches [][]FieldElem) ([]FieldElem, erro
 
 	o.Log("Generate share of inner product")
 
-	cts_res := o.tensorCTS(blocks, cts_sel, branches)
+	cts_res, res_rel := tensor(cts_sel)
 
 	// aggregate the shares of the inner product
 
-	if err := o.aggregateCTS(cts_res); err != nil {
+	if err := o.aggregatePhase(PhaseTensorAggregation, cts_res, res_rel); err != nil {
 		return nil, err
 	}
 
 	// run distributed decryption
 
-	shares, err := o.E2S(cts_res)
+	return o.decrypt(cts_res, length)
+}
+
+// aggregateCTS with the traffic accounted to phase p
+func (o *OIP) aggregatePhase(p Phase, cts []*bfv.Ciphertext, rel *zkRelation) error {
+	defer o.phase(p)()
+	return o.aggregateCTS(cts, rel)
+}
+
+// decrypt cts to shares of their first length elements (checking the noise budget in debug mode)
+func (o *OIP) decrypt(cts []*bfv.Ciphertext, length int) ([]FieldElem, error) {
+	defer o.phase(PhaseE2S)()
+
+	if CDN_DEBUG {
+		if err := o.checkNoise(cts); err != nil {
+			return nil, err
+		}
+	}
+
+	shares, err := o.E2S(cts)
 	if err != nil {
 		return nil, err
 	}
 
 	// convert shares back to array
 
-	return o.sharesToArray(shares)[:max_len], nil
+	return o.sharesToArray(shares)[:length], nil
 }
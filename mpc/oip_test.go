@@ -1,13 +1,25 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"math/rand"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
+	"time"
+
+	"github.com/ldsec/lattigo/v2/bfv"
 )
 
 func reconstruct(shares [][]FieldElem) []FieldElem {
+	return reconstructIn(defaultField, shares)
+}
+
+// reconstruct in the field f
+func reconstructIn(f Field, shares [][]FieldElem) []FieldElem {
 	size := len(shares[0])
 	res := make([]FieldElem, size)
 	for _, s := range shares {
@@ -15,13 +27,13 @@ func reconstruct(shares [][]FieldElem) []FieldElem {
 			panic("Invalid number of shares")
 		}
 		for i := 0; i < len(s); i++ {
-			res[i] = add(res[i], s[i])
+			res[i] = f.add(res[i], s[i])
 		}
 	}
 	return res
 }
 
-func reconstruct_branches(shares [][][]FieldElem) [][]FieldElem {
+func reconstruct_branches(f Field, shares [][][]FieldElem) [][]FieldElem {
 	players := len(shares)
 	branches := len(shares[0])
 
@@ -32,34 +44,49 @@ func reconstruct_branches(shares [][][]FieldElem) [][]FieldElem {
 		for p := range shares {
 			s[p] = shares[p][b]
 		}
-		output[b] = reconstruct(s)
+		output[b] = reconstructIn(f, s)
 	}
 
 	return output
 }
 
-func testMuln(length, players, repetitions int) {
+// players connected using in-memory connections
+func setupOIPs(params bfv.Parameters, topology Topology, players int) []*OIP {
+	return setupOIPsConns(params, topology, MemoryDummies(topology, players, MemoryCopy))
+}
+
+func setupOIPsConns(params bfv.Parameters, topology Topology, conns [][]*Connection) []*OIP {
+	var oips []*OIP
+	for p, c := range conns {
+		oip := NewOIP(params, p, c)
+		oip.topology = topology
+		oips = append(oips, oip)
+	}
+	return oips
+}
+
+func testMuln(topology Topology, length, players, repetitions int) {
+	testMul(setupOIPs(SetupParams(), topology, players), length, repetitions)
+}
+
+func testMul(oips []*OIP, length, repetitions int) {
+
+	players := len(oips)
+	f := oips[0].Field()
 
 	left := make([][]FieldElem, players)
 	right := make([][]FieldElem, players)
 
 	for p := 0; p < players; p++ {
-		left[p] = random(length)
-		right[p] = random(length)
+		left[p] = f.random(length)
+		right[p] = f.random(length)
 	}
 
-	out_l := reconstruct(left)
-	out_r := reconstruct(right)
+	out_l := reconstructIn(f, left)
+	out_r := reconstructIn(f, right)
 	out_m := make([]FieldElem, len(out_l))
 	for i := 0; i < len(out_m); i++ {
-		out_m[i] = mul(out_l[i], out_r[i])
-	}
-
-	params := SetupParams()
-
-	var oips []*OIP
-	for p, c := range StarDummies(players) {
-		oips = append(oips, NewOIP(params, p, c))
+		out_m[i] = f.mul(out_l[i], out_r[i])
 	}
 
 	res_shares := make([][]FieldElem, players)
@@ -79,7 +106,7 @@ func testMuln(length, players, repetitions int) {
 
 			go func(p int, oip *OIP) {
 				// oip.log = true
-				res, err := oip.Multiply(left[p], right[p])
+				res, err := oip.Multiply(context.Background(), left[p], right[p])
 
 				res_shares[p] = res
 
@@ -96,7 +123,7 @@ func testMuln(length, players, repetitions int) {
 
 	fmt.Println("Check output")
 
-	res := reconstruct(res_shares)
+	res := reconstructIn(f, res_shares)
 
 	if len(res) != len(out_m) {
 		panic("Wrong size")
@@ -110,44 +137,45 @@ func testMuln(length, players, repetitions int) {
 
 }
 
-func testOIPn(branches, length, players, repetitions int) {
+func testOIPn(topology Topology, branches, length, players, repetitions int) {
+
+	fmt.Println("Branches", branches, "Length", length, "Players", players, "Topology", topology)
+
+	testOIP(setupOIPs(SetupParams(), topology, players), branches, length, repetitions)
+}
+
+func testOIP(oips []*OIP, branches, length, repetitions int) {
 
-	fmt.Println("Branches", branches, "Length", length, "Players", players)
+	players := len(oips)
+	f := oips[0].Field()
 
 	s := make([][]FieldElem, players)
 	v := make([][][]FieldElem, players)
 
 	for p := 0; p < players; p++ {
-		s[p] = random(branches)
+		s[p] = f.random(branches)
 	}
 
 	for p := 0; p < players; p++ {
 		v[p] = make([][]FieldElem, branches)
 		for b := 0; b < branches; b++ {
-			v[p][b] = random(length)
+			v[p][b] = f.random(length)
 		}
 	}
 
 	// reconstruct
 
-	sel := reconstruct(s)
-	bra := reconstruct_branches(v)
+	sel := reconstructIn(f, s)
+	bra := reconstruct_branches(f, v)
 
 	correct := make([]FieldElem, length)
 
 	for b := 0; b < branches; b++ {
 		for i := 0; i < length; i++ {
-			correct[i] = add(correct[i], mul(sel[b], bra[b][i]))
+			correct[i] = f.add(correct[i], f.mul(sel[b], bra[b][i]))
 		}
 	}
 
-	params := SetupParams()
-
-	var oips []*OIP
-	for p, c := range StarDummies(players) {
-		oips = append(oips, NewOIP(params, p, c))
-	}
-
 	res_shares := make([][]FieldElem, players)
 
 	// repetions
@@ -166,6 +194,7 @@ func testOIPn(branches, length, players, repetitions int) {
 			go func(p int, oip *OIP) {
 				// oip.log = true
 				res, err := oip.Select(
+					context.Background(),
 					s[p],
 					v[p],
 				)
@@ -187,7 +216,7 @@ func testOIPn(branches, length, players, repetitions int) {
 
 	fmt.Println("Check output")
 
-	result := reconstruct(res_shares)
+	result := reconstructIn(f, res_shares)
 
 	if len(result) != len(correct) {
 		panic("Wrong size")
@@ -204,37 +233,386 @@ func testOIPn(branches, length, players, repetitions int) {
 func TestMul(t *testing.T) {
 	for p := 1; p < 10; p++ {
 		length := rand.Intn(1 << 13)
-		testMuln(length, p, 1)
+		testMuln(TopologyStar, length, p, 1)
 	}
 
 }
 
+func TestMulMesh(t *testing.T) {
+	for p := 1; p < 10; p++ {
+		length := rand.Intn(1 << 13)
+		testMuln(TopologyMesh, length, p, 1)
+	}
+}
+
 func TestOIP(t *testing.T) {
 
 	for p := 1; p < 10; p++ {
-		branches := rand.Intn(32)
+		branches := rand.Intn(32) + 1
 		length := rand.Intn(1 << 13)
 
-		testOIPn(branches, length, p, 1)
+		testOIPn(TopologyStar, branches, length, p, 1)
+	}
+
+	// many players, branches and ciphertexts take minutes and several GB of memory
+	if testing.Short() {
+		return
 	}
 
 	for r := 1; r < 10; r++ {
-		branches := rand.Intn(1 << 8)
+		branches := rand.Intn(1<<8) + 1
 		length := rand.Intn(1 << 16)
 		players := rand.Intn(32) + 1
-		testOIPn(branches, length, players, 1)
+		testOIPn(TopologyStar, branches, length, players, 1)
+	}
+
+}
+
+func TestOIPMesh(t *testing.T) {
+	for p := 1; p < 10; p++ {
+		branches := rand.Intn(32) + 1
+		length := rand.Intn(1 << 15)
+
+		testOIPn(TopologyMesh, branches, length, p, 1)
 	}
+}
 
+// run f with the branching factor of the tree topology set to arity
+func withArity(arity int, f func()) {
+	prev := TREE_ARITY
+	TREE_ARITY = arity
+	defer func() { TREE_ARITY = prev }()
+	f()
+}
+
+func TestMulTree(t *testing.T) {
+	for arity := 1; arity <= 3; arity++ {
+		withArity(arity, func() {
+			for p := 1; p < 10; p++ {
+				length := rand.Intn(1 << 13)
+				testMuln(TopologyTree, length, p, 1)
+			}
+		})
+	}
+}
+
+func TestOIPTree(t *testing.T) {
+	for arity := 2; arity <= 3; arity++ {
+		withArity(arity, func() {
+			for p := 1; p < 10; p++ {
+				branches := rand.Intn(32) + 1
+				length := rand.Intn(1 << 15)
+
+				testOIPn(TopologyTree, branches, length, p, 1)
+			}
+		})
+	}
+}
+
+func testReconstructn(topology Topology, length, players int) {
+	testReconstruct(setupOIPs(SetupParams(), topology, players), length)
+}
+
+func testReconstruct(oips []*OIP, length int) {
+	players := len(oips)
+	shares := make([][]FieldElem, players)
+	for p := 0; p < players; p++ {
+		shares[p] = random(length)
+	}
+
+	correct := reconstruct(shares)
+
+	var wg sync.WaitGroup
+
+	for p, oip := range oips {
+		wg.Add(1)
+
+		go func(p int, oip *OIP) {
+			res, err := NewCDN(oip).Reconstruct(context.Background(), shares[p])
+			if err != nil {
+				panic(err)
+			}
+
+			for i := range res {
+				if res[i] != correct[i] {
+					panic("Does not match")
+				}
+			}
+
+			wg.Done()
+		}(p, oip)
+	}
+
+	wg.Wait()
+}
+
+func TestReconstruct(t *testing.T) {
+	for p := 1; p < 10; p++ {
+		testReconstructn(TopologyStar, rand.Intn(1<<10)+1, p)
+		testReconstructn(TopologyMesh, rand.Intn(1<<10)+1, p)
+		for arity := 1; arity <= 3; arity++ {
+			withArity(arity, func() {
+				testReconstructn(TopologyTree, rand.Intn(1<<10)+1, p)
+			})
+		}
+	}
+}
+
+// star topology aggregated by agg (or rotating starting at agg), every pair of players is connected
+func setupOIPsAggregator(players int, agg int, rotate bool) []*OIP {
+	oips := setupOIPsConns(SetupParams(), TopologyStar, MemoryDummies(TopologyMesh, players, MemoryCopy))
+	for _, oip := range oips {
+		oip.SetAggregator(agg, rotate)
+	}
+	return oips
+}
+
+func TestAggregator(t *testing.T) {
+	for p := 2; p < 6; p++ {
+		for _, rotate := range []bool{false, true} {
+			agg := rand.Intn(p)
+			oips := setupOIPsAggregator(p, agg, rotate)
+			testMul(oips, rand.Intn(1<<13)+1, 2)
+			testOIP(oips, rand.Intn(8)+1, rand.Intn(1<<13)+1, 2)
+			testReconstruct(oips, rand.Intn(1<<10)+1)
+		}
+	}
+}
+
+func TestAggregatorRotation(t *testing.T) {
+	oip := setupOIPsAggregator(3, 1, true)[0]
+	for _, expect := range []int{1, 2, 0, 1} {
+		if agg := oip.nextAggregator(); agg != expect {
+			t.Fatal("Expected aggregator", expect, "got", agg)
+		}
+	}
+}
+
+// the aggregator must be linked to every player: in the star topology only player 0 is
+func TestAggregatorUnlinked(t *testing.T) {
+	conns := StarDummies(3)
+	if conns[1][2] != nil {
+		t.Fatal("Unlinked players connected")
+	}
+	oip := NewOIP(SetupParams(), 1, conns[1])
+	defer func() {
+		if r := recover(); r == nil || !strings.Contains(fmt.Sprint(r), "No connection to player 2") {
+			t.Fatal("Expected missing connection, got", r)
+		}
+	}()
+	oip.SetAggregator(1, false)
+}
+
+// only the aggregations of ciphertexts and decryption shares take a turn, not the setup or reconstructions
+func TestAggregatorRotationRounds(t *testing.T) {
+	oips := setupOIPsAggregator(3, 1, true)
+	for p, err := range setupAll(oips) {
+		if err != nil {
+			t.Fatal("Player", p, "setup failed:", err)
+		}
+	}
+	testReconstruct(oips, 100)
+	for p, oip := range oips {
+		if oip.round != 0 {
+			t.Fatal("Player", p, "rotated", oip.round, "times during setup and reconstruction")
+		}
+	}
+
+	// two aggregations and a decryption
+	testMul(oips, 100, 1)
+	for p, oip := range oips {
+		if oip.round != 3 {
+			t.Fatal("Player", p, "rotated", oip.round, "times during a multiplication")
+		}
+	}
+}
+
+// every message of every protocol survives the binary wire format
+func TestMemoryCheck(t *testing.T) {
+	for _, topology := range []Topology{TopologyStar, TopologyMesh, TopologyTree} {
+		oips := setupOIPsConns(SetupParams(), topology, MemoryDummies(topology, 4, MemoryCheck))
+		testMul(oips, rand.Intn(1<<13)+1, 1)
+		testOIP(oips, rand.Intn(8)+1, rand.Intn(1<<13)+1, 1)
+		testReconstruct(oips, rand.Intn(1<<10)+1)
+	}
+}
+
+// compare against sockets
+func TestOIPSockets(t *testing.T) {
+	for _, topology := range []Topology{TopologyStar, TopologyMesh, TopologyTree} {
+		oips := setupOIPsConns(SetupParams(), topology, Dummies(topology, 4))
+		testOIP(oips, rand.Intn(8)+1, rand.Intn(1<<13)+1, 1)
+	}
 }
 
 func BenchmarkOIP_P2_B2_L20(b *testing.B) {
-	testOIPn(2, 1<<20, 2, b.N)
+	testOIPn(TopologyStar, 2, 1<<20, 2, b.N)
 }
 
 func BenchmarkOIP_P2_B32_L20(b *testing.B) {
-	testOIPn(2, 1<<20, 32, b.N)
+	testOIPn(TopologyStar, 2, 1<<20, 32, b.N)
 }
 
 func BenchmarkMul_P3_L20(b *testing.B) {
-	testMuln(1<<20, 10, 100)
+	testMuln(TopologyStar, 1<<20, 10, 100)
+}
+
+func BenchmarkOIPMesh_P8_B16_L16(b *testing.B) {
+	testOIPn(TopologyMesh, 16, 1<<16, 8, b.N)
+}
+
+func BenchmarkOIPStar_P8_B16_L16(b *testing.B) {
+	testOIPn(TopologyStar, 16, 1<<16, 8, b.N)
+}
+
+func BenchmarkOIPTree_P8_B16_L16(b *testing.B) {
+	testOIPn(TopologyTree, 16, 1<<16, 8, b.N)
+}
+
+func TestTraffic(t *testing.T) {
+	players := 3
+	branches := 4
+	length := 1000
+
+	oips := setupOIPsConns(SetupParams(), TopologyStar, Dummies(TopologyStar, players))
+	traffic := make([]*Traffic, players)
+	for p, oip := range oips {
+		traffic[p] = NewTraffic()
+		for q, c := range oip.conns {
+			if c != nil {
+				traffic[p].Attach(q, c)
+			}
+		}
+		oip.traffic = traffic[p]
+	}
+
+	var wg sync.WaitGroup
+
+	for p, oip := range oips {
+		wg.Add(1)
+
+		go func(p int, oip *OIP) {
+			sel := random(branches)
+			vec := make([][]FieldElem, branches)
+			for b := range vec {
+				vec[b] = random(length)
+			}
+
+			res, err := oip.Select(context.Background(), sel, vec)
+			if err != nil {
+				panic(err)
+			}
+
+			// the phases of Select are scoped to it
+			if oip.Phase() != PhaseOther {
+				panic("Select did not restore the phase")
+			}
+
+			if _, err := NewCDN(oip).Reconstruct(context.Background(), res); err != nil {
+				panic(err)
+			}
+
+			wg.Done()
+		}(p, oip)
+	}
+
+	wg.Wait()
+
+	snaps := make([]TrafficSnapshot, players)
+	for p := range snaps {
+		snaps[p] = traffic[p].Snapshot()
+	}
+
+	// every phase of Select and Reconstruct generated traffic
+
+	for _, phase := range []Phase{
+		PhaseKeyGen,
+		PhaseSelectorAggregation,
+		PhaseTensorAggregation,
+		PhaseE2S,
+		PhaseReconstruct,
+	} {
+		var total LinkStats
+		for p := range snaps {
+			total.add(snaps[p].Phase(phase))
+		}
+		if total.BytesSent == 0 || total.MsgsSent == 0 || total.MsgsSent != total.MsgsRecv {
+			t.Fatal("Wrong accounting for phase", phase, total)
+		}
+	}
+
+	if snaps[0].Phase(PhaseMul).MsgsSent != 0 {
+		t.Fatal("Traffic accounted to multiplication")
+	}
+
+	// what player 0 sends to player p is what p receives from player 0
+
+	for p := 1; p < players; p++ {
+		if snaps[0].Link(p).BytesSent != snaps[p].Link(0).BytesRecv {
+			t.Fatal("Bytes sent and received does not match")
+		}
+		if snaps[p].Link(0).BytesSent != snaps[0].Link(p).BytesRecv {
+			t.Fatal("Bytes sent and received does not match")
+		}
+	}
+
+	var out bytes.Buffer
+	if err := WriteTrafficYAML(&out, 0, []TrafficSample{{Time: 1, Traffic: snaps[0]}}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "- comm: "+strconv.FormatUint(snaps[0].Total().BytesSent, 10)) {
+		t.Fatal("Missing comm in YAML output")
+	}
+}
+
+// run Select using strategy over an emulated network
+func benchmarkOIPLatency(b *testing.B, topology Topology, strategy SelectStrategy, latency time.Duration, branches, length, players int) {
+	params := SetupParams()
+	conns := EmulatedDummies(topology, players, UniformProfile(NetProfile{Latency: latency}))
+	oips := setupOIPsConns(params, topology, conns)
+	for _, oip := range oips {
+		oip.SetEvaluationKeys(strategy == SelectCiphertext, nil, false)
+		oip.SetSelectStrategy(strategy)
+	}
+
+	// run the setup outside the measurement
+	for _, err := range setupAll(oips) {
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	s := make([][]FieldElem, players)
+	v := make([][][]FieldElem, players)
+	for p := 0; p < players; p++ {
+		s[p] = random(branches)
+		v[p] = make([][]FieldElem, branches)
+		for i := range v[p] {
+			v[p][i] = random(length)
+		}
+	}
+
+	b.ResetTimer()
+
+	for r := 0; r < b.N; r++ {
+		var wg sync.WaitGroup
+		for p, oip := range oips {
+			wg.Add(1)
+			go func(p int, oip *OIP) {
+				if _, err := oip.Select(context.Background(), s[p], v[p]); err != nil {
+					panic(err)
+				}
+				wg.Done()
+			}(p, oip)
+		}
+		wg.Wait()
+	}
+}
+
+func BenchmarkOIPLatency10ms_P3_B16_L16(b *testing.B) {
+	benchmarkOIPLatency(b, TopologyStar, SelectTensor, 10*time.Millisecond, 16, 1<<16, 3)
+}
+
+func BenchmarkOIPLatency100ms_P3_B16_L16(b *testing.B) {
+	benchmarkOIPLatency(b, TopologyStar, SelectTensor, 100*time.Millisecond, 16, 1<<16, 3)
 }
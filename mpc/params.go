@@ -0,0 +1,233 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"math/bits"
+	"sort"
+	"strings"
+
+	"github.com/ldsec/lattigo/v2/bfv"
+	"github.com/ldsec/lattigo/v2/rlwe"
+)
+
+// Parameter selection:
+//
+// heuristic (central limit) noise model of the deepest OIP computation, a selection among some branches:
+// the coefficients of a product of two random polynomials of degree N are approximately Gaussian,
+// with variance N times the product of the variances of the coefficients of the factors.
+// With sk = \sum_p sk_p the collective key and the public key (-a sk + e, a), e = \sum_p e_p:
+//
+//   - a fresh encryption, computed modulo QP and divided by P, has noise (u e + e_0 + e_1 sk) / P + d_0 + d_1 sk
+//     (u, sk_p ternary, e_p, e_0, e_1 Gaussian, d_0, d_1 rounding errors in [0, 1)),
+//   - the rounding errors have mean 1/2: the coefficients of d_1 sk have a non-zero average mu (fixed by the key),
+//   - the aggregated selector is the sum of the fresh encryptions of all parties,
+//   - every party multiplies it by (the encoding of) its share of every branch, coefficients uniform in [0, T):
+//     the average mu of the noise multiplied by the average T/2 of the shares adds up over the N coefficients,
+//     the parties and the branches, which dominates the noise (about mu N T/2 per party and branch),
+//   - the distributed decryption (E2S) adds the smudging noise of every party, scaled down by P.
+//
+// Decryption is correct as long as the noise is smaller than Q / (2T).
+
+// noise bound in standard deviations (probability about 2^-76 for a coefficient to exceed it)
+const NOISE_TAIL = 10.0
+
+// bits of noise budget required to be left after the deepest computation
+const NOISE_MARGIN = 10.0
+
+// largest log2(QP) for ternary secrets by security level and log2(N) (homomorphic encryption standard)
+var MAX_LOG_QP = map[int]map[int]int{
+	128: {12: 109, 13: 218, 14: 438, 15: 881},
+	192: {12: 75, 13: 152, 14: 305, 15: 611},
+	256: {12: 58, 13: 118, 14: 237, 15: 476},
+}
+
+// largest log2(QP) for 128 bits of post-quantum security (as the pq presets of lattigo)
+var MAX_LOG_QP_PQ = map[int]int{12: 101, 13: 202, 14: 411, 15: 827}
+
+const MIN_LOG_N = 12
+const MAX_LOG_N = 15
+
+// shape of the compiled circuit, emitted into the runner by circuit.py (CIRCUIT)
+type CircuitShape struct {
+	Branches int // number of branches of the largest disjunction (1 without disjunctions)
+	Width    int // length of the longest vector selected by a disjunction (0 without disjunctions)
+}
+
+// parameter request of the circuit among parties
+func (s CircuitShape) Request(parties int) ParamRequest {
+	branches := s.Branches
+	if branches < 1 {
+		branches = 1
+	}
+	return ParamRequest{Branches: branches, Parties: parties, Slots: min(s.Width, 1<<MAX_LOG_N)}
+}
+
+type ParamRequest struct {
+	Branches    int       // number of branches of the largest selection (1 for multiplications only)
+	Parties     int       // number of parties
+	Slots       int       // number of field elements packed in every ciphertext, at most N (0: any)
+	Security    int       // bits of security: 128 (default), 192 or 256
+	PostQuantum bool      // 128 bits of post-quantum security
+	Prime       FieldElem // field modulus, the plaintext modulus of the parameters (default PRIME)
+}
+
+type NoiseEstimate struct {
+	Noise  float64 // log2 of the bound on the noise before decryption
+	Budget float64 // log2 of the largest noise which decrypts correctly: Q / (2T)
+}
+
+func (e NoiseEstimate) Margin() float64 {
+	return e.Budget - e.Noise
+}
+
+func (e NoiseEstimate) String() string {
+	return fmt.Sprintf("noise %.1f bits, budget %.1f bits, margin %.1f bits", e.Noise, e.Budget, e.Margin())
+}
+
+type ParamChoice struct {
+	Name    string                // preset name or "custom"
+	Literal bfv.ParametersLiteral // with the field modulus as plaintext modulus
+	NoiseEstimate
+}
+
+func log2Big(x *big.Int) float64 {
+	mant := new(big.Float)
+	exp := new(big.Float).SetInt(x).MantExp(mant)
+	f, _ := mant.Float64()
+	return math.Log2(f) + float64(exp)
+}
+
+// log2 of the noise bound for ring degree n, plaintext modulus t and extended modulus p
+func noiseBound(n, t, sigma, p float64, branches, parties int) float64 {
+	b, k := float64(branches), float64(parties)
+
+	// variance of the coefficients of sk, of the fresh noise around its average and bound on the average
+	tern := 2 * k / 3
+	fresh := sigma*sigma*(1+2*n*tern)/(p*p) + (2+n*tern)/12
+	mu := NOISE_TAIL * math.Sqrt(n*tern/3) / 2
+
+	// second moment of the sum of the parties' shares of a plaintext coefficient
+	shares := k*t*t/3 + k*(k-1)*t*t/4
+	product := b * n * k * fresh * shares
+	bias := k * mu * n * k * b * t / 2
+
+	e2s := k * (SIGMA*SIGMA/(p*p) + 1)
+
+	return math.Log2(NOISE_TAIL*math.Sqrt(product+e2s) + bias)
+}
+
+// estimate the noise of a selection among branches by parties players with params
+func EstimateNoise(params bfv.Parameters, branches, parties int) NoiseEstimate {
+	p, _ := new(big.Float).SetInt(params.RingP().ModulusBigint).Float64()
+	return NoiseEstimate{
+		Noise:  noiseBound(float64(params.N()), float64(params.T()), params.Sigma(), p, branches, parties),
+		Budget: log2Big(params.RingQ().ModulusBigint) - math.Log2(float64(params.T())) - 1,
+	}
+}
+
+func maxLogQP(req ParamRequest, logN int) int {
+	if req.PostQuantum {
+		return MAX_LOG_QP_PQ[logN]
+	}
+	return MAX_LOG_QP[req.Security][logN]
+}
+
+// presets with ring degree 2^logN providing the requested security, classical presets first
+func presetsFor(req ParamRequest, logN int) []string {
+	var names []string
+	if req.Security != 128 {
+		return nil
+	}
+	for name, literal := range BFV_PRESETS {
+		if literal.LogN == logN && (!req.PostQuantum || strings.HasSuffix(name, "pq")) {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		pi, pj := strings.HasSuffix(names[i], "pq"), strings.HasSuffix(names[j], "pq")
+		if pi != pj {
+			return pj
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
+
+// evaluate literal (with the field modulus as plaintext modulus) for req,
+// the special modulus P must not be smaller than the field modulus (the distributed decryption fails occasionally otherwise)
+func evalLiteral(req ParamRequest, name string, literal bfv.ParametersLiteral) (ParamChoice, bool) {
+	literal.T = req.Prime
+	if checkPlaintextModulus(literal) != nil {
+		return ParamChoice{}, false
+	}
+	params, err := bfv.NewParametersFromLiteral(literal)
+	if err != nil || params.LogP() < bits.Len64(req.Prime) {
+		return ParamChoice{}, false
+	}
+	choice := ParamChoice{Name: name, Literal: literal, NoiseEstimate: EstimateNoise(params, req.Branches, req.Parties)}
+	return choice, choice.Margin() >= NOISE_MARGIN
+}
+
+// custom parameters with ring degree 2^logN: moduli of equal size (at most 60 bits, larger than the field modulus),
+// the special modulus P as large as the others or the remaining bits allow
+func customLiteral(req ParamRequest, logN int) (bfv.ParametersLiteral, bool) {
+	logT := math.Log2(float64(req.Prime))
+	noise := noiseBound(float64(int(1)<<logN), float64(req.Prime), rlwe.DefaultSigma, 1<<MAX_PRIME_BITS, req.Branches, req.Parties)
+	need := int(math.Ceil(logT + 1 + noise + NOISE_MARGIN))
+
+	k := (need + MAX_PRIME_BITS - 1) / MAX_PRIME_BITS
+	size := (need + k - 1) / k
+	if size < bits.Len64(req.Prime) {
+		size = bits.Len64(req.Prime)
+	}
+	// primes of a given size may exceed 2^size, which costs at most one bit in total
+	logP := min(size, maxLogQP(req, logN)-k*size-1)
+	if size > MAX_PRIME_BITS || logP < bits.Len64(req.Prime) {
+		return bfv.ParametersLiteral{}, false
+	}
+
+	logQ := make([]int, k)
+	for i := range logQ {
+		logQ[i] = size
+	}
+	return bfv.ParametersLiteral{LogN: logN, LogQ: logQ, LogP: []int{logP}, Sigma: rlwe.DefaultSigma}, true
+}
+
+// smallest BFV parameters (presets preferred) for which the noise model of req leaves a margin of NOISE_MARGIN bits
+func SelectParams(req ParamRequest) (ParamChoice, error) {
+	if req.Security == 0 {
+		req.Security = 128
+	}
+	if req.Prime == 0 {
+		req.Prime = PRIME
+	}
+	if req.Branches < 1 || req.Parties < 1 {
+		return ParamChoice{}, errors.New("at least one branch and one party required")
+	}
+	if _, ok := MAX_LOG_QP[req.Security]; !ok {
+		return ParamChoice{}, fmt.Errorf("unsupported security level %d (128, 192 or 256)", req.Security)
+	}
+	if req.PostQuantum && req.Security != 128 {
+		return ParamChoice{}, errors.New("post-quantum parameters provide 128 bits of security")
+	}
+
+	for logN := MIN_LOG_N; logN <= MAX_LOG_N; logN++ {
+		if req.Slots > 1<<logN {
+			continue
+		}
+		for _, name := range presetsFor(req, logN) {
+			if choice, ok := evalLiteral(req, name, BFV_PRESETS[name]); ok {
+				return choice, nil
+			}
+		}
+		if literal, ok := customLiteral(req, logN); ok {
+			if choice, ok := evalLiteral(req, "custom", literal); ok {
+				return choice, nil
+			}
+		}
+	}
+	return ParamChoice{}, fmt.Errorf("no parameters with N <= 2^%d for %d branches and %d parties", MAX_LOG_N, req.Branches, req.Parties)
+}
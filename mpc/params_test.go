@@ -0,0 +1,167 @@
+package main
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/ldsec/lattigo/v2/bfv"
+)
+
+// aggregated inner product of a selection among branches (before E2S) of every player
+func selection(t *testing.T, oips []*OIP, branches int) [][]*bfv.Ciphertext {
+	block_size := 1 << oips[0].params.LogN()
+	res := make([][]*bfv.Ciphertext, len(oips))
+	errs := make([]error, len(oips))
+
+	var wg sync.WaitGroup
+	for p, oip := range oips {
+		wg.Add(1)
+		go func(p int, o *OIP) {
+			defer wg.Done()
+			if errs[p] = o.Setup(); errs[p] != nil {
+				return
+			}
+			sel := make([][]FieldElem, branches)
+			vecs := make([][]FieldElem, branches)
+			for b := range sel {
+				sel[b] = dup(random(1)[0], block_size)
+				vecs[b] = random(block_size)
+			}
+			cts, _ := o.packEncrypt(sel)
+			if errs[p] = o.aggregateCTS(cts, nil); errs[p] != nil {
+				return
+			}
+			res[p], _ = o.tensorCTS(1, cts, vecs)
+			errs[p] = o.aggregateCTS(res[p], nil)
+		}(p, oip)
+	}
+	wg.Wait()
+	for p, err := range errs {
+		if err != nil {
+			t.Fatal("Player", p, "failed:", err)
+		}
+	}
+	return res
+}
+
+// log2 of the largest noise of ct, decrypted with the collective secret key: c_0 + c_1 sk = (Q/T) m + noise
+func decryptNoise(oips []*OIP, ct *bfv.Ciphertext) float64 {
+	r := oips[0].params.RingQ()
+	sk, c1 := r.NewPoly(), r.NewPoly()
+	for _, oip := range oips {
+		r.Add(sk, oip.sk.Value.Q, sk)
+	}
+	r.NTT(ct.Value[1], c1)
+	r.MulCoeffsMontgomery(c1, sk, c1)
+	r.InvNTT(c1, c1)
+	r.Add(ct.Value[0], c1, c1)
+
+	return maxNoise(oips[0].params, c1)
+}
+
+func TestNoiseEstimate(t *testing.T) {
+	params := SetupParams()
+	for _, players := range []int{2, 5} {
+		oips := setupOIPs(params, TopologyStar, players)
+		for _, branches := range []int{1, 32} {
+			measured := decryptNoise(oips, selection(t, oips, branches)[0][0])
+			estimate := EstimateNoise(params, branches, players)
+			if measured > estimate.Noise {
+				t.Fatal("Players", players, "branches", branches, "measured noise of", measured, "bits exceeds the estimate:", estimate)
+			}
+		}
+	}
+
+	// the noise grows with the number of branches and of parties
+	if EstimateNoise(params, 16, 3).Noise <= EstimateNoise(params, 8, 3).Noise {
+		t.Fatal("Estimate does not grow with the number of branches")
+	}
+	if EstimateNoise(params, 8, 6).Noise <= EstimateNoise(params, 8, 3).Noise {
+		t.Fatal("Estimate does not grow with the number of parties")
+	}
+}
+
+func TestSelectParams(t *testing.T) {
+	for _, req := range []ParamRequest{
+		{Branches: 8, Parties: 3},
+		{Branches: 1000, Parties: 10},
+		{Branches: 100, Parties: 3, PostQuantum: true},
+		{Branches: 100, Parties: 3, Security: 192},
+		{Branches: 2, Parties: 3, Security: 256},
+		{Branches: 2, Parties: 3, Slots: 10000},
+	} {
+		choice, err := SelectParams(req)
+		if err != nil {
+			t.Fatal(req, err)
+		}
+		params, err := bfv.NewParametersFromLiteral(choice.Literal)
+		if err != nil {
+			t.Fatal(req, err)
+		}
+		security := req.Security
+		if security == 0 {
+			security = 128
+		}
+		limit := MAX_LOG_QP[security][params.LogN()]
+		if req.PostQuantum {
+			limit = MAX_LOG_QP_PQ[params.LogN()]
+		}
+		if params.LogQP() > limit || params.N() < req.Slots || params.T() != PRIME {
+			t.Fatal(req, "invalid parameters", choice.Name, "log(QP)", params.LogQP(), "N", params.N())
+		}
+		if choice.Margin() < NOISE_MARGIN || EstimateNoise(params, req.Branches, req.Parties) != choice.NoiseEstimate {
+			t.Fatal(req, "insufficient noise margin:", choice.NoiseEstimate)
+		}
+	}
+
+	if choice, _ := SelectParams(ParamRequest{Branches: 8, Parties: 3}); choice.Name != "PN12QP109" {
+		t.Fatal("Expected the default preset, got", choice.Name)
+	}
+
+	for _, req := range []ParamRequest{
+		{Branches: 0, Parties: 3},
+		{Branches: 1, Parties: 3, Security: 100},
+		{Branches: 1, Parties: 3, Security: 256, PostQuantum: true},
+		{Branches: 1, Parties: 3, Slots: 1 << 16},
+	} {
+		if _, err := SelectParams(req); err == nil {
+			t.Fatal(req, "accepted")
+		}
+	}
+}
+
+func TestCircuitShapeRequest(t *testing.T) {
+	for _, tc := range []struct {
+		shape CircuitShape
+		want  ParamRequest
+	}{
+		{CircuitShape{}, ParamRequest{Branches: 1, Parties: 3}},
+		{CircuitShape{Branches: 3, Width: 128}, ParamRequest{Branches: 3, Parties: 3, Slots: 128}},
+		{CircuitShape{Branches: 2, Width: 1 << 20}, ParamRequest{Branches: 2, Parties: 3, Slots: 1 << MAX_LOG_N}},
+	} {
+		if req := tc.shape.Request(3); req != tc.want {
+			t.Fatal(tc.shape, "got", req, "want", tc.want)
+		}
+	}
+
+	// the ring holds the widest selection
+	choice, err := SelectParams(CircuitShape{Branches: 3, Width: 10000}.Request(3))
+	if err != nil || choice.Literal.LogN < 14 {
+		t.Fatal("Wrong parameters for a wide circuit", choice.Name, err)
+	}
+}
+
+// selected custom parameters decrypt correctly, also for a 60-bit field
+func TestOIPSelectedParams(t *testing.T) {
+	choice, err := SelectParams(ParamRequest{Branches: 8, Parties: 3, Security: 256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testOIP(setupOIPs(paramsFor(PRIME, choice.Literal), TopologyStar, 3), 8, 100, 1)
+
+	choice, err = SelectParams(ParamRequest{Branches: 8, Parties: 3, Prime: PRIME_60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testOIP(setupOIPs(paramsFor(PRIME_60, choice.Literal), TopologyStar, 3), 8, 100, 1)
+}
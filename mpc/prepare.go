@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/ldsec/lattigo/v2/bfv"
+)
+
+// Preprocessing of Select:
+//
+// only the selectors of a Select are private inputs, everything else can be computed ahead of time:
+// the blocks of every branch are encoded for multiplication (in the NTT domain) and the encryptions
+// of the selector shares are prepared as encryptions of zero. Online, a selector is encrypted by adding
+// its encoding to an encryption of zero, the tensor multiplies by the encoded blocks, and the aggregations
+// and the distributed decryption run as before.
+// A prepared Select can be used once: its encryptions of zero must not be reused.
+// With proofs of plaintext knowledge the selectors are encrypted online (the proofs require the encryption randomness).
+// With the ciphertext strategy (see ctselect.go) the blocks of every branch are encrypted ahead of time instead
+// of encoded, with proofs they are encrypted online along with the selectors.
+
+// selector-independent material of a Select
+type PreparedSelect struct {
+	strategy SelectStrategy
+	branches int
+	length   int                   // maximum length of any branch
+	blocks   int                   // number of blocks of every branch
+	pts      [][]*bfv.PlaintextMul // pts[b][i]: block b of branch i encoded for multiplication
+	witness  [][]zkPoly            // witness[b][i]: plaintext of pts[b][i] (with proofs)
+	zeros    []*bfv.Ciphertext     // encryptions of zero, one for every selector (without proofs)
+	cts      []*bfv.Ciphertext     // encrypted blocks of every branch (ciphertext strategy without proofs)
+	vecs     [][]FieldElem         // branches encrypted online (ciphertext strategy with proofs)
+	used     bool
+}
+
+func (p *PreparedSelect) Branches() int {
+	return p.branches
+}
+
+// encode blocks of every vector for multiplication, returns the plaintexts pts[b][i] of block b of vector i
+// (and their witnesses with proofs)
+func (o *OIP) encodeBranches(blocks int, vecs [][]FieldElem) ([][]*bfv.PlaintextMul, [][]zkPoly) {
+	block_size := 1 << o.params.LogN()
+
+	pts := make([][]*bfv.PlaintextMul, blocks)
+	var witness [][]zkPoly
+	if o.zk {
+		witness = make([][]zkPoly, blocks)
+	}
+
+	var wg sync.WaitGroup
+	for b := 0; b < blocks; b++ {
+		pts[b] = make([]*bfv.PlaintextMul, len(vecs))
+		if witness != nil {
+			witness[b] = make([]zkPoly, len(vecs))
+		}
+		for i, vec := range vecs {
+			wg.Add(1)
+			go func(b int, i int, vec []FieldElem) {
+				p := bfv.NewPlaintextMul(o.params)
+				s := min(len(vec), b*block_size)
+				e := min(len(vec), (b+1)*block_size)
+
+				var w *zkPoly
+				if witness != nil {
+					w = &witness[b][i]
+				}
+
+				// encode (slow)
+				enco := o.getEncoder()
+				o.encodeMul(enco, vec[s:e], p, w)
+				o.putEncoder(enco)
+
+				pts[b][i] = p
+				wg.Done()
+			}(b, i, vec)
+		}
+	}
+	wg.Wait()
+
+	return pts, witness
+}
+
+// prepare a Select of branches, aborts if ctx is cancelled (see abort.go)
+func (o *OIP) PrepareSelect(ctx context.Context, branches [][]FieldElem) (prep *PreparedSelect, err error) {
+	err = o.run(ctx, func() error {
+		prep, err = o.prepareSelect(branches)
+		return err
+	})
+	return prep, err
+}
+
+func (o *OIP) prepareSelect(branches [][]FieldElem) (*PreparedSelect, error) {
+	if len(branches) == 0 {
+		log.Panicln("No branches to select")
+	}
+
+	// check if one-time key generation setup required
+	if o.pk == nil {
+		if err := o.Setup(); err != nil {
+			o.Log("Setup failed:", err)
+			return nil, err
+		}
+	} else {
+		o.Log("Use previous setup")
+	}
+
+	// maximum length of any vector in v
+	max_len := 0
+	for i := 0; i < len(branches); i++ {
+		if len(branches[i]) > max_len {
+			max_len = len(branches[i])
+		}
+	}
+
+	block_size := 1 << o.params.LogN()
+	blocks := (max_len + (block_size - 1)) / block_size
+
+	o.Log("Prepare select: Max Len", max_len, "Blocks", blocks)
+
+	prep := &PreparedSelect{strategy: o.strategy, branches: len(branches), length: max_len, blocks: blocks}
+	if o.strategy == SelectCiphertext {
+		if o.zk {
+			prep.vecs = branches
+		} else {
+			prep.cts, _ = o.packEncrypt(branchBlocks(blocks, block_size, branches))
+		}
+	} else {
+		prep.pts, prep.witness = o.encodeBranches(blocks, branches)
+	}
+
+	// encryptions of zero for the selector shares
+	if !o.zk {
+		prep.zeros = make([]*bfv.Ciphertext, len(branches))
+		zero := bfv.NewPlaintext(o.params)
+		for i := range prep.zeros {
+			prep.zeros[i] = bfv.NewCiphertext(o.params, 1)
+			encr := o.getEncryptor()
+			encr.Encrypt(zero, prep.zeros[i])
+			o.putEncryptor(encr)
+		}
+	}
+
+	return prep, nil
+}
+
+// encrypt every selector pack by adding it to a prepared encryption of zero
+func (o *OIP) addEncrypt(zeros []*bfv.Ciphertext, packs [][]FieldElem) []*bfv.Ciphertext {
+	cts := make([]*bfv.Ciphertext, len(packs))
+
+	var wg sync.WaitGroup
+	for i, pack := range packs {
+		wg.Add(1)
+		go func(i int, pack []FieldElem) {
+			pt := bfv.NewPlaintext(o.params)
+			enco := o.getEncoder()
+			enco.EncodeUint(pack, pt)
+			o.putEncoder(enco)
+
+			cts[i] = bfv.NewCiphertext(o.params, 1)
+			eval := o.getEvaluator()
+			eval.Add(zeros[i], pt, cts[i])
+			o.putEvaluator(eval)
+			wg.Done()
+		}(i, pack)
+	}
+	wg.Wait()
+
+	return cts
+}
+
+// compute shares of the sum of the prepared branches weighted by sel, aborts if ctx is cancelled (see abort.go)
+func (o *OIP) SelectPrepared(ctx context.Context, sel []FieldElem, prep *PreparedSelect) (res []FieldElem, err error) {
+	start := time.Now()
+	defer func() {
+		o.selecting += time.Since(start)
+	}()
+	err = o.run(ctx, func() error {
+		res, err = o.selectPrepared(sel, prep)
+		return err
+	})
+	return res, err
+}
+
+func (o *OIP) selectPrepared(sel []FieldElem, prep *PreparedSelect) ([]FieldElem, error) {
+	if len(sel) != prep.Branches() {
+		log.Panicln("Dimensions does not match")
+	}
+	if prep.used {
+		log.Panicln("Prepared select used twice")
+	}
+	prep.used = true
+
+	if prep.strategy == SelectCiphertext && prep.cts == nil {
+		return o.selectCiphertexts(sel, prep.vecs)
+	}
+
+	block_size := 1 << o.params.LogN()
+
+	// encode and encrypt selector shares
+
+	o.Log("Generate encrypted selector shares")
+
+	sel_blocks := make([][]FieldElem, len(sel))
+	for i, s := range sel {
+		sel_blocks[i] = dup(s, block_size)
+	}
+
+	var cts_sel []*bfv.Ciphertext
+	var sel_rel *zkRelation
+	if prep.zeros != nil {
+		cts_sel = o.addEncrypt(prep.zeros, sel_blocks)
+	} else {
+		cts_sel, sel_rel = o.packEncrypt(sel_blocks)
+	}
+
+	if prep.strategy == SelectCiphertext {
+		return o.selectAggregated(len(sel), prep.blocks, prep.length, append(cts_sel, prep.cts...), nil)
+	}
+
+	return o.selectEncrypted(cts_sel, sel_rel, prep.length, func(cts_sel []*bfv.Ciphertext) ([]*bfv.Ciphertext, *zkRelation) {
+		return o.tensorEncoded(cts_sel, prep.pts, prep.witness)
+	})
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"testing"
+)
+
+func TestSelectPrepared(t *testing.T) {
+	for _, tc := range []struct {
+		topology Topology
+		zk       bool
+		strategy SelectStrategy
+	}{
+		{TopologyStar, false, SelectTensor},
+		{TopologyMesh, false, SelectTensor},
+		{TopologyTree, false, SelectTensor},
+		{TopologyStar, true, SelectTensor},
+		{TopologyTree, false, SelectCiphertext},
+		{TopologyStar, true, SelectCiphertext},
+	} {
+		oips := setupOIPs(SetupParams(), tc.topology, 3)
+		for _, oip := range oips {
+			oip.zk = tc.zk
+			oip.SetEvaluationKeys(tc.strategy == SelectCiphertext, nil, false)
+			oip.SetSelectStrategy(tc.strategy)
+		}
+
+		branches := rand.Intn(4) + 1
+		length := rand.Intn(1<<13) + 1
+		v := make([][][]FieldElem, len(oips))
+		for p := range v {
+			v[p] = make([][]FieldElem, branches)
+			for b := range v[p] {
+				v[p][b] = random(length)
+			}
+		}
+
+		// prepare before the selectors are known
+		preps := make([]*PreparedSelect, len(oips))
+		_, errs := runCDN(oips, func(p int, e *CDN) ([]FieldElem, error) {
+			var err error
+			preps[p], err = e.oip.PrepareSelect(context.Background(), v[p])
+			return nil, err
+		})
+		for p, err := range errs {
+			if err != nil {
+				t.Fatal(tc.topology, "player", p, "failed to prepare:", err)
+			}
+		}
+
+		s := randomShares(len(oips), branches)
+		outs, errs := runCDN(oips, func(p int, e *CDN) ([]FieldElem, error) {
+			return e.oip.SelectPrepared(context.Background(), s[p], preps[p])
+		})
+		for p, err := range errs {
+			if err != nil {
+				t.Fatal(tc.topology, "player", p, "failed:", err)
+			}
+		}
+
+		sel, bra, res := reconstruct(s), reconstruct_branches(defaultField, v), reconstruct(outs)
+		if len(res) != length {
+			t.Fatal(tc.topology, "wrong length", len(res))
+		}
+		for i := range res {
+			var expected FieldElem
+			for b := range bra {
+				expected = add(expected, mul(sel[b], bra[b][i]))
+			}
+			if res[i] != expected {
+				t.Fatal(tc.topology, "wrong selection at", i, "with proofs:", tc.zk)
+			}
+		}
+	}
+}
+
+func TestDisjunctionPrepared(t *testing.T) {
+	oips := setupOIPs(SetupParams(), TopologyMesh, 3)
+
+	// u = x0, x1, g0, g1, g2, g3: two levels of two gates
+	levels := []int{1, 3}
+	mapping := [][]int{
+		{0, 1, 0, 1, 2, 3, 2, 0}, // g0 = x0 * x1, g1 = x0 + x1, g2 = g0 * g1, g3 = g0 + x0
+		{0, 0, 1, 1, 2, 3, 3, 1}, // g0 = x0 + x0, g1 = x1 * x1, g2 = g0 + g1, g3 = g1 * x1
+	}
+	programs := [][]bool{
+		{true, false, true, false},
+		{false, true, false, true},
+	}
+
+	preps := make([]*PreparedDisjunction, len(oips))
+	_, errs := runCDN(oips, func(p int, e *CDN) ([]FieldElem, error) {
+		var err error
+		preps[p], err = e.PrepareDisjunction(context.Background(), mapping, 2)
+		return nil, err
+	})
+	for p, err := range errs {
+		if err != nil {
+			t.Fatal("Player", p, "failed to prepare:", err)
+		}
+	}
+
+	inputs := randomShares(len(oips), 2)
+	x := reconstruct(inputs)
+	g0, g1 := mul(x[0], x[1]), add(x[0], x[1])
+	expected := []FieldElem{g0, g1, mul(g0, g1), add(g0, x[0])}
+
+	outs, errs := runCDN(oips, func(p int, e *CDN) ([]FieldElem, error) {
+		ctx := context.Background()
+		sel := []Share{e.Input(1, 0), e.Input(0, 0)}
+		w, err := e.DisjunctionPrepared(ctx, preps[p], levels, inputs[p], sel, programs)
+		if err != nil {
+			return nil, err
+		}
+		return e.Reconstruct(ctx, w)
+	})
+
+	for p := range oips {
+		if errs[p] != nil {
+			t.Fatal("Player", p, "failed:", errs[p])
+		}
+		for i, v := range expected {
+			if outs[p][i] != v {
+				t.Fatal("Player", p, "wrong output of gate", i)
+			}
+		}
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"log"
+	"math"
+	"math/big"
+	"sync"
+
+	"github.com/ldsec/lattigo/v2/bfv"
+	"github.com/ldsec/lattigo/v2/dbfv"
+	"github.com/ldsec/lattigo/v2/drlwe"
+	"github.com/ldsec/lattigo/v2/ring"
+	"github.com/ldsec/lattigo/v2/rlwe"
+	"github.com/ldsec/lattigo/v2/utils"
+)
+
+// Collective refresh:
+//
+// re-encrypt ciphertexts with fresh noise (or rearrange their slots, see repack) in a single round, without decrypting them.
+
+// refresh the ciphertexts (in place) in a single round, aborts if ctx is cancelled (see abort.go)
+func (o *OIP) Refresh(ctx context.Context, cts []*bfv.Ciphertext) error {
+	return o.run(ctx, func() error {
+		return o.refresh(cts)
+	})
+}
+
+func (o *OIP) refresh(cts []*bfv.Ciphertext) error {
+	if o.threshold > 0 {
+		log.Panicln("Refresh is not supported with threshold decryption")
+	}
+
+	defer o.phase(PhaseRefresh)()
+
+	o.Log("Refresh", len(cts), "ciphertexts")
+
+	crs, err := o.refreshCRS("refresh", o.refreshes)
+	if err != nil {
+		return err
+	}
+	o.refreshes++
+
+	rfp := dbfv.NewRefreshProtocol(o.params, SIGMA)
+
+	crps := make([]drlwe.CKSCRP, len(cts))
+	shares := make([]*dbfv.RefreshShare, len(cts))
+	for i, ct := range cts {
+		if ct.Degree() != 1 {
+			log.Panicln("Refresh of a ciphertext of degree", ct.Degree())
+		}
+		crps[i] = rfp.SampleCRP(ct.Level(), crs)
+		shares[i] = rfp.AllocateShare()
+		rfp.GenShares(o.sk, ct, crps[i], shares[i])
+	}
+
+	var lock sync.Mutex
+
+	recv := func(p int) ([]*dbfv.RefreshShare, error) {
+		var others []*dbfv.RefreshShare
+		if err := o.recv(p, &others); err != nil {
+			return nil, err
+		}
+		if err := checkRefreshShares(others, shares); err != nil {
+			return nil, o.peerError(p, err)
+		}
+		return others, nil
+	}
+
+	err = o.allAggregate(
+		func() interface{} {
+			return shares
+		},
+		func(p int) error {
+			others, err := recv(p)
+			if err != nil {
+				return err
+			}
+			lock.Lock()
+			for i := range shares {
+				rfp.Aggregate(others[i], shares[i], shares[i])
+			}
+			lock.Unlock()
+			return nil
+		},
+		func(p int) error {
+			sums, err := recv(p)
+			if err != nil {
+				return err
+			}
+			shares = sums
+			return nil
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	for i, ct := range cts {
+		rfp.Finalize(ct, crps[i], shares[i], ct)
+	}
+	return nil
+}
+
+// the refresh shares of a peer must have the shape of ours to be aggregated with them
+func checkRefreshShares(shares, ours []*dbfv.RefreshShare) error {
+	if len(shares) != len(ours) {
+		return errors.New("refresh shares have wrong length")
+	}
+	for i, share := range shares {
+		pols, err := refreshPolys(share)
+		if err != nil {
+			return err
+		}
+		expect, err := refreshPolys(ours[i])
+		if err != nil {
+			return err
+		}
+		for j := range pols {
+			if checkPoly(pols[j], expect[j]) != nil {
+				return errors.New("refresh share has wrong dimensions")
+			}
+		}
+	}
+	return nil
+}
+
+// the polynomials of a refresh share are private: decode them from its binary encoding
+func refreshPolys(share *dbfv.RefreshShare) ([2]*ring.Poly, error) {
+	pols := [2]*ring.Poly{new(ring.Poly), new(ring.Poly)}
+	if share == nil {
+		return pols, errors.New("missing refresh share")
+	}
+	data, err := share.MarshalBinary()
+	if err != nil {
+		return pols, err
+	}
+	half := len(data) / 2
+	if err := decodeExact(pols[0], data[:half]); err != nil {
+		return pols, err
+	}
+	return pols, decodeExact(pols[1], data[half:])
+}
+
+// the common reference string of the refresh (or repacking) number counter, expanded from the coin-tossed seed
+func (o *OIP) refreshCRS(label string, counter uint64) (utils.PRNG, error) {
+	if o.refreshSeed == nil {
+		o.Log("Toss the seed of the refresh")
+		seed, err := o.coinToss()
+		if err != nil {
+			return nil, err
+		}
+		o.refreshSeed = seed
+	}
+
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], counter)
+	key := append([]byte("bmpc crs "+label), o.refreshSeed...)
+	return utils.NewKeyedPRNG(append(key, buf[:]...))
+}
+
+// a slot of a ciphertext, none if ct < 0
+type slotRef struct {
+	ct   int
+	slot int
+}
+
+// re-encrypt the slots of cts rearranged in a single round: slot j of the i'th result holds the plaintext
+// of slot layout[i][j] of cts (zero for none and beyond the layout)
+func (o *OIP) repack(cts []*bfv.Ciphertext, layout [][]slotRef) ([]*bfv.Ciphertext, error) {
+	if o.threshold > 0 {
+		log.Panicln("Repacking is not supported with threshold decryption")
+	}
+
+	defer o.phase(PhaseRefresh)()
+
+	o.Log("Repack", len(cts), "ciphertexts into", len(layout))
+
+	crs, err := o.refreshCRS("repack", o.repacks)
+	if err != nil {
+		return nil, err
+	}
+	o.repacks++
+
+	e2s := dbfv.NewE2SProtocol(o.params, SIGMA)
+	s2e := dbfv.NewS2EProtocol(o.params, SIGMA)
+	level := len(o.params.RingQ().Modulus) - 1
+	slots := o.params.N()
+
+	// rearrange the slot values (one array of every ciphertext) into a plaintext of every target
+	arrange := func(values []FieldElem, i int) *bfv.PlaintextRingT {
+		vec := make([]FieldElem, slots)
+		for j, ref := range layout[i] {
+			if ref.ct >= 0 {
+				vec[j] = values[ref.ct*slots+ref.slot]
+			}
+		}
+		pt := bfv.NewPlaintextRingT(o.params)
+		enco := o.getEncoder()
+		enco.EncodeUintRingT(vec, pt)
+		o.putEncoder(enco)
+		return pt
+	}
+
+	// masked decryption shares of the sources and encryption shares of the rearranged masks
+	masks := make([]*rlwe.AdditiveShare, len(cts))
+	shares := make([]*drlwe.CKSShare, len(cts)+len(layout))
+	for i, ct := range cts {
+		if ct.Degree() != 1 {
+			log.Panicln("Repacking of a ciphertext of degree", ct.Degree())
+		}
+		masks[i] = rlwe.NewAdditiveShare(o.params.Parameters)
+		shares[i] = e2s.AllocateShare(ct.Level())
+		e2s.GenShare(o.sk, ct, masks[i], shares[i])
+	}
+	masked := o.sharesToArray(masks)
+	crps := make([]drlwe.CKSCRP, len(layout))
+	for i := range layout {
+		crps[i] = s2e.SampleCRP(level, crs)
+		shares[len(cts)+i] = s2e.AllocateShare(level)
+		s2e.GenShare(o.sk, crps[i], &rlwe.AdditiveShare{Value: *arrange(masked, i).Value}, shares[len(cts)+i])
+	}
+
+	var lock sync.Mutex
+
+	recv := func(p int) ([]*drlwe.CKSShare, error) {
+		var others []*drlwe.CKSShare
+		if err := o.recv(p, &others); err != nil {
+			return nil, err
+		}
+		if err := checkShares(others, shares); err != nil {
+			return nil, o.peerError(p, err)
+		}
+		return others, nil
+	}
+
+	err = o.allAggregate(
+		func() interface{} {
+			return shares
+		},
+		func(p int) error {
+			others, err := recv(p)
+			if err != nil {
+				return err
+			}
+			lock.Lock()
+			for i := range shares {
+				e2s.AggregateShares(others[i], shares[i], shares[i])
+			}
+			lock.Unlock()
+			return nil
+		},
+		func(p int) error {
+			sums, err := recv(p)
+			if err != nil {
+				return err
+			}
+			shares = sums
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// the masked plaintexts, rearranged and added to the re-encrypted masks
+	for i, ct := range cts {
+		e2s.GetShare(nil, shares[i], ct, masks[i])
+	}
+	masked = o.sharesToArray(masks)
+	res := make([]*bfv.Ciphertext, len(layout))
+	for i := range layout {
+		pt := bfv.NewPlaintext(o.params)
+		enco := o.getEncoder()
+		enco.ScaleUp(arrange(masked, i), pt)
+		o.putEncoder(enco)
+
+		res[i] = bfv.NewCiphertext(o.params, 1)
+		o.params.RingQ().Add(pt.Value, shares[len(cts)+i].Value, res[i].Value[0])
+		s2e.GetEncryption(&drlwe.CKSShare{Value: res[i].Value[0]}, crps[i], res[i])
+	}
+	return res, nil
+}
+
+// log2 of the largest noise which decrypts correctly: Q / (2T)
+func (o *OIP) noiseCapacity() float64 {
+	return log2Big(o.params.RingQ().ModulusBigint) - math.Log2(float64(o.params.T())) - 1
+}
+
+// log2 of the noise bound of the sum of the fresh encryptions of all players
+func (o *OIP) freshNoise() float64 {
+	n, k := float64(o.params.N()), float64(o.n)
+	p, _ := new(big.Float).SetInt(o.params.RingP().ModulusBigint).Float64()
+	sigma := o.params.Sigma()
+
+	tern := 2 * k / 3
+	fresh := sigma*sigma*(1+2*n*tern)/(p*p) + (2+n*tern)/12
+	mu := NOISE_TAIL * math.Sqrt(n*tern/3) / 2
+
+	return math.Log2(NOISE_TAIL*math.Sqrt(k*fresh) + k*mu)
+}
+
+// log2 of the noise bound of a refreshed ciphertext
+func (o *OIP) refreshedNoise() float64 {
+	k := float64(o.n)
+	p, _ := new(big.Float).SetInt(o.params.RingP().ModulusBigint).Float64()
+	return math.Log2(NOISE_TAIL*math.Sqrt(k*(SIGMA*SIGMA/(p*p)+1)) + k)
+}
+
+// log2 of the growth of the noise bound by a relinearized product (added to the larger bound of the factors)
+func (o *OIP) productGrowth() float64 {
+	n, k := float64(o.params.N()), float64(o.n)
+	return math.Log2(float64(o.params.T())) + math.Log2(NOISE_TAIL*math.Sqrt(n*(1+n*2*k/3))) + 3
+}
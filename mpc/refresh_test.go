@@ -0,0 +1,165 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/ldsec/lattigo/v2/bfv"
+	"github.com/ldsec/lattigo/v2/dbfv"
+)
+
+func TestRefresh(t *testing.T) {
+	for _, topology := range []Topology{TopologyStar, TopologyMesh, TopologyTree} {
+		oips := setupOIPsConns(SetupParams(), topology, MemoryDummies(topology, 3, MemoryCheck))
+		for _, oip := range oips {
+			oip.SetEvaluationKeys(true, nil, false)
+		}
+		for p, err := range setupAll(oips) {
+			if err != nil {
+				t.Fatal(topology, "player", p, "setup failed:", err)
+			}
+		}
+
+		slots := oips[0].params.N()
+		x, y := randomShares(len(oips), slots), randomShares(len(oips), slots)
+
+		// refresh a product twice, every refresh restores the noise budget
+		budgets := make([][]float64, len(oips))
+		outs, errs := runCDN(oips, func(p int, e *CDN) ([]FieldElem, error) {
+			o := e.oip
+			ctx, err := encryptShares(o, x[p])
+			if err != nil {
+				return nil, err
+			}
+			cty, err := encryptShares(o, y[p])
+			if err != nil {
+				return nil, err
+			}
+
+			eval := o.getEvaluator()
+			defer o.putEvaluator(eval)
+			prod := []*bfv.Ciphertext{eval.RelinearizeNew(eval.MulNew(ctx, cty))}
+
+			for i := 0; i < 3; i++ {
+				budget, err := o.noiseBudget(prod)
+				if err != nil {
+					return nil, err
+				}
+				budgets[p] = append(budgets[p], budget)
+				if i < 2 {
+					if err := o.refresh(prod); err != nil {
+						return nil, err
+					}
+				}
+			}
+
+			shares, err := o.E2S(prod)
+			if err != nil {
+				return nil, err
+			}
+			return o.sharesToArray(shares), nil
+		})
+		for p, err := range errs {
+			if err != nil {
+				t.Fatal(topology, "player", p, "failed:", err)
+			}
+		}
+
+		refreshed := oips[0].noiseCapacity() - oips[0].refreshedNoise()
+		for p, b := range budgets {
+			if b[1] < refreshed || b[2] < refreshed || b[1] <= b[0] {
+				t.Fatal(topology, "player", p, "noise budgets", b, "below", refreshed, "bits after refresh")
+			}
+		}
+
+		vx, vy, res := reconstruct(x), reconstruct(y), reconstruct(outs)
+		for i := 0; i < slots; i++ {
+			if res[i] != mul(vx[i], vy[i]) {
+				t.Fatal(topology, "wrong refreshed product at", i)
+			}
+		}
+	}
+}
+
+func TestRepack(t *testing.T) {
+	for _, topology := range []Topology{TopologyStar, TopologyMesh, TopologyTree} {
+		oips := setupOIPsConns(SetupParams(), topology, MemoryDummies(topology, 3, MemoryCheck))
+		for p, err := range setupAll(oips) {
+			if err != nil {
+				t.Fatal(topology, "player", p, "setup failed:", err)
+			}
+		}
+
+		slots := oips[0].params.N()
+		x, y := randomShares(len(oips), slots), randomShares(len(oips), slots)
+
+		// interleave the reversed slots of x and y, the last slot remains empty
+		layout := make([][]slotRef, 2)
+		for j := 0; j < slots-1; j++ {
+			layout[0] = append(layout[0], slotRef{ct: j % 2, slot: slots - 1 - j})
+		}
+		layout[1] = []slotRef{{ct: -1}, {ct: 1, slot: 0}}
+
+		outs, errs := runCDN(oips, func(p int, e *CDN) ([]FieldElem, error) {
+			o := e.oip
+			ctx, err := encryptShares(o, x[p])
+			if err != nil {
+				return nil, err
+			}
+			cty, err := encryptShares(o, y[p])
+			if err != nil {
+				return nil, err
+			}
+			res, err := o.repack([]*bfv.Ciphertext{ctx, cty}, layout)
+			if err != nil {
+				return nil, err
+			}
+			shares, err := o.E2S(res)
+			if err != nil {
+				return nil, err
+			}
+			return o.sharesToArray(shares), nil
+		})
+		for p, err := range errs {
+			if err != nil {
+				t.Fatal(topology, "player", p, "failed:", err)
+			}
+		}
+
+		vx, vy, res := reconstruct(x), reconstruct(y), reconstruct(outs)
+		for j := 0; j < 2*slots; j++ {
+			expected := FieldElem(0)
+			switch {
+			case j < slots-1 && j%2 == 0:
+				expected = vx[slots-1-j]
+			case j < slots-1:
+				expected = vy[slots-1-j]
+			case j == slots+1:
+				expected = vy[0]
+			}
+			if res[j] != expected {
+				t.Fatal(topology, "wrong repacked slot", j)
+			}
+		}
+	}
+}
+
+// refresh shares of another shape are rejected before they are aggregated
+func TestCheckRefreshShares(t *testing.T) {
+	params, other := SetupParams(), paramsFor(PRIME, bfv.PN13QP218)
+	rfp := dbfv.NewRefreshProtocol(params, SIGMA)
+	ours := []*dbfv.RefreshShare{rfp.AllocateShare()}
+
+	if err := checkRefreshShares([]*dbfv.RefreshShare{rfp.AllocateShare()}, ours); err != nil {
+		t.Fatal(err)
+	}
+	wrong := dbfv.NewRefreshProtocol(other, SIGMA).AllocateShare()
+	if err := checkRefreshShares([]*dbfv.RefreshShare{wrong}, ours); err == nil {
+		t.Fatal("accepted refresh share of another ring")
+	}
+	if err := checkRefreshShares(nil, ours); err == nil {
+		t.Fatal("accepted refresh shares of wrong length")
+	}
+	if err := checkRefreshShares([]*dbfv.RefreshShare{nil}, ours); err == nil {
+		t.Fatal("accepted missing refresh share")
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"math/big"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ldsec/lattigo/v2/bfv"
+	"github.com/ldsec/lattigo/v2/dbfv"
+	"github.com/ldsec/lattigo/v2/drlwe"
+	"github.com/ldsec/lattigo/v2/ring"
+	"github.com/ldsec/lattigo/v2/rlwe"
+	"github.com/ldsec/lattigo/v2/utils"
+)
+
+// Threshold decryption:
+//
+// the secret key is additionally Shamir shared with degree t, so any t+1 players can decrypt:
+// the aggregator of the star topology drops the players which fail during E2S and restarts it among the live players.
+
+var PEER_TIMEOUT = 60 * time.Second
+
+// a player dropped during an earlier decryption is required (by a coin toss)
+var ErrDropped = errors.New("dropped during an earlier decryption")
+
+// any t+1 players can decrypt, requires a link between every pair of players (for the key generation)
+func (o *OIP) SetThreshold(t int) {
+	if t <= 0 || t >= o.n {
+		log.Panicln("Invalid threshold", t, "for", o.n, "players")
+	}
+	if o.topology != TopologyStar || o.rotate {
+		log.Panicln("Threshold decryption requires the star topology with a fixed aggregator")
+	}
+	for p, conn := range o.conns {
+		if p != o.me && conn == nil {
+			log.Panicln("No connection to player", p)
+		}
+	}
+
+	o.threshold = t
+	o.dead = make([]bool, o.n)
+}
+
+func (o *OIP) live(p int) bool {
+	o.deadLock.Lock()
+	defer o.deadLock.Unlock()
+	return o.dead == nil || !o.dead[p]
+}
+
+// the live players (in increasing order)
+func (o *OIP) liveSet() []int {
+	o.deadLock.Lock()
+	defer o.deadLock.Unlock()
+	set := make([]int, 0, o.n)
+	for p := 0; p < o.n; p++ {
+		if o.dead == nil || !o.dead[p] {
+			set = append(set, p)
+		}
+	}
+	return set
+}
+
+// drop player p, fails if fewer than t+1 players remain
+func (o *OIP) drop(p int, err error) error {
+	o.deadLock.Lock()
+	o.dead[p] = true
+	o.deadLock.Unlock()
+
+	o.Log("Drop player", p, "cause:", err)
+	o.Pi(p).Close()
+
+	if live := len(o.liveSet()); live <= o.threshold {
+		return o.peerError(p, errors.New("only "+strconv.Itoa(live)+" players are live: "+err.Error()))
+	}
+	return nil
+}
+
+// run f(p) concurrently for every other live player p, aborting the OIP if any of them fails
+// (with threshold decryption: or does not respond within the peer timeout)
+func (o *OIP) gather(agg int, f func(p int) error) error {
+	status := make(chan error, o.n)
+	num := 0
+	for p := 0; p < o.n; p++ {
+		if p == agg || !o.live(p) {
+			continue
+		}
+		num++
+		go func(p int) {
+			status <- o.timed(p, f)
+		}(p)
+	}
+	return o.collect(status, num)
+}
+
+// run f(p) concurrently for every other live player p (during E2S with threshold decryption):
+// players which fail or time out are dropped rather than aborting the OIP
+func (o *OIP) gatherLive(agg int, f func(p int) error) error {
+	status := make(chan error, o.n)
+	num := 0
+	for p := 0; p < o.n; p++ {
+		if p == agg || !o.live(p) {
+			continue
+		}
+		num++
+		go func(p int) {
+			err := o.timed(p, f)
+			if err != nil {
+				err = o.drop(p, err)
+			}
+			status <- err
+		}(p)
+	}
+	return o.collect(status, num)
+}
+
+// run f(p), with threshold decryption player p fails if it does not respond within the peer timeout
+func (o *OIP) timed(p int, f func(p int) error) error {
+	if o.threshold == 0 {
+		return f(p)
+	}
+	timer := time.AfterFunc(o.timeout, func() { o.Pi(p).Close() })
+	err := f(p)
+	if !timer.Stop() {
+		return o.peerError(p, errors.New("timed out"))
+	}
+	return err
+}
+
+// send v to every other live player (as the aggregator agg, during E2S with threshold decryption)
+func (o *OIP) broadcastLive(agg int, v interface{}) error {
+	return o.gatherLive(agg, func(p int) error {
+		return o.send(p, v)
+	})
+}
+
+// Shamir share the secret key share with every other player
+func (o *OIP) shareSecretKey() error {
+	r := o.params.RingQ()
+
+	prng, err := utils.NewPRNG()
+	if err != nil {
+		return err
+	}
+	sampler := ring.NewUniformSampler(prng, r)
+	coeffs := make([]*ring.Poly, o.threshold)
+	for k := range coeffs {
+		coeffs[k] = sampler.ReadNew()
+	}
+
+	// f(x) = s_i + \sum_k coeffs[k] x^(k+1) (Horner)
+	eval := func(p int) *ring.Poly {
+		x := uint64(p + 1)
+		res := r.NewPoly()
+		for k := len(coeffs) - 1; k >= 0; k-- {
+			r.Add(res, coeffs[k], res)
+			r.MulScalar(res, x, res)
+		}
+		r.Add(res, o.sk.Value.Q, res)
+		return res
+	}
+
+	o.tsk = eval(o.me)
+
+	var lock sync.Mutex
+	return o.exchange(
+		func(p int) error {
+			return o.send(p, eval(p))
+		},
+		func(p int) error {
+			share := r.NewPoly()
+			if err := o.recv(p, share); err != nil {
+				return err
+			}
+			if share.Degree() != r.N || share.Level() != len(r.Modulus)-1 {
+				return o.peerError(p, errors.New("secret key share has wrong dimensions"))
+			}
+			lock.Lock()
+			r.Add(o.tsk, share, o.tsk)
+			lock.Unlock()
+			return nil
+		},
+	)
+}
+
+// Lagrange coefficient of player p (evaluated at p+1) for interpolating at 0 from the players in set, modulo q
+func lagrange(set []int, p int, q *big.Int) *big.Int {
+	num, den := big.NewInt(1), big.NewInt(1)
+	for _, k := range set {
+		if k == p {
+			continue
+		}
+		num.Mul(num, big.NewInt(int64(k+1)))
+		den.Mul(den, big.NewInt(int64(k-p)))
+	}
+	den.Mod(den, q)
+	num.Mul(num, den.ModInverse(den, q))
+	return num.Mod(num, q)
+}
+
+// the decryption shares of the players in set: the secret key is the Lagrange weighted Shamir share
+func (o *OIP) thresholdShares(
+	e2s *dbfv.E2SProtocol,
+	cts []*bfv.Ciphertext,
+	set []int,
+) ([]*drlwe.CKSShare, []*rlwe.AdditiveShare) {
+	r := o.params.RingQ()
+	sk := rlwe.NewSecretKey(o.params.Parameters)
+	r.MulScalarBigint(o.tsk, lagrange(set, o.me, r.ModulusBigint), sk.Value.Q)
+
+	publicShares := make([]*drlwe.CKSShare, len(cts))
+	secretShares := make([]*rlwe.AdditiveShare, len(cts))
+	for i, ct := range cts {
+		publicShares[i] = e2s.AllocateShare(ct.Level())
+		secretShares[i] = rlwe.NewAdditiveShare(o.params.Parameters)
+		e2s.GenShare(sk, ct, secretShares[i], publicShares[i])
+	}
+	return publicShares, secretShares
+}
+
+// E2S by the live players: the aggregator announces the decryption set,
+// every player in the set sends its decryption shares and the aggregator announces the next set,
+// until every player in the set responded (announced by the empty set)
+func (o *OIP) e2sThreshold(e2s *dbfv.E2SProtocol, cts []*bfv.Ciphertext) ([]*rlwe.AdditiveShare, error) {
+	agg := o.nextAggregator()
+
+	if o.me != agg {
+		var secretShares []*rlwe.AdditiveShare
+		for {
+			var set []int
+			if err := o.RecvAgg(agg, &set); err != nil {
+				return nil, err
+			}
+			if len(set) == 0 {
+				return secretShares, nil
+			}
+			if len(set) <= o.threshold {
+				return nil, o.peerError(agg, errors.New("decryption set is too small"))
+			}
+
+			var publicShares []*drlwe.CKSShare
+			publicShares, secretShares = o.thresholdShares(e2s, cts, set)
+			if err := o.SendAgg(agg, publicShares); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for {
+		set := o.liveSet()
+		if err := o.broadcastLive(agg, set); err != nil {
+			return nil, err
+		}
+
+		publicShares, secretShares := o.thresholdShares(e2s, cts, set)
+		locks := make([]sync.Mutex, len(cts))
+
+		err := o.gatherLive(agg, func(p int) error {
+			shares := make([]*drlwe.CKSShare, len(cts))
+			for i, ct := range cts {
+				shares[i] = e2s.AllocateShare(ct.Level())
+			}
+			if err := o.recv(p, &shares); err != nil {
+				return err
+			}
+			if err := checkShares(shares, publicShares); err != nil {
+				return o.peerError(p, err)
+			}
+			for i := range cts {
+				locks[i].Lock()
+				e2s.AggregateShares(publicShares[i], shares[i], publicShares[i])
+				locks[i].Unlock()
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		// restart if a player of the set dropped
+		if len(o.liveSet()) != len(set) {
+			o.Log("Restart distributed decryption with", len(o.liveSet()), "players")
+			continue
+		}
+
+		if err := o.broadcastLive(agg, []int{}); err != nil {
+			return nil, err
+		}
+
+		for i, ct := range cts {
+			e2s.GetShare(secretShares[i], publicShares[i], ct, secretShares[i])
+		}
+		return secretShares, nil
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ldsec/lattigo/v2/ring"
+)
+
+// star topology with a link between every pair of players
+func setupOIPsThreshold(players, t int) []*OIP {
+	oips := setupOIPsConns(SetupParams(), TopologyStar, MemoryDummies(TopologyMesh, players, MemoryCopy))
+	for _, oip := range oips {
+		oip.SetThreshold(t)
+	}
+	return oips
+}
+
+// multiply among the players in set, returns the shares of every player in set
+func testMulSet(t *testing.T, oips []*OIP, set []int, left, right [][]FieldElem) [][]FieldElem {
+	res := make([][]FieldElem, len(oips))
+	errs := make([]error, len(oips))
+
+	var wg sync.WaitGroup
+	for _, p := range set {
+		wg.Add(1)
+		go func(p int) {
+			res[p], errs[p] = oips[p].Multiply(context.Background(), left[p], right[p])
+			wg.Done()
+		}(p)
+	}
+	wg.Wait()
+
+	for _, p := range set {
+		if errs[p] != nil {
+			t.Fatal("Player", p, "failed:", errs[p])
+		}
+	}
+	return res
+}
+
+// the shares of the players in set reconstruct the products of the inputs (shared among all players)
+func checkMulSet(t *testing.T, set []int, left, right, res [][]FieldElem) {
+	var m [][]FieldElem
+	for _, p := range set {
+		m = append(m, res[p])
+	}
+	out_l, out_r, out_m := reconstruct(left), reconstruct(right), reconstruct(m)
+	for i := range out_m {
+		if out_m[i] != mul(out_l[i], out_r[i]) {
+			t.Fatal("Wrong product at", i)
+		}
+	}
+}
+
+func TestThresholdKey(t *testing.T) {
+	oips := setupOIPsThreshold(5, 2)
+	testMul(oips, 16, 1)
+
+	r := oips[0].params.RingQ()
+	sk := r.NewPoly()
+	for _, oip := range oips {
+		r.Add(sk, oip.sk.Value.Q, sk)
+	}
+
+	// interpolation of the Shamir shares of the players in set
+	interpolate := func(set []int) *ring.Poly {
+		res, tmp := r.NewPoly(), r.NewPoly()
+		for _, p := range set {
+			r.MulScalarBigint(oips[p].tsk, lagrange(set, p, r.ModulusBigint), tmp)
+			r.Add(res, tmp, res)
+		}
+		return res
+	}
+
+	// every set of t+1 (or more) players interpolates the secret key, t players do not
+	for _, set := range [][]int{{0, 1, 2}, {2, 3, 4}, {0, 2, 4}, {0, 1, 2, 3, 4}} {
+		if !r.Equal(interpolate(set), sk) {
+			t.Fatal("Set", set, "does not interpolate the secret key")
+		}
+	}
+	if r.Equal(interpolate([]int{0, 1}), sk) {
+		t.Fatal("Two players interpolate the secret key")
+	}
+}
+
+// select among the players in set, checks that their shares reconstruct the weighted sum of the branches
+func testSelectSet(t *testing.T, oips []*OIP, set []int, branches, length int) {
+	sel := make([][]FieldElem, len(oips))
+	vecs := make([][][]FieldElem, len(oips))
+	res := make([][]FieldElem, len(oips))
+	errs := make([]error, len(oips))
+	for _, p := range set {
+		sel[p] = random(branches)
+		vecs[p] = make([][]FieldElem, branches)
+		for b := range vecs[p] {
+			vecs[p][b] = random(length)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, p := range set {
+		wg.Add(1)
+		go func(p int) {
+			res[p], errs[p] = oips[p].Select(context.Background(), sel[p], vecs[p])
+			wg.Done()
+		}(p)
+	}
+	wg.Wait()
+
+	var s, m [][]FieldElem
+	var v [][][]FieldElem
+	for _, p := range set {
+		if errs[p] != nil {
+			t.Fatal("Player", p, "failed:", errs[p])
+		}
+		s, v, m = append(s, sel[p]), append(v, vecs[p]), append(m, res[p])
+	}
+	out_s, out_v, out_m := reconstruct(s), reconstruct_branches(defaultField, v), reconstruct(m)
+	for i := 0; i < length; i++ {
+		var sum FieldElem
+		for b := 0; b < branches; b++ {
+			sum = add(sum, mul(out_s[b], out_v[b][i]))
+		}
+		if out_m[i] != sum {
+			t.Fatal("Wrong selection at", i)
+		}
+	}
+}
+
+// a player which disconnects during the decryption is dropped: the remaining players obtain shares of the products
+// and keep running the OIP among themselves (the shares of the dropped player are lost)
+func TestThresholdDropout(t *testing.T) {
+	oips := setupOIPsThreshold(4, 1)
+	oips[0].timeout = 500 * time.Millisecond
+	testMul(oips, 16, 1)
+
+	left := randomShares(4, 100)
+	right := randomShares(4, 100)
+
+	// player 3 takes part in the aggregations of ciphertexts, then disconnects before the decryption
+	done := make(chan error)
+	go func() {
+		o := oips[3]
+		cts, rel := o.packEncrypt([][]FieldElem{left[3]})
+		if err := o.aggregateCTS(cts, rel); err != nil {
+			done <- err
+			return
+		}
+		res, rel := o.mulCTS(cts, right[3])
+		if err := o.aggregateCTS(res, rel); err != nil {
+			done <- err
+			return
+		}
+		for _, conn := range o.conns {
+			if conn != nil {
+				conn.Close()
+			}
+		}
+		done <- nil
+	}()
+	set := []int{0, 1, 2}
+	res := testMulSet(t, oips, set, left, right)
+	if err := <-done; err != nil {
+		t.Fatal("Player 3 failed:", err)
+	}
+	checkMulSet(t, set, left, right, res)
+
+	if live := oips[0].liveSet(); len(live) != 3 {
+		t.Fatal("Expected three live players, got", live)
+	}
+
+	// later rounds run among the live players, on values shared among them
+	for i := 0; i < 3; i++ {
+		testSelectSet(t, oips, set, 3, 100)
+	}
+
+	// square the outputs of the decryption
+	sq := testMulSet(t, oips, set, res, res)
+	var m, s [][]FieldElem
+	for _, p := range set {
+		m, s = append(m, res[p]), append(s, sq[p])
+	}
+	out_m, out_s := reconstruct(m), reconstruct(s)
+	for i := range out_s {
+		if out_s[i] != mul(out_m[i], out_m[i]) {
+			t.Fatal("Wrong square at", i)
+		}
+	}
+
+	// a coin toss requires player 3: every player aborts
+	errs := make([]error, len(set))
+	var wg sync.WaitGroup
+	for _, p := range set {
+		wg.Add(1)
+		go func(p int) {
+			errs[p] = oips[p].run(context.Background(), func() error {
+				_, err := oips[p].coinToss()
+				return err
+			})
+			wg.Done()
+		}(p)
+	}
+	wg.Wait()
+
+	var perr *ProtocolError
+	if !errors.Is(errs[0], ErrDropped) || !errors.As(errs[0], &perr) || perr.Peer != 3 {
+		t.Fatal("Expected abort caused by player 3, got", errs[0])
+	}
+	for _, p := range set[1:] {
+		if errs[p] == nil {
+			t.Error("Player", p, "did not abort")
+		}
+	}
+}
+
+// a player which is unresponsive during an aggregation of ciphertexts is not dropped: the aggregator aborts
+func TestThresholdUnresponsive(t *testing.T) {
+	oips := setupOIPsThreshold(3, 1)
+	oips[0].timeout = 500 * time.Millisecond
+	testMul(oips, 16, 1)
+
+	left := randomShares(3, 100)
+	right := randomShares(3, 100)
+
+	errs := make([]error, 2)
+	var wg sync.WaitGroup
+	for p := range errs {
+		wg.Add(1)
+		go func(p int) {
+			_, errs[p] = oips[p].Multiply(context.Background(), left[p], right[p])
+			wg.Done()
+		}(p)
+	}
+	wg.Wait()
+
+	var perr *ProtocolError
+	if !errors.As(errs[0], &perr) || perr.Peer != 2 || !strings.Contains(perr.Error(), "timed out") {
+		t.Fatal("Expected abort caused by player 2, got", errs[0])
+	}
+	if errs[1] == nil {
+		t.Error("Player 1 did not abort")
+	}
+}
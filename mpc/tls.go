@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// every player certificate carries the DNS name "player-<index>"
+const PLAYER_NAME_PREFIX = "player-"
+
+// mutually authenticated TLS 1.3 between players,
+// all player certificates are issued by a common certificate authority
+type TLSConfig struct {
+	ca   *x509.CertPool  // certificate authority for all players
+	cert tls.Certificate // certificate (and key) of this player
+}
+
+func PlayerName(player int) string {
+	return PLAYER_NAME_PREFIX + strconv.Itoa(player)
+}
+
+func NewTLSConfig(ca *x509.CertPool, cert tls.Certificate) *TLSConfig {
+	return &TLSConfig{
+		ca:   ca,
+		cert: cert,
+	}
+}
+
+// load PEM encoded CA certificate and player certificate / key pair
+func LoadTLSConfig(caPath string, certPath string, keyPath string) (*TLSConfig, error) {
+	pem, err := os.ReadFile(caPath)
+	if err != nil {
+		return nil, err
+	}
+
+	ca := x509.NewCertPool()
+	if !ca.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificates found in " + caPath)
+	}
+
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewTLSConfig(ca, cert), nil
+}
+
+func (t *TLSConfig) config() *tls.Config {
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS13,
+		Certificates: []tls.Certificate{t.cert},
+		RootCAs:      t.ca,
+		ClientCAs:    t.ca,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+}
+
+// extract the player index from the (verified) certificate of the peer
+func peerPlayer(state tls.ConnectionState) (int, error) {
+	if len(state.PeerCertificates) == 0 {
+		return 0, errors.New("peer did not present a certificate")
+	}
+
+	player := -1
+	for _, name := range state.PeerCertificates[0].DNSNames {
+		if !strings.HasPrefix(name, PLAYER_NAME_PREFIX) {
+			continue
+		}
+		p, err := strconv.Atoi(name[len(PLAYER_NAME_PREFIX):])
+		if err != nil || p < 0 {
+			continue
+		}
+		if player != -1 && player != p {
+			return 0, errors.New("certificate names multiple players")
+		}
+		player = p
+	}
+
+	if player == -1 {
+		return 0, errors.New("certificate does not name a player")
+	}
+	return player, nil
+}
+
+// connect to player as TLS client: the server certificate must belong to player
+func (t *TLSConfig) Client(conn net.Conn, player int) (*tls.Conn, error) {
+	config := t.config()
+	config.ServerName = PlayerName(player)
+
+	tconn := tls.Client(conn, config)
+	if err := tconn.Handshake(); err != nil {
+		return nil, err
+	}
+
+	them, err := peerPlayer(tconn.ConnectionState())
+	if err != nil {
+		return nil, err
+	}
+	if them != player {
+		return nil, errors.New("certificate belongs to player " + strconv.Itoa(them) + " not " + strconv.Itoa(player))
+	}
+
+	return tconn, nil
+}
+
+// accept a TLS client, returns the player index from the client certificate
+func (t *TLSConfig) Server(conn net.Conn) (*tls.Conn, int, error) {
+	tconn := tls.Server(conn, t.config())
+	if err := tconn.Handshake(); err != nil {
+		return nil, 0, err
+	}
+
+	them, err := peerPlayer(tconn.ConnectionState())
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return tconn, them, nil
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// protocol phase which the traffic is accounted to
+type Phase int32
+
+const (
+	PhaseOther Phase = iota
+	PhaseKeyGen
+	PhaseSelectorAggregation
+	PhaseTensorAggregation
+	PhaseE2S
+	PhaseReconstruct
+	PhaseMul
+	PhaseCheck
+	PhaseRefresh
+	PHASES int = iota
+)
+
+var PHASE_NAMES = [PHASES]string{
+	"other",
+	"keygen",
+	"selector_aggregation",
+	"tensor_aggregation",
+	"e2s",
+	"reconstruct",
+	"mul",
+	"mac_check",
+	"refresh",
+}
+
+func (p Phase) String() string {
+	return PHASE_NAMES[p]
+}
+
+type LinkStats struct {
+	BytesSent uint64
+	BytesRecv uint64
+	MsgsSent  uint64
+	MsgsRecv  uint64
+}
+
+func (s *LinkStats) add(o LinkStats) {
+	s.BytesSent += o.BytesSent
+	s.BytesRecv += o.BytesRecv
+	s.MsgsSent += o.MsgsSent
+	s.MsgsRecv += o.MsgsRecv
+}
+
+func (s *LinkStats) sub(o LinkStats) {
+	s.BytesSent -= o.BytesSent
+	s.BytesRecv -= o.BytesRecv
+	s.MsgsSent -= o.MsgsSent
+	s.MsgsRecv -= o.MsgsRecv
+}
+
+// per-link and per-phase counts of the traffic of a player
+type Traffic struct {
+	phase int32 // current phase (atomic)
+	lock  sync.Mutex
+	links map[int]*[PHASES]LinkStats // counters are updated atomically
+}
+
+// a consistent copy of the counters
+type TrafficSnapshot map[int][PHASES]LinkStats
+
+func NewTraffic() *Traffic {
+	return &Traffic{
+		links: make(map[int]*[PHASES]LinkStats),
+	}
+}
+
+// start accounting the traffic on the connection to peer
+func (t *Traffic) Attach(peer int, c *Connection) {
+	t.lock.Lock()
+	stats, ok := t.links[peer]
+	if !ok {
+		stats = new([PHASES]LinkStats)
+		t.links[peer] = stats
+	}
+	t.lock.Unlock()
+
+	c.traffic = t
+	c.stats = stats
+}
+
+func (t *Traffic) Phase() Phase {
+	return Phase(atomic.LoadInt32(&t.phase))
+}
+
+// set the current phase, returns the previous phase
+func (t *Traffic) SetPhase(p Phase) Phase {
+	return Phase(atomic.SwapInt32(&t.phase, int32(p)))
+}
+
+func (t *Traffic) Snapshot() TrafficSnapshot {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	snap := make(TrafficSnapshot)
+	for peer, stats := range t.links {
+		var cpy [PHASES]LinkStats
+		for p := range stats {
+			cpy[p] = LinkStats{
+				BytesSent: atomic.LoadUint64(&stats[p].BytesSent),
+				BytesRecv: atomic.LoadUint64(&stats[p].BytesRecv),
+				MsgsSent:  atomic.LoadUint64(&stats[p].MsgsSent),
+				MsgsRecv:  atomic.LoadUint64(&stats[p].MsgsRecv),
+			}
+		}
+		snap[peer] = cpy
+	}
+	return snap
+}
+
+// traffic between two snapshots
+func (s TrafficSnapshot) Sub(before TrafficSnapshot) TrafficSnapshot {
+	diff := make(TrafficSnapshot)
+	for peer, stats := range s {
+		prev := before[peer]
+		for p := range stats {
+			stats[p].sub(prev[p])
+		}
+		diff[peer] = stats
+	}
+	return diff
+}
+
+func (s TrafficSnapshot) Phase(p Phase) LinkStats {
+	var total LinkStats
+	for _, stats := range s {
+		total.add(stats[p])
+	}
+	return total
+}
+
+func (s TrafficSnapshot) Link(peer int) LinkStats {
+	var total LinkStats
+	stats := s[peer]
+	for p := range stats {
+		total.add(stats[p])
+	}
+	return total
+}
+
+func (s TrafficSnapshot) Total() LinkStats {
+	var total LinkStats
+	for peer := range s {
+		total.add(s.Link(peer))
+	}
+	return total
+}
+
+func (s TrafficSnapshot) peers() []int {
+	peers := make([]int, 0, len(s))
+	for peer := range s {
+		peers = append(peers, peer)
+	}
+	sort.Ints(peers)
+	return peers
+}
+
+// a single measurement, corresponds to one repetition of the benchmark
+type TrafficSample struct {
+	Time    float64 // seconds
+	Prepare float64 // seconds spent preparing the selector-independent material (included in Time)
+	Select  float64 // seconds spent in the online phase of the prepared selections (included in Time)
+	Traffic TrafficSnapshot
+}
+
+func writeLinkStats(w io.Writer, indent string, s LinkStats) error {
+	_, err := fmt.Fprintf(
+		w,
+		"%sbytes_sent: %d\n%sbytes_recv: %d\n%smsgs_sent: %d\n%smsgs_recv: %d\n",
+		indent, s.BytesSent,
+		indent, s.BytesRecv,
+		indent, s.MsgsSent,
+		indent, s.MsgsRecv,
+	)
+	return err
+}
+
+// Write samples in the schema of the benchmark files (see runner.py):
+// comm is the number of bytes sent by this player, i.e. the sum of comm over all players is the total traffic.
+// The breakdown per phase and per link is included under traffic.
+func WriteTrafficYAML(w io.Writer, me int, samples []TrafficSample) error {
+	if _, err := fmt.Fprintf(w, "player: %d\nsamples:\n", me); err != nil {
+		return err
+	}
+
+	for _, sample := range samples {
+		snap := sample.Traffic
+
+		if _, err := fmt.Fprintf(
+			w,
+			"- comm: %d\n  time: %v\n  prepare: %v\n  select: %v\n  traffic:\n    phases:\n",
+			snap.Total().BytesSent,
+			sample.Time,
+			sample.Prepare,
+			sample.Select,
+		); err != nil {
+			return err
+		}
+
+		for p := 0; p < PHASES; p++ {
+			if _, err := fmt.Fprintf(w, "      %s:\n", Phase(p)); err != nil {
+				return err
+			}
+			if err := writeLinkStats(w, "        ", snap.Phase(Phase(p))); err != nil {
+				return err
+			}
+		}
+
+		if _, err := fmt.Fprintf(w, "    links:\n"); err != nil {
+			return err
+		}
+
+		for _, peer := range snap.peers() {
+			if _, err := fmt.Fprintf(w, "      %d:\n", peer); err != nil {
+				return err
+			}
+			if err := writeLinkStats(w, "        ", snap.Link(peer)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/ldsec/lattigo/v2/bfv"
+	"github.com/ldsec/lattigo/v2/dbfv"
+	"github.com/ldsec/lattigo/v2/drlwe"
+	"github.com/ldsec/lattigo/v2/rlwe"
+)
+
+// Tree topology:
+//
+// the players form a complete k-ary tree rooted at player 0 (k = arity),
+// the parent of player p is (p-1)/k and its children are p*k+1, ..., p*k+k.
+// Aggregation runs up the tree: every player sums the contributions of its subtree before forwarding to its parent,
+// the result is broadcast down the same tree.
+// Player 0 receives k messages per aggregation (rather than n-1), at the cost of log_k(n) rounds.
+
+func (o *OIP) parent() int {
+	return treeParent(o.me, o.arity)
+}
+
+func (o *OIP) children() []int {
+	return treeChildren(o.me, o.arity, o.n)
+}
+
+// receive from every child concurrently (recv(c)), then send the result to the parent (unless root)
+func (o *OIP) treeReduce(recv func(c int) error, send func(parent int) error) error {
+	children := o.children()
+	status := make(chan error, len(children))
+	for _, c := range children {
+		go func(c int) { status <- recv(c) }(c)
+	}
+	if err := o.collect(status, len(children)); err != nil {
+		return err
+	}
+	if o.me == 0 {
+		return nil
+	}
+	return send(o.parent())
+}
+
+// receive from the parent (unless root), then send to every child concurrently
+func (o *OIP) treeBroadcast(recv func(parent int) error, send func(c int) error) error {
+	if o.me != 0 {
+		if err := recv(o.parent()); err != nil {
+			return err
+		}
+	}
+	children := o.children()
+	status := make(chan error, len(children))
+	for _, c := range children {
+		go func(c int) { status <- send(c) }(c)
+	}
+	return o.collect(status, len(children))
+}
+
+// aggregate the public key shares at player 0, which broadcasts the public key down the tree
+func (o *OIP) setupTree() error {
+	var lock sync.Mutex
+
+	err := o.treeReduce(
+		func(c int) error {
+			ss := o.ckg.AllocateShares()
+			if err := o.recv(c, ss); err != nil {
+				return err
+			}
+			if err := checkKeyShare(ss, o.ss); err != nil {
+				return o.peerError(c, err)
+			}
+			lock.Lock()
+			o.ckg.AggregateShares(ss, o.ss, o.ss)
+			lock.Unlock()
+			return nil
+		},
+		func(parent int) error {
+			return o.send(parent, o.ss)
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	o.pk = bfv.NewPublicKey(o.params)
+	if o.IsP0() {
+		o.ckg.GenPublicKey(o.ss, o.crp, o.pk)
+	}
+
+	return o.treeBroadcast(
+		func(parent int) error {
+			return o.recv(parent, o.pk)
+		},
+		func(c int) error {
+			return o.send(c, o.pk)
+		},
+	)
+}
+
+func (o *OIP) aggregateCTSTree(cts []*bfv.Ciphertext) error {
+
+	if err := o.reduceCTSTree(cts); err != nil {
+		return err
+	}
+
+	o.Log("Broadcast aggregated encryptions down the tree")
+
+	return o.treeBroadcast(
+		func(parent int) error {
+			return o.recvCTS(parent, cts)
+		},
+		func(c int) error {
+			return o.send(c, cts)
+		},
+	)
+}
+
+// sum cts up the tree, player 0 holds the sum of all players
+func (o *OIP) reduceCTSTree(cts []*bfv.Ciphertext) error {
+
+	dim := len(cts)
+	locks := make([]sync.Mutex, dim)
+
+	o.Log("Aggregate subtree of", len(o.children()), "children")
+
+	return o.treeReduce(
+		func(c int) error {
+			ctp := make([]*bfv.Ciphertext, dim)
+			for i := 0; i < dim; i++ {
+				ctp[i] = bfv.NewCiphertext(o.params, 1)
+			}
+			if err := o.recv(c, &ctp); err != nil {
+				return err
+			}
+			if err := checkShapes(ctp, cts); err != nil {
+				return o.peerError(c, err)
+			}
+
+			evl := o.getEvaluator()
+			for i := 0; i < dim; i++ {
+				locks[i].Lock()
+				evl.Add(ctp[i], cts[i], cts[i])
+				locks[i].Unlock()
+			}
+			o.putEvaluator(evl)
+			return nil
+		},
+		func(parent int) error {
+			return o.send(parent, cts)
+		},
+	)
+}
+
+// aggregate the decryption shares up the tree, player 0 generates the correction share
+func (o *OIP) e2sTree(
+	e2s *dbfv.E2SProtocol,
+	cts []*bfv.Ciphertext,
+	publicShares []*drlwe.CKSShare,
+	secretShares []*rlwe.AdditiveShare,
+) ([]*rlwe.AdditiveShare, error) {
+	locks := make([]sync.Mutex, len(cts))
+
+	err := o.treeReduce(
+		func(c int) error {
+			shares := make([]*drlwe.CKSShare, len(cts))
+			for i, ct := range cts {
+				shares[i] = e2s.AllocateShare(ct.Level())
+			}
+			if err := o.recv(c, &shares); err != nil {
+				return err
+			}
+			if err := checkShares(shares, publicShares); err != nil {
+				return o.peerError(c, err)
+			}
+			for i := range cts {
+				locks[i].Lock()
+				e2s.AggregateShares(publicShares[i], shares[i], publicShares[i])
+				locks[i].Unlock()
+			}
+			return nil
+		},
+		func(parent int) error {
+			return o.send(parent, publicShares)
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.IsP0() {
+		for i, ct := range cts {
+			e2s.GetShare(secretShares[i], publicShares[i], ct, secretShares[i])
+		}
+	}
+
+	return secretShares, nil
+}
+
+// sum the shares up the tree, broadcast the reconstruction down the tree
+func (e *CDN) reconstructTree(shares []Share) ([]FieldElem, error) {
+
+	recon := make([]FieldElem, len(shares))
+	copy(recon, shares)
+
+	var lock sync.Mutex
+
+	err := e.oip.treeReduce(
+		func(c int) error {
+			var tmp []FieldElem
+			if err := e.oip.recv(c, &tmp); err != nil {
+				return err
+			}
+			if len(tmp) != len(recon) {
+				return e.oip.peerError(c, errors.New("reconstruction share has wrong length"))
+			}
+			if !e.oip.field.contains(tmp) {
+				return e.oip.peerError(c, errors.New("reconstruction share out of range"))
+			}
+			lock.Lock()
+			for i := 0; i < len(recon); i++ {
+				recon[i] = e.oip.field.add(recon[i], tmp[i])
+			}
+			lock.Unlock()
+			return nil
+		},
+		func(parent int) error {
+			return e.oip.send(parent, recon)
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	err = e.oip.treeBroadcast(
+		func(parent int) error {
+			if err := e.oip.recv(parent, &recon); err != nil {
+				return err
+			}
+			if len(recon) != len(shares) {
+				return e.oip.peerError(parent, errors.New("reconstruction has wrong length"))
+			}
+			if !e.oip.field.contains(recon) {
+				return e.oip.peerError(parent, errors.New("reconstruction out of range"))
+			}
+			return nil
+		},
+		func(c int) error {
+			return e.oip.send(c, recon)
+		},
+	)
+	return recon, err
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"log"
+)
+
+// Beaver triples:
+//
+// in an offline phase (before the inputs are known) the players sample random shares a, b
+// and compute shares of c = a * b using the OIP, the triples are stored in a pool.
+// Online, l * r is computed from the next triple by opening d = l - a and e = r - b (in one round):
+//
+//	l * r = c + d * b + e * a + d * e
+//
+// where the public d * e is added by player 0 only. Every triple is used once.
+// Triples are consumed in order, hence all players must run the same sequence of multiplications.
+// A multiplication is only computed using triples if the pool holds enough triples for the whole batch,
+// otherwise the OIP is used directly (see CDN.Mul).
+
+// preprocessed triples (shares of a, b and c = a * b)
+type TriplePool struct {
+	a []Share
+	b []Share
+	c []Share
+}
+
+// number of remaining triples
+func (t *TriplePool) Len() int {
+	return len(t.a)
+}
+
+// remove the next n triples from the pool
+func (t *TriplePool) take(n int) ([]Share, []Share, []Share) {
+	if n > t.Len() {
+		log.Panicln("Insufficient triples:", t.Len(), "for", n, "multiplications")
+	}
+	a, b, c := t.a[:n], t.b[:n], t.c[:n]
+	t.a, t.b, t.c = t.a[n:], t.b[n:], t.c[n:]
+	return a, b, c
+}
+
+// generate n triples using the OIP and add them to the pool, aborts if ctx is cancelled (see abort.go)
+func (o *OIP) Preprocess(ctx context.Context, n int) error {
+	o.Log("Preprocess", n, "triples")
+
+	a := o.field.random(n)
+	b := o.field.random(n)
+	c, err := o.Multiply(ctx, a, b)
+	if err != nil {
+		return err
+	}
+
+	o.triples.a = append(o.triples.a, a...)
+	o.triples.b = append(o.triples.b, b...)
+	o.triples.c = append(o.triples.c, c...)
+	return nil
+}
+
+// multiply using the next triples of the pool, aborts if ctx is cancelled (see abort.go)
+func (e *CDN) MulBeaver(ctx context.Context, l []Share, r []Share) (res []Share, err error) {
+	err = e.oip.run(ctx, func() error {
+		res, err = e.mulBeaver(l, r)
+		return err
+	})
+	return res, err
+}
+
+func (e *CDN) mulBeaver(l []Share, r []Share) ([]Share, error) {
+	n := len(l)
+	if len(r) != n {
+		log.Panicln("Left and right dimension does not match")
+	}
+
+	defer e.oip.phase(PhaseMul)()
+
+	a, b, c := e.oip.triples.take(n)
+	field := e.oip.field
+
+	// open d = l - a and e = r - b
+	masked := make([]Share, 2*n)
+	for i := 0; i < n; i++ {
+		masked[i] = field.sub(l[i], a[i])
+		masked[n+i] = field.sub(r[i], b[i])
+	}
+	opened, err := e.open(masked)
+	if err != nil {
+		return nil, err
+	}
+	d, f := opened[:n], opened[n:] // d and e
+
+	res := make([]Share, n)
+	for i := 0; i < n; i++ {
+		res[i] = field.add(c[i], field.add(field.mul(d[i], b[i]), field.mul(f[i], a[i])))
+		if e.oip.me == 0 {
+			res[i] = field.add(res[i], field.mul(d[i], f[i]))
+		}
+	}
+	return res, nil
+}
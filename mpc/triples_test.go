@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+// run f for every player on its engine, returns the outputs and errors of every player
+func runCDN(oips []*OIP, f func(p int, e *CDN) ([]FieldElem, error)) ([][]FieldElem, []error) {
+	outs := make([][]FieldElem, len(oips))
+	errs := make([]error, len(oips))
+
+	var wg sync.WaitGroup
+	for p, oip := range oips {
+		wg.Add(1)
+		go func(p int, oip *OIP) {
+			outs[p], errs[p] = f(p, NewCDN(oip))
+			wg.Done()
+		}(p, oip)
+	}
+	wg.Wait()
+	return outs, errs
+}
+
+func preprocessAll(t testing.TB, oips []*OIP, n int) {
+	_, errs := runCDN(oips, func(p int, e *CDN) ([]FieldElem, error) {
+		return nil, e.oip.Preprocess(context.Background(), n)
+	})
+	for p, err := range errs {
+		if err != nil {
+			t.Fatal("Player", p, "failed to preprocess:", err)
+		}
+	}
+}
+
+func TestMulBeaver(t *testing.T) {
+	for _, topology := range []Topology{TopologyStar, TopologyMesh, TopologyTree} {
+		oips := setupOIPs(SetupParams(), topology, 3)
+
+		length := rand.Intn(1000) + 11
+		preprocessAll(t, oips, length+10)
+
+		for _, beaver := range []bool{true, false} {
+			left := randomShares(len(oips), length)
+			right := randomShares(len(oips), length)
+
+			outs, errs := runCDN(oips, func(p int, e *CDN) ([]FieldElem, error) {
+				return e.Mul(context.Background(), left[p], right[p])
+			})
+			for p, err := range errs {
+				if err != nil {
+					t.Fatal(topology, "player", p, "failed:", err)
+				}
+			}
+
+			l, r, m := reconstruct(left), reconstruct(right), reconstruct(outs)
+			for i := range m {
+				if m[i] != mul(l[i], r[i]) {
+					t.Fatal(topology, "wrong product at", i, "using triples:", beaver)
+				}
+			}
+
+			// the second batch does not fit the remaining 10 triples and uses the OIP
+			for p, oip := range oips {
+				if oip.triples.Len() != 10 {
+					t.Fatal(topology, "player", p, "has", oip.triples.Len(), "triples left")
+				}
+			}
+		}
+	}
+}
+
+func TestDisjunctionTriples(t *testing.T) {
+	oips := setupOIPs(SetupParams(), TopologyStar, 3)
+
+	// u = x0, x1, g0, g1: one level of two gates
+	levels := []int{1}
+	mapping := [][]int{
+		{0, 1, 0, 1}, // g0 = x0 * x1, g1 = x0 + x1
+		{0, 0, 1, 1}, // g0 = x0 + x0, g1 = x1 * x1
+	}
+	programs := [][]bool{
+		{true, false},
+		{false, true},
+	}
+
+	// every level multiplies its gates once and twice (l * r, then p * (l * r) and (1 - p) * (l + r))
+	preprocessAll(t, oips, 3*2)
+
+	inputs := randomShares(len(oips), 2)
+	x := reconstruct(inputs)
+	expected := []FieldElem{add(x[0], x[0]), mul(x[1], x[1])}
+
+	outs, errs := runCDN(oips, func(p int, e *CDN) ([]FieldElem, error) {
+		ctx := context.Background()
+		sel := []Share{e.Input(0, 0), e.Input(1, 0)}
+		w, err := e.Disjunction(ctx, levels, mapping, inputs[p], sel, programs)
+		if err != nil {
+			return nil, err
+		}
+		return e.Reconstruct(ctx, w)
+	})
+
+	for p := range oips {
+		if errs[p] != nil {
+			t.Fatal("Player", p, "failed:", errs[p])
+		}
+		if oips[p].triples.Len() != 0 {
+			t.Fatal("Player", p, "did not use its triples")
+		}
+		for i, v := range expected {
+			if outs[p][i] != v {
+				t.Fatal("Player", p, "wrong output of gate", i)
+			}
+		}
+	}
+}
+
+// multiply over an emulated network, with or without preprocessed triples
+func benchmarkMulLatency(b *testing.B, latency time.Duration, beaver bool, length, players int) {
+	conns := EmulatedDummies(TopologyStar, players, UniformProfile(NetProfile{Latency: latency}))
+	oips := setupOIPsConns(SetupParams(), TopologyStar, conns)
+
+	left := randomShares(players, length)
+	right := randomShares(players, length)
+
+	// run the setup outside the measurement
+	preprocessAll(b, oips, 1)
+	if beaver {
+		preprocessAll(b, oips, b.N*length)
+	}
+
+	b.ResetTimer()
+
+	for r := 0; r < b.N; r++ {
+		_, errs := runCDN(oips, func(p int, e *CDN) ([]FieldElem, error) {
+			return e.Mul(context.Background(), left[p], right[p])
+		})
+		for _, err := range errs {
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkMulLatency100ms_P3_L12(b *testing.B) {
+	benchmarkMulLatency(b, 100*time.Millisecond, false, 1<<12, 3)
+}
+
+func BenchmarkMulBeaverLatency100ms_P3_L12(b *testing.B) {
+	benchmarkMulLatency(b, 100*time.Millisecond, true, 1<<12, 3)
+}
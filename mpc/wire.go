@@ -0,0 +1,622 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"io"
+	"strconv"
+
+	"github.com/ldsec/lattigo/v2/bfv"
+	"github.com/ldsec/lattigo/v2/dbfv"
+	"github.com/ldsec/lattigo/v2/drlwe"
+	"github.com/ldsec/lattigo/v2/ring"
+	"github.com/ldsec/lattigo/v2/rlwe"
+)
+
+// Binary wire format:
+//
+// every message is a frame starting with a 5 byte header: [type (1 byte)] [count (4 bytes)]
+//
+// MsgInt:         8 bytes
+// MsgFieldElems:  count * 8 bytes
+// MsgBytes:       count bytes
+// MsgGob:         count bytes of a self-contained gob stream (fallback for all other types)
+// otherwise:      count items, each prefixed by its length (4 bytes) and encoded using MarshalBinary
+//
+// all integers are little endian
+
+const (
+	MsgInt byte = iota + 1
+	MsgFieldElems
+	MsgBytes
+	MsgGob
+	MsgCiphertexts
+	MsgCKSShares
+	MsgCKGShare
+	MsgPublicKey
+	MsgProof
+	MsgRKGShare
+	MsgRTGShares
+	MsgRefreshShares
+)
+
+const WIRE_HEADER = 5
+const WIRE_MAX_ITEM = 1 << 30 // sanity limit on the size of a single item / payload
+
+func msgName(t byte) string {
+	switch t {
+	case MsgInt:
+		return "int"
+	case MsgFieldElems:
+		return "field elements"
+	case MsgBytes:
+		return "bytes"
+	case MsgGob:
+		return "gob"
+	case MsgCiphertexts:
+		return "ciphertexts"
+	case MsgCKSShares:
+		return "CKS shares"
+	case MsgCKGShare:
+		return "CKG share"
+	case MsgPublicKey:
+		return "public key"
+	case MsgProof:
+		return "proof"
+	case MsgRKGShare:
+		return "RKG share"
+	case MsgRTGShares:
+		return "RTG shares"
+	case MsgRefreshShares:
+		return "refresh shares"
+	}
+	return "unknown (" + strconv.Itoa(int(t)) + ")"
+}
+
+// the message type used to transmit v
+func msgType(v interface{}) byte {
+	switch v.(type) {
+	case int, *int:
+		return MsgInt
+	case []FieldElem, *[]FieldElem:
+		return MsgFieldElems
+	case []byte, *[]byte:
+		return MsgBytes
+	case []*bfv.Ciphertext, *[]*bfv.Ciphertext:
+		return MsgCiphertexts
+	case []*drlwe.CKSShare, *[]*drlwe.CKSShare:
+		return MsgCKSShares
+	case *drlwe.CKGShare:
+		return MsgCKGShare
+	case *rlwe.PublicKey:
+		return MsgPublicKey
+	case *zkProof:
+		return MsgProof
+	case *drlwe.RKGShare:
+		return MsgRKGShare
+	case []*drlwe.RTGShare, *[]*drlwe.RTGShare:
+		return MsgRTGShares
+	case []*dbfv.RefreshShare, *[]*dbfv.RefreshShare:
+		return MsgRefreshShares
+	}
+	return MsgGob
+}
+
+func (c *Connection) writeHeader(t byte, count int) error {
+	var hdr [WIRE_HEADER]byte
+	hdr[0] = t
+	binary.LittleEndian.PutUint32(hdr[1:], uint32(count))
+	_, err := c.w.Write(hdr[:])
+	return err
+}
+
+func (c *Connection) writeUint64(v uint64) error {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	_, err := c.w.Write(b[:])
+	return err
+}
+
+func (c *Connection) writeItem(item []byte) error {
+	var l [4]byte
+	binary.LittleEndian.PutUint32(l[:], uint32(len(item)))
+	if _, err := c.w.Write(l[:]); err != nil {
+		return err
+	}
+	_, err := c.w.Write(item)
+	return err
+}
+
+// write count items produced by marshal
+func (c *Connection) writeItems(t byte, count int, marshal func(i int) ([]byte, error)) error {
+	if err := c.writeHeader(t, count); err != nil {
+		return err
+	}
+	for i := 0; i < count; i++ {
+		item, err := marshal(i)
+		if err != nil {
+			return err
+		}
+		if err := c.writeItem(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Connection) sendBinary(v interface{}) error {
+	var err error
+
+	switch m := v.(type) {
+	case int:
+		if err = c.writeHeader(MsgInt, 1); err == nil {
+			err = c.writeUint64(uint64(m))
+		}
+
+	case []FieldElem:
+		if err = c.writeHeader(MsgFieldElems, len(m)); err != nil {
+			break
+		}
+		for _, e := range m {
+			if err = c.writeUint64(e); err != nil {
+				break
+			}
+		}
+
+	case []byte:
+		if err = c.writeHeader(MsgBytes, len(m)); err == nil {
+			_, err = c.w.Write(m)
+		}
+
+	case []*bfv.Ciphertext:
+		err = c.writeItems(MsgCiphertexts, len(m), func(i int) ([]byte, error) {
+			return m[i].MarshalBinary()
+		})
+
+	case []*drlwe.CKSShare:
+		err = c.writeItems(MsgCKSShares, len(m), func(i int) ([]byte, error) {
+			return m[i].MarshalBinary()
+		})
+
+	case *drlwe.CKGShare:
+		err = c.writeItems(MsgCKGShare, 1, func(int) ([]byte, error) {
+			return m.MarshalBinary()
+		})
+
+	case *rlwe.PublicKey:
+		err = c.writeItems(MsgPublicKey, 1, func(int) ([]byte, error) {
+			return m.MarshalBinary()
+		})
+
+	case *zkProof:
+		err = c.writeItems(MsgProof, 1, func(int) ([]byte, error) {
+			return m.MarshalBinary()
+		})
+
+	case *drlwe.RKGShare:
+		err = c.writeItems(MsgRKGShare, 1, func(int) ([]byte, error) {
+			return m.MarshalBinary()
+		})
+
+	case []*drlwe.RTGShare:
+		err = c.writeItems(MsgRTGShares, len(m), func(i int) ([]byte, error) {
+			return m[i].MarshalBinary()
+		})
+
+	case []*dbfv.RefreshShare:
+		err = c.writeItems(MsgRefreshShares, len(m), func(i int) ([]byte, error) {
+			return m[i].MarshalBinary()
+		})
+
+	default:
+		// fallback: self-contained gob encoding
+		var buf bytes.Buffer
+		if err = gob.NewEncoder(&buf).Encode(v); err != nil {
+			break
+		}
+		if err = c.writeHeader(MsgGob, buf.Len()); err == nil {
+			_, err = c.w.Write(buf.Bytes())
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+func (c *Connection) readHeader() (byte, int, error) {
+	var hdr [WIRE_HEADER]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		return 0, 0, err
+	}
+	return hdr[0], int(binary.LittleEndian.Uint32(hdr[1:])), nil
+}
+
+// read size bytes into the receive buffer (reused across messages)
+func (c *Connection) readN(size int) ([]byte, error) {
+	if size > WIRE_MAX_ITEM {
+		return nil, errors.New("message too large")
+	}
+	if cap(c.buf) < size {
+		c.buf = make([]byte, size)
+	}
+	c.buf = c.buf[:size]
+	_, err := io.ReadFull(c.r, c.buf)
+	return c.buf, err
+}
+
+func (c *Connection) readItem() ([]byte, error) {
+	var l [4]byte
+	if _, err := io.ReadFull(c.r, l[:]); err != nil {
+		return nil, err
+	}
+	return c.readN(int(binary.LittleEndian.Uint32(l[:])))
+}
+
+func (c *Connection) recvBinary(v interface{}) error {
+	t, count, err := c.readHeader()
+	if err != nil {
+		return err
+	}
+
+	// check that the peer sent what we expect
+
+	if expect := msgType(v); t != expect {
+		return errors.New("expected " + msgName(expect) + " message, got " + msgName(t))
+	}
+
+	switch m := v.(type) {
+	case *int:
+		data, err := c.readN(8)
+		if err != nil {
+			return err
+		}
+		*m = int(binary.LittleEndian.Uint64(data))
+		return nil
+
+	case *[]FieldElem:
+		if count > WIRE_MAX_ITEM/8 {
+			return errors.New("message too large")
+		}
+		data, err := c.readN(8 * count)
+		if err != nil {
+			return err
+		}
+		if cap(*m) < count {
+			*m = make([]FieldElem, count)
+		}
+		*m = (*m)[:count]
+		for i := range *m {
+			(*m)[i] = binary.LittleEndian.Uint64(data[8*i:])
+		}
+		return nil
+
+	case *[]byte:
+		data, err := c.readN(count)
+		if err != nil {
+			return err
+		}
+		*m = append((*m)[:0], data...)
+		return nil
+
+	case *[]*bfv.Ciphertext:
+		if err := expectCount(len(*m), count); err != nil {
+			return err
+		}
+		cts := *m
+		for i := 0; i < count; i++ {
+			data, err := c.readItem()
+			if err != nil {
+				return err
+			}
+			// allocated as the ciphertexts arrive: the count is chosen by the peer
+			if i == len(cts) {
+				cts = append(cts, nil)
+			}
+			if cts[i] == nil {
+				cts[i] = new(bfv.Ciphertext)
+			}
+			if cts[i].Ciphertext == nil {
+				cts[i].Ciphertext = new(rlwe.Ciphertext)
+			}
+			if err := decodeCiphertext(cts[i].Ciphertext, data); err != nil {
+				return err
+			}
+		}
+		*m = cts
+		return nil
+
+	case *[]*drlwe.CKSShare:
+		if err := expectCount(len(*m), count); err != nil {
+			return err
+		}
+		shares := *m
+		for i := 0; i < count; i++ {
+			data, err := c.readItem()
+			if err != nil {
+				return err
+			}
+			if i == len(shares) {
+				shares = append(shares, nil)
+			}
+			if shares[i] == nil {
+				shares[i] = new(drlwe.CKSShare)
+			}
+			if shares[i].Value == nil {
+				shares[i].Value = new(ring.Poly)
+			}
+			if err := decodeExact(shares[i].Value, data); err != nil {
+				return err
+			}
+		}
+		*m = shares
+		return nil
+
+	case *drlwe.CKGShare:
+		if count != 1 {
+			return errors.New("expected a single CKG share")
+		}
+		data, err := c.readItem()
+		if err != nil {
+			return err
+		}
+		n, err := decodePolyQP(&m.Value, data)
+		if err == nil && n != len(data) {
+			err = errors.New("remaining unparsed data")
+		}
+		return err
+
+	case *rlwe.PublicKey:
+		if count != 1 {
+			return errors.New("expected a single public key")
+		}
+		data, err := c.readItem()
+		if err != nil {
+			return err
+		}
+		n0, err := decodePolyQP(&m.Value[0], data)
+		if err != nil {
+			return err
+		}
+		n1, err := decodePolyQP(&m.Value[1], data[n0:])
+		if err == nil && n0+n1 != len(data) {
+			err = errors.New("remaining unparsed data")
+		}
+		return err
+
+	case *zkProof:
+		if count != 1 {
+			return errors.New("expected a single proof")
+		}
+		data, err := c.readItem()
+		if err != nil {
+			return err
+		}
+		return m.UnmarshalBinary(data)
+
+	case *drlwe.RKGShare:
+		if count != 1 {
+			return errors.New("expected a single RKG share")
+		}
+		data, err := c.readItem()
+		if err != nil {
+			return err
+		}
+		return decodeRKGShare(m, data)
+
+	case *[]*drlwe.RTGShare:
+		if count > WIRE_MAX_ITEM {
+			return errors.New("message too large")
+		}
+		shares := make([]*drlwe.RTGShare, count)
+		for i := range shares {
+			data, err := c.readItem()
+			if err != nil {
+				return err
+			}
+			shares[i] = new(drlwe.RTGShare)
+			if err := decodeRTGShare(shares[i], data); err != nil {
+				return err
+			}
+		}
+		*m = shares
+		return nil
+
+	case *[]*dbfv.RefreshShare:
+		if count > WIRE_MAX_ITEM {
+			return errors.New("message too large")
+		}
+		shares := make([]*dbfv.RefreshShare, count)
+		for i := range shares {
+			data, err := c.readItem()
+			if err != nil {
+				return err
+			}
+			shares[i] = new(dbfv.RefreshShare)
+			if err := decodeRefreshShare(shares[i], data); err != nil {
+				return err
+			}
+		}
+		*m = shares
+		return nil
+
+	default:
+		data, err := c.readN(count)
+		if err != nil {
+			return err
+		}
+		return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+	}
+}
+
+// the peer must send the expected number of items (any if expected is 0: received into an empty slice)
+func expectCount(expected, count int) error {
+	if expected > 0 && count != expected {
+		return errors.New("expected " + strconv.Itoa(expected) + " items, got " + strconv.Itoa(count))
+	}
+	if count > WIRE_MAX_ITEM {
+		return errors.New("message too large")
+	}
+	return nil
+}
+
+// decode a polynomial (as encoded by ring.Poly.WriteTo) into pol,
+// the coefficients of pol are reused when the dimensions match.
+// returns the number of bytes consumed
+func decodePoly(pol *ring.Poly, data []byte) (int, error) {
+	if len(data) < 4 {
+		return 0, errors.New("truncated polynomial")
+	}
+
+	if data[0] > 20 {
+		return 0, errors.New("invalid polynomial degree")
+	}
+
+	N := 1 << data[0]
+	moduli := int(data[1])
+	size := 4 + 8*N*moduli
+
+	if len(data) < size {
+		return 0, errors.New("truncated polynomial")
+	}
+
+	pol.IsNTT = data[2] == 1
+	pol.IsMForm = data[3] == 1
+
+	if len(pol.Coeffs) != moduli || (moduli > 0 && len(pol.Coeffs[0]) != N) {
+		pol.Coeffs = make([][]uint64, moduli)
+		for i := range pol.Coeffs {
+			pol.Coeffs[i] = make([]uint64, N)
+		}
+	}
+
+	return ring.DecodeCoeffs(4, N, moduli, pol.Coeffs, data)
+}
+
+// decode a single polynomial spanning all of data
+func decodeExact(pol *ring.Poly, data []byte) error {
+	n, err := decodePoly(pol, data)
+	if err == nil && n != len(data) {
+		err = errors.New("remaining unparsed data")
+	}
+	return err
+}
+
+func decodePolyQP(p *rlwe.PolyQP, data []byte) (int, error) {
+	if p.Q == nil {
+		p.Q = new(ring.Poly)
+	}
+	if p.P == nil {
+		p.P = new(ring.Poly)
+	}
+
+	nq, err := decodePoly(p.Q, data)
+	if err != nil {
+		return 0, err
+	}
+
+	np, err := decodePoly(p.P, data[nq:])
+	return nq + np, err
+}
+
+// decode a ciphertext (as encoded by rlwe.Ciphertext.MarshalBinary) into ct
+func decodeCiphertext(ct *rlwe.Ciphertext, data []byte) error {
+	if len(data) < 1 {
+		return errors.New("truncated ciphertext")
+	}
+
+	// every polynomial has a header of 4 bytes
+	polys := int(data[0])
+	if polys < 1 || len(data) < 1+4*polys {
+		return errors.New("invalid ciphertext degree")
+	}
+	if len(ct.Value) != polys {
+		ct.Value = make([]*ring.Poly, polys)
+	}
+
+	pointer := 1
+	for i := range ct.Value {
+		if ct.Value[i] == nil {
+			ct.Value[i] = new(ring.Poly)
+		}
+		n, err := decodePoly(ct.Value[i], data[pointer:])
+		if err != nil {
+			return err
+		}
+		pointer += n
+	}
+
+	if pointer != len(data) {
+		return errors.New("remaining unparsed data")
+	}
+	return nil
+}
+
+// decode a share of the relinearization key generation (as encoded by drlwe.RKGShare.MarshalBinary) into share
+func decodeRKGShare(share *drlwe.RKGShare, data []byte) error {
+	if len(data) < 1 {
+		return errors.New("truncated RKG share")
+	}
+
+	share.Value = make([][2]rlwe.PolyQP, data[0])
+
+	pointer := 1
+	for i := range share.Value {
+		for j := range share.Value[i] {
+			n, err := decodePolyQP(&share.Value[i][j], data[pointer:])
+			if err != nil {
+				return err
+			}
+			pointer += n
+		}
+	}
+
+	if pointer != len(data) {
+		return errors.New("remaining unparsed data")
+	}
+	return nil
+}
+
+// decode a share of the rotation key generation (as encoded by drlwe.RTGShare.MarshalBinary) into share
+func decodeRTGShare(share *drlwe.RTGShare, data []byte) error {
+	if len(data) < 1 {
+		return errors.New("truncated RTG share")
+	}
+
+	share.Value = make([]rlwe.PolyQP, data[0])
+
+	pointer := 1
+	for i := range share.Value {
+		n, err := decodePolyQP(&share.Value[i], data[pointer:])
+		if err != nil {
+			return err
+		}
+		pointer += n
+	}
+
+	if pointer != len(data) {
+		return errors.New("remaining unparsed data")
+	}
+	return nil
+}
+
+// decode a share of the refresh protocol (as encoded by dbfv.RefreshShare.MarshalBinary) into share:
+// two polynomials of the same size, checked before they are handed to UnmarshalBinary (which does not fail)
+func decodeRefreshShare(share *dbfv.RefreshShare, data []byte) error {
+	half := len(data) / 2
+	if len(data) == 0 || len(data)%2 != 0 {
+		return errors.New("truncated refresh share")
+	}
+
+	var pol ring.Poly
+	if err := decodeExact(&pol, data[:half]); err != nil {
+		return err
+	}
+	if err := decodeExact(&pol, data[half:]); err != nil {
+		return err
+	}
+	return share.UnmarshalBinary(data)
+}
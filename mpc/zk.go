@@ -0,0 +1,645 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"log"
+	"math"
+	"math/big"
+	"math/bits"
+	"sync"
+
+	"github.com/ldsec/lattigo/v2/bfv"
+	"github.com/ldsec/lattigo/v2/ring"
+	"github.com/ldsec/lattigo/v2/utils"
+)
+
+// Zero-knowledge proofs of plaintext knowledge:
+//
+// every ciphertext a player sends during aggregateCTS comes with a non-interactive (Fiat-Shamir) proof
+// that the player knows a short witness w of the ciphertext x = F(w), for a public linear map F (see zkRelation).
+
+// statistical zero-knowledge of the proofs in bits, determines the slack of the masks
+var ZK_ZERO_KNOWLEDGE = 40
+
+// soundness of the proofs in bits, determines the number of repetitions
+var ZK_SOUNDNESS = 128
+
+// linear relation x = F(w) between the polynomials of the ciphertexts sent by a player and its witness
+type zkRelation struct {
+	public  []*ring.Poly                         // public inputs of F (bound by the proof)
+	bounds  []uint64                             // bound on the coefficients of every witness polynomial
+	apply   func(w []*ring.Poly, x []*ring.Poly) // x = F(w), coefficient domain
+	outputs int                                  // number of polynomials in x
+	witness []zkPoly                             // known to the prover only
+}
+
+// non-interactive proof of knowledge of a short witness
+type zkProof struct {
+	digest [sha256.Size]byte // Fiat-Shamir hash
+	z      [][]zkPoly        // responses of every repetition
+}
+
+// polynomial with signed 128 bit coefficients (two's complement)
+type zkPoly struct {
+	lo []uint64
+	hi []uint64
+}
+
+func newZKPoly(n int) zkPoly {
+	return zkPoly{lo: make([]uint64, n), hi: make([]uint64, n)}
+}
+
+// small polynomial from the centered coefficients of p (modulo the first prime)
+func zkPolyCentered(r *ring.Ring, p *ring.Poly) zkPoly {
+	z := newZKPoly(r.N)
+	q := r.Modulus[0]
+	for j, v := range p.Coeffs[0] {
+		if v > q>>1 {
+			z.set(j, int64(v)-int64(q))
+		} else {
+			z.set(j, int64(v))
+		}
+	}
+	return z
+}
+
+// polynomial with coefficients in [0, 2^64)
+func zkPolyUint(coeffs []uint64) zkPoly {
+	return zkPoly{lo: append([]uint64(nil), coeffs...), hi: make([]uint64, len(coeffs))}
+}
+
+func (p zkPoly) set(j int, v int64) {
+	p.lo[j] = uint64(v)
+	p.hi[j] = uint64(v >> 63)
+}
+
+// absolute value of the j'th coefficient and its sign
+func (p zkPoly) abs(j int) (uint64, uint64, bool) {
+	hi, lo := p.hi[j], p.lo[j]
+	if hi>>63 == 0 {
+		return hi, lo, false
+	}
+	lo, borrow := bits.Sub64(0, lo, 0)
+	hi, _ = bits.Sub64(0, hi, borrow)
+	return hi, lo, true
+}
+
+// every coefficient is at most (hi, lo) in absolute value
+func (p zkPoly) bounded(hi, lo uint64) bool {
+	for j := range p.lo {
+		h, l, _ := p.abs(j)
+		if h > hi || (h == hi && l > lo) {
+			return false
+		}
+	}
+	return true
+}
+
+// reduce modulo every prime of r
+func (p zkPoly) reduce(r *ring.Ring, out *ring.Poly) {
+	for j := range p.lo {
+		hi, lo, neg := p.abs(j)
+		for i, q := range r.Modulus {
+			v := bits.Rem64(hi, lo, q)
+			if neg && v != 0 {
+				v = q - v
+			}
+			out.Coeffs[i][j] = v
+		}
+	}
+}
+
+// p = y + X^k w (negacyclic)
+func (p zkPoly) addMonomial(y zkPoly, w zkPoly, k int) {
+	n := len(p.lo)
+	copy(p.lo, y.lo)
+	copy(p.hi, y.hi)
+	for j := range w.lo {
+		lo, hi := w.lo[j], w.hi[j]
+		s := (j + k) % (2 * n)
+		if s >= n {
+			s -= n
+			var borrow uint64
+			lo, borrow = bits.Sub64(0, lo, 0)
+			hi, _ = bits.Sub64(0, hi, borrow)
+		}
+		var carry uint64
+		p.lo[s], carry = bits.Add64(p.lo[s], lo, 0)
+		p.hi[s], _ = bits.Add64(p.hi[s], hi, carry)
+	}
+}
+
+// slack of the masks of the proofs for rel: hides all coefficients of c w up to 2^-ZK_ZERO_KNOWLEDGE,
+// the masks and responses must fit in 128 bits
+func (rel *zkRelation) slack(n int) uint {
+	coeffs := float64(zkRepetitions(n)) * float64(n) * float64(len(rel.bounds))
+	slack := ZK_ZERO_KNOWLEDGE + int(math.Ceil(math.Log2(coeffs))) - 1
+	for _, b := range rel.bounds {
+		if bits.Len64(b)+slack+2 > 127 {
+			log.Panicln("Witness bound", b, "with a slack of", slack, "bits exceeds 128 bits")
+		}
+	}
+	return uint(slack)
+}
+
+// bound on the masks: b 2^slack
+func zkMaskBound(b uint64, slack uint) (uint64, uint64) {
+	if slack >= 64 {
+		return b << (slack - 64), 0
+	}
+	return b >> (64 - slack), b << slack
+}
+
+// bound on the responses: b (2^slack + 1)
+func zkResponseBound(b uint64, slack uint) (uint64, uint64) {
+	hi, lo := zkMaskBound(b, slack)
+	lo, carry := bits.Add64(lo, b, 0)
+	return hi + carry, lo
+}
+
+// mask with coefficients uniform in [-b 2^slack, b 2^slack]
+func zkMask(prng utils.PRNG, n int, b uint64, slack uint) zkPoly {
+	bhi, blo := zkMaskBound(b, slack)
+
+	// sample uniform in [0, 2 bound] by rejection
+	rhi, rlo := bhi<<1|blo>>63, blo<<1
+	width := bits.Len64(rhi) + 64
+	if rhi == 0 {
+		width = bits.Len64(rlo)
+	}
+
+	y := newZKPoly(n)
+	buf := make([]byte, 16*n)
+	for j := 0; j < n; {
+		prng.Clock(buf)
+		for i := 0; i < n && j < n; i++ {
+			lo := binary.LittleEndian.Uint64(buf[16*i:])
+			hi := binary.LittleEndian.Uint64(buf[16*i+8:])
+			if width <= 64 {
+				lo &= math.MaxUint64 >> (64 - width)
+				hi = 0
+			} else {
+				hi &= math.MaxUint64 >> (128 - width)
+			}
+			if hi > rhi || (hi == rhi && lo > rlo) {
+				continue
+			}
+			var borrow uint64
+			y.lo[j], borrow = bits.Sub64(lo, blo, 0)
+			y.hi[j], _ = bits.Sub64(hi, bhi, borrow)
+			j++
+		}
+	}
+	return y
+}
+
+// number of repetitions for ZK_SOUNDNESS bits of soundness (2N+1 challenges per repetition)
+func zkRepetitions(n int) int {
+	return int(math.Ceil(float64(ZK_SOUNDNESS) / math.Log2(float64(2*n+1))))
+}
+
+// challenges derived from the Fiat-Shamir hash: 0 <= k < 2N is X^k, k = 2N is 0
+func zkChallenges(digest []byte, reps int, n int) []int {
+	prng, err := utils.NewKeyedPRNG(digest)
+	if err != nil {
+		panic(err)
+	}
+	mask := uint64(1)<<bits.Len(uint(2*n)) - 1
+	challenges := make([]int, reps)
+	var buf [8]byte
+	for i := range challenges {
+		for {
+			prng.Clock(buf[:])
+			if k := binary.LittleEndian.Uint64(buf[:]) & mask; k <= uint64(2*n) {
+				challenges[i] = int(k)
+				break
+			}
+		}
+	}
+	return challenges
+}
+
+func zkHashPolys(h hash.Hash, polys []*ring.Poly) {
+	var buf []byte
+	for _, p := range polys {
+		for _, coeffs := range p.Coeffs {
+			if cap(buf) < 8*len(coeffs) {
+				buf = make([]byte, 8*len(coeffs))
+			}
+			buf = buf[:8*len(coeffs)]
+			for j, c := range coeffs {
+				binary.LittleEndian.PutUint64(buf[8*j:], c)
+			}
+			h.Write(buf)
+		}
+	}
+}
+
+// Fiat-Shamir hash of the statement and the commitments a of every repetition
+func (rel *zkRelation) digest(context []byte, x []*ring.Poly, a [][]*ring.Poly) [sha256.Size]byte {
+	h := sha256.New()
+	h.Write([]byte("bmpc zkpopk"))
+	h.Write(context)
+	zkHashPolys(h, rel.public)
+	zkHashPolys(h, x)
+	for _, ar := range a {
+		zkHashPolys(h, ar)
+	}
+	var digest [sha256.Size]byte
+	copy(digest[:], h.Sum(nil))
+	return digest
+}
+
+func (rel *zkRelation) image(r *ring.Ring, w []zkPoly) []*ring.Poly {
+	wq := make([]*ring.Poly, len(w))
+	for i, p := range w {
+		wq[i] = r.NewPoly()
+		p.reduce(r, wq[i])
+	}
+	x := make([]*ring.Poly, rel.outputs)
+	for i := range x {
+		x[i] = r.NewPoly()
+	}
+	rel.apply(wq, x)
+	return x
+}
+
+// prove knowledge of the witness of x, the context binds the proof to the prover and the aggregation
+func (rel *zkRelation) prove(r *ring.Ring, context []byte, x []*ring.Poly) *zkProof {
+	reps := zkRepetitions(r.N)
+	slack := rel.slack(r.N)
+
+	// commit to masks
+	y := make([][]zkPoly, reps)
+	a := make([][]*ring.Poly, reps)
+
+	var wg sync.WaitGroup
+	for rep := 0; rep < reps; rep++ {
+		wg.Add(1)
+		go func(rep int) {
+			defer wg.Done()
+			prng, err := utils.NewPRNG()
+			if err != nil {
+				panic(err)
+			}
+			y[rep] = make([]zkPoly, len(rel.bounds))
+			for i, b := range rel.bounds {
+				y[rep][i] = zkMask(prng, r.N, b, slack)
+			}
+			a[rep] = rel.image(r, y[rep])
+		}(rep)
+	}
+	wg.Wait()
+
+	// respond to the challenges
+	proof := &zkProof{digest: rel.digest(context, x, a), z: make([][]zkPoly, reps)}
+	for rep, k := range zkChallenges(proof.digest[:], reps, r.N) {
+		proof.z[rep] = make([]zkPoly, len(rel.bounds))
+		for i := range rel.bounds {
+			if k == 2*r.N {
+				proof.z[rep][i] = y[rep][i]
+				continue
+			}
+			proof.z[rep][i] = newZKPoly(r.N)
+			proof.z[rep][i].addMonomial(y[rep][i], rel.witness[i], k)
+		}
+	}
+	return proof
+}
+
+func (rel *zkRelation) verify(r *ring.Ring, context []byte, x []*ring.Poly, proof *zkProof) error {
+	reps := zkRepetitions(r.N)
+	slack := rel.slack(r.N)
+
+	if len(x) != rel.outputs {
+		return errors.New("invalid proof: wrong number of ciphertexts")
+	}
+	if len(proof.z) != reps {
+		return errors.New("invalid proof: wrong number of repetitions")
+	}
+	for _, zr := range proof.z {
+		if len(zr) != len(rel.bounds) {
+			return errors.New("invalid proof: wrong number of responses")
+		}
+		for i, b := range rel.bounds {
+			if len(zr[i].lo) != r.N {
+				return errors.New("invalid proof: wrong ring degree")
+			}
+			if !zr[i].bounded(zkResponseBound(b, slack)) {
+				return errors.New("invalid proof: response out of bounds")
+			}
+		}
+	}
+
+	// recompute the commitments: a = F(z) - c x
+	challenges := zkChallenges(proof.digest[:], reps, r.N)
+	a := make([][]*ring.Poly, reps)
+
+	var wg sync.WaitGroup
+	for rep := 0; rep < reps; rep++ {
+		wg.Add(1)
+		go func(rep int) {
+			defer wg.Done()
+			a[rep] = rel.image(r, proof.z[rep])
+			if k := challenges[rep]; k != 2*r.N {
+				cx := r.NewPoly()
+				for i := range x {
+					r.MultByMonomial(x[i], k, cx)
+					r.Sub(a[rep][i], cx, a[rep][i])
+				}
+			}
+		}(rep)
+	}
+	wg.Wait()
+
+	if rel.digest(context, x, a) != proof.digest {
+		return errors.New("invalid proof of plaintext knowledge")
+	}
+	return nil
+}
+
+// polynomials of the ciphertexts (checking their shape)
+func ciphertextPolys(r *ring.Ring, cts []*bfv.Ciphertext) ([]*ring.Poly, error) {
+	x := make([]*ring.Poly, 0, 2*len(cts))
+	for _, ct := range cts {
+		if ct == nil || ct.Ciphertext == nil || len(ct.Value) != 2 {
+			return nil, errors.New("malformed ciphertext")
+		}
+		for _, p := range ct.Value {
+			if p == nil || p.IsNTT || len(p.Coeffs) != len(r.Modulus) || len(p.Coeffs[0]) != r.N {
+				return nil, errors.New("malformed ciphertext")
+			}
+			x = append(x, p)
+		}
+	}
+	return x, nil
+}
+
+// fresh encryptions of dim plaintexts: w = (m, u, e0, e1) for every ciphertext
+func (o *OIP) encryptionRelation(dim int) *zkRelation {
+	r := o.params.RingQ()
+	pk0, pk1 := o.pk.Value[0].Q, o.pk.Value[1].Q
+	delta := new(big.Int).Quo(r.ModulusBigint, new(big.Int).SetUint64(o.params.T()))
+	noise := uint64(6 * o.params.Sigma())
+
+	rel := &zkRelation{
+		public:  []*ring.Poly{pk0, pk1},
+		outputs: 2 * dim,
+	}
+	for k := 0; k < dim; k++ {
+		rel.bounds = append(rel.bounds, o.params.T(), 1, noise, noise)
+	}
+	rel.apply = func(w []*ring.Poly, x []*ring.Poly) {
+		u := r.NewPoly()
+		for k := 0; k < dim; k++ {
+			m, e0, e1 := w[4*k], w[4*k+2], w[4*k+3]
+			r.NTT(w[4*k+1], u)
+			r.MulCoeffs(u, pk0, x[2*k])
+			r.MulCoeffs(u, pk1, x[2*k+1])
+			r.InvNTT(x[2*k], x[2*k])
+			r.InvNTT(x[2*k+1], x[2*k+1])
+			r.Add(x[2*k], e0, x[2*k])
+			r.Add(x[2*k+1], e1, x[2*k+1])
+			r.MulScalarBigint(m, delta, u)
+			r.Add(x[2*k], u, x[2*k])
+		}
+	}
+	return rel
+}
+
+// encrypt packs, keeping the witness of every ciphertext
+func (o *OIP) encryptWitness(packs [][]FieldElem) ([]*bfv.Ciphertext, *zkRelation) {
+	r := o.params.RingQ()
+	rel := o.encryptionRelation(len(packs))
+	rel.witness = make([]zkPoly, 4*len(packs))
+
+	var wg sync.WaitGroup
+	for k, pack := range packs {
+		wg.Add(1)
+		go func(k int, pack []FieldElem) {
+			defer wg.Done()
+			prng, err := utils.NewPRNG()
+			if err != nil {
+				panic(err)
+			}
+
+			pt := bfv.NewPlaintextRingT(o.params)
+			enco := o.getEncoder()
+			enco.EncodeUintRingT(pack, pt)
+			o.putEncoder(enco)
+
+			u := ring.NewTernarySampler(prng, r, 0.5, false).ReadNew()
+			gauss := ring.NewGaussianSampler(prng, r, o.params.Sigma(), int(6*o.params.Sigma()))
+
+			rel.witness[4*k] = zkPolyUint(pt.Value.Coeffs[0])
+			rel.witness[4*k+1] = zkPolyCentered(r, u)
+			rel.witness[4*k+2] = zkPolyCentered(r, gauss.ReadNew())
+			rel.witness[4*k+3] = zkPolyCentered(r, gauss.ReadNew())
+		}(k, pack)
+	}
+	wg.Wait()
+
+	x := rel.image(r, rel.witness)
+	cts := make([]*bfv.Ciphertext, len(packs))
+	for k := range cts {
+		cts[k] = bfv.NewCiphertext(o.params, 1)
+		cts[k].Value[0].Copy(x[2*k])
+		cts[k].Value[1].Copy(x[2*k+1])
+	}
+	return cts, rel
+}
+
+// products of public ciphertexts and plaintexts: x_b = \sum_i cts[terms[b][i]] m_(b, i)
+func (o *OIP) productRelation(cts []*bfv.Ciphertext, terms [][]int) *zkRelation {
+	r := o.params.RingQ()
+
+	// the public ciphertexts in the NTT domain
+	public := make([]*ring.Poly, 0, 2*len(cts))
+	ntt := make([][2]*ring.Poly, len(cts))
+	for i, ct := range cts {
+		for j := 0; j < 2; j++ {
+			ntt[i][j] = r.NewPoly()
+			r.NTT(ct.Value[j], ntt[i][j])
+			public = append(public, ct.Value[j])
+		}
+	}
+
+	rel := &zkRelation{
+		public:  public,
+		outputs: 2 * len(terms),
+	}
+	for _, t := range terms {
+		for range t {
+			rel.bounds = append(rel.bounds, o.params.T())
+		}
+	}
+	rel.apply = func(w []*ring.Poly, x []*ring.Poly) {
+		m := r.NewPoly()
+		next := 0
+		for b, t := range terms {
+			x0, x1 := x[2*b], x[2*b+1]
+			x0.Zero()
+			x1.Zero()
+			for _, i := range t {
+				r.NTT(w[next], m)
+				r.MulCoeffsAndAdd(ntt[i][0], m, x0)
+				r.MulCoeffsAndAdd(ntt[i][1], m, x1)
+				next++
+			}
+			r.InvNTT(x0, x0)
+			r.InvNTT(x1, x1)
+		}
+	}
+	return rel
+}
+
+// context of the proofs of player p in the current aggregation
+func (o *OIP) proofContext(p int) []byte {
+	var ctx [16]byte
+	binary.LittleEndian.PutUint64(ctx[:], uint64(p))
+	binary.LittleEndian.PutUint64(ctx[8:], uint64(o.proofs))
+	return ctx[:]
+}
+
+// receive and verify the proof of player p for its ciphertexts cts
+func (o *OIP) verifyFrom(p int, rel *zkRelation, cts []*bfv.Ciphertext) error {
+	r := o.params.RingQ()
+	x, err := ciphertextPolys(r, cts)
+	if err != nil {
+		return o.peerError(p, err)
+	}
+	proof := new(zkProof)
+	if err := o.recv(p, proof); err != nil {
+		return err
+	}
+	if err := rel.verify(r, o.proofContext(p), x, proof); err != nil {
+		return o.peerError(p, err)
+	}
+	return nil
+}
+
+// prove knowledge of the witness of my ciphertexts cts
+func (o *OIP) proveTo(agg int, rel *zkRelation, cts []*bfv.Ciphertext) error {
+	r := o.params.RingQ()
+	x, err := ciphertextPolys(r, cts)
+	if err != nil {
+		panic(err)
+	}
+	return o.SendAgg(agg, rel.prove(r, o.proofContext(o.me), x))
+}
+
+// wire format: digest, repetitions, polynomials per repetition and ring degree (4 bytes each),
+// then every polynomial as the byte width of its coefficients (1 byte) followed by the truncated little endian coefficients
+func (p *zkProof) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write(p.digest[:])
+
+	polys, n := 0, 0
+	if len(p.z) > 0 {
+		polys = len(p.z[0])
+		if polys > 0 {
+			n = len(p.z[0][0].lo)
+		}
+	}
+
+	var hdr [12]byte
+	binary.LittleEndian.PutUint32(hdr[0:], uint32(len(p.z)))
+	binary.LittleEndian.PutUint32(hdr[4:], uint32(polys))
+	binary.LittleEndian.PutUint32(hdr[8:], uint32(n))
+	buf.Write(hdr[:])
+
+	for _, zr := range p.z {
+		if len(zr) != polys {
+			return nil, errors.New("inconsistent proof")
+		}
+		for _, z := range zr {
+			if len(z.lo) != n {
+				return nil, errors.New("inconsistent proof")
+			}
+
+			// bytes needed for the largest coefficient (and the sign)
+			width := 1
+			for j := range z.lo {
+				hi, lo, _ := z.abs(j)
+				l := bits.Len64(lo)
+				if hi != 0 {
+					l = 64 + bits.Len64(hi)
+				}
+				if w := l/8 + 1; w > width {
+					width = w
+				}
+			}
+			buf.WriteByte(byte(width))
+
+			var b [16]byte
+			for j := range z.lo {
+				binary.LittleEndian.PutUint64(b[:], z.lo[j])
+				binary.LittleEndian.PutUint64(b[8:], z.hi[j])
+				buf.Write(b[:width])
+			}
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func (p *zkProof) UnmarshalBinary(data []byte) error {
+	if len(data) < sha256.Size+12 {
+		return errors.New("truncated proof")
+	}
+	copy(p.digest[:], data)
+	data = data[sha256.Size:]
+
+	reps := int(binary.LittleEndian.Uint32(data[0:]))
+	polys := int(binary.LittleEndian.Uint32(data[4:]))
+	n := int(binary.LittleEndian.Uint32(data[8:]))
+	data = data[12:]
+
+	if reps > len(data) || polys > len(data) || n > 1<<17 || reps*polys*n > len(data) {
+		return errors.New("truncated proof")
+	}
+
+	p.z = make([][]zkPoly, reps)
+	for rep := range p.z {
+		p.z[rep] = make([]zkPoly, polys)
+		for i := range p.z[rep] {
+			if len(data) < 1 {
+				return errors.New("truncated proof")
+			}
+			width := int(data[0])
+			data = data[1:]
+			if width < 1 || width > 16 {
+				return errors.New("invalid coefficient width")
+			}
+			if len(data) < width*n {
+				return errors.New("truncated proof")
+			}
+
+			z := newZKPoly(n)
+			var b [16]byte
+			for j := 0; j < n; j++ {
+				// sign extend
+				fill := byte(0)
+				if data[width-1]&0x80 != 0 {
+					fill = 0xff
+				}
+				for k := range b {
+					b[k] = fill
+				}
+				copy(b[:], data[:width])
+				z.lo[j] = binary.LittleEndian.Uint64(b[:])
+				z.hi[j] = binary.LittleEndian.Uint64(b[8:])
+				data = data[width:]
+			}
+			p.z[rep][i] = z
+		}
+	}
+
+	if len(data) != 0 {
+		return errors.New("remaining unparsed data")
+	}
+	return nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ldsec/lattigo/v2/bfv"
+	"github.com/ldsec/lattigo/v2/ring"
+)
+
+// single player OIP with a key pair
+func setupProver() *OIP {
+	o := NewOIP(SetupParams(), 0, []*Connection{nil})
+	o.sk, o.pk = bfv.NewKeyGenerator(o.params).GenKeyPair()
+	o.zk = true
+	return o
+}
+
+func testPolys(t *testing.T, o *OIP, cts []*bfv.Ciphertext) []*ring.Poly {
+	x, err := ciphertextPolys(o.params.RingQ(), cts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return x
+}
+
+func TestProofEncryption(t *testing.T) {
+	o := setupProver()
+	r := o.params.RingQ()
+
+	packs := [][]FieldElem{random(1 << o.params.LogN()), random(100), random(1)}
+	cts, rel := o.packEncrypt(packs)
+
+	// the ciphertexts decrypt correctly
+	dec := bfv.NewDecryptor(o.params, o.sk)
+	enc := bfv.NewEncoder(o.params)
+	for i, ct := range cts {
+		res := enc.DecodeUintNew(dec.DecryptNew(ct))
+		for j, v := range packs[i] {
+			if res[j] != v {
+				t.Fatal("Decryption of ciphertext", i, "failed at", j)
+			}
+		}
+	}
+
+	x := testPolys(t, o, cts)
+	proof := rel.prove(r, []byte("test"), x)
+
+	if err := rel.verify(r, []byte("test"), x, proof); err != nil {
+		t.Fatal(err)
+	}
+
+	// bound to the context
+	if err := rel.verify(r, []byte("other"), x, proof); err == nil {
+		t.Error("Proof accepted in another context")
+	}
+
+	// bound to the ciphertexts
+	other, _ := o.packEncrypt(packs)
+	if err := rel.verify(r, []byte("test"), testPolys(t, o, other), proof); err == nil {
+		t.Error("Proof accepted for other ciphertexts")
+	}
+
+	// survives the wire format
+	data, err := proof.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := new(zkProof)
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := rel.verify(r, []byte("test"), x, decoded); err != nil {
+		t.Fatal(err)
+	}
+	if err := decoded.UnmarshalBinary(data[:len(data)-1]); err == nil {
+		t.Error("Truncated proof decoded")
+	}
+
+	// tampered responses
+	decoded.UnmarshalBinary(data)
+	decoded.z[0][0].lo[0] ^= 1
+	if err := rel.verify(r, []byte("test"), x, decoded); err == nil {
+		t.Error("Tampered proof accepted")
+	}
+}
+
+func TestProofOutOfBounds(t *testing.T) {
+	o := setupProver()
+	r := o.params.RingQ()
+
+	cts, rel := o.packEncrypt([][]FieldElem{random(10)})
+
+	// noise far beyond the bound (the ciphertext is no longer a fresh encryption)
+	big := newZKPoly(r.N)
+	for j := range big.lo {
+		big.set(j, rand.Int63n(1<<60)-1<<59)
+	}
+	rel.witness[2] = big
+	x := rel.image(r, rel.witness)
+	cts[0].Value[0].Copy(x[0])
+
+	err := rel.verify(r, nil, testPolys(t, o, cts), rel.prove(r, nil, testPolys(t, o, cts)))
+	if err == nil || !strings.Contains(err.Error(), "out of bounds") {
+		t.Fatal("Expected response out of bounds, got", err)
+	}
+}
+
+func TestProofSlack(t *testing.T) {
+	rel := &zkRelation{bounds: []uint64{1, 1, 1, 1}}
+
+	// a single fresh encryption with N = 2^13: 10 repetitions of 4 witness polynomials
+	if slack := rel.slack(1 << 13); slack != 58 {
+		t.Fatal("Expected a slack of 58 bits, got", slack)
+	}
+
+	// one bit more for every doubling of the batch
+	rel.bounds = append(rel.bounds, rel.bounds...)
+	if slack := rel.slack(1 << 13); slack != 59 {
+		t.Fatal("Expected a slack of 59 bits, got", slack)
+	}
+
+	// masks beyond 128 bits: 62 bits of slack for 16 witness polynomials with N = 2^16
+	rel.bounds = make([]uint64, 16)
+	for i := range rel.bounds {
+		rel.bounds[i] = 1 << 63
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("Slack beyond 128 bits accepted")
+		}
+	}()
+	rel.slack(1 << 16)
+}
+
+func TestProofProduct(t *testing.T) {
+	o := setupProver()
+	r := o.params.RingQ()
+	block_size := 1 << o.params.LogN()
+
+	cts, _ := o.packEncrypt([][]FieldElem{random(block_size), random(block_size)})
+
+	// [cts_b] * vec_b
+	res, rel := o.mulCTS(cts, random(block_size+10))
+	x := testPolys(t, o, res)
+	if err := rel.verify(r, nil, x, rel.prove(r, nil, x)); err != nil {
+		t.Fatal(err)
+	}
+
+	// \sum_j [cts_j] * vec_j
+	res, rel = o.tensorCTS(2, cts, [][]FieldElem{random(2 * block_size), random(block_size + 1)})
+	x = testPolys(t, o, res)
+	if err := rel.verify(r, nil, x, rel.prove(r, nil, x)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the proof of a product does not verify against another product
+	other, _ := o.tensorCTS(2, cts, [][]FieldElem{random(2 * block_size), random(block_size + 1)})
+	if err := rel.verify(r, nil, testPolys(t, o, other), rel.prove(r, nil, x)); err == nil {
+		t.Error("Proof accepted for another product")
+	}
+}
+
+func TestProofsOIP(t *testing.T) {
+	oips := setupOIPs(SetupParams(), TopologyStar, 3)
+	for _, oip := range oips {
+		oip.zk = true
+	}
+	testMul(oips, rand.Intn(1<<13)+1, 1)
+	testOIP(oips, rand.Intn(4)+1, rand.Intn(1<<13)+1, 1)
+
+	// through the binary wire format
+	oips = setupOIPsConns(SetupParams(), TopologyStar, MemoryDummies(TopologyStar, 3, MemoryCheck))
+	for _, oip := range oips {
+		oip.zk = true
+	}
+	testMul(oips, rand.Intn(1<<10)+1, 1)
+}
+
+// player 1 encrypts under another public key: its proof fails and player 0 aborts
+func TestProofsCheating(t *testing.T) {
+	oips := setupOIPs(SetupParams(), TopologyStar, 3)
+
+	var wg sync.WaitGroup
+	for _, oip := range oips {
+		oip.zk = true
+		wg.Add(1)
+		go func(oip *OIP) {
+			if err := oip.Setup(); err != nil {
+				panic(err)
+			}
+			wg.Done()
+		}(oip)
+	}
+	wg.Wait()
+
+	_, oips[1].pk = bfv.NewKeyGenerator(oips[1].params).GenKeyPair()
+
+	errs := make([]error, len(oips))
+	for p, oip := range oips {
+		wg.Add(1)
+		go func(p int, oip *OIP) {
+			_, errs[p] = oip.Multiply(context.Background(), random(16), random(16))
+			wg.Done()
+		}(p, oip)
+	}
+	wg.Wait()
+
+	var perr *ProtocolError
+	if !errors.As(errs[0], &perr) || perr.Peer != 1 || !strings.Contains(perr.Error(), "invalid proof") {
+		t.Fatal("Expected invalid proof of player 1, got", errs[0])
+	}
+	for p := 1; p < len(oips); p++ {
+		if errs[p] == nil {
+			t.Error("Player", p, "did not abort")
+		}
+	}
+}
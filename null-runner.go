@@ -1,7 +1,15 @@
 package main
 
+import "context"
+
 func init() { MP_SPDZ = false }
 
-func run(me int, inputs []FieldElem, mpc *MPC, oip *OIP) ([]Share, error) {
+var CIRCUIT = CircuitShape{Branches: 1}
+
+func prepare(ctx context.Context, me int, e *AuthCDN) ([]*PreparedAuthDisjunction, error) {
+    return nil, nil
+}
+
+func run(ctx context.Context, me int, inputs []FieldElem, mpc *MPC, e *AuthCDN, prep []*PreparedAuthDisjunction) ([]Share, error) {
     return nil, nil
 }
@@ -1,5 +1,6 @@
 import yaml
 import time
+import uuid
 
 from pwn import *
 
@@ -7,20 +8,48 @@ ADDRESSES = [
     '127.0.0.1:%d' % (i + 7000) for i in range(200)
 ]
 
-with open('/tmp/players.txt', 'w') as f:
-    for addr in ADDRESSES:
-        f.write(addr + '\n')
+SESSION = '/tmp/session.yml'
 
-def start_player(players, n, params):
-    cmd = 'cd MP-SPDZ && ../bmpc-{params} ./semi-party.x -N {players} -I -p {n} bmpc-{params}'.format(
-        players=players,
+# field modulus of the benchmark (the "prime" of the mpc description)
+PRIME = 65537
+
+# options of the mpc description passed on to the session configuration (see mpc/config.go),
+# e.g. "disjunction: homomorphic" with "eval_keys: {relin: true}" evaluates the disjunctions on packed encryptions
+SESSION_OPTIONS = ['disjunction', 'select', 'eval_keys', 'triples', 'macs', 'crt']
+
+def write_session(players, backend, options={}):
+    # session configuration shared by all parties (see mpc/config.go),
+    # written once per run before any player starts: all players must read the same session identifier
+    session = {
+        'parties': [{'address': addr} for addr in ADDRESSES[:players]],
+        'backend': backend,
+        'prime': PRIME,
+        'session': 'bench-%s' % uuid.uuid4(),
+        'traffic': '/tmp/traffic-{player}.yml',
+    }
+    session.update({k: v for (k, v) in options.items() if k in SESSION_OPTIONS})
+    if 'crt' in session:
+        # the plaintext moduli replace the prime
+        del session['prime']
+    with open(SESSION, 'w') as f:
+        yaml.safe_dump(session, f)
+
+def mp_spdz_backend(circuit):
+    return {
+        'type': 'mp-spdz',
+        'binary': './semi-party.x',
+        'args': ['-N', '{parties}', '-I', '-p', '{player}', circuit],
+    }
+
+def start_player(session, n, params):
+    cmd = 'cd MP-SPDZ && ../bmpc-{params} -config {session} -player {n}'.format(
+        session=session,
         n=n,
         params=params
     )
     print(cmd)
     return process(
         cmd,
-        env = {'PLAYER_ADDRESSES':'/tmp/players.txt'},
         shell=True
     )
 
@@ -30,24 +59,42 @@ def start_random(players, n):
         shell=True
     )
 
-def start_cdn(binary, players, n):
+def traffic_path(n):
+    return '/tmp/traffic-%d.yml' % n
+
+def start_cdn(binary, session, n):
     return process(
-        './%s -N %s -p %s' % (binary, players, n),
-        env = {'PLAYER_ADDRESSES':'/tmp/players.txt'},
+        './%s -config %s -player %s' % (binary, session, n),
         shell=True
     )
 
-def start_mascot_semi(binary, players, circuit, n):
-    cmd = 'cd MP-SPDZ && ../{binary} ./semi-party.x -N {players} -I -p {n} {circuit}'.format(
-        players=players,
+def cdn_traffic(players):
+    # exact traffic counted by each player:
+    # the sum of the bytes sent by every player
+    # (and the slowest player's preparation and online selection time)
+    total = 0
+    phases = {}
+    prepare = 0
+    select = 0
+    for n in range(players):
+        with open(traffic_path(n), 'r') as f:
+            sample = yaml.safe_load(f)['samples'][0]
+        total += sample['comm']
+        prepare = max(prepare, sample['prepare'])
+        select = max(select, sample['select'])
+        for phase, stats in sample['traffic']['phases'].items():
+            phases[phase] = phases.get(phase, 0) + stats['bytes_sent']
+    return total, phases, prepare, select
+
+def start_mascot_semi(binary, session, n):
+    cmd = 'cd MP-SPDZ && ../{binary} -config {session} -player {n}'.format(
+        session=session,
         n=n,
-        circuit=circuit,
         binary=binary
     )
     print('Start', cmd)
     return process(
         cmd,
-        env = {'PLAYER_ADDRESSES':'/tmp/players.txt'},
         shell=True
     )
 
@@ -94,6 +141,7 @@ class NetCapture:
         return total
 
 def main():
+    global PRIME
 
     path = sys.argv[1]
     name = os.path.basename(path)
@@ -111,6 +159,7 @@ def main():
     # build prereqs for benchmark
 
     mpc = config['mpc']
+    PRIME = mpc.get('prime', PRIME)
 
     if mpc['type'] == 'cdn':
         follow(process([
@@ -120,6 +169,7 @@ def main():
     else:
         follow(process([
             'make',
+            'PRIME=%d' % PRIME,
             'bmpc-%s' % name,
             'MP-SPDZ/Programs/Schedules/bmpc-%s.sch' % name
         ]))
@@ -138,25 +188,29 @@ def main():
 
         parties = mpc['parties']
 
-        net = NetCapture()
+        # CDN counts its own traffic, MP-SPDZ requires capturing it
+        net = None if mpc['type'] == 'cdn' else NetCapture()
 
         if mpc['type'] == 'cdn':
+            write_session(parties, {'type': 'cdn'}, mpc)
+
+            # the CDN parties retry connecting (start order does not matter)
             for p in range(parties):
                 print('Starting', p)
-                time.sleep(WAIT)
                 ses.append(start_cdn(
                     'bmpc-%s' % name,
-                    parties,
+                    SESSION,
                     p
                 ))
         elif mpc['type'] == 'mascot_semi':
+            write_session(parties, mp_spdz_backend('bmpc-%s' % name))
+
             for p in range(parties):
                 print('Starting', p)
                 time.sleep(WAIT)
                 ses.append(start_mascot_semi(
                     binary='bmpc-%s' % name,
-                    circuit='bmpc-%s' % name,
-                    players=parties,
+                    session=SESSION,
                     n=p
                 ))
 
@@ -172,12 +226,21 @@ def main():
 
         end = time.time()
 
-        total = net.stop()
-
-        samples.append({
-            'time': end - start,
-            'comm': total
-        })
+        if net is None:
+            total, phases, prepare, select = cdn_traffic(parties)
+            samples.append({
+                'time': end - start,
+                'prepare': prepare,
+                'select': select,
+                'comm': total,
+                'phases': phases
+            })
+        else:
+            total = net.stop()
+            samples.append({
+                'time': end - start,
+                'comm': total
+            })
 
 
     stopped = time.time()